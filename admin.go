@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// adminFileInfo is a stored file as the admin interface describes it
+type adminFileInfo struct {
+	Root string `json:"root"`
+	fileInfo
+}
+
+// adminStats summarizes the store for the admin interface
+type adminStats struct {
+	Files       int   `json:"files"`        // names across every root
+	LogicalSize int64 `json:"logical_size"` // bytes the files would take if stored separately
+	Blobs       int   `json:"blobs"`        // distinct contents actually stored
+	StoredSize  int64 `json:"stored_size"`  // bytes the distinct contents take
+}
+
+// adminMetrics reports how the server itself is doing, for monitoring
+type adminMetrics struct {
+	Requests   requestMetrics   `json:"requests"`
+	Transfers  transferMetrics  `json:"transfers"`
+	Ports      portMetrics      `json:"ports"`
+	RateLimits rateLimitMetrics `json:"rate_limits"`
+}
+
+// serveAdmin runs the admin HTTP interface on addr.  It is meant for trusted
+// operators only, so addr should normally be a loopback or management address.
+func serveAdmin(addr string) {
+	log.Println("Admin interface listening on ", addr)
+	if err := http.ListenAndServe(addr, adminHandler()); err != nil {
+		log.Println("Admin interface failed.  error: ", err)
+	}
+}
+
+// adminHandler serves
+//
+//	GET /files             every stored file, in every root
+//	GET /files/<name>      one stored file, from the root named by ?root=
+//	GET /versions/<name>   the retained versions of a file
+//	GET /content/<name>    the contents of a file, or of the version named by ?version=
+//	GET /stats             totals for the store
+//	GET /metrics           counters for monitoring the server
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/files", adminListFiles)
+	mux.HandleFunc("/files/", adminStatFile)
+	mux.HandleFunc("/versions/", adminListVersions)
+	mux.HandleFunc("/content/", adminFileContent)
+	mux.HandleFunc("/stats", adminStoreStats)
+	mux.HandleFunc("/metrics", adminServerMetrics)
+	return mux
+}
+
+func adminListFiles(w http.ResponseWriter, r *http.Request) {
+	infos := []adminFileInfo{}
+	stores := rootStores()
+	for _, root := range rootNames() {
+		for _, name := range stores[root].Names() {
+			if info, ok := stores[root].Stat(name); ok {
+				infos = append(infos, adminFileInfo{Root: root, fileInfo: info})
+			}
+		}
+	}
+	writeJSON(w, infos)
+}
+
+func adminStatFile(w http.ResponseWriter, r *http.Request) {
+	root, store, ok := adminRootStore(w, r)
+	if !ok {
+		return
+	}
+	info, ok := store.Stat(strings.TrimPrefix(r.URL.Path, "/files/"))
+	if !ok {
+		http.Error(w, "no such file", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, adminFileInfo{Root: root, fileInfo: info})
+}
+
+func adminListVersions(w http.ResponseWriter, r *http.Request) {
+	root, store, ok := adminRootStore(w, r)
+	if !ok {
+		return
+	}
+	versions := store.Versions(strings.TrimPrefix(r.URL.Path, "/versions/"))
+	if len(versions) == 0 {
+		http.Error(w, "no such file", http.StatusNotFound)
+		return
+	}
+	infos := make([]adminFileInfo, len(versions))
+	for i, info := range versions {
+		infos[i] = adminFileInfo{Root: root, fileInfo: info}
+	}
+	writeJSON(w, infos)
+}
+
+func adminFileContent(w http.ResponseWriter, r *http.Request) {
+	_, store, ok := adminRootStore(w, r)
+	if !ok {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/content/")
+	if version := r.URL.Query().Get("version"); version != "" {
+		name += "@v" + version
+	}
+	contents, ok := store.Read(name)
+	if !ok {
+		http.Error(w, "no such file", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.WriteString(w, contents)
+}
+
+// adminRootStore finds the store for the root named by the request's ?root=,
+// responding with a 404 if there's no such root.
+func adminRootStore(w http.ResponseWriter, r *http.Request) (string, fileStore, bool) {
+	root := r.URL.Query().Get("root")
+	store, ok := rootStores()[root]
+	if !ok {
+		http.Error(w, "no such root", http.StatusNotFound)
+	}
+	return root, store, ok
+}
+
+func adminStoreStats(w http.ResponseWriter, r *http.Request) {
+	stats := adminStats{}
+	for _, store := range rootStores() {
+		for _, name := range store.Names() {
+			if info, ok := store.Stat(name); ok {
+				stats.Files++
+				stats.LogicalSize += info.Size
+			}
+		}
+	}
+	stats.Blobs, stats.StoredSize = blobs.stats()
+	writeJSON(w, stats)
+}
+
+func adminServerMetrics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, adminMetrics{
+		Requests:   activeRequests.snapshot(),
+		Transfers:  transferSlots.snapshot(),
+		Ports:      tidPorts.snapshot(),
+		RateLimits: rateMetrics.snapshot(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Unable to write admin response.  error: ", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	files = newCASStore()
+	roots, err := compileVirtualRoots([]virtualRootConfig{{Root: "labA", Clients: []string{"10.1.0.0/16"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldRoots := virtualRoots
+	virtualRoots = roots
+	defer func() { virtualRoots = oldRoots }()
+
+	files.Write("boot.cfg", "default", "")
+	roots[0].store.Write("boot.cfg", "default", "")
+	roots[0].store.Write("lab.cfg", "lab A only", "")
+
+	server := httptest.NewServer(adminHandler())
+	defer server.Close()
+
+	var listed []adminFileInfo
+	getJSON(t, server.URL+"/files", &listed)
+	if len(listed) != 3 || listed[0].Root != "" || listed[1].Root != "labA" || listed[2].Name != "lab.cfg" {
+		t.Errorf("Unexpected file list %#v", listed)
+	}
+	if listed[0].SHA256 != listed[1].SHA256 {
+		t.Errorf("Expected identical files to have the same hash")
+	}
+
+	var info adminFileInfo
+	getJSON(t, server.URL+"/files/lab.cfg?root=labA", &info)
+	if info.Name != "lab.cfg" || info.Size != 10 || len(info.SHA256) != 64 {
+		t.Errorf("Unexpected file info %#v", info)
+	}
+
+	for _, missing := range []string{"/files/lab.cfg", "/files/boot.cfg?root=labB"} {
+		resp, err := http.Get(server.URL + missing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s: expected 404; got %s", missing, resp.Status)
+		}
+	}
+
+	roots[0].store.Write("lab.cfg", "lab A, take 2", "10.1.0.5:3000")
+	var versions []adminFileInfo
+	getJSON(t, server.URL+"/versions/lab.cfg?root=labA", &versions)
+	if len(versions) != 1 || versions[0].Version != 2 || versions[0].Uploader != "10.1.0.5:3000" {
+		t.Errorf("Unexpected versions with default retention %#v", versions)
+	}
+	oldKeep := keepVersions
+	defer func() { keepVersions = oldKeep }()
+	keepVersions = 0
+	roots[0].store.Write("lab.cfg", "lab A, take 3", "10.1.0.5:3000")
+	getJSON(t, server.URL+"/versions/lab.cfg?root=labA", &versions)
+	if len(versions) != 2 || versions[0].Version != 2 || versions[1].Version != 3 {
+		t.Errorf("Unexpected versions %#v", versions)
+	}
+	resp, err := http.Get(server.URL + "/content/lab.cfg?root=labA&version=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(contents) != "lab A, take 2" {
+		t.Errorf("Unexpected contents of version 2 %q", contents)
+	}
+
+	var stats adminStats
+	getJSON(t, server.URL+"/stats", &stats)
+	if stats.Files != 3 || stats.LogicalSize != 27 {
+		t.Errorf("Unexpected stats %#v", stats)
+	}
+
+	var metrics adminMetrics
+	getJSON(t, server.URL+"/metrics", &metrics)
+	if metrics.Ports.RangeSize != tidPorts.snapshot().RangeSize {
+		t.Errorf("Unexpected metrics %#v", metrics)
+	}
+}
+
+func getJSON(t *testing.T, url string, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %s", url, err)
+	}
+}
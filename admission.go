@@ -0,0 +1,150 @@
+package main
+
+import (
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"sync"
+	"time"
+)
+
+// concurrency limits, 0 for no limit
+var maxTransfers = 0                // transfers running at once
+var maxTransfersPerClient = 0       // transfers running at once for one client IP
+var maxTransfersPerFile = 0         // transfers of one file running at once, however it was requested
+var queueTimeout = time.Duration(0) // how long a request over a limit waits for a slot.  0 to reject it at once
+var maxQueued = 0                   // requests waiting for a slot at once
+
+var transferSlots = newTransferLimiter()
+
+var errServerBusy = &tftpError{Code: 0, Msg: "Server busy, try again later"}
+
+// concurrencyConfig is the concurrency section of the config file.
+// QueueTimeout is a duration such as "30s".
+type concurrencyConfig struct {
+	MaxTransfers int    `json:"max_transfers"`
+	MaxPerClient int    `json:"max_per_client"`
+	MaxPerFile   int    `json:"max_per_file"`
+	QueueTimeout string `json:"queue_timeout"`
+	MaxQueued    int    `json:"max_queued"`
+}
+
+// transferMetrics describes the running and waiting transfers, for the admin interface
+type transferMetrics struct {
+	Active   int    `json:"active"`
+	Queued   int    `json:"queued"` // requests waiting for a slot right now
+	Admitted uint64 `json:"admitted"`
+	Waited   uint64 `json:"waited"`   // requests that had to queue before being admitted
+	Rejected uint64 `json:"rejected"` // requests turned away with no slot, including timeouts
+	TimedOut uint64 `json:"timed_out"`
+}
+
+// transferLimiter hands out slots for transfers, within the concurrency limits
+type transferLimiter struct {
+	sync.Mutex
+	perClient map[string]int
+	perFile   map[string]int
+	changed   chan struct{} // closed and replaced whenever a slot is freed
+	metrics   transferMetrics
+}
+
+func newTransferLimiter() *transferLimiter {
+	return &transferLimiter{
+		perClient: make(map[string]int),
+		perFile:   make(map[string]int),
+		changed:   make(chan struct{}),
+	}
+}
+
+// slotFile is the name a request from addr is counted under for
+// maxTransfersPerFile: the file it resolves to once the rewrite rules have been
+// applied and the name cleaned, in the client's root.  Requests the rewrite
+// rules reject are counted under the name they asked for.
+func slotFile(request *wire.PacketRequest, addr net.Addr) string {
+	filename, err := applyRewriteRules(rewriteRules, request, addr)
+	if err != nil {
+		filename = request.Filename
+	}
+	rootName, _ := storeFor(addr)
+	return rootName + ":" + cleanMemberName(filename)
+}
+
+// fits reports whether a transfer of file for client is within the limits.
+// The caller must hold the lock.
+func (l *transferLimiter) fits(client, file string) bool {
+	return (maxTransfers <= 0 || l.metrics.Active < maxTransfers) &&
+		(maxTransfersPerClient <= 0 || l.perClient[client] < maxTransfersPerClient) &&
+		(maxTransfersPerFile <= 0 || l.perFile[file] < maxTransfersPerFile)
+}
+
+// acquire takes a slot for a transfer of file for client, waiting up to
+// queueTimeout for one to be freed, or until cancel is closed.  It returns
+// errServerBusy if there's none to be had.  Every slot taken must be given
+// back with release.
+func (l *transferLimiter) acquire(client, file string, cancel <-chan struct{}) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.fits(client, file) {
+		l.take(client, file)
+		return nil
+	}
+	if queueTimeout <= 0 || (maxQueued > 0 && l.metrics.Queued >= maxQueued) {
+		l.metrics.Rejected++
+		return errServerBusy
+	}
+
+	l.metrics.Queued++
+	defer func() { l.metrics.Queued-- }()
+	timeout := time.NewTimer(queueTimeout)
+	defer timeout.Stop()
+	for !l.fits(client, file) {
+		changed := l.changed
+		l.Unlock()
+		select {
+		case <-changed:
+			l.Lock()
+		case <-timeout.C:
+			l.Lock()
+			if !l.fits(client, file) {
+				l.metrics.TimedOut++
+				l.metrics.Rejected++
+				return errServerBusy
+			}
+		case <-cancel:
+			l.Lock()
+			l.metrics.Rejected++
+			return errServerBusy
+		}
+	}
+	l.metrics.Waited++
+	l.take(client, file)
+	return nil
+}
+
+// take marks a slot as used.  The caller must hold the lock.
+func (l *transferLimiter) take(client, file string) {
+	l.metrics.Active++
+	l.metrics.Admitted++
+	l.perClient[client]++
+	l.perFile[file]++
+}
+
+// release gives back a slot taken by acquire, waking the requests waiting for one
+func (l *transferLimiter) release(client, file string) {
+	l.Lock()
+	defer l.Unlock()
+	l.metrics.Active--
+	if l.perClient[client]--; l.perClient[client] <= 0 {
+		delete(l.perClient, client)
+	}
+	if l.perFile[file]--; l.perFile[file] <= 0 {
+		delete(l.perFile, file)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *transferLimiter) snapshot() transferMetrics {
+	l.Lock()
+	defer l.Unlock()
+	return l.metrics
+}
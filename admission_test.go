@@ -0,0 +1,131 @@
+package main
+
+import (
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"testing"
+	"time"
+)
+
+// withConcurrencyLimits installs limits and a fresh limiter for the length of a test
+func withConcurrencyLimits(t *testing.T, total, perClient, perFile int, timeout time.Duration, queued int) *transferLimiter {
+	oldTotal, oldClient, oldFile := maxTransfers, maxTransfersPerClient, maxTransfersPerFile
+	oldTimeout, oldQueued, oldSlots := queueTimeout, maxQueued, transferSlots
+	t.Cleanup(func() {
+		maxTransfers, maxTransfersPerClient, maxTransfersPerFile = oldTotal, oldClient, oldFile
+		queueTimeout, maxQueued, transferSlots = oldTimeout, oldQueued, oldSlots
+	})
+	maxTransfers, maxTransfersPerClient, maxTransfersPerFile = total, perClient, perFile
+	queueTimeout, maxQueued = timeout, queued
+	transferSlots = newTransferLimiter()
+	return transferSlots
+}
+
+func TestTransferLimiterRejects(t *testing.T) {
+	slots := withConcurrencyLimits(t, 3, 2, 1, 0, 0)
+	tests := []struct {
+		client, file string
+		admitted     bool
+	}{
+		{"10.0.0.1", "a", true},
+		{"10.0.0.1", "a", false}, // per file
+		{"10.0.0.1", "b", true},
+		{"10.0.0.1", "c", false}, // per client
+		{"10.0.0.2", "c", true},
+		{"10.0.0.3", "d", false}, // total
+	}
+
+	for i, test := range tests {
+		err := slots.acquire(test.client, test.file, nil)
+		if test.admitted && err != nil {
+			t.Errorf("Request %d: expected to be admitted; got %s", i+1, err)
+		} else if !test.admitted && err != errServerBusy {
+			t.Errorf("Request %d: expected to be refused; got %v", i+1, err)
+		}
+	}
+
+	slots.release("10.0.0.1", "a")
+	if err := slots.acquire("10.0.0.3", "d", nil); err != nil {
+		t.Errorf("Expected a released slot to be reused; got %s", err)
+	}
+	if metrics := slots.snapshot(); metrics.Active != 3 || metrics.Admitted != 4 || metrics.Rejected != 3 {
+		t.Errorf("Unexpected metrics %+v", metrics)
+	}
+}
+
+func TestTransferLimiterQueues(t *testing.T) {
+	slots := withConcurrencyLimits(t, 1, 0, 0, time.Second, 1)
+	if err := slots.acquire("10.0.0.1", "a", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan error)
+	go func() { admitted <- slots.acquire("10.0.0.2", "b", nil) }()
+	for slots.snapshot().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := slots.acquire("10.0.0.3", "c", nil); err != errServerBusy {
+		t.Errorf("Expected a request to be refused once the queue is full; got %v", err)
+	}
+
+	slots.release("10.0.0.1", "a")
+	if err := <-admitted; err != nil {
+		t.Errorf("Expected the queued request to be admitted; got %s", err)
+	}
+	if metrics := slots.snapshot(); metrics.Queued != 0 || metrics.Waited != 1 || metrics.Active != 1 {
+		t.Errorf("Unexpected metrics %+v", metrics)
+	}
+}
+
+func TestTransferLimiterTimesOut(t *testing.T) {
+	slots := withConcurrencyLimits(t, 1, 0, 0, 20*time.Millisecond, 0)
+	if err := slots.acquire("10.0.0.1", "a", nil); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := slots.acquire("10.0.0.2", "b", nil); err != errServerBusy {
+		t.Errorf("Expected the queued request to time out; got %v", err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("Expected to wait for the queue timeout; waited %s", waited)
+	}
+	if metrics := slots.snapshot(); metrics.TimedOut != 1 || metrics.Queued != 0 {
+		t.Errorf("Unexpected metrics %+v", metrics)
+	}
+}
+
+func TestSlotFile(t *testing.T) {
+	rules, err := compileRewriteRules([]rewriteRuleConfig{
+		{Match: `^BOOT\.CFG$`, Replace: strPtr("boot.cfg"), Flags: "i"},
+		{Match: `secret`, Flags: "a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, err := compileVirtualRoots([]virtualRootConfig{{Root: "labA", Clients: []string{"10.1.0.0/16"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldRules, oldRoots := rewriteRules, virtualRoots
+	rewriteRules, virtualRoots = rules, roots
+	defer func() { rewriteRules, virtualRoots = oldRules, oldRoots }()
+
+	tests := []struct {
+		ip, filename string
+		file         string
+	}{
+		{"10.0.0.1", "boot.cfg", ":boot.cfg"},
+		{"10.0.0.1", "./boot.cfg", ":boot.cfg"},
+		{"10.0.0.1", "/pxe//../boot.cfg", ":boot.cfg"},
+		{"10.0.0.1", "Boot.Cfg", ":boot.cfg"},
+		{"10.1.0.1", "boot.cfg", "labA:boot.cfg"},
+		{"10.0.0.1", "secret", ":secret"},
+	}
+	for _, test := range tests {
+		request := &wire.PacketRequest{Op: wire.OpRRQ, Filename: test.filename, Mode: "octet"}
+		addr := &net.UDPAddr{IP: net.ParseIP(test.ip), Port: 1069}
+		if file := slotFile(request, addr); file != test.file {
+			t.Errorf("%s from %s: expected to count as %q; got %q", test.filename, test.ip, test.file, file)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+var archiveMounts []*archiveMount // read-only archives served under a filename prefix
+
+// archiveMountConfig is an archive mount as it appears in the config file.
+// Members of the tar, tar.gz, zip or ISO9660 image at Path are served as
+// Prefix followed by their path inside the archive.
+type archiveMountConfig struct {
+	Prefix string `json:"prefix"`
+	Path   string `json:"path"`
+}
+
+// archiveMount is an archive served under a prefix.  The archive isn't opened
+// or indexed until a client first asks for one of its members.
+type archiveMount struct {
+	prefix string
+	path   string
+
+	once sync.Once
+	arc  archive
+	err  error
+}
+
+// archive is a read-only collection of files indexed by path
+type archive interface {
+	// Open returns a reader for the named member and its size, or
+	// errFileNotFound if there is no such member
+	Open(name string) (io.ReadCloser, int64, error)
+	// Names lists the archive's members in no particular order
+	Names() []string
+}
+
+func compileArchiveMounts(configs []archiveMountConfig) ([]*archiveMount, error) {
+	mounts := make([]*archiveMount, 0, len(configs))
+	for i, c := range configs {
+		if c.Path == "" {
+			return nil, fmt.Errorf("archive %d: missing path", i+1)
+		}
+		if _, err := os.Stat(c.Path); err != nil {
+			return nil, fmt.Errorf("archive %d: %s", i+1, err)
+		}
+		mounts = append(mounts, &archiveMount{prefix: c.Prefix, path: c.Path})
+	}
+	return mounts, nil
+}
+
+// findMount returns the mount filename falls under and the name of the member
+// within it, or nil if filename isn't in any archive.
+func findMount(filename string) (*archiveMount, string) {
+	for _, mount := range archiveMounts {
+		if strings.HasPrefix(filename, mount.prefix) {
+			return mount, cleanMemberName(strings.TrimPrefix(filename, mount.prefix))
+		}
+	}
+	return nil, ""
+}
+
+func (m *archiveMount) open(member string) (io.ReadCloser, int64, error) {
+	m.once.Do(func() {
+		m.arc, m.err = openArchive(m.path)
+		if m.err != nil {
+			log.Printf("Unable to index archive %s.  error: %s", m.path, m.err)
+		}
+	})
+	if m.err != nil {
+		return nil, 0, &tftpError{Code: 0, Msg: "Unable to read archive"}
+	}
+	return m.arc.Open(member)
+}
+
+// cleanMemberName puts a path into the form archive indexes are keyed by
+func cleanMemberName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// openArchive works out what kind of archive is at filename from its contents
+// and indexes it.
+func openArchive(filename string) (archive, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	magic := make([]byte, isoSystemAreaSize+6)
+	n, _ := f.ReadAt(magic, 0)
+	magic = magic[:n]
+
+	var arc archive
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")) || bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		arc, err = newZipArchive(f, info.Size())
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		f.Close()
+		return newTarGzArchive(filename)
+	case len(magic) >= 262 && bytes.Equal(magic[257:262], []byte("ustar")):
+		arc, err = newTarArchive(f)
+	case len(magic) >= isoSystemAreaSize+6 && bytes.Equal(magic[isoSystemAreaSize+1:isoSystemAreaSize+6], []byte("CD001")):
+		arc, err = newISOArchive(f)
+	default:
+		err = fmt.Errorf("%s is not a tar, tar.gz, zip or ISO9660 file", filename)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return arc, nil
+}
+
+// sectionArchive is an archive whose members are stored uncompressed at known
+// offsets in one file, so they can be read directly (and seeked) in place.
+type sectionArchive struct {
+	f       *os.File
+	members map[string]*io.SectionReader
+}
+
+func (a *sectionArchive) Open(name string) (io.ReadCloser, int64, error) {
+	section, ok := a.members[name]
+	if !ok {
+		return nil, 0, errFileNotFound
+	}
+	return io.NopCloser(io.NewSectionReader(section, 0, section.Size())), section.Size(), nil
+}
+
+func (a *sectionArchive) Names() []string {
+	names := make([]string, 0, len(a.members))
+	for name := range a.members {
+		names = append(names, name)
+	}
+	return names
+}
+
+// offsetReader tracks how far into a file a reader has got, so that the
+// offsets of tar members can be recorded as they're indexed.
+type offsetReader struct {
+	f   *os.File
+	pos int64
+}
+
+func (r *offsetReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *offsetReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.f.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
+
+func newTarArchive(f *os.File) (archive, error) {
+	r := &offsetReader{f: f}
+	tr := tar.NewReader(r)
+	arc := &sectionArchive{f: f, members: make(map[string]*io.SectionReader)}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return arc, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			// the reader stops at the start of the member's data
+			arc.members[cleanMemberName(hdr.Name)] = io.NewSectionReader(f, r.pos, hdr.Size)
+		}
+	}
+}
+
+// tarGzArchive can't seek within the compressed stream, so the index only says
+// which members exist and opening one decompresses the archive up to it.
+type tarGzArchive struct {
+	filename string
+	sizes    map[string]int64
+}
+
+func newTarGzArchive(filename string) (archive, error) {
+	arc := &tarGzArchive{filename: filename, sizes: make(map[string]int64)}
+	err := arc.scan(func(hdr *tar.Header, tr *tar.Reader) bool {
+		arc.sizes[cleanMemberName(hdr.Name)] = hdr.Size
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return arc, nil
+}
+
+// scan decompresses the archive and calls found for each regular file, with
+// the reader positioned at its data, until found returns true.
+func (a *tarGzArchive) scan(found func(*tar.Header, *tar.Reader) bool) error {
+	f, err := os.Open(a.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg && found(hdr, tr) {
+			return nil
+		}
+	}
+}
+
+func (a *tarGzArchive) Open(name string) (io.ReadCloser, int64, error) {
+	size, ok := a.sizes[name]
+	if !ok {
+		return nil, 0, errFileNotFound
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		var copyErr error
+		found := false
+		err := a.scan(func(hdr *tar.Header, tr *tar.Reader) bool {
+			if cleanMemberName(hdr.Name) != name {
+				return false
+			}
+			found = true
+			_, copyErr = io.Copy(pw, tr)
+			return true
+		})
+		if err == nil && !found {
+			err = errFileNotFound
+		}
+		if copyErr != nil {
+			err = copyErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, size, nil
+}
+
+func (a *tarGzArchive) Names() []string {
+	names := make([]string, 0, len(a.sizes))
+	for name := range a.sizes {
+		names = append(names, name)
+	}
+	return names
+}
+
+type zipArchive struct {
+	f       *os.File
+	members map[string]*zip.File
+}
+
+func newZipArchive(f *os.File, size int64) (archive, error) {
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return nil, err
+	}
+	arc := &zipArchive{f: f, members: make(map[string]*zip.File, len(zr.File))}
+	for _, zf := range zr.File {
+		if !zf.FileInfo().IsDir() {
+			arc.members[cleanMemberName(zf.Name)] = zf
+		}
+	}
+	return arc, nil
+}
+
+func (a *zipArchive) Open(name string) (io.ReadCloser, int64, error) {
+	zf, ok := a.members[name]
+	if !ok {
+		return nil, 0, errFileNotFound
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, 0, err
+	}
+	return rc, int64(zf.UncompressedSize64), nil
+}
+
+func (a *zipArchive) Names() []string {
+	names := make([]string, 0, len(a.members))
+	for name := range a.members {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testArchiveMembers = map[string]string{
+	"boot/vmlinuz":   strings.Repeat("kernel", 200),
+	"boot/initrd.gz": "initrd",
+	"readme.txt":     "",
+}
+
+func writeTestTar(t *testing.T, w io.Writer) {
+	tw := tar.NewWriter(w)
+	tw.WriteHeader(&tar.Header{Name: "./boot/", Typeflag: tar.TypeDir, Mode: 0755})
+	for name, contents := range testArchiveMembers {
+		if err := tw.WriteHeader(&tar.Header{Name: "./" + name, Typeflag: tar.TypeReg, Size: int64(len(contents)), Mode: 0644}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(contents))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// isoRecord builds an ISO9660 directory record
+func isoRecord(name []byte, sector, size uint32, dir bool, systemUse []byte) []byte {
+	length := 33 + len(name)
+	if len(name)%2 == 0 {
+		length++
+	}
+	record := make([]byte, length, length+len(systemUse))
+	record = append(record, systemUse...)
+	record[0] = byte(len(record))
+	binary.LittleEndian.PutUint32(record[2:], sector)
+	binary.BigEndian.PutUint32(record[6:], sector)
+	binary.LittleEndian.PutUint32(record[10:], size)
+	binary.BigEndian.PutUint32(record[14:], size)
+	if dir {
+		record[25] = 2
+	}
+	record[32] = byte(len(name))
+	copy(record[33:], name)
+	return record
+}
+
+// rockRidgeNM builds the system use area holding a Rock Ridge alternate name
+func rockRidgeNM(name string) []byte {
+	return append([]byte{'N', 'M', byte(5 + len(name)), 1, 0}, name...)
+}
+
+// buildTestISO lays out a minimal image: volume descriptors at sectors 16 and
+// 17, the root directory at 18, a boot directory at 19 and file data after.
+func buildTestISO(rockRidge bool) []byte {
+	image := make([]byte, 24*isoSectorSize)
+	sector := func(n int) []byte { return image[n*isoSectorSize : (n+1)*isoSectorSize] }
+	name := func(iso, rr string) ([]byte, []byte) {
+		if rockRidge {
+			return []byte(iso), rockRidgeNM(rr)
+		}
+		return []byte(iso), nil
+	}
+	put := func(n int, records ...[]byte) {
+		pos := 0
+		for _, record := range records {
+			copy(sector(n)[pos:], record)
+			pos += len(record)
+		}
+	}
+
+	kernel := testArchiveMembers["boot/vmlinuz"]
+	copy(sector(20), kernel)
+	copy(sector(22), testArchiveMembers["boot/initrd.gz"])
+
+	vmlinuz, vmlinuzSU := name("VMLINUZ.;1", "vmlinuz")
+	initrd, initrdSU := name("INITRD.GZ;1", "initrd.gz")
+	put(19,
+		isoRecord([]byte{0}, 19, isoSectorSize, true, nil),
+		isoRecord([]byte{1}, 18, isoSectorSize, true, nil),
+		isoRecord(vmlinuz, 20, uint32(len(kernel)), false, vmlinuzSU),
+		isoRecord(initrd, 22, 6, false, initrdSU),
+	)
+	boot, bootSU := name("BOOT", "boot")
+	readme, readmeSU := name("README.TXT;1", "readme.txt")
+	put(18,
+		isoRecord([]byte{0}, 18, isoSectorSize, true, nil),
+		isoRecord([]byte{1}, 18, isoSectorSize, true, nil),
+		isoRecord(boot, 19, isoSectorSize, true, bootSU),
+		isoRecord(readme, 23, 0, false, readmeSU),
+	)
+
+	pvd := sector(16)
+	pvd[0] = 1
+	copy(pvd[1:], "CD001")
+	copy(pvd[156:], isoRecord([]byte{0}, 18, isoSectorSize, true, nil))
+	terminator := sector(17)
+	terminator[0] = 255
+	copy(terminator[1:], "CD001")
+	return image
+}
+
+func TestArchives(t *testing.T) {
+	dir := t.TempDir()
+
+	var tarBuf bytes.Buffer
+	writeTestTar(t, &tarBuf)
+	writeTestFile(t, dir, "images.tar", tarBuf.String())
+
+	var tgzBuf bytes.Buffer
+	gz := gzip.NewWriter(&tgzBuf)
+	writeTestTar(t, gz)
+	gz.Close()
+	writeTestFile(t, dir, "images.tgz", tgzBuf.String())
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	for name, contents := range testArchiveMembers {
+		w, _ := zw.Create(name)
+		w.Write([]byte(contents))
+	}
+	zw.Close()
+	writeTestFile(t, dir, "images.zip", zipBuf.String())
+
+	writeTestFile(t, dir, "plain.iso", string(buildTestISO(false)))
+	writeTestFile(t, dir, "rockridge.iso", string(buildTestISO(true)))
+
+	for _, name := range []string{"images.tar", "images.tgz", "images.zip", "plain.iso", "rockridge.iso"} {
+		arc, err := openArchive(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s: unable to open archive: %s", name, err)
+			continue
+		}
+		if len(arc.Names()) != len(testArchiveMembers) {
+			t.Errorf("%s: expected %d members; got %v", name, len(testArchiveMembers), arc.Names())
+		}
+		for member, expected := range testArchiveMembers {
+			rc, size, err := arc.Open(member)
+			if err != nil {
+				t.Errorf("%s: unable to open %s: %s", name, member, err)
+				continue
+			}
+			contents, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || string(contents) != expected || size != int64(len(expected)) {
+				t.Errorf("%s: reading %s: expected %d bytes; got %d bytes (size %d), %v", name, member, len(expected), len(contents), size, err)
+			}
+		}
+		if _, _, err := arc.Open("boot/missing"); err != errFileNotFound {
+			t.Errorf("%s: expected errFileNotFound for a missing member; got %v", name, err)
+		}
+	}
+
+	if _, err := openArchive(writeTestFile(t, dir, "notes.txt", "just some text")); err == nil {
+		t.Errorf("expected error opening a file that isn't an archive")
+	}
+}
+
+func TestISORejectsRepeatedDirectories(t *testing.T) {
+	tests := []struct {
+		name   string
+		sector int // directory to add a record for the boot directory to
+	}{
+		{"fanout.iso", 18},
+		{"loop.iso", 19},
+	}
+	dir := t.TempDir()
+	for _, test := range tests {
+		image := buildTestISO(false)
+		parent := image[test.sector*isoSectorSize : (test.sector+1)*isoSectorSize]
+		pos := 0
+		for parent[pos] != 0 {
+			pos += int(parent[pos])
+		}
+		copy(parent[pos:], isoRecord([]byte("AGAIN"), 19, isoSectorSize, true, nil))
+
+		if _, err := openArchive(writeTestFile(t, dir, test.name, string(image))); err == nil {
+			t.Errorf("%s: expected error opening an ISO with a directory reached twice", test.name)
+		}
+	}
+}
+
+func TestOpReadArchiveMount(t *testing.T) {
+	dir := t.TempDir()
+	iso := writeTestFile(t, dir, "installer.iso", string(buildTestISO(true)))
+
+	oldMounts := archiveMounts
+	defer func() { archiveMounts = oldMounts }()
+	var err error
+	if archiveMounts, err = compileArchiveMounts([]archiveMountConfig{{Prefix: "debian/", Path: iso}}); err != nil {
+		t.Fatalf("unable to compile archive mounts: %s", err)
+	}
+	files = newCASStore()
+
+	contents, options, err := readOverUDP(t, &wire.PacketRequest{Op: wire.OpRRQ, Filename: "debian/boot/vmlinuz", Mode: "octet", Options: map[string]string{"tsize": "0"}})
+	if err != nil || string(contents) != testArchiveMembers["boot/vmlinuz"] {
+		t.Errorf("Reading from mounted ISO: got %d bytes, %v", len(contents), err)
+	}
+	if options["tsize"] != "1200" {
+		t.Errorf("Reading from mounted ISO: expected tsize 1200; got %#v", options)
+	}
+
+	err = writeOverUDP(t, &wire.PacketRequest{Op: wire.OpWRQ, Filename: "debian/boot/vmlinuz", Mode: "octet"}, []byte("x"))
+	if tErr, ok := err.(*tftpError); !ok || tErr.Code != 2 {
+		t.Errorf("Writing to mounted ISO: expected access violation; got %v", err)
+	}
+
+	if _, err := compileArchiveMounts([]archiveMountConfig{{Prefix: "x/", Path: filepath.Join(dir, "missing.iso")}}); err == nil {
+		t.Errorf("expected error mounting a missing archive")
+	}
+}
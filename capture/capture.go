@@ -0,0 +1,286 @@
+// Package capture reads packet captures in the pcap and pcapng formats, and
+// writes them in pcap, without libpcap.  It decodes frames only as far as UDP,
+// which is all TFTP needs.
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Link types, as numbered by tcpdump.org, that DecodeUDP understands
+const (
+	LinkNull      = 0   // BSD loopback: a host order address family, then IP
+	LinkEthernet  = 1   // Ethernet, with or without VLAN tags
+	LinkRaw       = 101 // IP with no link layer header
+	LinkLoop      = 108 // OpenBSD loopback: a network order address family, then IP
+	LinkLinuxSLL  = 113 // Linux "any" interface captures
+	LinkIPv4      = 228
+	LinkIPv6      = 229
+	LinkLinuxSLL2 = 276
+)
+
+// maxBlockSize bounds the records and blocks read, so a corrupt length
+// doesn't have us allocate gigabytes
+const maxBlockSize = 16 << 20
+
+// Packet is one frame of a capture
+type Packet struct {
+	Time     time.Time
+	LinkType int
+	Data     []byte // the frame as captured, which may have been cut short
+}
+
+// Reader reads the packets of a pcap or pcapng capture in order
+type Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	next  func() (Packet, error)
+
+	// pcap
+	linkType int
+	nanos    bool
+
+	// pcapng, where each interface has its own link type and clock
+	interfaces []pcapngInterface
+}
+
+// pcapngInterface is what an Interface Description Block says of an interface
+type pcapngInterface struct {
+	linkType int
+	snapLen  int
+	unit     time.Duration // length of a timestamp tick, if it's a whole number of nanoseconds
+	perSec   uint64        // ticks per second otherwise
+}
+
+const (
+	pcapMagic      = 0xa1b2c3d4 // microsecond timestamps
+	pcapMagicNanos = 0xa1b23c4d // nanosecond timestamps
+
+	pcapngSectionHeader = 0x0a0d0d0a
+	pcapngByteOrder     = 0x1a2b3c4d
+	pcapngInterfaceDesc = 1
+	pcapngPacket        = 2 // obsolete, but still written by some tools
+	pcapngSimplePacket  = 3
+	pcapngEnhanced      = 6
+)
+
+// NewReader reads the header of the capture in r, working out its format
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: bufio.NewReader(r)}
+	magic, err := reader.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("reading capture header: %w", unexpected(err))
+	}
+	switch {
+	case binary.LittleEndian.Uint32(magic) == pcapngSectionHeader:
+		reader.next = reader.nextPcapng
+		return reader, nil
+	case binary.LittleEndian.Uint32(magic) == pcapMagic || binary.LittleEndian.Uint32(magic) == pcapMagicNanos:
+		reader.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(magic) == pcapMagic || binary.BigEndian.Uint32(magic) == pcapMagicNanos:
+		reader.order = binary.BigEndian
+	default:
+		return nil, errors.New("not a pcap or pcapng capture")
+	}
+
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(reader.r, header); err != nil {
+		return nil, fmt.Errorf("reading capture header: %w", unexpected(err))
+	}
+	reader.nanos = reader.order.Uint32(header) == pcapMagicNanos
+	// the top bits of the link type can carry FCS details
+	reader.linkType = int(reader.order.Uint32(header[20:]) & 0x0fffffff)
+	reader.next = reader.nextPcap
+	return reader, nil
+}
+
+// Next returns the next packet, or io.EOF at the end of the capture.  The
+// packet's Data is its own; later calls don't overwrite it.
+func (r *Reader) Next() (Packet, error) {
+	return r.next()
+}
+
+func (r *Reader) nextPcap() (Packet, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		if err == io.EOF {
+			return Packet{}, io.EOF
+		}
+		return Packet{}, fmt.Errorf("reading packet header: %w", unexpected(err))
+	}
+	sec, frac := r.order.Uint32(header), r.order.Uint32(header[4:])
+	length := r.order.Uint32(header[8:])
+	if length > maxBlockSize {
+		return Packet{}, fmt.Errorf("packet of %d bytes is too large", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return Packet{}, fmt.Errorf("reading packet: %w", unexpected(err))
+	}
+	nsec := int64(frac)
+	if !r.nanos {
+		nsec *= 1000
+	}
+	return Packet{Time: time.Unix(int64(sec), nsec), LinkType: r.linkType, Data: data}, nil
+}
+
+func (r *Reader) nextPcapng() (Packet, error) {
+	for {
+		blockType, body, err := r.readBlock()
+		if err != nil {
+			return Packet{}, err
+		}
+		switch blockType {
+		case pcapngInterfaceDesc:
+			if len(body) < 8 {
+				return Packet{}, errors.New("interface description block too short")
+			}
+			r.interfaces = append(r.interfaces, r.parseInterface(body))
+		case pcapngEnhanced, pcapngPacket:
+			if len(body) < 20 {
+				return Packet{}, errors.New("packet block too short")
+			}
+			var id int
+			if blockType == pcapngEnhanced {
+				id = int(r.order.Uint32(body))
+			} else {
+				id = int(r.order.Uint16(body))
+			}
+			if id >= len(r.interfaces) {
+				return Packet{}, fmt.Errorf("packet on undescribed interface %d", id)
+			}
+			iface := r.interfaces[id]
+			ticks := uint64(r.order.Uint32(body[4:]))<<32 | uint64(r.order.Uint32(body[8:]))
+			length := int(r.order.Uint32(body[12:]))
+			if length > len(body)-20 {
+				return Packet{}, errors.New("packet block shorter than its packet")
+			}
+			data := append([]byte(nil), body[20:20+length]...)
+			return Packet{Time: iface.time(ticks), LinkType: iface.linkType, Data: data}, nil
+		case pcapngSimplePacket:
+			// these have no timestamp, and belong to the first interface
+			if len(r.interfaces) == 0 || len(body) < 4 {
+				return Packet{}, errors.New("simple packet block without an interface")
+			}
+			iface := r.interfaces[0]
+			length := int(r.order.Uint32(body))
+			if length > len(body)-4 {
+				length = len(body) - 4
+			}
+			if iface.snapLen > 0 && length > iface.snapLen {
+				length = iface.snapLen
+			}
+			data := append([]byte(nil), body[4:4+length]...)
+			return Packet{LinkType: iface.linkType, Data: data}, nil
+		}
+		// anything else, such as statistics or name resolution, is skipped
+	}
+}
+
+// readBlock reads a pcapng block, returning its type and the body between
+// its lengths.  A section header sets the byte order of what follows, and
+// forgets the interfaces of the last section.
+func (r *Reader) readBlock() (uint32, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		if err == io.EOF {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, fmt.Errorf("reading block header: %w", unexpected(err))
+	}
+	if binary.LittleEndian.Uint32(header) == pcapngSectionHeader {
+		magic, err := r.r.Peek(4)
+		if err != nil {
+			return 0, nil, fmt.Errorf("reading section header: %w", unexpected(err))
+		}
+		switch {
+		case binary.LittleEndian.Uint32(magic) == pcapngByteOrder:
+			r.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic) == pcapngByteOrder:
+			r.order = binary.BigEndian
+		default:
+			return 0, nil, errors.New("section header with an unknown byte order")
+		}
+		r.interfaces = nil
+	}
+	blockType, length := r.order.Uint32(header), r.order.Uint32(header[4:])
+	if length < 12 || length%4 != 0 || length > maxBlockSize {
+		return 0, nil, fmt.Errorf("block of type %#x has a bad length %d", blockType, length)
+	}
+	rest := make([]byte, length-8)
+	if _, err := io.ReadFull(r.r, rest); err != nil {
+		return 0, nil, fmt.Errorf("reading block: %w", unexpected(err))
+	}
+	if r.order.Uint32(rest[len(rest)-4:]) != length {
+		return 0, nil, fmt.Errorf("block of type %#x has mismatched lengths", blockType)
+	}
+	return blockType, rest[:len(rest)-4], nil
+}
+
+// parseInterface reads an Interface Description Block.  Only the timestamp
+// resolution option matters; it defaults to microseconds.
+func (r *Reader) parseInterface(body []byte) pcapngInterface {
+	iface := pcapngInterface{
+		linkType: int(r.order.Uint16(body)),
+		snapLen:  int(r.order.Uint32(body[4:])),
+		unit:     time.Microsecond,
+	}
+	for options := body[8:]; len(options) >= 4; {
+		code, length := r.order.Uint16(options), int(r.order.Uint16(options[2:]))
+		if code == 0 || 4+length > len(options) {
+			break
+		}
+		if code == 9 && length >= 1 { // if_tsresol
+			iface.unit, iface.perSec = resolution(options[4])
+		}
+		options = options[4+(length+3)/4*4:]
+	}
+	return iface
+}
+
+// resolution decodes an if_tsresol option: a power of ten, or of two if the
+// top bit is set, of ticks per second
+func resolution(tsresol byte) (time.Duration, uint64) {
+	exponent := uint64(tsresol & 0x7f)
+	if tsresol&0x80 != 0 {
+		if exponent > 63 {
+			exponent = 63
+		}
+		return 0, 1 << exponent
+	}
+	if exponent > 19 {
+		exponent = 19
+	}
+	perSec := uint64(1)
+	for i := uint64(0); i < exponent; i++ {
+		perSec *= 10
+	}
+	if perSec <= uint64(time.Second) {
+		return time.Second / time.Duration(perSec), 0
+	}
+	return 0, perSec
+}
+
+// time converts a timestamp in the interface's ticks
+func (iface pcapngInterface) time(ticks uint64) time.Time {
+	if iface.perSec == 0 {
+		unit := uint64(iface.unit)
+		perSec := uint64(time.Second) / unit
+		return time.Unix(int64(ticks/perSec), int64(ticks%perSec*unit))
+	}
+	frac := float64(ticks%iface.perSec) / float64(iface.perSec)
+	return time.Unix(int64(ticks/iface.perSec), int64(frac*float64(time.Second)))
+}
+
+// unexpected turns the io.EOF of a capture cut short into io.ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,274 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var (
+	client  = netip.MustParseAddrPort("10.0.0.2:2000")
+	server  = netip.MustParseAddrPort("10.0.0.1:69")
+	client6 = netip.MustParseAddrPort("[2001:db8::2]:2000")
+	server6 = netip.MustParseAddrPort("[2001:db8::1]:69")
+)
+
+// rawUDP is the IP packet Writer records for a datagram
+func rawUDP(t *testing.T, src, dst netip.AddrPort, payload string) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteUDP(time.Unix(0, 0), src, dst, []byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()[24+16:]
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := time.Unix(1700000000, 123456789)
+	w.WriteUDP(first, client, server, []byte("\x00\x01pxelinux.0\x00octet\x00"))
+	w.WriteUDP(first.Add(time.Millisecond), server6, client6, []byte("\x00\x03\x00\x01odd"))
+	mapped := netip.AddrPortFrom(netip.AddrFrom16(client.Addr().As16()), client.Port())
+	w.WriteUDP(first.Add(2*time.Millisecond), mapped, server, nil)
+	if err := w.WriteUDP(first, client, server6, nil); err == nil {
+		t.Errorf("Expected an error for addresses of different families")
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		at       time.Time
+		src, dst netip.AddrPort
+		payload  string
+	}{
+		{first, client, server, "\x00\x01pxelinux.0\x00octet\x00"},
+		{first.Add(time.Millisecond), server6, client6, "\x00\x03\x00\x01odd"},
+		{first.Add(2 * time.Millisecond), client, server, ""},
+	}
+	for _, e := range expected {
+		p, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, ok := DecodeUDP(p.LinkType, p.Data)
+		if !ok || !p.Time.Equal(e.at) || d.Src != e.src || d.Dst != e.dst || string(d.Payload) != e.payload {
+			t.Errorf("Expected %s %s -> %s %q; got %s %+v %t", e.at, e.src, e.dst, e.payload, p.Time, d, ok)
+		}
+		if !checksumValid(p.Data) {
+			t.Errorf("Bad checksum on %s -> %s", e.src, e.dst)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF after the last packet; got %v", err)
+	}
+}
+
+// checksumValid checks the UDP checksum of a raw IP packet
+func checksumValid(packet []byte) bool {
+	var pseudo, datagram []byte
+	if packet[0]>>4 == 4 {
+		pseudo, datagram = append([]byte(nil), packet[12:20]...), packet[20:]
+	} else {
+		pseudo, datagram = append([]byte(nil), packet[8:40]...), packet[40:]
+	}
+	pseudo = append(pseudo, 0, protocolUDP)
+	pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(datagram)))
+	return sum(uint32(sum(0, pseudo)), datagram) == 0xffff
+}
+
+func TestReadPcap(t *testing.T) {
+	// big-endian, microsecond timestamps, Ethernet with a VLAN tag
+	frame := append([]byte("\x00\x11\x22\x33\x44\x55\x66\x77\x88\x99\xaa\xbb\x81\x00\x00\x07\x08\x00"), rawUDP(t, client, server, "hello")...)
+	var buf bytes.Buffer
+	header := make([]byte, 24)
+	binary.BigEndian.PutUint32(header, pcapMagic)
+	binary.BigEndian.PutUint32(header[20:], LinkEthernet)
+	buf.Write(header)
+	record := make([]byte, 16)
+	binary.BigEndian.PutUint32(record, 1700000000)
+	binary.BigEndian.PutUint32(record[4:], 250000)
+	binary.BigEndian.PutUint32(record[8:], uint32(len(frame)))
+	binary.BigEndian.PutUint32(record[12:], uint32(len(frame)))
+	buf.Write(record)
+	buf.Write(frame)
+	buf.Write(record) // and a record cut short
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Time.Equal(time.Unix(1700000000, 250000000)) || p.LinkType != LinkEthernet {
+		t.Errorf("Expected an Ethernet frame at .25s; got %d at %s", p.LinkType, p.Time)
+	}
+	if d, ok := DecodeUDP(p.LinkType, p.Data); !ok || string(d.Payload) != "hello" || d.Src != client {
+		t.Errorf("Expected hello from %s; got %+v", client, d)
+	}
+	if _, err := r.Next(); err == nil || err == io.EOF {
+		t.Errorf("Expected an error for the truncated record; got %v", err)
+	}
+
+	if _, err := NewReader(bytes.NewReader([]byte("not a capture at all"))); err == nil {
+		t.Errorf("Expected an error for something that isn't a capture")
+	}
+}
+
+// byteOrder is binary.LittleEndian or binary.BigEndian
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// pcapngBlock builds a block of blockType around body
+func pcapngBlock(order byteOrder, blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	block := order.AppendUint32(nil, blockType)
+	block = order.AppendUint32(block, uint32(12+len(body)))
+	block = append(block, body...)
+	return order.AppendUint32(block, uint32(12+len(body)))
+}
+
+func TestReadPcapng(t *testing.T) {
+	packet := rawUDP(t, client, server, "hello")
+	for _, order := range []byteOrder{binary.LittleEndian, binary.BigEndian} {
+		var buf bytes.Buffer
+		shb := order.AppendUint32(nil, pcapngByteOrder)
+		shb = append(shb, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+		if order == byteOrder(binary.BigEndian) {
+			shb[4], shb[5] = 0, 1
+		}
+		shbBlock := pcapngBlock(order, pcapngSectionHeader, shb)
+		binary.LittleEndian.PutUint32(shbBlock, pcapngSectionHeader) // a palindrome, but be sure
+		buf.Write(shbBlock)
+
+		// interface 0 is raw IP in microseconds; 1 is raw IP in nanoseconds
+		idb := order.AppendUint16(nil, LinkRaw)
+		idb = append(idb, 0, 0)
+		idb = order.AppendUint32(idb, 0)
+		buf.Write(pcapngBlock(order, pcapngInterfaceDesc, idb))
+		idb = order.AppendUint16(idb[:8], 9)
+		idb = order.AppendUint16(idb, 1)
+		idb = append(idb, 9, 0, 0, 0)
+		idb = append(idb, 0, 0, 0, 0) // end of options
+		buf.Write(pcapngBlock(order, pcapngInterfaceDesc, idb))
+
+		buf.Write(pcapngBlock(order, 0x5, []byte("statistics, skipped")))
+		for id, ticks := range []uint64{1700000000500000, 1700000000500000123} {
+			epb := order.AppendUint32(nil, uint32(id))
+			epb = order.AppendUint32(epb, uint32(ticks>>32))
+			epb = order.AppendUint32(epb, uint32(ticks))
+			epb = order.AppendUint32(epb, uint32(len(packet)))
+			epb = order.AppendUint32(epb, uint32(len(packet)))
+			buf.Write(pcapngBlock(order, pcapngEnhanced, append(epb, packet...)))
+		}
+		spb := order.AppendUint32(nil, uint32(len(packet)))
+		buf.Write(pcapngBlock(order, pcapngSimplePacket, append(spb, packet...)))
+
+		r, err := NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range []time.Time{time.Unix(1700000000, 500000000), time.Unix(1700000000, 500000123), {}} {
+			p, err := r.Next()
+			if err != nil {
+				t.Fatalf("%s: %s", order, err)
+			}
+			if !p.Time.Equal(expected) {
+				t.Errorf("%s: expected a packet at %s; got %s", order, expected, p.Time)
+			}
+			if d, ok := DecodeUDP(p.LinkType, p.Data); !ok || string(d.Payload) != "hello" {
+				t.Errorf("%s: expected hello; got %+v", order, d)
+			}
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Errorf("%s: expected io.EOF; got %v", order, err)
+		}
+	}
+}
+
+func TestResolution(t *testing.T) {
+	tests := []struct {
+		tsresol  byte
+		ticks    uint64
+		expected time.Time
+	}{
+		{6, 1500000, time.Unix(1, 500000000)},
+		{9, 1500000000, time.Unix(1, 500000000)},
+		{0, 3, time.Unix(3, 0)},
+		{12, 1500000000000, time.Unix(1, 500000000)},
+		{0x80 | 10, 1024 + 512, time.Unix(1, 500000000)},
+	}
+	for _, test := range tests {
+		var iface pcapngInterface
+		iface.unit, iface.perSec = resolution(test.tsresol)
+		if actual := iface.time(test.ticks); !actual.Equal(test.expected) {
+			t.Errorf("tsresol %#x, %d ticks: expected %s; got %s", test.tsresol, test.ticks, test.expected, actual)
+		}
+	}
+}
+
+func TestDecodeUDP(t *testing.T) {
+	v4 := rawUDP(t, client, server, "four")
+	v6 := rawUDP(t, client6, server6, "six")
+	// a hop-by-hop options header between IPv6 and UDP
+	hopByHop := append(append([]byte(nil), v6[:40]...), protocolUDP, 0, 1, 4, 0, 0, 0, 0)
+	hopByHop = append(hopByHop, v6[40:]...)
+	hopByHop[6] = 0
+	binary.BigEndian.PutUint16(hopByHop[4:], uint16(len(hopByHop)-40))
+	fragment := append([]byte(nil), v4...)
+	fragment[6] = 0x20 // more fragments
+	tcp := append([]byte(nil), v4...)
+	tcp[9] = 6
+
+	tests := []struct {
+		name     string
+		linkType int
+		frame    []byte
+		payload  string // "" if no datagram should be found
+	}{
+		{"raw v4", LinkRaw, v4, "four"},
+		{"raw v6", LinkRaw, v6, "six"},
+		{"ipv4", LinkIPv4, v4, "four"},
+		{"ipv6", LinkIPv6, v6, "six"},
+		{"ethernet v6", LinkEthernet, append([]byte("\x00\x11\x22\x33\x44\x55\x66\x77\x88\x99\xaa\xbb\x86\xdd"), v6...), "six"},
+		{"null", LinkNull, append([]byte{2, 0, 0, 0}, v4...), "four"},
+		{"null big-endian v6", LinkNull, append([]byte{0, 0, 0, 30}, v6...), "six"},
+		{"loop", LinkLoop, append([]byte{0, 0, 0, 2}, v4...), "four"},
+		{"sll", LinkLinuxSLL, append(make([]byte, 14), append([]byte{0x08, 0x00}, v4...)...), "four"},
+		{"sll2", LinkLinuxSLL2, append([]byte{0x86, 0xdd}, append(make([]byte, 18), v6...)...), "six"},
+		{"hop-by-hop", LinkRaw, hopByHop, "six"},
+		{"padded", LinkRaw, append(append([]byte(nil), v4...), 0, 0, 0, 0), "four"},
+		{"fragment", LinkRaw, fragment, ""},
+		{"tcp", LinkRaw, tcp, ""},
+		{"truncated", LinkRaw, v4[:24], ""},
+		{"arp", LinkEthernet, append(make([]byte, 12), 0x08, 0x06, 0, 1), ""},
+		{"unknown link", 147, v4, ""},
+	}
+	for _, test := range tests {
+		d, ok := DecodeUDP(test.linkType, test.frame)
+		if test.payload == "" {
+			if ok {
+				t.Errorf("%s: expected no datagram; got %+v", test.name, d)
+			}
+		} else if !ok || string(d.Payload) != test.payload {
+			t.Errorf("%s: expected %q; got %+v %t", test.name, test.payload, d, ok)
+		}
+	}
+}
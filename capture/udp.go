@@ -0,0 +1,134 @@
+package capture
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// Datagram is a UDP datagram found in a frame
+type Datagram struct {
+	Src, Dst netip.AddrPort
+	Payload  []byte // as much of the payload as was captured
+}
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+
+	protocolUDP = 17
+)
+
+// DecodeUDP finds the UDP datagram carried by a frame of linkType.  It
+// reports false for frames that hold anything else, including fragments of
+// datagrams, which aren't reassembled.
+func DecodeUDP(linkType int, frame []byte) (Datagram, bool) {
+	switch linkType {
+	case LinkEthernet:
+		if len(frame) < 14 {
+			return Datagram{}, false
+		}
+		etherType, rest := binary.BigEndian.Uint16(frame[12:]), frame[14:]
+		for (etherType == etherTypeVLAN || etherType == etherTypeQinQ) && len(rest) >= 4 {
+			etherType, rest = binary.BigEndian.Uint16(rest[2:]), rest[4:]
+		}
+		return decodeIP(etherType, rest)
+	case LinkNull, LinkLoop:
+		if len(frame) < 4 {
+			return Datagram{}, false
+		}
+		// the family is in the capturing host's byte order for LinkNull, so
+		// look for it in either end
+		family := binary.BigEndian.Uint32(frame)
+		if linkType == LinkNull && family > 0xffff {
+			family = binary.LittleEndian.Uint32(frame)
+		}
+		switch family {
+		case 2:
+			return decodeIP(etherTypeIPv4, frame[4:])
+		case 10, 24, 28, 30: // AF_INET6 of Linux, the BSDs and macOS
+			return decodeIP(etherTypeIPv6, frame[4:])
+		}
+		return Datagram{}, false
+	case LinkRaw:
+		if len(frame) == 0 {
+			return Datagram{}, false
+		}
+		if frame[0]>>4 == 6 {
+			return decodeIP(etherTypeIPv6, frame)
+		}
+		return decodeIP(etherTypeIPv4, frame)
+	case LinkIPv4:
+		return decodeIP(etherTypeIPv4, frame)
+	case LinkIPv6:
+		return decodeIP(etherTypeIPv6, frame)
+	case LinkLinuxSLL:
+		if len(frame) < 16 {
+			return Datagram{}, false
+		}
+		return decodeIP(binary.BigEndian.Uint16(frame[14:]), frame[16:])
+	case LinkLinuxSLL2:
+		if len(frame) < 20 {
+			return Datagram{}, false
+		}
+		return decodeIP(binary.BigEndian.Uint16(frame), frame[20:])
+	}
+	return Datagram{}, false
+}
+
+// decodeIP finds the UDP datagram in an IP packet of etherType
+func decodeIP(etherType uint16, packet []byte) (Datagram, bool) {
+	var src, dst netip.Addr
+	var payload []byte
+	switch etherType {
+	case etherTypeIPv4:
+		if len(packet) < 20 || packet[0]>>4 != 4 {
+			return Datagram{}, false
+		}
+		headerLen := int(packet[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(packet[2:]))
+		fragment := binary.BigEndian.Uint16(packet[6:])
+		if headerLen < 20 || total < headerLen || len(packet) < headerLen || packet[9] != protocolUDP || fragment&0x3fff != 0 {
+			return Datagram{}, false
+		}
+		src, dst = netip.AddrFrom4([4]byte(packet[12:16])), netip.AddrFrom4([4]byte(packet[16:20]))
+		payload = packet[headerLen:min(total, len(packet))]
+	case etherTypeIPv6:
+		if len(packet) < 40 || packet[0]>>4 != 6 {
+			return Datagram{}, false
+		}
+		src, dst = netip.AddrFrom16([16]byte(packet[8:24])), netip.AddrFrom16([16]byte(packet[24:40]))
+		next, rest := packet[6], packet[40:min(40+int(binary.BigEndian.Uint16(packet[4:])), len(packet))]
+		// skip the extension headers that can come before UDP
+		for next == 0 || next == 43 || next == 60 {
+			if len(rest) < 8 {
+				return Datagram{}, false
+			}
+			length := (int(rest[1]) + 1) * 8
+			if len(rest) < length {
+				return Datagram{}, false
+			}
+			next, rest = rest[0], rest[length:]
+		}
+		if next != protocolUDP {
+			return Datagram{}, false
+		}
+		payload = rest
+	default:
+		return Datagram{}, false
+	}
+
+	if len(payload) < 8 {
+		return Datagram{}, false
+	}
+	length := int(binary.BigEndian.Uint16(payload[4:]))
+	if length < 8 {
+		return Datagram{}, false
+	}
+	return Datagram{
+		Src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(payload)),
+		Dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(payload[2:])),
+		Payload: payload[8:min(length, len(payload))],
+	}, true
+}
@@ -0,0 +1,104 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"time"
+)
+
+// Writer writes UDP datagrams to a pcap capture as raw IP packets, with
+// nanosecond timestamps, so that what a program sent and received can be
+// recorded without the frames it came in.  Any pcap reader, Wireshark
+// included, can open the result.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewWriter writes the capture header to w
+func NewWriter(w io.Writer) (*Writer, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header, pcapMagicNanos)
+	binary.LittleEndian.PutUint16(header[4:], 2) // version 2.4
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535) // snapshot length
+	binary.LittleEndian.PutUint32(header[20:], LinkRaw)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// WriteUDP records payload sent from src to dst at t.  The addresses must be
+// of the same family, though IPv4 addresses mapped into IPv6 count as IPv4.
+func (w *Writer) WriteUDP(t time.Time, src, dst netip.AddrPort, payload []byte) error {
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	if src.Addr().Is4() != dst.Addr().Is4() {
+		return errors.New("source and destination are of different address families")
+	}
+	if len(payload) > 65535-48 {
+		return errors.New("payload too large for a datagram")
+	}
+	buf := append(w.buf[:0], make([]byte, 16)...) // record header, filled in below
+	udpLen := 8 + len(payload)
+	if src.Addr().Is4() {
+		ip := [20]byte{0: 0x45, 8: 64, 9: protocolUDP}
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+udpLen))
+		copy(ip[12:], src.Addr().AsSlice())
+		copy(ip[16:], dst.Addr().AsSlice())
+		binary.BigEndian.PutUint16(ip[10:], ^sum(0, ip[:]))
+		buf = append(buf, ip[:]...)
+	} else {
+		ip := [40]byte{0: 0x60, 6: protocolUDP, 7: 64}
+		binary.BigEndian.PutUint16(ip[4:], uint16(udpLen))
+		copy(ip[8:], src.Addr().AsSlice())
+		copy(ip[24:], dst.Addr().AsSlice())
+		buf = append(buf, ip[:]...)
+	}
+	udp := len(buf)
+	buf = binary.BigEndian.AppendUint16(buf, src.Port())
+	buf = binary.BigEndian.AppendUint16(buf, dst.Port())
+	buf = binary.BigEndian.AppendUint16(buf, uint16(udpLen))
+	buf = append(buf, 0, 0)
+	buf = append(buf, payload...)
+	binary.BigEndian.PutUint16(buf[udp+6:], udpChecksum(src.Addr(), dst.Addr(), buf[udp:]))
+
+	binary.LittleEndian.PutUint32(buf, uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(t.Nanosecond()))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(buf)-16))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(len(buf)-16))
+	w.buf = buf
+	_, err := w.w.Write(buf)
+	return err
+}
+
+// udpChecksum is the checksum of a UDP datagram, over the pseudo header of
+// its addresses too
+func udpChecksum(src, dst netip.Addr, datagram []byte) uint16 {
+	pseudo := append(src.AsSlice(), dst.AsSlice()...)
+	pseudo = append(pseudo, 0, protocolUDP)
+	pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(datagram)))
+	checksum := ^sum(uint32(sum(0, pseudo)), datagram)
+	if checksum == 0 {
+		return 0xffff // zero means no checksum
+	}
+	return checksum
+}
+
+// sum adds data to the ones' complement sum of the internet checksum
+func sum(initial uint32, data []byte) uint16 {
+	total := initial
+	for i := 0; i+1 < len(data); i += 2 {
+		total += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		total += uint32(data[len(data)-1]) << 8
+	}
+	for total > 0xffff {
+		total = total>>16 + total&0xffff
+	}
+	return uint16(total)
+}
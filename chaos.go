@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const chaosIdleTimeout = 2 * time.Minute        // sessions with no packets for this long are closed
+const chaosReorderHold = 500 * time.Millisecond // longest a packet is held back waiting for one to overtake it
+
+// chaosFaults are the chances of each fault befalling a packet that no
+// scripted rule matched.  At most one fault is applied to a packet.
+type chaosFaults struct {
+	Drop      float64
+	Duplicate float64
+	Reorder   float64
+	Spoof     float64 // a copy is also sent from a port the receiver hasn't seen
+	Delay     time.Duration
+	Jitter    time.Duration // extra delay picked uniformly up to this
+}
+
+// chaosRule is a scripted fault, applied to the first packet of each session
+// that matches it.  A line of a script reads
+//
+//	<to-server|to-client|any> <RRQ|WRQ|DATA|ACK|ERROR|OACK|*> <block|*> <drop|duplicate|reorder|spoof|delay DURATION>
+//
+// and lines starting with # are comments.
+type chaosRule struct {
+	direction string
+	op        string
+	block     int // -1 for any block
+	action    string
+	delay     time.Duration
+}
+
+// parseChaosScript reads scripted faults, one per line
+func parseChaosScript(r *bufio.Scanner) ([]chaosRule, error) {
+	var rules []chaosRule
+	for line := 1; r.Scan(); line++ {
+		fields := strings.Fields(r.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		rule, err := parseChaosRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, r.Err()
+}
+
+func parseChaosRule(fields []string) (chaosRule, error) {
+	if len(fields) < 4 {
+		return chaosRule{}, errors.New("expected direction, packet type, block and action")
+	}
+	rule := chaosRule{direction: fields[0], op: strings.ToUpper(fields[1]), block: -1, action: fields[3]}
+	switch rule.direction {
+	case "to-server", "to-client", "any":
+	default:
+		return chaosRule{}, fmt.Errorf("unknown direction %q", rule.direction)
+	}
+	switch rule.op {
+	case "RRQ", "WRQ", "DATA", "ACK", "ERROR", "OACK", "*":
+	default:
+		return chaosRule{}, fmt.Errorf("unknown packet type %q", fields[1])
+	}
+	if fields[2] != "*" {
+		block, err := strconv.ParseUint(fields[2], 10, 16)
+		if err != nil {
+			return chaosRule{}, fmt.Errorf("bad block number %q", fields[2])
+		}
+		rule.block = int(block)
+	}
+	switch rule.action {
+	case "drop", "duplicate", "reorder", "spoof":
+		if len(fields) != 4 {
+			return chaosRule{}, fmt.Errorf("unexpected %q after %s", fields[4], rule.action)
+		}
+	case "delay":
+		if len(fields) != 5 {
+			return chaosRule{}, errors.New("delay needs a duration")
+		}
+		d, err := time.ParseDuration(fields[4])
+		if err != nil || d < 0 {
+			return chaosRule{}, fmt.Errorf("bad delay %q", fields[4])
+		}
+		rule.delay = d
+	default:
+		return chaosRule{}, fmt.Errorf("unknown action %q", rule.action)
+	}
+	return rule, nil
+}
+
+func (r chaosRule) matches(direction, op string, block int) bool {
+	return (r.direction == "any" || r.direction == direction) &&
+		(r.op == "*" || r.op == op) &&
+		(r.block < 0 || r.block == block)
+}
+
+// describePacket names a packet's type and, for DATA and ACK, its block
+// number, which is -1 for other packets
+func describePacket(packet []byte) (string, int) {
+	parsed, err := wire.ParsePacket(packet)
+	if err != nil {
+		return "BAD", -1
+	}
+	switch p := parsed.(type) {
+	case *wire.PacketRequest:
+		if p.Op == wire.OpWRQ {
+			return "WRQ", -1
+		}
+		return "RRQ", -1
+	case *wire.PacketData:
+		return "DATA", int(p.BlockNum)
+	case *wire.PacketAck:
+		return "ACK", int(p.BlockNum)
+	case *wire.PacketError:
+		return "ERROR", -1
+	case *wire.PacketOAck:
+		return "OACK", -1
+	}
+	return "BAD", -1
+}
+
+// chaosProxy relays TFTP between clients and a server, injecting faults on
+// the way.  Each client gets a session with its own ports facing the client
+// and the server, so the transfer IDs each side sees behave as they would
+// talking directly.
+type chaosProxy struct {
+	listen net.PacketConn
+	server *net.UDPAddr
+	faults chaosFaults
+	rules  []chaosRule
+
+	sync.Mutex
+	rng      *rand.Rand
+	sessions map[string]*chaosSession
+	counts   map[string]int // packets relayed, by what was done to them
+}
+
+type chaosSession struct {
+	proxy  *chaosProxy
+	client net.Addr
+
+	clientSide net.PacketConn // the client sees packets from the server come from here
+	serverSide net.PacketConn // the server sees packets from the client come from here
+	spoofSide  net.PacketConn // spoofed copies come from here
+
+	sync.Mutex
+	serverTID  net.Addr               // where the server is sending from, once it has replied
+	fired      []bool                 // scripted rules already applied in this session
+	held       map[string]*heldPacket // packets held back for reordering, by direction
+	lastActive time.Time
+}
+
+type heldPacket struct {
+	packet []byte
+	via    net.PacketConn
+	to     net.Addr
+}
+
+func newChaosProxy(listen net.PacketConn, server *net.UDPAddr, faults chaosFaults, rules []chaosRule, seed int64) *chaosProxy {
+	return &chaosProxy{
+		listen:   listen,
+		server:   server,
+		faults:   faults,
+		rules:    rules,
+		rng:      rand.New(rand.NewSource(seed)),
+		sessions: make(map[string]*chaosSession),
+		counts:   make(map[string]int),
+	}
+}
+
+// run relays requests until the listening connection is closed
+func (p *chaosProxy) run() {
+	go p.sweep()
+	buf := make([]byte, wire.MaxPacketSize)
+	for {
+		n, addr, err := p.listen.ReadFrom(buf)
+		if err != nil {
+			p.closeSessions()
+			return
+		}
+		session, err := p.session(addr)
+		if err != nil {
+			log.Println("chaos: unable to open a session for", addr, " error: ", err)
+			continue
+		}
+		packet := append([]byte(nil), buf[:n]...)
+		session.relay("to-server", packet, true)
+	}
+}
+
+// session returns the session for the client at addr, starting one if needed
+func (p *chaosProxy) session(addr net.Addr) (*chaosSession, error) {
+	p.Lock()
+	defer p.Unlock()
+	if s, ok := p.sessions[addr.String()]; ok {
+		return s, nil
+	}
+	s := &chaosSession{proxy: p, client: addr, fired: make([]bool, len(p.rules)), held: make(map[string]*heldPacket), lastActive: time.Now()}
+	var err error
+	for _, c := range []*net.PacketConn{&s.clientSide, &s.serverSide, &s.spoofSide} {
+		if *c, err = net.ListenPacket("udp", ":0"); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+	p.sessions[addr.String()] = s
+	log.Printf("chaos: session for %s, client side %s, server side %s", addr, s.clientSide.LocalAddr(), s.serverSide.LocalAddr())
+	go s.readClient()
+	go s.readServer()
+	go s.readSpoofed()
+	return s, nil
+}
+
+// sweep closes sessions that have gone quiet.  A session's lock is never
+// taken while holding the proxy's, as relaying takes them the other way round.
+func (p *chaosProxy) sweep() {
+	for {
+		time.Sleep(chaosIdleTimeout / 4)
+		p.Lock()
+		if p.sessions == nil {
+			p.Unlock()
+			return
+		}
+		sessions := make([]*chaosSession, 0, len(p.sessions))
+		for _, s := range p.sessions {
+			sessions = append(sessions, s)
+		}
+		p.Unlock()
+
+		for _, s := range sessions {
+			s.Lock()
+			idle := time.Since(s.lastActive) > chaosIdleTimeout
+			s.Unlock()
+			if idle {
+				p.Lock()
+				delete(p.sessions, s.client.String())
+				p.Unlock()
+				s.close()
+			}
+		}
+	}
+}
+
+func (p *chaosProxy) closeSessions() {
+	p.Lock()
+	defer p.Unlock()
+	for _, s := range p.sessions {
+		s.close()
+	}
+	p.sessions = nil
+}
+
+func (p *chaosProxy) count(what string) {
+	p.Lock()
+	p.counts[what]++
+	p.Unlock()
+}
+
+// pick decides what happens to the next packet.  Scripted rules come first,
+// then the random faults.
+func (p *chaosProxy) pick(s *chaosSession, direction, op string, block int) (string, time.Duration) {
+	for i, rule := range p.rules {
+		if !s.fired[i] && rule.matches(direction, op, block) {
+			s.fired[i] = true
+			return rule.action, rule.delay
+		}
+	}
+	p.Lock()
+	defer p.Unlock()
+	roll := p.rng.Float64()
+	for _, fault := range []struct {
+		action string
+		chance float64
+	}{
+		{"drop", p.faults.Drop},
+		{"duplicate", p.faults.Duplicate},
+		{"reorder", p.faults.Reorder},
+		{"spoof", p.faults.Spoof},
+	} {
+		if roll < fault.chance {
+			return fault.action, 0
+		}
+		roll -= fault.chance
+	}
+	delay := p.faults.Delay
+	if p.faults.Jitter > 0 {
+		delay += time.Duration(p.rng.Int63n(int64(p.faults.Jitter)))
+	}
+	if delay > 0 {
+		return "delay", delay
+	}
+	return "pass", 0
+}
+
+// relay sends packet on in direction, unless a fault gets in the way.  A
+// request, sent to the proxy's listening port, goes to the server's and
+// starts a new transfer, so the server's transfer ID is learned afresh.
+func (s *chaosSession) relay(direction string, packet []byte, request bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastActive = time.Now()
+	if request {
+		s.serverTID = nil
+	}
+	via, to := s.serverSide, s.serverTID
+	if direction == "to-client" {
+		via, to = s.clientSide, s.client
+	} else if to == nil {
+		to = s.proxy.server
+	}
+
+	op, block := describePacket(packet)
+	action, delay := s.proxy.pick(s, direction, op, block)
+	s.proxy.count(action)
+	if action != "pass" {
+		log.Printf("chaos: %s %s %s %s", s.client, direction, packetName(op, block), action)
+	}
+
+	// a packet held back for reordering goes out after this one
+	held := s.held[direction]
+	delete(s.held, direction)
+	switch action {
+	case "pass":
+		via.WriteTo(packet, to)
+	case "drop":
+	case "duplicate":
+		via.WriteTo(packet, to)
+		via.WriteTo(packet, to)
+	case "reorder":
+		if held == nil {
+			hold := &heldPacket{packet, via, to}
+			s.held[direction] = hold
+			time.AfterFunc(chaosReorderHold, func() { s.flush(direction, hold) })
+		} else {
+			via.WriteTo(packet, to) // already holding one back, let this one overtake it
+		}
+	case "spoof":
+		via.WriteTo(packet, to)
+		s.spoofSide.WriteTo(packet, to)
+	case "delay":
+		time.AfterFunc(delay, func() { via.WriteTo(packet, to) })
+	}
+	if held != nil && action != "reorder" {
+		held.via.WriteTo(held.packet, held.to)
+	}
+}
+
+// flush sends hold if it's still being held back, as nothing came along to
+// overtake it
+func (s *chaosSession) flush(direction string, hold *heldPacket) {
+	s.Lock()
+	defer s.Unlock()
+	if s.held[direction] == hold {
+		delete(s.held, direction)
+		hold.via.WriteTo(hold.packet, hold.to)
+	}
+}
+
+func packetName(op string, block int) string {
+	if block < 0 {
+		return op
+	}
+	return fmt.Sprintf("%s %d", op, block)
+}
+
+// readClient relays what the client sends to its session's port
+func (s *chaosSession) readClient() {
+	buf := make([]byte, wire.MaxPacketSize)
+	for {
+		n, addr, err := s.clientSide.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if addr.String() != s.client.String() {
+			continue
+		}
+		s.relay("to-server", append([]byte(nil), buf[:n]...), false)
+	}
+}
+
+// readServer relays what the server sends back, learning the server's
+// transfer ID from its first reply
+func (s *chaosSession) readServer() {
+	buf := make([]byte, wire.MaxPacketSize)
+	for {
+		n, addr, err := s.serverSide.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || (!udpAddr.IP.Equal(s.proxy.server.IP) && !s.proxy.server.IP.IsUnspecified()) {
+			continue
+		}
+		s.Lock()
+		if s.serverTID == nil {
+			s.serverTID = addr
+		}
+		s.Unlock()
+		s.relay("to-client", append([]byte(nil), buf[:n]...), false)
+	}
+}
+
+// readSpoofed logs how the client and server answer spoofed packets.  Both
+// should send ERROR 5 (unknown transfer ID) and carry on with the transfer.
+func (s *chaosSession) readSpoofed() {
+	buf := make([]byte, wire.MaxPacketSize)
+	for {
+		n, addr, err := s.spoofSide.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		answer := "ERROR 5"
+		if packet, err := wire.ParsePacket(buf[:n]); err != nil {
+			answer = "a malformed packet"
+		} else if errPack, ok := packet.(*wire.PacketError); !ok {
+			op, block := describePacket(buf[:n])
+			answer = packetName(op, block)
+		} else if errPack.Code != 5 {
+			answer = fmt.Sprintf("ERROR %d", errPack.Code)
+		}
+		side := "server"
+		if addr.String() == s.client.String() {
+			side = "client"
+		}
+		s.proxy.count("spoof answered by " + side + " with " + answer)
+		log.Printf("chaos: %s answered a spoofed packet from %s with %s", side, addr, answer)
+	}
+}
+
+func (s *chaosSession) close() {
+	for _, c := range []net.PacketConn{s.clientSide, s.serverSide, s.spoofSide} {
+		if c != nil {
+			c.Close()
+		}
+	}
+}
+
+// runChaos is the chaos subcommand: a UDP proxy that drops, duplicates,
+// reorders, delays and spoofs packets between TFTP clients and a server, for
+// seeing how clients cope with a bad network.
+func runChaos(args []string) int {
+	flags := flag.NewFlagSet("chaos", flag.ContinueOnError)
+	listenAddr := flags.String("listen", "127.0.0.1:6969", "address clients send requests to")
+	serverAddr := flags.String("server", "127.0.0.1:9010", "address of the TFTP server")
+	script := flags.String("script", "", "file of scripted faults, applied before the random ones")
+	seed := flags.Int64("seed", 0, "seed for the random faults.  0 picks one from the clock")
+	var faults chaosFaults
+	flags.Float64Var(&faults.Drop, "drop", 0, "chance of dropping a packet")
+	flags.Float64Var(&faults.Duplicate, "duplicate", 0, "chance of sending a packet twice")
+	flags.Float64Var(&faults.Reorder, "reorder", 0, "chance of holding a packet back until after the next one")
+	flags.Float64Var(&faults.Spoof, "spoof", 0, "chance of also sending a packet from an unknown transfer ID")
+	flags.DurationVar(&faults.Delay, "delay", 0, "delay added to every other packet")
+	flags.DurationVar(&faults.Jitter, "jitter", 0, "random extra delay of up to this")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if total := faults.Drop + faults.Duplicate + faults.Reorder + faults.Spoof; total > 1 || faults.Drop < 0 || faults.Duplicate < 0 || faults.Reorder < 0 || faults.Spoof < 0 {
+		fmt.Fprintln(os.Stderr, "chaos: fault chances must be between 0 and 1 and add up to at most 1")
+		return 2
+	}
+
+	var rules []chaosRule
+	if *script != "" {
+		f, err := os.Open(*script)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "chaos:", err)
+			return 1
+		}
+		rules, err = parseChaosScript(bufio.NewScanner(f))
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "chaos: %s: %s\n", *script, err)
+			return 1
+		}
+	}
+	server, err := net.ResolveUDPAddr("udp", *serverAddr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "chaos:", err)
+		return 1
+	}
+	listen, err := net.ListenPacket("udp", *listenAddr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "chaos:", err)
+		return 1
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	log.Printf("chaos: relaying %s to %s with seed %d", listen.LocalAddr(), server, *seed)
+
+	proxy := newChaosProxy(listen, server, faults, rules, *seed)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listen.Close()
+	}()
+	proxy.run()
+
+	fmt.Println("Packets relayed at chaos proxy quit")
+	proxy.Lock()
+	defer proxy.Unlock()
+	whats := make([]string, 0, len(proxy.counts))
+	for what := range proxy.counts {
+		whats = append(whats, what)
+	}
+	sort.Strings(whats)
+	for _, what := range whats {
+		fmt.Printf("%s: %d\n", what, proxy.counts[what])
+	}
+	return 0
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseChaosScript(t *testing.T) {
+	rules, err := parseChaosScript(bufio.NewScanner(strings.NewReader(`
+# lose the second block, then make the client see a stranger
+to-client DATA 2 drop
+to-client data * spoof
+any ACK 3 delay 250ms
+to-server * * reorder
+`)))
+	expected := []chaosRule{
+		{"to-client", "DATA", 2, "drop", 0},
+		{"to-client", "DATA", -1, "spoof", 0},
+		{"any", "ACK", 3, "delay", 250 * time.Millisecond},
+		{"to-server", "*", -1, "reorder", 0},
+	}
+	if err != nil || len(rules) != len(expected) {
+		t.Fatalf("Expected %d rules; got %v, %v", len(expected), rules, err)
+	}
+	for i := range expected {
+		if rules[i] != expected[i] {
+			t.Errorf("Rule %d: expected %v; got %v", i+1, expected[i], rules[i])
+		}
+	}
+
+	bad := []string{
+		"to-client DATA 2",
+		"sideways DATA 2 drop",
+		"to-client FOO 2 drop",
+		"to-client DATA 70000 drop",
+		"to-client DATA 2 explode",
+		"to-client DATA 2 delay",
+		"to-client DATA 2 delay soon",
+		"to-client DATA 2 drop now",
+	}
+	for _, line := range bad {
+		if _, err := parseChaosScript(bufio.NewScanner(strings.NewReader(line))); err == nil || !strings.HasPrefix(err.Error(), "line 1:") {
+			t.Errorf("%q: expected an error for line 1; got %v", line, err)
+		}
+	}
+}
+
+func TestChaosProxy(t *testing.T) {
+	oldTimeout := timeoutSeconds
+	defer func() { timeoutSeconds = oldTimeout }()
+	timeoutSeconds = 1
+
+	contents := bytes.Repeat([]byte("chaos"), 600) // 3000 bytes, 6 blocks
+	files = newCASStore()
+	files.Write("firmware.bin", string(contents), "")
+	files.Write("small.cfg", "small", "")
+	listeners, err := openListeners([]listenSpec{{network: "udp4", address: "127.0.0.1:0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	forgetRequests(t)
+	wg.Add(1)
+	txID := int64(0)
+	txns := make(chan string, 10)
+	go serve(listeners[0], wire.ParseDefault, &txID, txns, &wg)
+	defer func() {
+		listeners[0].Close()
+		wg.Wait()
+	}()
+
+	listen, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := []chaosRule{
+		{"to-client", "DATA", 2, "drop", 0},
+		{"to-server", "ACK", 3, "duplicate", 0},
+		{"to-server", "ACK", 4, "spoof", 0},
+		{"to-client", "DATA", 5, "reorder", 0},
+		{"to-client", "DATA", 6, "delay", 100 * time.Millisecond},
+	}
+	proxy := newChaosProxy(listen, listeners[0].LocalAddr().(*net.UDPAddr), chaosFaults{}, rules, 1)
+	go proxy.run()
+	defer listen.Close()
+
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	rrq := wire.PacketRequest{Op: wire.OpRRQ, Filename: "firmware.bin", Mode: "octet"}
+	last := rrq.Serialize()
+	client.WriteTo(last, listen.LocalAddr())
+	var tid net.Addr
+	var received []byte
+	expected := uint16(1)
+	buf := make([]byte, wire.MaxPacketSize)
+	for timeouts := 0; timeouts < 10; {
+		client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		n, addr, err := client.ReadFrom(buf)
+		if err != nil {
+			if tid == nil {
+				client.WriteTo(last, listen.LocalAddr())
+			} else {
+				client.WriteTo(last, tid)
+			}
+			timeouts++
+			continue
+		}
+		if tid == nil {
+			tid = addr
+		} else if addr.String() != tid.String() {
+			continue
+		}
+		packet, err := wire.ParsePacket(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, ok := packet.(*wire.PacketData)
+		if !ok {
+			t.Fatalf("Expected DATA; got %#v", packet)
+		}
+		if data.BlockNum == expected {
+			received = append(received, data.Data...)
+			expected++
+		}
+		ack := wire.PacketAck{BlockNum: data.BlockNum}
+		last = ack.Serialize()
+		client.WriteTo(last, tid)
+		if len(data.Data) < 512 && data.BlockNum+1 == expected {
+			break
+		}
+	}
+
+	if !bytes.Equal(received, contents) {
+		t.Errorf("Expected %d bytes through the proxy; got %d", len(contents), len(received))
+	}
+	if txn := <-txns; !strings.Contains(txn, "success") {
+		t.Errorf("Expected the server to log success; got %q", txn)
+	}
+
+	// the server's answer to the spoofed ACK comes back asynchronously
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		proxy.Lock()
+		counts := make(map[string]int)
+		for what, n := range proxy.counts {
+			counts[what] = n
+		}
+		proxy.Unlock()
+		answered := 0
+		for what, n := range counts {
+			if strings.HasPrefix(what, "spoof answered by server with ERROR") {
+				answered += n
+			}
+		}
+		if answered == 1 {
+			for _, action := range []string{"drop", "duplicate", "spoof", "reorder", "delay"} {
+				if counts[action] != 1 {
+					t.Errorf("Expected the scripted %s once; got %d", action, counts[action])
+				}
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the server to answer the spoofed ACK with an ERROR; got %v", counts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a second request from the same client starts a new transfer rather
+	// than going to the finished one's port
+	rrq = wire.PacketRequest{Op: wire.OpRRQ, Filename: "small.cfg", Mode: "octet"}
+	client.WriteTo(rrq.Serialize(), listen.LocalAddr())
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, addr, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Expected the second request to be answered; got %s", err)
+	}
+	if packet, err := wire.ParsePacket(buf[:n]); err != nil || string(packet.(*wire.PacketData).Data) != "small" {
+		t.Fatalf("Expected DATA 1 of small.cfg; got %v, %v", packet, err)
+	}
+	ack := wire.PacketAck{BlockNum: 1}
+	client.WriteTo(ack.Serialize(), addr)
+	if txn := <-txns; !strings.Contains(txn, "success") {
+		t.Errorf("Expected the server to log the second read's success; got %q", txn)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// config is the layout of the JSON file named by the -config flag.  Every
+// section is optional; a missing section leaves that feature at its default.
+type config struct {
+	Listen     []listenConfig `json:"listen"`
+	SinglePort bool           `json:"single_port"` // run transfers over the listening socket, for strict firewalls
+	Ports      *portsConfig   `json:"ports"`
+
+	RateLimits  *rateLimitsConfig  `json:"rate_limits"`
+	Concurrency *concurrencyConfig `json:"concurrency"`
+
+	Rewrite []rewriteRuleConfig `json:"rewrite"`
+	Roots   []virtualRootConfig `json:"roots"`
+
+	Templates []fileTemplateConfig `json:"templates"`
+	Inventory string               `json:"inventory"` // CSV or JSON file of per-host template variables
+
+	Hooks []hookConfig `json:"hooks"`
+
+	Webhooks []webhookConfig `json:"webhooks"`
+
+	Archives []archiveMountConfig `json:"archives"`
+
+	Versions *versionsConfig `json:"versions"`
+
+	Quotas *quotaConfig `json:"quotas"`
+
+	Expiry []expiryRuleConfig `json:"expiry"`
+
+	Recording *recordingConfig `json:"recording"`
+}
+
+// versionsConfig is the retention policy for old versions of written files.
+// Zero means no limit; without this section only the current version is kept.
+type versionsConfig struct {
+	Keep       int `json:"keep"` // versions of each file to keep, including the current one
+	MaxAgeDays int `json:"max_age_days"`
+}
+
+// loadConfig reads and decodes the config file at path.  Unknown keys are an
+// error so that a typo doesn't silently disable a feature.
+func loadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &config{}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyConfig compiles cfg and installs it in the server's globals.  Nothing
+// is installed unless the whole config is valid.
+func applyConfig(cfg *config) error {
+	rules, err := compileRewriteRules(cfg.Rewrite)
+	if err != nil {
+		return err
+	}
+	roots, err := compileVirtualRoots(cfg.Roots)
+	if err != nil {
+		return err
+	}
+	templates, err := compileFileTemplates(cfg.Templates)
+	if err != nil {
+		return err
+	}
+	var inv *inventory
+	if cfg.Inventory != "" {
+		if inv, err = newInventory(cfg.Inventory); err != nil {
+			return err
+		}
+	}
+	hooks, err := compileHooks(cfg.Hooks)
+	if err != nil {
+		return err
+	}
+	notifiers, err := compileWebhooks(cfg.Webhooks)
+	if err != nil {
+		return err
+	}
+	mounts, err := compileArchiveMounts(cfg.Archives)
+	if err != nil {
+		return err
+	}
+	keep, keepDays := 1, 0
+	if cfg.Versions != nil {
+		if cfg.Versions.Keep < 0 || cfg.Versions.MaxAgeDays < 0 {
+			return errors.New("versions: keep and max_age_days can't be negative")
+		}
+		keep, keepDays = cfg.Versions.Keep, cfg.Versions.MaxAgeDays
+	}
+	var maxSize, capacity int64
+	var quotas []*clientQuota
+	if cfg.Quotas != nil {
+		if cfg.Quotas.MaxFileSize < 0 || cfg.Quotas.Capacity < 0 {
+			return errors.New("quotas: max_file_size and capacity can't be negative")
+		}
+		if quotas, err = compileClientQuotas(cfg.Quotas.Clients); err != nil {
+			return err
+		}
+		maxSize, capacity = cfg.Quotas.MaxFileSize, cfg.Quotas.Capacity
+	}
+	specs := listenSpecs
+	if len(cfg.Listen) > 0 {
+		if specs, err = compileListeners(cfg.Listen); err != nil {
+			return err
+		}
+	}
+	if cfg.Ports != nil {
+		if err := checkPortRange(*cfg.Ports); err != nil {
+			return err
+		}
+	}
+	limits := &rateLimitsConfig{}
+	if cfg.RateLimits != nil {
+		limits = cfg.RateLimits
+	}
+	if limits.Action != "" && limits.Action != "delay" && limits.Action != "reject" {
+		return errors.New("rate_limits: action must be \"delay\" or \"reject\"")
+	}
+	for name, bucket := range map[string]*bucketConfig{"requests_per_ip": limits.Requests, "transfer_bytes": limits.TransferBytes, "total_bytes": limits.TotalBytes} {
+		if err := checkBucketConfig(name, bucket); err != nil {
+			return err
+		}
+	}
+	concurrency := &concurrencyConfig{}
+	if cfg.Concurrency != nil {
+		concurrency = cfg.Concurrency
+	}
+	if concurrency.MaxTransfers < 0 || concurrency.MaxPerClient < 0 || concurrency.MaxPerFile < 0 || concurrency.MaxQueued < 0 {
+		return errors.New("concurrency: limits can't be negative")
+	}
+	var queueWait time.Duration
+	if concurrency.QueueTimeout != "" {
+		if queueWait, err = time.ParseDuration(concurrency.QueueTimeout); err != nil || queueWait < 0 {
+			return errors.New("concurrency: queue_timeout must be a duration such as \"30s\"")
+		}
+	}
+	expiry, err := compileExpiryRules(cfg.Expiry)
+	if err != nil {
+		return err
+	}
+	recording, err := compileRecording(cfg.Recording)
+	if err != nil {
+		return err
+	}
+	listenSpecs = specs
+	singlePort = cfg.SinglePort
+	if cfg.Ports != nil {
+		tidPorts.setRange(cfg.Ports.First, cfg.Ports.Last)
+	}
+	rewriteRules = rules
+	virtualRoots = roots
+	fileTemplates = templates
+	hostInventory = inv
+	commandHooks = hooks
+	webhooks = notifiers
+	archiveMounts = mounts
+	keepVersions, keepVersionDays = keep, keepDays
+	maxFileSize, storeCapacity = maxSize, capacity
+	installQuotas(quotas)
+	expiryRules = expiry
+	recordingRule = recording
+	requestLimit, transferLimit, totalBytes = limits.Requests, limits.TransferBytes, nil
+	if limits.TotalBytes != nil {
+		totalBytes = newTokenBucket(limits.TotalBytes, time.Now())
+	}
+	rejectOverLimit = limits.Action == "reject"
+	maxTransfers, maxTransfersPerClient, maxTransfersPerFile = concurrency.MaxTransfers, concurrency.MaxPerClient, concurrency.MaxPerFile
+	queueTimeout, maxQueued = queueWait, concurrency.MaxQueued
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/coffeepac/tftp/conformance"
+	"os"
+	"regexp"
+)
+
+// runConformance is the conformance subcommand: it runs the conformance
+// suite against a TFTP server and reports how it did, exiting with 1 if any
+// scenario failed.
+func runConformance(args []string) int {
+	defaults := conformance.DefaultConfig("127.0.0.1:9010")
+	flags := flag.NewFlagSet("conformance", flag.ContinueOnError)
+	server := flags.String("server", defaults.Server, "address of the TFTP server to test")
+	prefix := flags.String("prefix", defaults.Prefix, "prepended to the names of files written for the tests")
+	timeout := flags.Duration("timeout", defaults.Timeout, "longest to wait for a reply that should come straight away")
+	retransmitWait := flags.Duration("retransmit-wait", defaults.RetransmitWait, "longest to wait for the server to retransmit after a loss")
+	quiet := flags.Duration("quiet", defaults.Quiet, "how long to watch for packets that shouldn't come")
+	retries := flags.Int("retries", defaults.Retries, "times a packet is resent before a transfer is given up")
+	rollover := flags.Bool("rollover", defaults.Rollover, "run the block number rollover scenario, which moves 32MB each way")
+	run := flags.String("run", "", "only run scenarios whose names match this regular expression")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg := defaults
+	cfg.Server, cfg.Prefix, cfg.Timeout, cfg.RetransmitWait, cfg.Quiet, cfg.Retries, cfg.Rollover = *server, *prefix, *timeout, *retransmitWait, *quiet, *retries, *rollover
+	if *run != "" {
+		re, err := regexp.Compile(*run)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "conformance: bad -run:", err)
+			return 2
+		}
+		cfg.Run = re
+	}
+
+	results, err := conformance.Run(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "conformance:", err)
+		return 1
+	}
+	if conformance.Report(os.Stdout, results) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,266 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"time"
+)
+
+// transfer is the client end of one exchange with the server
+type transfer struct {
+	conn   net.PacketConn
+	server *net.UDPAddr // where requests go
+	tid    net.Addr     // where the server sends from, once it has replied
+}
+
+// errorReply is an ERROR packet the server answered with
+type errorReply struct {
+	code uint16
+	msg  string
+}
+
+func (e *errorReply) Error() string {
+	return fmt.Sprintf("server sent ERROR %d %q", e.code, e.msg)
+}
+
+// errTimeout is returned when the server doesn't answer in time
+var errTimeout = errors.New("timed out")
+
+func (s *suite) dial() (*transfer, error) {
+	network := "udp4"
+	if s.server.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := net.ListenPacket(network, ":0")
+	if err != nil {
+		return nil, err
+	}
+	return &transfer{conn: conn, server: s.server}, nil
+}
+
+func (t *transfer) close() {
+	t.conn.Close()
+}
+
+// send sends packet to the server's transfer ID, or to where it listens for
+// requests if it hasn't replied yet
+func (t *transfer) send(packet wire.Packet) {
+	to := t.tid
+	if to == nil {
+		to = t.server
+	}
+	t.conn.WriteTo(packet.Serialize(), to)
+}
+
+// receive waits up to wait for the server's next packet, which must follow
+// the RFCs strictly.  The first packet fixes the server's transfer ID, and
+// anything later from elsewhere is ignored.
+func (t *transfer) receive(wait time.Duration) (wire.Packet, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		buf := make([]byte, wire.MaxPacketSize)
+		t.conn.SetReadDeadline(deadline)
+		n, addr, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return nil, errTimeout
+			}
+			return nil, err
+		}
+		if t.tid == nil {
+			t.tid = addr
+		} else if addr.String() != t.tid.String() {
+			continue
+		}
+		packet, err := wire.ParsePacketMode(buf[:n], wire.ParseStrict)
+		if err != nil {
+			return nil, fmt.Errorf("malformed packet from the server: %s", err)
+		}
+		return packet, nil
+	}
+}
+
+// expectData waits for DATA block, failing on anything else
+func (t *transfer) expectData(block uint16, wait time.Duration) (*wire.PacketData, error) {
+	packet, err := t.receive(wait)
+	if err == errTimeout {
+		return nil, fmt.Errorf("no DATA %d within %s", block, wait)
+	} else if err != nil {
+		return nil, err
+	}
+	data, ok := packet.(*wire.PacketData)
+	if !ok || data.BlockNum != block {
+		return nil, fmt.Errorf("expected DATA %d; got %s", block, describe(packet))
+	}
+	return data, nil
+}
+
+// expectAck waits for ACK block, failing on anything else
+func (t *transfer) expectAck(block uint16, wait time.Duration) error {
+	packet, err := t.receive(wait)
+	if err == errTimeout {
+		return fmt.Errorf("no ACK %d within %s", block, wait)
+	} else if err != nil {
+		return err
+	}
+	if ack, ok := packet.(*wire.PacketAck); !ok || ack.BlockNum != block {
+		return fmt.Errorf("expected ACK %d; got %s", block, describe(packet))
+	}
+	return nil
+}
+
+// expectSilence fails if the server sends anything within wait
+func (t *transfer) expectSilence(wait time.Duration, why string) error {
+	packet, err := t.receive(wait)
+	if err == errTimeout {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return fmt.Errorf("%s; got %s", why, describe(packet))
+}
+
+// describe names a packet for a failure message
+func describe(packet wire.Packet) string {
+	switch p := packet.(type) {
+	case *wire.PacketRequest:
+		return "a request"
+	case *wire.PacketData:
+		return fmt.Sprintf("DATA %d", p.BlockNum)
+	case *wire.PacketAck:
+		return fmt.Sprintf("ACK %d", p.BlockNum)
+	case *wire.PacketError:
+		return fmt.Sprintf("ERROR %d %q", p.Code, p.Msg)
+	case *wire.PacketOAck:
+		return fmt.Sprintf("OACK %v", p.Options)
+	}
+	return "an unknown packet"
+}
+
+// download reads name from the server the way a well behaved client would,
+// retransmitting on timeouts.  It returns the file, the number of DATA
+// packets it came in, and the options of the OACK if there was one.
+func (s *suite) download(name string, options map[string]string) ([]byte, int, map[string]string, error) {
+	t, err := s.dial()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer t.close()
+
+	var last wire.Packet = &wire.PacketRequest{Op: wire.OpRRQ, Filename: name, Mode: "octet", Options: options}
+	t.send(last)
+	var contents []byte
+	var oack map[string]string
+	blocks := 0
+	expected := uint16(1)
+	for retries := 0; ; {
+		packet, err := t.receive(s.Timeout)
+		if err == errTimeout {
+			if retries++; retries > s.Retries {
+				return nil, 0, nil, fmt.Errorf("gave up waiting for DATA %d", expected)
+			}
+			t.send(last)
+			continue
+		} else if err != nil {
+			return nil, 0, nil, err
+		}
+		switch p := packet.(type) {
+		case *wire.PacketOAck:
+			if blocks > 0 {
+				continue // a retransmit
+			}
+			oack = p.Options
+			last = &wire.PacketAck{BlockNum: 0}
+			t.send(last)
+		case *wire.PacketData:
+			if p.BlockNum != expected {
+				continue // a retransmit, our ACK is on its way
+			}
+			contents = append(contents, p.Data...)
+			blocks++
+			retries = 0
+			last = &wire.PacketAck{BlockNum: p.BlockNum}
+			t.send(last)
+			if len(p.Data) < 512 {
+				return contents, blocks, oack, nil
+			}
+			expected++
+		case *wire.PacketError:
+			return nil, 0, nil, &errorReply{p.Code, p.Msg}
+		default:
+			return nil, 0, nil, fmt.Errorf("expected DATA %d; got %s", expected, describe(packet))
+		}
+	}
+}
+
+// upload writes contents to the server as name the way a well behaved client
+// would.  It returns the options of the OACK if there was one.
+func (s *suite) upload(name string, contents []byte, options map[string]string) (map[string]string, error) {
+	t, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer t.close()
+
+	var last wire.Packet = &wire.PacketRequest{Op: wire.OpWRQ, Filename: name, Mode: "octet", Options: options}
+	t.send(last)
+	var oack map[string]string
+	block := uint16(0) // the last block sent, which the next ACK should be for
+	offset := 0
+	final := false
+	for retries := 0; ; {
+		packet, err := t.receive(s.Timeout)
+		if err == errTimeout {
+			if retries++; retries > s.Retries {
+				return nil, fmt.Errorf("gave up waiting for ACK %d", block)
+			}
+			t.send(last)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		switch p := packet.(type) {
+		case *wire.PacketOAck:
+			if block != 0 {
+				continue // a retransmit
+			}
+			oack = p.Options
+		case *wire.PacketAck:
+			if p.BlockNum != block {
+				continue // a duplicate
+			}
+		case *wire.PacketError:
+			return nil, &errorReply{p.Code, p.Msg}
+		default:
+			return nil, fmt.Errorf("expected ACK %d; got %s", block, describe(packet))
+		}
+		if final {
+			return oack, nil
+		}
+		chunk := contents[offset:]
+		if len(chunk) > 512 {
+			chunk = chunk[:512]
+		}
+		offset += len(chunk)
+		final = len(chunk) < 512
+		block++
+		retries = 0
+		last = &wire.PacketData{BlockNum: block, Data: chunk}
+		t.send(last)
+	}
+}
+
+// verify downloads name and checks it holds contents
+func (s *suite) verify(name string, contents []byte) error {
+	stored, _, _, err := s.download(name, nil)
+	if err != nil {
+		return fmt.Errorf("reading the file back: %s", err)
+	}
+	if !bytes.Equal(stored, contents) {
+		return fmt.Errorf("read back %d bytes that differ from the %d written", len(stored), len(contents))
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Package conformance drives a TFTP server through scripted exchanges and
+// reports, clause by clause, where it departs from RFC1350 and the option
+// extensions.  It only needs the server's address, so it can be pointed at
+// any implementation.
+package conformance
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"time"
+)
+
+// Config says where the server under test is and how patient to be with it
+type Config struct {
+	Server         string         // host:port the server listens on
+	Prefix         string         // prepended to the name of every file uploaded for the tests
+	Timeout        time.Duration  // longest to wait for a reply that should come straight away
+	RetransmitWait time.Duration  // longest to wait for the server to retransmit after a loss
+	Quiet          time.Duration  // how long to watch for packets that shouldn't come
+	Retries        int            // times a packet is resent before a transfer is given up
+	Rollover       bool           // run the block number rollover scenario, which moves 32MB each way
+	Run            *regexp.Regexp // only run scenarios whose names match.  nil runs them all
+}
+
+// DefaultConfig suits a server with the usual retransmission timeouts of a
+// few seconds up to 20, such as this one
+func DefaultConfig(server string) Config {
+	return Config{
+		Server:         server,
+		Prefix:         "conformance-",
+		Timeout:        5 * time.Second,
+		RetransmitWait: 30 * time.Second,
+		Quiet:          time.Second,
+		Retries:        5,
+		Rollover:       true,
+	}
+}
+
+// Status is the outcome of a scenario
+type Status string
+
+const (
+	Pass Status = "PASS"
+	Fail Status = "FAIL"
+	Skip Status = "SKIP" // the scenario couldn't be run, e.g. the server refused to store a file it needed
+)
+
+// Result is the outcome of one scenario
+type Result struct {
+	Scenario string
+	Clause   string // the part of the RFCs the scenario checks
+	Status   Status
+	Detail   string // why it failed or was skipped
+	Elapsed  time.Duration
+}
+
+// Scenario is one scripted exchange with the server
+type Scenario struct {
+	Name     string
+	Clause   string
+	run      func(s *suite) error
+	Rollover bool // moves enough blocks to roll over, so only run when Config.Rollover is set
+}
+
+// skipped is returned by a scenario that couldn't be run
+type skipped struct {
+	reason string
+}
+
+func (e *skipped) Error() string {
+	return e.reason
+}
+
+func skip(format string, args ...interface{}) error {
+	return &skipped{fmt.Sprintf(format, args...)}
+}
+
+// suite is the state shared by the scenarios of one run
+type suite struct {
+	Config
+	server   *net.UDPAddr
+	uploaded map[string]error // test files already put on the server, and how that went
+}
+
+// Run runs the scenarios against the server in order.  An error is only
+// returned if the server's address is unusable.
+func Run(cfg Config) ([]Result, error) {
+	server, err := net.ResolveUDPAddr("udp", cfg.Server)
+	if err != nil {
+		return nil, err
+	}
+	if server.Port == 0 {
+		return nil, errors.New("the server's port is needed")
+	}
+	s := &suite{Config: cfg, server: server, uploaded: make(map[string]error)}
+
+	var results []Result
+	for _, scenario := range Scenarios {
+		if cfg.Run != nil && !cfg.Run.MatchString(scenario.Name) {
+			continue
+		}
+		if scenario.Rollover && !cfg.Rollover {
+			continue
+		}
+		start := time.Now()
+		err := scenario.run(s)
+		result := Result{Scenario: scenario.Name, Clause: scenario.Clause, Status: Pass, Elapsed: time.Since(start)}
+		var skipErr *skipped
+		if errors.As(err, &skipErr) {
+			result.Status, result.Detail = Skip, skipErr.reason
+		} else if err != nil {
+			result.Status, result.Detail = Fail, err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Report writes one line per result followed by a summary, returning the
+// number of scenarios that failed
+func Report(w io.Writer, results []Result) int {
+	counts := make(map[Status]int)
+	for _, r := range results {
+		counts[r.Status]++
+		fmt.Fprintf(w, "%s  %-30s %-24s %6.1fs", r.Status, r.Clause, r.Scenario, r.Elapsed.Seconds())
+		if r.Detail != "" {
+			fmt.Fprintf(w, "  %s", r.Detail)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%d passed, %d failed, %d skipped\n", counts[Pass], counts[Fail], counts[Skip])
+	return counts[Fail]
+}
+
+// prepare makes sure the server has contents stored as name, for scenarios
+// that read it back
+func (s *suite) prepare(name string, contents []byte) error {
+	err, done := s.uploaded[name]
+	if !done {
+		_, err = s.upload(name, contents, nil)
+		s.uploaded[name] = err
+	}
+	if err != nil {
+		return skip("unable to store %s on the server: %s", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package conformance
+
+import (
+	"bytes"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunAgainstSilentServer(t *testing.T) {
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	cfg := DefaultConfig(silent.LocalAddr().String())
+	cfg.Timeout, cfg.RetransmitWait, cfg.Quiet, cfg.Retries = 20*time.Millisecond, 20*time.Millisecond, 20*time.Millisecond, 1
+	cfg.Run = regexp.MustCompile("^(missing file|lost ACK|lost DATA)$")
+	results, err := Run(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		scenario string
+		status   Status
+	}{
+		{"missing file", Fail},
+		{"lost ACK", Skip}, // its file couldn't be stored
+		{"lost DATA", Skip},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results; got %#v", len(expected), results)
+	}
+	for i, e := range expected {
+		if results[i].Scenario != e.scenario || results[i].Status != e.status || results[i].Detail == "" {
+			t.Errorf("Expected %s to %s with a reason; got %#v", e.scenario, e.status, results[i])
+		}
+	}
+
+	var report bytes.Buffer
+	if failed := Report(&report, results); failed != 1 {
+		t.Errorf("Expected 1 failure to be counted; got %d", failed)
+	}
+	if !strings.HasSuffix(report.String(), "0 passed, 1 failed, 2 skipped\n") || !strings.HasPrefix(report.String(), "FAIL  RFC1350 5") {
+		t.Errorf("Unexpected report\n%s", report.String())
+	}
+}
+
+func TestRunNeedsPort(t *testing.T) {
+	if _, err := Run(DefaultConfig("127.0.0.1")); err == nil {
+		t.Errorf("Expected an address without a port to be refused")
+	}
+}
@@ -0,0 +1,326 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"strconv"
+)
+
+// Scenarios are run in this order.  Those that read files store them first,
+// so a server that won't accept uploads has them skipped.
+var Scenarios = []Scenario{
+	{"missing file", "RFC1350 5 (error codes)", missingFile, false},
+	{"zero-length file", "RFC1350 6 (termination)", zeroLength, false},
+	{"exact multiple of 512", "RFC1350 6 (termination)", multipleOf512, false},
+	{"lost ACK", "RFC1350 2 (retransmission)", lostAck, false},
+	{"lost DATA", "RFC1350 2 (retransmission)", lostData, false},
+	{"duplicate ACK", "RFC1123 4.2.3.1 (apprentice)", duplicateAck, false},
+	{"duplicate DATA", "RFC1350 2 (retransmission)", duplicateData, false},
+	{"wrong TID", "RFC1350 4 (transfer IDs)", wrongTID, false},
+	{"tsize on read", "RFC2349 (transfer size)", tsizeRead, false},
+	{"tsize on write", "RFC2349 (transfer size)", tsizeWrite, false},
+	{"unknown option", "RFC2347 (option negotiation)", unknownOption, false},
+	{"block number rollover", "RFC1350 5 (16-bit blocks)", rollover, true},
+}
+
+// pattern makes size bytes of contents that show up misplaced blocks
+func pattern(size int) []byte {
+	contents := make([]byte, size)
+	for i := range contents {
+		contents[i] = byte(i/512 + i)
+	}
+	return contents
+}
+
+// twoBlocks is stored for scenarios that need a short transfer to upset
+func (s *suite) twoBlocks() (string, error) {
+	name := s.Prefix + "two-blocks"
+	return name, s.prepare(name, pattern(700))
+}
+
+func missingFile(s *suite) error {
+	_, _, _, err := s.download(s.Prefix+"does-not-exist", nil)
+	var reply *errorReply
+	if !errors.As(err, &reply) {
+		return fmt.Errorf("expected ERROR 1; got %v", err)
+	}
+	if reply.code != 1 {
+		return fmt.Errorf("expected ERROR 1 (file not found); got ERROR %d %q", reply.code, reply.msg)
+	}
+	return nil
+}
+
+func zeroLength(s *suite) error {
+	name := s.Prefix + "empty"
+	if err := s.prepare(name, nil); err != nil {
+		return err
+	}
+	contents, blocks, _, err := s.download(name, nil)
+	if err != nil {
+		return err
+	}
+	if len(contents) != 0 || blocks != 1 {
+		return fmt.Errorf("expected one empty DATA packet; got %d bytes in %d", len(contents), blocks)
+	}
+	return nil
+}
+
+func multipleOf512(s *suite) error {
+	name := s.Prefix + "1024-bytes"
+	contents := pattern(1024)
+	if err := s.prepare(name, contents); err != nil {
+		return err
+	}
+	stored, blocks, _, err := s.download(name, nil)
+	if err != nil {
+		return err
+	}
+	if blocks != 3 {
+		return fmt.Errorf("expected two full blocks and an empty one; got %d DATA packets", blocks)
+	}
+	if !bytes.Equal(stored, contents) {
+		return errors.New("contents differ from what was written")
+	}
+	return nil
+}
+
+// lostAck withholds the ACK of the first block of a read, as if it had been
+// lost, and waits for the server to send the block again
+func lostAck(s *suite) error {
+	name, err := s.twoBlocks()
+	if err != nil {
+		return err
+	}
+	t, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	t.send(&wire.PacketRequest{Op: wire.OpRRQ, Filename: name, Mode: "octet"})
+	if _, err := t.expectData(1, s.Timeout); err != nil {
+		return err
+	}
+	if _, err := t.expectData(1, s.RetransmitWait); err != nil {
+		return fmt.Errorf("DATA 1 not retransmitted: %s", err)
+	}
+	t.send(&wire.PacketAck{BlockNum: 1})
+	if _, err := t.expectData(2, s.Timeout); err != nil {
+		return fmt.Errorf("after retransmission: %s", err)
+	}
+	t.send(&wire.PacketAck{BlockNum: 2})
+	return nil
+}
+
+// lostData withholds the second block of a write, as if it had been lost,
+// and waits for the server to send its ACK of the first block again
+func lostData(s *suite) error {
+	t, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	contents := pattern(700)
+	t.send(&wire.PacketRequest{Op: wire.OpWRQ, Filename: s.Prefix + "lost-data", Mode: "octet"})
+	if err := t.expectAck(0, s.Timeout); err != nil {
+		return skip("write refused: %s", err)
+	}
+	t.send(&wire.PacketData{BlockNum: 1, Data: contents[:512]})
+	if err := t.expectAck(1, s.Timeout); err != nil {
+		return err
+	}
+	if err := t.expectAck(1, s.RetransmitWait); err != nil {
+		return fmt.Errorf("ACK 1 not retransmitted: %s", err)
+	}
+	t.send(&wire.PacketData{BlockNum: 2, Data: contents[512:]})
+	if err := t.expectAck(2, s.Timeout); err != nil {
+		return fmt.Errorf("after retransmission: %s", err)
+	}
+	return s.verify(s.Prefix+"lost-data", contents)
+}
+
+// duplicateAck sends the ACK of the first block of a read twice.  The server
+// must only send the second block once, or every packet after would be
+// doubled: the Sorcerer's Apprentice syndrome.
+func duplicateAck(s *suite) error {
+	name, err := s.twoBlocks()
+	if err != nil {
+		return err
+	}
+	t, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	t.send(&wire.PacketRequest{Op: wire.OpRRQ, Filename: name, Mode: "octet"})
+	if _, err := t.expectData(1, s.Timeout); err != nil {
+		return err
+	}
+	t.send(&wire.PacketAck{BlockNum: 1})
+	t.send(&wire.PacketAck{BlockNum: 1})
+	if _, err := t.expectData(2, s.Timeout); err != nil {
+		return err
+	}
+	if err := t.expectSilence(s.Quiet, "DATA 2 sent again in answer to the duplicate ACK"); err != nil {
+		return err
+	}
+	t.send(&wire.PacketAck{BlockNum: 2})
+	return nil
+}
+
+// duplicateData sends the first block of a write twice, as a client does when
+// its ACK is lost.  The server must ACK it again and store it once.
+func duplicateData(s *suite) error {
+	t, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	contents := pattern(700)
+	name := s.Prefix + "duplicate-data"
+	t.send(&wire.PacketRequest{Op: wire.OpWRQ, Filename: name, Mode: "octet"})
+	if err := t.expectAck(0, s.Timeout); err != nil {
+		return skip("write refused: %s", err)
+	}
+	t.send(&wire.PacketData{BlockNum: 1, Data: contents[:512]})
+	if err := t.expectAck(1, s.Timeout); err != nil {
+		return err
+	}
+	t.send(&wire.PacketData{BlockNum: 1, Data: contents[:512]})
+	if err := t.expectAck(1, s.Timeout); err != nil {
+		return fmt.Errorf("duplicate DATA 1 not acknowledged: %s", err)
+	}
+	t.send(&wire.PacketData{BlockNum: 2, Data: contents[512:]})
+	if err := t.expectAck(2, s.Timeout); err != nil {
+		return err
+	}
+	return s.verify(name, contents)
+}
+
+// wrongTID sends an ACK into a read from a port the server hasn't seen.  The
+// server should answer that port with ERROR 5 and carry on with the transfer.
+func wrongTID(s *suite) error {
+	name, err := s.twoBlocks()
+	if err != nil {
+		return err
+	}
+	t, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer t.close()
+	stranger, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer stranger.close()
+
+	t.send(&wire.PacketRequest{Op: wire.OpRRQ, Filename: name, Mode: "octet"})
+	if _, err := t.expectData(1, s.Timeout); err != nil {
+		return err
+	}
+	stranger.tid = t.tid
+	stranger.send(&wire.PacketAck{BlockNum: 1})
+	packet, err := stranger.receive(s.Timeout)
+	if err == errTimeout {
+		return errors.New("no ERROR sent to the unknown TID")
+	} else if err != nil {
+		return err
+	}
+	if errPack, ok := packet.(*wire.PacketError); !ok || errPack.Code != 5 {
+		return fmt.Errorf("expected ERROR 5 (unknown transfer ID) at the unknown TID; got %s", describe(packet))
+	}
+
+	t.send(&wire.PacketAck{BlockNum: 1})
+	if _, err := t.expectData(2, s.Timeout); err != nil {
+		return fmt.Errorf("transfer disturbed: %s", err)
+	}
+	t.send(&wire.PacketAck{BlockNum: 2})
+	return nil
+}
+
+func tsizeRead(s *suite) error {
+	name, err := s.twoBlocks()
+	if err != nil {
+		return err
+	}
+	t, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	t.send(&wire.PacketRequest{Op: wire.OpRRQ, Filename: name, Mode: "octet", Options: map[string]string{"tsize": "0"}})
+	packet, err := t.receive(s.Timeout)
+	if err != nil {
+		return err
+	}
+	if _, ok := packet.(*wire.PacketData); ok {
+		return skip("the server doesn't support tsize")
+	}
+	oack, ok := packet.(*wire.PacketOAck)
+	if !ok {
+		return fmt.Errorf("expected OACK; got %s", describe(packet))
+	}
+	if oack.Options["tsize"] != "700" {
+		return fmt.Errorf("expected tsize 700 in the OACK; got %v", oack.Options)
+	}
+	t.send(&wire.PacketAck{BlockNum: 0})
+	if _, err := t.expectData(1, s.Timeout); err != nil {
+		return fmt.Errorf("after acknowledging the OACK: %s", err)
+	}
+	t.send(&wire.PacketError{Code: 0, Msg: "conformance test done"})
+	return nil
+}
+
+func tsizeWrite(s *suite) error {
+	contents := pattern(700)
+	name := s.Prefix + "tsize-write"
+	oack, err := s.upload(name, contents, map[string]string{"tsize": strconv.Itoa(len(contents))})
+	if err != nil {
+		return err
+	}
+	if oack == nil {
+		return skip("the server doesn't support tsize")
+	}
+	if oack["tsize"] != "700" {
+		return fmt.Errorf("expected tsize 700 echoed in the OACK; got %v", oack)
+	}
+	return s.verify(name, contents)
+}
+
+// unknownOption asks for an option no server knows alongside one it may.  The
+// OACK must leave the unknown one out.
+func unknownOption(s *suite) error {
+	name, err := s.twoBlocks()
+	if err != nil {
+		return err
+	}
+	contents, _, oack, err := s.download(name, map[string]string{"tsize": "0", "x-conformance-test": "1"})
+	if err != nil {
+		return err
+	}
+	if _, ok := oack["x-conformance-test"]; ok {
+		return fmt.Errorf("OACK acknowledged an unknown option: %v", oack)
+	}
+	if len(contents) != 700 {
+		return fmt.Errorf("expected 700 bytes; got %d", len(contents))
+	}
+	return nil
+}
+
+// rollover moves a file of more than 65535 blocks each way.  RFC1350 leaves
+// what follows block 65535 open; this expects the common choice of 0.
+func rollover(s *suite) error {
+	contents := pattern(65536*512 + 100)
+	name := s.Prefix + "rollover"
+	if _, err := s.upload(name, contents, nil); err != nil {
+		return fmt.Errorf("writing: %s", err)
+	}
+	return s.verify(name, contents)
+}
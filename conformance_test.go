@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"github.com/coffeepac/tftp/conformance"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConformance(t *testing.T) {
+	oldTimeout := timeoutSeconds
+	defer func() { timeoutSeconds = oldTimeout }()
+	timeoutSeconds = 1
+
+	files = newCASStore()
+	listeners, err := openListeners([]listenSpec{{network: "udp4", address: "127.0.0.1:0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	forgetRequests(t)
+	wg.Add(1)
+	txID := int64(0)
+	txns := make(chan string, 100)
+	go serve(listeners[0], wire.ParseStrict, &txID, txns, &wg)
+	defer func() {
+		listeners[0].Close()
+		wg.Wait()
+	}()
+	go func() {
+		for range txns {
+		}
+	}()
+
+	cfg := conformance.DefaultConfig(listeners[0].LocalAddr().String())
+	cfg.Timeout, cfg.RetransmitWait, cfg.Quiet = time.Second, 3*time.Second, 300*time.Millisecond
+	cfg.Rollover = !testing.Short()
+	results, err := conformance.Run(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report bytes.Buffer
+	if conformance.Report(&report, results) > 0 || len(results) < 11 {
+		t.Errorf("Expected every scenario to pass; got\n%s", report.String())
+	}
+	for _, r := range results {
+		if r.Status != conformance.Pass {
+			t.Errorf("%s: %s %s", r.Scenario, r.Status, r.Detail)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var activeRequests = newRequestTracker()
+
+// requestKey identifies a request well enough to spot it being retransmitted
+type requestKey struct {
+	peer     string
+	op       uint16
+	filename string
+}
+
+// requestTracker remembers the requests whose transfers are running, and for
+// a retransmit timeout those that just finished, so that a client
+// retransmitting its request before the first reply arrives doesn't start a
+// second transfer on another port.
+type requestTracker struct {
+	sync.Mutex
+	active    map[requestKey]trackedRequest
+	lastSweep time.Time // when finished requests were last cleared out
+	metrics   requestMetrics
+}
+
+// trackedRequest is the transaction for a request, and when it stops being
+// remembered once finished
+type trackedRequest struct {
+	txID    int64
+	expires time.Time // zero while the transfer is running
+}
+
+func (t trackedRequest) expired(now time.Time) bool {
+	return !t.expires.IsZero() && !now.Before(t.expires)
+}
+
+// requestMetrics counts requests the listeners have seen, for the admin interface
+type requestMetrics struct {
+	Duplicates uint64 `json:"duplicates_dropped"`
+}
+
+func newRequestTracker() *requestTracker {
+	return &requestTracker{active: make(map[requestKey]trackedRequest)}
+}
+
+// start records a request from peer as running under txID.  It returns false,
+// and the request should be dropped, if the same request is already running or
+// has only just finished.
+func (r *requestTracker) start(peer net.Addr, op uint16, filename string, txID int64) bool {
+	key := requestKey{peer: peer.String(), op: op, filename: filename}
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+	r.sweep(now)
+	if tracked, ok := r.active[key]; ok && !tracked.expired(now) {
+		r.metrics.Duplicates++
+		log.Printf("Dropped retransmitted request for %q from %s, already seen as transaction #%d", filename, peer, tracked.txID)
+		return false
+	}
+	r.active[key] = trackedRequest{txID: txID}
+	return true
+}
+
+// finish marks a request's transfer as over.  It is forgotten a retransmit
+// timeout later, as the client may have sent the request again before the
+// first reply reached it.
+func (r *requestTracker) finish(peer net.Addr, op uint16, filename string) {
+	key := requestKey{peer: peer.String(), op: op, filename: filename}
+	r.Lock()
+	defer r.Unlock()
+	if tracked, ok := r.active[key]; ok {
+		tracked.expires = time.Now().Add(time.Duration(timeoutSeconds) * time.Second)
+		r.active[key] = tracked
+	}
+}
+
+// sweep forgets the finished requests that have expired, at most once a
+// retransmit timeout.  The caller must hold the lock.
+func (r *requestTracker) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < time.Duration(timeoutSeconds)*time.Second {
+		return
+	}
+	r.lastSweep = now
+	for key, tracked := range r.active {
+		if tracked.expired(now) {
+			delete(r.active, key)
+		}
+	}
+}
+
+func (r *requestTracker) snapshot() requestMetrics {
+	r.Lock()
+	defer r.Unlock()
+	return r.metrics
+}
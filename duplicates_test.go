@@ -0,0 +1,113 @@
+package main
+
+import (
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// forgetRequests gives a test a tracker of its own, as the kernel may hand a
+// new client socket the port of one whose request for the same file has just
+// finished, and that would be taken for a retransmit
+func forgetRequests(t *testing.T) {
+	old := activeRequests
+	activeRequests = newRequestTracker()
+	t.Cleanup(func() { activeRequests = old })
+}
+
+func TestRequestTracker(t *testing.T) {
+	tracker := newRequestTracker()
+	peer := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2000}
+	otherPort := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2001}
+
+	tests := []struct {
+		peer     net.Addr
+		op       uint16
+		filename string
+		started  bool
+	}{
+		{peer, wire.OpRRQ, "pxelinux.0", true},
+		{peer, wire.OpRRQ, "pxelinux.0", false},
+		{peer, wire.OpRRQ, "ldlinux.c32", true},
+		{peer, wire.OpWRQ, "pxelinux.0", true},
+		{otherPort, wire.OpRRQ, "pxelinux.0", true},
+	}
+	for i, test := range tests {
+		if started := tracker.start(test.peer, test.op, test.filename, int64(i)); started != test.started {
+			t.Errorf("Request %d: expected started %v; got %v", i+1, test.started, started)
+		}
+	}
+
+	// a retransmit arriving just after the transfer finished is still dropped
+	tracker.finish(peer, wire.OpRRQ, "pxelinux.0")
+	if tracker.start(peer, wire.OpRRQ, "pxelinux.0", 10) {
+		t.Errorf("Expected a request to be dropped just after its transfer is over")
+	}
+
+	// but once the retransmit timeout has passed it starts again
+	oldTimeout := timeoutSeconds
+	timeoutSeconds = 0
+	defer func() { timeoutSeconds = oldTimeout }()
+	tracker.finish(peer, wire.OpRRQ, "ldlinux.c32")
+	if !tracker.start(peer, wire.OpRRQ, "ldlinux.c32", 11) {
+		t.Errorf("Expected a request to start again once it has been forgotten")
+	}
+	tracker.finish(otherPort, wire.OpRRQ, "pxelinux.0")
+	tracker.start(otherPort, wire.OpWRQ, "log", 12)
+	if len(tracker.active) != 4 {
+		t.Errorf("Expected finished requests to be swept; %d left", len(tracker.active))
+	}
+	if metrics := tracker.snapshot(); metrics.Duplicates != 2 {
+		t.Errorf("Expected two duplicates to be counted; got %d", metrics.Duplicates)
+	}
+}
+
+func TestServeDropsRetransmittedRequest(t *testing.T) {
+	files = newCASStore()
+	files.Write("pxelinux.0", "boot loader", "")
+	listeners, err := openListeners([]listenSpec{{network: "udp4", address: "127.0.0.1:0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	forgetRequests(t)
+	wg.Add(1)
+	txID := int64(0)
+	txns := make(chan string, 10)
+	go serve(listeners[0], wire.ParseDefault, &txID, txns, &wg)
+	defer func() {
+		listeners[0].Close()
+		wg.Wait()
+	}()
+
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// an eager boot ROM sends its RRQ twice before the first DATA arrives
+	rrq := wire.PacketRequest{Op: wire.OpRRQ, Filename: "pxelinux.0", Mode: "octet"}
+	client.WriteTo(rrq.Serialize(), listeners[0].LocalAddr())
+	client.WriteTo(rrq.Serialize(), listeners[0].LocalAddr())
+
+	buf := make([]byte, wire.MaxPacketSize)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, tid, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, addr, err := client.ReadFrom(buf); err == nil {
+		t.Errorf("Expected only one transfer; got a second packet from %s", addr)
+	}
+
+	ack := wire.PacketAck{BlockNum: 1}
+	client.WriteTo(ack.Serialize(), tid)
+	<-txns
+	if len(txns) != 0 {
+		t.Errorf("Expected one transaction to be logged; got %d more", len(txns))
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var expiryRules []*expiryRule           // checked in order, first rule matching the filename sets its TTL
+var reapInterval = time.Minute          // how often the reaper looks for expired files
+var maxTTLOption = 365 * 24 * time.Hour // longest TTL a client may ask for with the ttl option
+
+// expiryRuleConfig gives files written under names matching Match a time to
+// live, such as "24h".  Once it passes the file and all its versions are
+// removed.
+type expiryRuleConfig struct {
+	Match string `json:"match"`
+	TTL   string `json:"ttl"`
+}
+
+type expiryRule struct {
+	re  *regexp.Regexp
+	ttl time.Duration
+}
+
+func compileExpiryRules(configs []expiryRuleConfig) ([]*expiryRule, error) {
+	rules := make([]*expiryRule, 0, len(configs))
+	for i, c := range configs {
+		re, err := regexp.Compile(c.Match)
+		if err != nil {
+			return nil, fmt.Errorf("expiry rule %d: %s", i+1, err)
+		}
+		ttl, err := time.ParseDuration(c.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("expiry rule %d: %s", i+1, err)
+		}
+		if ttl <= 0 {
+			return nil, fmt.Errorf("expiry rule %d: ttl must be positive", i+1)
+		}
+		rules = append(rules, &expiryRule{re: re, ttl: ttl})
+	}
+	return rules, nil
+}
+
+// parseTTLOption reads the ttl request option, a whole number of seconds
+func parseTTLOption(value string) (time.Duration, bool) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds <= 0 || seconds > int64(maxTTLOption/time.Second) {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// fileTTL works out how long a file written as filename should live, or 0 if
+// it should be kept until overwritten.  A client's ttl option sets the TTL of
+// files no rule covers, but can only shorten the TTL a rule gives.
+func fileTTL(filename string, options map[string]string) time.Duration {
+	ttl := time.Duration(0)
+	for _, rule := range expiryRules {
+		if rule.re.MatchString(filename) {
+			ttl = rule.ttl
+			break
+		}
+	}
+	if value, ok := options["ttl"]; ok {
+		if requested, ok := parseTTLOption(value); ok && (ttl == 0 || requested < ttl) {
+			ttl = requested
+		}
+	}
+	return ttl
+}
+
+// reapExpiredFiles removes expired files from every store each reapInterval,
+// logging each removal as a transaction numbered from the servers' txID.
+func reapExpiredFiles(txID *int64, txns chan string) {
+	for range time.Tick(reapInterval) {
+		reapExpired(time.Now(), txID, txns)
+	}
+}
+
+func reapExpired(now time.Time, txID *int64, txns chan string) {
+	for root, store := range rootStores() {
+		for _, name := range store.Expire(now) {
+			if root != "" {
+				name = root + ":" + name
+			}
+			txns <- fmt.Sprintf(txnTemplate, atomic.AddInt64(txID, 1)-1, "EXPIRE", "success", "Removed expired file "+name)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileTTL(t *testing.T) {
+	rules, err := compileExpiryRules([]expiryRuleConfig{
+		{Match: `^dumps/`, TTL: "24h"},
+		{Match: `\.tmp$`, TTL: "10m"},
+	})
+	if err != nil {
+		t.Fatalf("unable to compile rules: %s", err)
+	}
+	oldRules := expiryRules
+	expiryRules = rules
+	defer func() { expiryRules = oldRules }()
+
+	tests := []struct {
+		filename string
+		options  map[string]string
+		expected time.Duration
+	}{
+		{"boot.cfg", nil, 0},
+		{"dumps/sw1.core", nil, 24 * time.Hour},
+		{"scratch.tmp", nil, 10 * time.Minute},
+		{"boot.cfg", map[string]string{"ttl": "60"}, time.Minute},
+		{"dumps/sw1.core", map[string]string{"ttl": "60"}, time.Minute},
+		{"dumps/sw1.core", map[string]string{"ttl": "172800"}, 24 * time.Hour},
+		{"boot.cfg", map[string]string{"ttl": "soon"}, 0},
+		{"boot.cfg", map[string]string{"ttl": "-60"}, 0},
+	}
+
+	for _, test := range tests {
+		if actual := fileTTL(test.filename, test.options); actual != test.expected {
+			t.Errorf("TTL of %q with %v: expected %s; got %s", test.filename, test.options, test.expected, actual)
+		}
+	}
+}
+
+func TestCompileExpiryRulesInvalid(t *testing.T) {
+	tests := []expiryRuleConfig{
+		{Match: "(unclosed", TTL: "1h"},
+		{Match: "ok", TTL: "a while"},
+		{Match: "ok", TTL: "0s"},
+		{Match: "ok"},
+	}
+
+	for _, test := range tests {
+		if _, err := compileExpiryRules([]expiryRuleConfig{test}); err == nil {
+			t.Errorf("Compiling %#v: expected error", test)
+		}
+	}
+}
+
+func TestCASStoreExpire(t *testing.T) {
+	pool := newBlobStore()
+	store := &casStore{blobs: pool, names: make(map[string]*fileHistory)}
+	now := time.Now()
+	store.WriteExpiring("dump1", "old dump", "", now.Add(-time.Minute))
+	store.WriteExpiring("dump2", "new dump", "", now.Add(time.Hour))
+	store.Write("boot.cfg", "permanent", "")
+
+	if _, ok := store.Read("dump1"); ok {
+		t.Errorf("Expected expired file to be unreadable before it is reaped")
+	}
+	if info, ok := store.Stat("dump2"); !ok || info.Expires == nil || !info.Expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected dump2 to report its expiry; got %+v", info)
+	}
+
+	expired := store.Expire(now)
+	if len(expired) != 1 || expired[0] != "dump1" {
+		t.Errorf("Expected only dump1 to expire; got %v", expired)
+	}
+	if names := store.Names(); len(names) != 2 {
+		t.Errorf("Expected two files left; got %v", names)
+	}
+	if count, _ := pool.stats(); count != 2 {
+		t.Errorf("Expected the expired file's blob to be freed; %d blobs left", count)
+	}
+
+	// overwriting without a TTL makes the file permanent again
+	store.Write("dump2", "kept dump", "")
+	if expired := store.Expire(now.Add(2 * time.Hour)); len(expired) != 0 {
+		t.Errorf("Expected nothing to expire; got %v", expired)
+	}
+}
+
+func TestReapExpired(t *testing.T) {
+	files = newCASStore()
+	files.WriteExpiring("dumps/sw1.core", "core", "", time.Now().Add(-time.Second))
+
+	txns := make(chan string, 10)
+	txID := int64(5)
+	reapExpired(time.Now(), &txID, txns)
+	if len(txns) != 1 {
+		t.Fatalf("Expected one removal to be logged; got %d", len(txns))
+	}
+	if txn := <-txns; !strings.HasPrefix(txn, "Transaction #5 ") || !strings.Contains(txn, "EXPIRE") || !strings.Contains(txn, "dumps/sw1.core") {
+		t.Errorf("Unexpected txn log line %q", txn)
+	}
+}
+
+func TestOpWriteTTLOption(t *testing.T) {
+	files = newCASStore()
+	request := &wire.PacketRequest{Op: wire.OpWRQ, Filename: "diag.txt", Mode: "octet", Options: map[string]string{"ttl": "3600"}}
+	if err := writeOverUDP(t, request, []byte("diagnostics")); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	info, ok := files.Stat("diag.txt")
+	if !ok || info.Expires == nil {
+		t.Fatalf("Expected uploaded file to expire; got %+v", info)
+	}
+	if remaining := time.Until(*info.Expires); remaining < 59*time.Minute || remaining > time.Hour {
+		t.Errorf("Expected file to expire in an hour; expires in %s", remaining)
+	}
+}
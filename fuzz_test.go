@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/coffeepac/tftp/memnet"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// FuzzServe sends the server an arbitrary first packet and, if it starts a
+// transfer, an arbitrary second one to the transfer's port, or in single port
+// mode to the listener.  Requests are parsed in any of the modes.  The server
+// must answer or drop anything without panicking.  It runs over a simulated
+// network, so transfers left waiting time out straight away, and anything
+// still waiting after that is ended by closing the server.
+func FuzzServe(f *testing.F) {
+	rrq := &wire.PacketRequest{Op: wire.OpRRQ, Filename: "pxelinux.0", Mode: "octet"}
+	wrq := &wire.PacketRequest{Op: wire.OpWRQ, Filename: "upload.bin", Mode: "octet", Options: map[string]string{"tsize": "10"}}
+	tsize := &wire.PacketRequest{Op: wire.OpRRQ, Filename: "pxelinux.0", Mode: "octet", Options: map[string]string{"tsize": "0"}}
+	seeds := []struct{ request, reply []byte }{
+		{rrq.Serialize(), (&wire.PacketAck{BlockNum: 1}).Serialize()},
+		{rrq.Serialize(), (&wire.PacketAck{BlockNum: 9}).Serialize()},
+		{rrq.Serialize(), (&wire.PacketData{BlockNum: 1, Data: []byte("x")}).Serialize()},
+		{rrq.Serialize(), []byte("\x00\x04\x00")},
+		{tsize.Serialize(), (&wire.PacketAck{BlockNum: 0}).Serialize()},
+		{wrq.Serialize(), (&wire.PacketData{BlockNum: 1, Data: []byte("0123456789")}).Serialize()},
+		{wrq.Serialize(), (&wire.PacketData{BlockNum: 2, Data: nil}).Serialize()},
+		{wrq.Serialize(), (&wire.PacketError{Code: 0, Msg: "bye"}).Serialize()},
+		{wrq.Serialize(), []byte("\x00\x03")},
+		{[]byte("\x00\x01pxelinux.0\x00netascii\x00"), []byte{}},
+		{[]byte("\x00\x01\x00\x00"), []byte{}},
+		{(&wire.PacketAck{BlockNum: 1}).Serialize(), []byte{}},
+		{[]byte{}, []byte{}},
+	}
+	for i, seed := range seeds {
+		f.Add(seed.request, seed.reply, i%2 == 0, uint8(i%3))
+	}
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	oldListen, oldSinglePort, oldRequests, oldSpawn := tidPorts.listen, singlePort, activeRequests, spawn
+	defer func() { tidPorts.listen, singlePort, activeRequests, spawn = oldListen, oldSinglePort, oldRequests, oldSpawn }()
+
+	f.Fuzz(func(t *testing.T, request, reply []byte, single bool, parsing uint8) {
+		singlePort = single
+		// every input comes from the same client address, so the last one's
+		// request mustn't look like a retransmit
+		activeRequests = newRequestTracker()
+		files = newCASStore()
+		files.Write("pxelinux.0", "boot loader", "")
+		network := memnet.New(1, true)
+		defer network.Close()
+		spawn = network.Go
+		tidPorts.listen = func(_ string, addr *net.UDPAddr) (net.PacketConn, error) {
+			return network.Listen(addr.String())
+		}
+		server, err := network.Listen("10.0.0.1:69")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := network.Listen("10.0.0.2:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		wg.Add(1)
+		txID := int64(0)
+		txns := make(chan string, 10)
+		network.Go(func() { serve(server, wire.ParseMode(parsing%3), &txID, txns, &wg) })
+		defer func() {
+			server.Close()
+			wg.Wait()
+		}()
+
+		network.Enter()
+		client.WriteTo(request, server.LocalAddr())
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, wire.MaxPacketSize)
+		if _, tid, err := client.ReadFrom(buf); err == nil && (single || tid.String() != server.LocalAddr().String()) {
+			client.WriteTo(reply, tid)
+			// then give up, so a transfer still waiting ends now rather than on
+			// a real timeout in single port mode
+			client.WriteTo((&wire.PacketError{Code: 0, Msg: "fuzzing"}).Serialize(), tid)
+		}
+		network.Leave()
+		// let the server get as far as it can with the input, then close it,
+		// which ends anything left running
+		network.Settle()
+	})
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var commandHooks []*commandHook // checked in order, first hook matching the filename runs
+var hookStderrLimit = 4096      // bytes of a hook's stderr kept for logging and error messages
+
+// hookConfig is a command hook as it appears in the config file.  Command is
+// the argv to run, where $1 or ${name} expand to submatches of Match and $$ is
+// a literal $ (so a shell's "$VAR" must be written "$$VAR").  Only is
+// "read" or "write" to restrict the hook to RRQs or WRQs, empty for both.
+//
+// For a RRQ the command's stdout is sent to the client; for a WRQ the upload
+// is piped to its stdin.  The command sees the client in TFTP_* environment
+// variables.  Exiting with 1 through 8 sends the TFTP error with that code,
+// using the first line of stderr as the message if there is one; any other
+// non-zero exit sends error 0.
+type hookConfig struct {
+	Match   string   `json:"match"`
+	Command []string `json:"command"`
+	Only    string   `json:"only"`
+}
+
+type commandHook struct {
+	re      *regexp.Regexp
+	command []string
+	onlyOp  uint16 // 0 for any request, otherwise wire.OpRRQ or wire.OpWRQ
+}
+
+// default messages for the error codes of RFC1350 and RFC2347
+var tftpErrorMessages = map[uint16]string{
+	0: "Not defined",
+	1: "File not found",
+	2: "Access violation",
+	3: "Disk full or allocation exceeded",
+	4: "Illegal TFTP operation",
+	5: "Unknown transfer ID",
+	6: "File already exists",
+	7: "No such user",
+	8: "Option negotiation failed",
+}
+
+func compileHooks(configs []hookConfig) ([]*commandHook, error) {
+	hooks := make([]*commandHook, 0, len(configs))
+	for i, c := range configs {
+		re, err := regexp.Compile(c.Match)
+		if err != nil {
+			return nil, fmt.Errorf("hook %d: %s", i+1, err)
+		}
+		if len(c.Command) == 0 {
+			return nil, fmt.Errorf("hook %d: missing command", i+1)
+		}
+		hook := &commandHook{re: re, command: c.Command}
+		switch c.Only {
+		case "":
+		case "read":
+			hook.onlyOp = wire.OpRRQ
+		case "write":
+			hook.onlyOp = wire.OpWRQ
+		default:
+			return nil, fmt.Errorf("hook %d: only must be \"read\" or \"write\", not %q", i+1, c.Only)
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// findHook returns the first hook for op that matches filename, or nil
+func findHook(filename string, op uint16) *commandHook {
+	for _, hook := range commandHooks {
+		if (hook.onlyOp == 0 || hook.onlyOp == op) && hook.re.MatchString(filename) {
+			return hook
+		}
+	}
+	return nil
+}
+
+// cmd builds the command for a request, expanding submatches into its
+// arguments and describing the client in its environment.
+func (h *commandHook) cmd(filename, rootName string, request *wire.PacketRequest, addr net.Addr) *exec.Cmd {
+	match := h.re.FindStringSubmatchIndex(filename)
+	args := make([]string, len(h.command))
+	for i, arg := range h.command {
+		args[i] = string(h.re.ExpandString(nil, arg, filename, match))
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	ip, port := clientIPPort(addr)
+	operation := "read"
+	if request.Op == wire.OpWRQ {
+		operation = "write"
+	}
+	cmd.Env = append(os.Environ(),
+		"TFTP_OPERATION="+operation,
+		"TFTP_FILENAME="+filename,
+		"TFTP_REQUESTED_FILENAME="+request.Filename,
+		"TFTP_ROOT="+rootName,
+		"TFTP_CLIENT_PORT="+strconv.Itoa(port),
+	)
+	if ip != nil {
+		cmd.Env = append(cmd.Env, "TFTP_CLIENT_IP="+ip.String(), "TFTP_CLIENT_MAC="+lookupMAC(ip))
+	}
+	for name, value := range request.Options {
+		cmd.Env = append(cmd.Env, "TFTP_OPTION_"+strings.ToUpper(name)+"="+value)
+	}
+	cmd.Stderr = &limitedBuffer{limit: hookStderrLimit}
+	return cmd
+}
+
+func (h *commandHook) startRead(filename, rootName string, request *wire.PacketRequest, addr net.Addr) (io.ReadCloser, error) {
+	cmd := h.cmd(filename, rootName, request, addr)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("Unable to start hook %q.  error: %s", cmd.Path, err)
+		return nil, &tftpError{Code: 0, Msg: "Unable to run command"}
+	}
+	return &hookReader{cmd: cmd, stdout: stdout, timeout: time.Duration(timeoutSeconds) * time.Second}, nil
+}
+
+func (h *commandHook) startWrite(filename, rootName string, request *wire.PacketRequest, addr net.Addr) (writeSink, error) {
+	cmd := h.cmd(filename, rootName, request, addr)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("Unable to start hook %q.  error: %s", cmd.Path, err)
+		return nil, &tftpError{Code: 0, Msg: "Unable to run command"}
+	}
+	return &hookSink{cmd: cmd, stdin: stdin, timeout: time.Duration(timeoutSeconds) * time.Second}, nil
+}
+
+// hookReader streams a command's stdout.  Closing it before the end of stdout
+// kills the command; closing it at the end reports how the command exited.  A
+// command that goes longer than the transfer timeout without sending more, or
+// without exiting once it has sent everything, is killed.
+type hookReader struct {
+	cmd     *exec.Cmd
+	stdout  io.Reader
+	timeout time.Duration
+	eof     bool
+	closed  bool
+	err     error
+}
+
+var errHookSilent = &tftpError{Code: 0, Msg: "Command stopped sending the file"}
+
+func (h *hookReader) Read(p []byte) (int, error) {
+	var n int
+	stalled, err := withinTimeout(h.cmd, h.timeout, func() (err error) {
+		n, err = h.stdout.Read(p)
+		return err
+	})
+	if stalled {
+		log.Printf("Hook %q stopped sending its file.  Killed it", h.cmd.Path)
+		return n, errHookSilent
+	}
+	if err == io.EOF {
+		h.eof = true
+	}
+	return n, err
+}
+
+func (h *hookReader) Close() error {
+	if !h.closed {
+		h.closed = true
+		if !h.eof {
+			h.cmd.Process.Kill()
+		}
+		stalled, _ := withinTimeout(h.cmd, h.timeout, func() error {
+			h.err = hookExitError(h.cmd, h.cmd.Wait())
+			return nil
+		})
+		if stalled {
+			log.Printf("Hook %q did not exit after sending its file.  Killed it", h.cmd.Path)
+			h.err = errHookSilent
+		}
+	}
+	return h.err
+}
+
+// hookSink pipes an upload into a command's stdin.  A command that stops
+// reading without exiting would hold up the transfer for good, so one that
+// takes longer than the transfer timeout over a block, or over exiting once
+// the upload is done, is killed.
+type hookSink struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	timeout time.Duration
+}
+
+var errHookStalled = &tftpError{Code: 0, Msg: "Command stopped reading the file"}
+
+func (h *hookSink) Write(p []byte) (int, error) {
+	var n int
+	stalled, err := withinTimeout(h.cmd, h.timeout, func() (err error) {
+		n, err = h.stdin.Write(p)
+		return err
+	})
+	if stalled {
+		log.Printf("Hook %q stopped reading its upload.  Killed it", h.cmd.Path)
+		return n, errHookStalled
+	}
+	if err != nil {
+		// the command has stopped reading, its exit status says why
+		if exitErr := h.Commit(); exitErr != nil {
+			return n, exitErr
+		}
+		return n, &tftpError{Code: 0, Msg: "Command did not read the whole file"}
+	}
+	return n, nil
+}
+
+func (h *hookSink) Commit() error {
+	h.stdin.Close()
+	var err error
+	stalled, _ := withinTimeout(h.cmd, h.timeout, func() error {
+		err = hookExitError(h.cmd, h.cmd.Wait())
+		return nil
+	})
+	if stalled {
+		log.Printf("Hook %q did not exit after its upload.  Killed it", h.cmd.Path)
+		return errHookStalled
+	}
+	return err
+}
+
+// withinTimeout runs f, killing cmd if f hasn't returned within timeout, and
+// reports whether it had to
+func withinTimeout(cmd *exec.Cmd, timeout time.Duration, f func() error) (bool, error) {
+	var stalled atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		stalled.Store(true)
+		cmd.Process.Kill()
+	})
+	err := f()
+	timer.Stop()
+	return stalled.Load(), err
+}
+
+func (h *hookSink) Abort() {
+	h.stdin.Close()
+	h.cmd.Process.Kill()
+	h.cmd.Wait()
+}
+
+// hookExitError maps the result of waiting for a hook onto the TFTP error the
+// client should see, nil if the command succeeded.
+func hookExitError(cmd *exec.Cmd, err error) error {
+	if err == nil {
+		return nil
+	}
+	stderr := strings.TrimSpace(cmd.Stderr.(*limitedBuffer).String())
+	log.Printf("Hook %q failed: %s.  stderr: %s", cmd.Path, err, stderr)
+
+	code := uint16(0)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() >= 1 && exitErr.ExitCode() <= 8 {
+		code = uint16(exitErr.ExitCode())
+	}
+	msg := tftpErrorMessages[code]
+	if stderr != "" {
+		msg = strings.SplitN(stderr, "\n", 2)[0]
+	}
+	return &tftpError{Code: code, Msg: msg}
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the rest
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommandHooks(t *testing.T) {
+	dir := t.TempDir()
+	oldHooks := commandHooks
+	defer func() { commandHooks = oldHooks }()
+
+	var err error
+	commandHooks, err = compileHooks([]hookConfig{
+		{Match: `^echo/(.*)$`, Command: []string{"/bin/sh", "-c", `printf '%s %s %s' "$$TFTP_OPERATION" "$$TFTP_CLIENT_IP" "$$0"`, "$1"}, Only: "read"},
+		{Match: `^big$`, Command: []string{"/bin/sh", "-c", "head -c 1300 /dev/zero"}},
+		{Match: `^missing$`, Command: []string{"/bin/sh", "-c", "echo no such config >&2; exit 1"}},
+		{Match: `^archive/(.*)$`, Command: []string{"/bin/sh", "-c", `cat > "$$0/$$1.$$TFTP_OPERATION"`, dir, "$1"}, Only: "write"},
+		{Match: `^full/`, Command: []string{"/bin/sh", "-c", "exit 3"}, Only: "write"},
+		{Match: `^crash$`, Command: []string{"/bin/sh", "-c", "exit 42"}},
+		{Match: `^unstartable$`, Command: []string{filepath.Join(dir, "no-such-command")}, Only: "write"},
+		{Match: `^stuck$`, Command: []string{"/bin/sh", "-c", "exec sleep 60"}},
+	})
+	if err != nil {
+		t.Fatalf("unable to compile hooks: %s", err)
+	}
+	files = newCASStore()
+
+	contents, _, err := readOverUDP(t, &wire.PacketRequest{Op: wire.OpRRQ, Filename: "echo/switch1", Mode: "octet"})
+	if err != nil || string(contents) != "read 127.0.0.1 switch1" {
+		t.Errorf("Reading echo hook: expected %q; got %q, %v", "read 127.0.0.1 switch1", contents, err)
+	}
+
+	contents, options, err := readOverUDP(t, &wire.PacketRequest{Op: wire.OpRRQ, Filename: "big", Mode: "octet", Options: map[string]string{"tsize": "0"}})
+	if err != nil || len(contents) != 1300 {
+		t.Errorf("Reading big hook: expected 1300 bytes; got %d, %v", len(contents), err)
+	} else if options != nil {
+		t.Errorf("Reading big hook: expected tsize to be declined for a stream; got %#v", options)
+	}
+
+	_, _, err = readOverUDP(t, &wire.PacketRequest{Op: wire.OpRRQ, Filename: "missing", Mode: "octet"})
+	if err == nil || err.Error() != "no such config" {
+		t.Errorf("Reading missing hook: expected error %q; got %v", "no such config", err)
+	}
+
+	_, _, err = readOverUDP(t, &wire.PacketRequest{Op: wire.OpRRQ, Filename: "crash", Mode: "octet"})
+	if err == nil || err.Error() != "Not defined" {
+		t.Errorf("Reading crash hook: expected error %q; got %v", "Not defined", err)
+	}
+
+	upload := bytes.Repeat([]byte("interface eth0\n"), 100)
+	if err := writeOverUDP(t, &wire.PacketRequest{Op: wire.OpWRQ, Filename: "archive/sw1.cfg", Mode: "octet"}, upload); err != nil {
+		t.Errorf("Writing archive hook: unexpected error %s", err)
+	}
+	archived, err := os.ReadFile(filepath.Join(dir, "sw1.cfg.write"))
+	if !bytes.Equal(archived, upload) {
+		t.Errorf("Writing archive hook: command received %d bytes, expected %d. %v", len(archived), len(upload), err)
+	}
+	if _, ok := files.Read("archive/sw1.cfg"); ok {
+		t.Errorf("Writing archive hook: upload should not also be stored")
+	}
+
+	// an upload declared too big is turned away before the hook is started,
+	// so this one can't fail to start
+	oldMax := maxFileSize
+	maxFileSize = 1000
+	err = writeOverUDP(t, &wire.PacketRequest{Op: wire.OpWRQ, Filename: "unstartable", Mode: "octet", Options: map[string]string{"tsize": "1500"}}, upload)
+	maxFileSize = oldMax
+	if tErr, ok := err.(*tftpError); !ok || tErr.Code != 3 {
+		t.Errorf("Writing oversized upload to a hook: expected error code 3; got %v", err)
+	}
+
+	err = writeOverUDP(t, &wire.PacketRequest{Op: wire.OpWRQ, Filename: "full/x", Mode: "octet"}, []byte(strings.Repeat("x", 2000)))
+	if tErr, ok := err.(*tftpError); !ok || tErr.Code != 3 {
+		t.Errorf("Writing full hook: expected error code 3; got %v", err)
+	}
+
+	// a hook that neither reads nor exits is killed once the pipe fills
+	oldTimeout := timeoutSeconds
+	timeoutSeconds = 1
+	defer func() { timeoutSeconds = oldTimeout }()
+	err = writeOverUDP(t, &wire.PacketRequest{Op: wire.OpWRQ, Filename: "stuck", Mode: "octet"}, bytes.Repeat([]byte("x"), 1<<17))
+	if err == nil || err.Error() != errHookStalled.Msg {
+		t.Errorf("Writing stuck hook: expected error %q; got %v", errHookStalled.Msg, err)
+	}
+	_, _, err = readOverUDP(t, &wire.PacketRequest{Op: wire.OpRRQ, Filename: "stuck", Mode: "octet"})
+	if err == nil || err.Error() != errHookSilent.Msg {
+		t.Errorf("Reading stuck hook: expected error %q; got %v", errHookSilent.Msg, err)
+	}
+}
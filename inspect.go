@@ -0,0 +1,392 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/coffeepac/tftp/capture"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// collapseRun is the fewest in-order DATA and ACKs a timeline sums up in one
+// line rather than listing
+const collapseRun = 6
+
+// inspection is what has been learnt of the transfers in a capture
+type inspection struct {
+	port      uint16 // where requests are sent, 0 for any port
+	transfers []*inspectedTransfer
+	byClient  map[netip.AddrPort]*inspectedTransfer // the latest transfer of each client port
+	stray     int                                   // UDP packets that belonged to no transfer
+}
+
+// inspectedTransfer is one transfer pieced together from a capture
+type inspectedTransfer struct {
+	id      int
+	request *wire.PacketRequest
+	client  netip.AddrPort
+	server  netip.AddrPort // where the request went
+	tid     netip.AddrPort // where the server answered from, once it has
+	start   time.Time
+	end     time.Time // when the last packet of the transfer was seen
+	events  []inspectEvent
+
+	contents        []byte
+	blockSize       int
+	blocks          int    // DATA blocks seen in order
+	expected        uint16 // block number of the next DATA wanted
+	ackedThrough    int    // blocks acknowledged in order, or -1 before any ACK
+	finalBlock      bool   // the short DATA that ends the file has been seen
+	retransmissions int
+	status          string // "" while the transfer seems to be running
+}
+
+// inspectEvent is a packet on a transfer's timeline
+type inspectEvent struct {
+	at         time.Time
+	fromClient bool
+	desc       string
+	note       string // anything unusual about the packet
+	block      int    // the block number of an in-order DATA or ACK, or -1
+}
+
+func newInspection(port uint16) *inspection {
+	return &inspection{port: port, byClient: make(map[netip.AddrPort]*inspectedTransfer)}
+}
+
+// inspectCapture pieces together the transfers of the capture in r whose
+// requests were sent to port, or to any port if it is 0
+func inspectCapture(r *capture.Reader, port uint16) (*inspection, error) {
+	in := newInspection(port)
+	for {
+		packet, err := r.Next()
+		if err == io.EOF {
+			return in, nil
+		} else if err != nil {
+			return in, err
+		}
+		if d, ok := capture.DecodeUDP(packet.LinkType, packet.Data); ok {
+			in.add(packet.Time, d)
+		}
+	}
+}
+
+// add puts the datagram d, seen at at, on the timeline of its transfer.  A
+// request to the TFTP port starts a new transfer unless it repeats one whose
+// reply hasn't come.  Anything else between a client and a port of another
+// host, such as its DNS lookups, is stray.
+func (in *inspection) add(at time.Time, d capture.Datagram) {
+	// lenient parsing, to see what a quirky client sent
+	packet, err := wire.ParsePacketMode(d.Payload, wire.ParseLenient)
+	request, ok := packet.(*wire.PacketRequest)
+	if ok && err == nil && (in.port == 0 || d.Dst.Port() == in.port) {
+		t := in.byClient[d.Src]
+		if t != nil && t.server == d.Dst && t.tid == (netip.AddrPort{}) && t.request.Op == request.Op && t.request.Filename == request.Filename {
+			t.retransmissions++
+			t.events = append(t.events, inspectEvent{at: at, fromClient: true, desc: describeInspected(request), note: "retransmission", block: -1})
+			t.end = at
+			return
+		}
+		t = &inspectedTransfer{
+			id:           len(in.transfers) + 1,
+			request:      request,
+			client:       d.Src,
+			server:       d.Dst,
+			start:        at,
+			end:          at,
+			blockSize:    512,
+			expected:     1,
+			ackedThrough: -1,
+		}
+		t.events = append(t.events, inspectEvent{at: at, fromClient: true, desc: describeInspected(request), block: -1})
+		in.transfers = append(in.transfers, t)
+		in.byClient[d.Src] = t
+		return
+	}
+
+	// the first reply is matched on the client alone, as a server with
+	// several addresses may answer from one the request wasn't sent to
+	if t := in.byClient[d.Src]; t != nil && t.follows(d.Dst, true) {
+		t.record(at, true, d.Dst, d.Payload, packet, err)
+	} else if t := in.byClient[d.Dst]; t != nil && t.follows(d.Src, false) {
+		t.record(at, false, d.Src, d.Payload, packet, err)
+	} else {
+		in.stray++
+	}
+}
+
+// follows reports whether a packet between the client and serverPort belongs
+// to the transfer.  Until the server has answered that's any packet from the
+// server and ones to where the request went; after, any to or from the
+// addresses of the request and the answer, so that packets to the wrong port
+// can be noted.
+func (t *inspectedTransfer) follows(serverPort netip.AddrPort, fromClient bool) bool {
+	if t.tid == (netip.AddrPort{}) {
+		return !fromClient || serverPort == t.server
+	}
+	return serverPort.Addr() == t.tid.Addr() || serverPort.Addr() == t.server.Addr()
+}
+
+// record adds a packet between the client and serverPort, the server's end,
+// to the timeline
+func (t *inspectedTransfer) record(at time.Time, fromClient bool, serverPort netip.AddrPort, payload []byte, packet wire.Packet, err error) {
+	event := inspectEvent{at: at, fromClient: fromClient, block: -1}
+	defer func() {
+		t.events = append(t.events, event)
+		t.end = at
+	}()
+	if t.tid == (netip.AddrPort{}) && !fromClient {
+		t.tid = serverPort
+		if serverPort.Addr() != t.server.Addr() {
+			event.note = fmt.Sprintf("from %s, not the address the request went to", serverPort.Addr())
+		}
+	}
+	if serverPort != t.tid {
+		event.desc = fmt.Sprintf("%d bytes", len(payload))
+		if err == nil {
+			event.desc = describeInspected(packet)
+		}
+		other := fmt.Sprintf("port %d", serverPort.Port())
+		if t.tid != (netip.AddrPort{}) && serverPort.Addr() != t.tid.Addr() {
+			other = serverPort.String()
+		}
+		if fromClient {
+			event.note = fmt.Sprintf("to %s, not the transfer's", other)
+		} else {
+			event.note = fmt.Sprintf("from %s, not the transfer's", other)
+		}
+		return
+	}
+	if err != nil {
+		event.desc = fmt.Sprintf("%d bytes", len(payload))
+		event.note = "malformed: " + err.Error()
+		return
+	}
+	event.desc = describeInspected(packet)
+	if t.status != "" {
+		event.note = "after the transfer ended"
+	}
+
+	dataFromClient := t.request.Op == wire.OpWRQ
+	switch p := packet.(type) {
+	case *wire.PacketOAck:
+		if fromClient {
+			event.note = "OACK from the client"
+		} else if size, err := strconv.Atoi(p.Options["blksize"]); err == nil && size > 0 {
+			t.blockSize = size
+		}
+	case *wire.PacketData:
+		switch {
+		case fromClient != dataFromClient:
+			event.note = "DATA from the wrong side"
+		case p.BlockNum == t.expected && !t.finalBlock:
+			t.contents = append(t.contents, p.Data...)
+			t.blocks++
+			t.expected++
+			t.finalBlock = len(p.Data) < t.blockSize
+			event.block = int(p.BlockNum)
+		case p.BlockNum == t.expected-1 && t.blocks > 0:
+			event.note = "retransmission"
+			t.retransmissions++
+		default:
+			event.note = fmt.Sprintf("out of order, block %d was next", t.expected)
+		}
+	case *wire.PacketAck:
+		switch {
+		case fromClient == dataFromClient:
+			event.note = "ACK from the wrong side"
+		case p.BlockNum == uint16(t.blocks) && t.ackedThrough < t.blocks:
+			t.ackedThrough = t.blocks
+			event.block = int(p.BlockNum)
+			if t.finalBlock {
+				t.status = "completed"
+			}
+		case t.ackedThrough >= 0 && p.BlockNum == uint16(t.ackedThrough):
+			event.note = "duplicate"
+			t.retransmissions++
+		default:
+			event.note = "acknowledges a block that wasn't sent"
+		}
+	case *wire.PacketError:
+		side := "server"
+		if fromClient {
+			side = "client"
+		}
+		t.status = fmt.Sprintf("failed: ERROR %d %q from the %s", p.Code, p.Msg, side)
+	default:
+		event.note = "unexpected during a transfer"
+	}
+}
+
+// describeInspected names a packet on a timeline
+func describeInspected(packet wire.Packet) string {
+	switch p := packet.(type) {
+	case *wire.PacketRequest:
+		desc := fmt.Sprintf("%s %s %s", opAbbrev(p.Op), p.Filename, p.Mode)
+		if len(p.Options) > 0 {
+			desc += " " + formatOptions(p.Options)
+		}
+		return desc
+	case *wire.PacketData:
+		return fmt.Sprintf("DATA %d, %d bytes", p.BlockNum, len(p.Data))
+	case *wire.PacketAck:
+		return fmt.Sprintf("ACK %d", p.BlockNum)
+	case *wire.PacketError:
+		return fmt.Sprintf("ERROR %d %q", p.Code, p.Msg)
+	case *wire.PacketOAck:
+		return "OACK " + formatOptions(p.Options)
+	}
+	return "unknown packet"
+}
+
+func opAbbrev(op uint16) string {
+	if op == wire.OpRRQ {
+		return "RRQ"
+	}
+	return "WRQ"
+}
+
+// formatOptions lists options as name=value, sorted by name
+func formatOptions(options map[string]string) string {
+	pairs := make([]string, 0, len(options))
+	for name, value := range options {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// outcome sums up how the transfer went
+func (t *inspectedTransfer) outcome() string {
+	switch {
+	case t.status != "":
+		return t.status
+	case t.tid == (netip.AddrPort{}):
+		return "no reply from the server"
+	case t.finalBlock:
+		return "last block's ACK not captured"
+	}
+	return "incomplete, the capture ends mid-transfer"
+}
+
+// report writes the transfer's timeline to w.  Runs of in-order DATA and ACKs
+// are summed up unless verbose.
+func (t *inspectedTransfer) report(w io.Writer, verbose bool) {
+	fmt.Fprintf(w, "Transfer %d: %s %s from %s to %s at %s\n", t.id, opAbbrev(t.request.Op), t.request.Filename, t.client, t.server, t.start.Format("2006-01-02 15:04:05.000000"))
+	if t.tid != (netip.AddrPort{}) && t.tid.Addr() != t.server.Addr() {
+		fmt.Fprintf(w, "  server transfer ID %s\n", t.tid)
+	} else if t.tid != (netip.AddrPort{}) && t.tid != t.server {
+		fmt.Fprintf(w, "  server transfer port %d\n", t.tid.Port())
+	}
+	for i := 0; i < len(t.events); {
+		run := i
+		for run < len(t.events) && t.events[run].block >= 0 && t.events[run].note == "" {
+			run++
+		}
+		if !verbose && run-i >= collapseRun {
+			first, last := t.events[i], t.events[run-1]
+			fmt.Fprintf(w, "  %+11.6f          blocks %d to %d in order, %d packets over %.6fs\n", first.at.Sub(t.start).Seconds(), first.block, last.block, run-i, last.at.Sub(first.at).Seconds())
+			i = run
+			continue
+		}
+		if run == i {
+			run++
+		}
+		for ; i < run; i++ {
+			e := t.events[i]
+			sender := "server"
+			if e.fromClient {
+				sender = "client"
+			}
+			fmt.Fprintf(w, "  %+11.6f  %s  %s", e.at.Sub(t.start).Seconds(), sender, e.desc)
+			if e.note != "" {
+				fmt.Fprintf(w, "  (%s)", e.note)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	fmt.Fprintf(w, "  %s: %d bytes in %d blocks over %.6fs, %d retransmissions\n", t.outcome(), len(t.contents), t.blocks, t.end.Sub(t.start).Seconds(), t.retransmissions)
+}
+
+// extract writes what the transfer moved into dir, named after the transfer
+// and the file.  Files not wholly transferred are marked partial.
+func (t *inspectedTransfer) extract(dir string) (string, error) {
+	path := filepath.Join(dir, fmt.Sprintf("%d-%s", t.id, safeFilename(t.request.Filename)))
+	if !t.finalBlock {
+		path += ".partial"
+	}
+	return path, os.WriteFile(path, t.contents, 0644)
+}
+
+// safeFilename makes a requested filename fit to name a local file, replacing
+// separators and anything unusual with underscores
+func safeFilename(filename string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, filename)
+}
+
+// runInspect is the inspect subcommand: it reads a packet capture and prints
+// the timeline of every TFTP transfer in it, optionally extracting the files
+// they moved.
+func runInspect(args []string) int {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	extract := flags.String("extract", "", "directory to write the files transferred to")
+	verbose := flags.Bool("v", false, "list every packet, rather than summing up runs of in-order blocks")
+	port := flags.Uint("port", 69, "UDP port the server takes requests on, 0 for any")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: tftp inspect [-extract dir] [-port n] [-v] capture.pcap")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || *port > 65535 {
+		flags.Usage()
+		return 2
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "inspect:", err)
+		return 1
+	}
+	defer f.Close()
+	reader, err := capture.NewReader(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "inspect: %s: %s\n", flags.Arg(0), err)
+		return 1
+	}
+	in, err := inspectCapture(reader, uint16(*port))
+	status := 0
+	if err != nil {
+		// report what was read before the damage
+		fmt.Fprintf(os.Stderr, "inspect: %s: %s\n", flags.Arg(0), err)
+		status = 1
+	}
+	for _, t := range in.transfers {
+		t.report(os.Stdout, *verbose)
+		if *extract != "" && (t.blocks > 0 || t.finalBlock) {
+			path, err := t.extract(*extract)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "inspect:", err)
+				status = 1
+			} else {
+				fmt.Printf("  extracted to %s\n", path)
+			}
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%d transfers, %d other UDP packets\n", len(in.transfers), in.stray)
+	return status
+}
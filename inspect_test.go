@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"github.com/coffeepac/tftp/capture"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capturedPacket is a datagram to put in a test capture
+type capturedPacket struct {
+	src, dst string
+	packet   wire.Packet
+}
+
+// buildCapture writes packets to a pcap capture, a millisecond apart
+func buildCapture(t *testing.T, packets []capturedPacket) []byte {
+	var buf bytes.Buffer
+	w, err := capture.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, p := range packets {
+		payload := []byte("not tftp")
+		if p.packet != nil {
+			payload = p.packet.Serialize()
+		}
+		if err := w.WriteUDP(at, netip.MustParseAddrPort(p.src), netip.MustParseAddrPort(p.dst), payload); err != nil {
+			t.Fatal(err)
+		}
+		at = at.Add(time.Millisecond)
+	}
+	return buf.Bytes()
+}
+
+func TestInspect(t *testing.T) {
+	const (
+		server    = "10.0.0.1:69"
+		tid       = "10.0.0.1:40001"
+		other     = "10.0.0.1:40002"
+		client    = "10.0.0.2:2000"
+		uploads   = "10.0.0.3:3000"
+		missing   = "10.0.0.4:4000"
+		big       = "10.0.0.5:5000"
+		homed     = "10.0.0.6:6000"
+		elsewhere = "10.0.0.9:40003"
+		dns       = "10.0.0.53:53"
+	)
+	block := bytes.Repeat([]byte("x"), 512)
+	packets := []capturedPacket{
+		// a read with an option, a lost ACK and a stranger
+		{client, server, &wire.PacketRequest{Op: wire.OpRRQ, Filename: "boot/pxelinux.0", Mode: "octet", Options: map[string]string{"tsize": "0"}}},
+		{client, server, &wire.PacketRequest{Op: wire.OpRRQ, Filename: "boot/pxelinux.0", Mode: "octet", Options: map[string]string{"tsize": "0"}}},
+		{tid, client, &wire.PacketOAck{Options: map[string]string{"tsize": "1124"}}},
+		{client, tid, &wire.PacketAck{BlockNum: 0}},
+		{tid, client, &wire.PacketData{BlockNum: 1, Data: block}},
+		{client, tid, &wire.PacketAck{BlockNum: 1}},
+		{tid, client, &wire.PacketData{BlockNum: 2, Data: block}},
+		{tid, client, &wire.PacketData{BlockNum: 2, Data: block}},
+		{other, client, &wire.PacketData{BlockNum: 3, Data: []byte("stranger")}},
+		{client, tid, &wire.PacketAck{BlockNum: 2}},
+		{tid, client, &wire.PacketData{BlockNum: 3, Data: []byte("end of file\n")}},
+		{client, tid, &wire.PacketAck{BlockNum: 3}},
+		{client, tid, &wire.PacketAck{BlockNum: 3}},
+		{"10.0.0.2:5353", "224.0.0.251:5353", nil},
+		// the same client port used for a lookup afterwards
+		{client, dns, nil},
+		{dns, client, nil},
+		// a lookup that happens to parse as a request
+		{"10.0.0.7:5300", dns, &wire.PacketRequest{Op: wire.OpRRQ, Filename: "example", Mode: "com"}},
+
+		// an upload
+		{uploads, server, &wire.PacketRequest{Op: wire.OpWRQ, Filename: "../logs/boot.log", Mode: "octet"}},
+		{tid, uploads, &wire.PacketAck{BlockNum: 0}},
+		{uploads, tid, &wire.PacketData{BlockNum: 1, Data: []byte("up")}},
+		{tid, uploads, &wire.PacketAck{BlockNum: 1}},
+
+		// a file that isn't there
+		{missing, server, &wire.PacketRequest{Op: wire.OpRRQ, Filename: "nothing", Mode: "octet"}},
+		{other, missing, &wire.PacketError{Code: 1, Msg: "File not found"}},
+	}
+	// a long read the capture stops in the middle of
+	packets = append(packets, capturedPacket{big, server, &wire.PacketRequest{Op: wire.OpRRQ, Filename: "big", Mode: "octet"}})
+	for i := uint16(1); i <= 10; i++ {
+		packets = append(packets,
+			capturedPacket{tid, big, &wire.PacketData{BlockNum: i, Data: block}},
+			capturedPacket{big, tid, &wire.PacketAck{BlockNum: i}})
+	}
+	// a read answered from another of the server's addresses
+	packets = append(packets,
+		capturedPacket{homed, server, &wire.PacketRequest{Op: wire.OpRRQ, Filename: "homed", Mode: "octet"}},
+		capturedPacket{elsewhere, homed, &wire.PacketData{BlockNum: 1, Data: []byte("multihomed")}},
+		capturedPacket{homed, elsewhere, &wire.PacketAck{BlockNum: 1}})
+
+	pcap := buildCapture(t, packets)
+	reader, err := capture.NewReader(bytes.NewReader(pcap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := inspectCapture(reader, 69)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(in.transfers) != 5 || in.stray != 4 {
+		t.Fatalf("Expected 5 transfers and 4 stray packets; got %d and %d", len(in.transfers), in.stray)
+	}
+	reader, _ = capture.NewReader(bytes.NewReader(pcap))
+	if anyPort, _ := inspectCapture(reader, 0); len(anyPort.transfers) != 6 {
+		t.Errorf("Expected requests to any port to start transfers; got %d transfers", len(anyPort.transfers))
+	}
+
+	expected := []struct {
+		outcome         string
+		bytes, blocks   int
+		retransmissions int
+		report          []string
+	}{
+		{"completed", 1036, 3, 3, []string{
+			"Transfer 1: RRQ boot/pxelinux.0 from 10.0.0.2:2000 to 10.0.0.1:69",
+			"server transfer port 40001",
+			"client  RRQ boot/pxelinux.0 octet tsize=0  (retransmission)",
+			"server  OACK tsize=1124\n",
+			"server  DATA 2, 512 bytes  (retransmission)",
+			"server  DATA 3, 8 bytes  (from port 40002, not the transfer's)",
+			"client  ACK 3  (duplicate)",
+			"completed: 1036 bytes in 3 blocks",
+		}},
+		{"completed", 2, 1, 0, []string{
+			"WRQ ../logs/boot.log",
+			"client  DATA 1, 2 bytes\n",
+		}},
+		{`failed: ERROR 1 "File not found" from the server`, 0, 0, 0, []string{
+			`server  ERROR 1 "File not found"`,
+		}},
+		{"incomplete, the capture ends mid-transfer", 5120, 10, 0, []string{
+			"blocks 1 to 10 in order, 20 packets",
+		}},
+		{"completed", 10, 1, 0, []string{
+			"server transfer ID 10.0.0.9:40003",
+			"server  DATA 1, 10 bytes  (from 10.0.0.9, not the address the request went to)",
+		}},
+	}
+	for i, transfer := range in.transfers {
+		e := expected[i]
+		if transfer.outcome() != e.outcome || len(transfer.contents) != e.bytes || transfer.blocks != e.blocks || transfer.retransmissions != e.retransmissions {
+			t.Errorf("Transfer %d: expected %s with %d bytes in %d blocks and %d retransmissions; got %s with %d bytes in %d blocks and %d retransmissions",
+				i+1, e.outcome, e.bytes, e.blocks, e.retransmissions, transfer.outcome(), len(transfer.contents), transfer.blocks, transfer.retransmissions)
+		}
+		var report strings.Builder
+		transfer.report(&report, false)
+		for _, line := range e.report {
+			if !strings.Contains(report.String(), line) {
+				t.Errorf("Transfer %d: expected the report to hold %q; got\n%s", i+1, line, report.String())
+			}
+		}
+	}
+
+	var verbose strings.Builder
+	in.transfers[3].report(&verbose, true)
+	if !strings.Contains(verbose.String(), "client  ACK 10\n") || strings.Contains(verbose.String(), "in order") {
+		t.Errorf("Expected every packet to be listed; got\n%s", verbose.String())
+	}
+
+	dir := t.TempDir()
+	for i, name := range []string{"1-boot_pxelinux.0", "2-.._logs_boot.log", "3-nothing.partial", "4-big.partial"} {
+		path, err := in.transfers[i].extract(dir)
+		if err != nil || path != filepath.Join(dir, name) {
+			t.Errorf("Transfer %d: expected to extract to %s; got %s, %v", i+1, name, path, err)
+			continue
+		}
+		contents, _ := os.ReadFile(path)
+		if !bytes.Equal(contents, in.transfers[i].contents) {
+			t.Errorf("Transfer %d: extracted %d bytes rather than %d", i+1, len(contents), len(in.transfers[i].contents))
+		}
+	}
+	if contents, _ := os.ReadFile(filepath.Join(dir, "1-boot_pxelinux.0")); !bytes.HasSuffix(contents, []byte("end of file\n")) {
+		t.Errorf("Expected the file read to end with its last block; got %q", contents[len(contents)-12:])
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+const isoSectorSize = 2048
+const isoSystemAreaSize = 16 * isoSectorSize // volume descriptors start after the system area
+const isoMaxDepth = 64                       // bound on directory nesting, in case of loops in a bad image
+const isoMaxDirSize = 64 << 20               // bound on the size of one directory, in case of a bad image
+
+// newISOArchive indexes an ISO9660 image.  Rock Ridge names are used if the
+// image has them, then Joliet names, and failing both the plain ISO9660 names
+// are lower cased and stripped of their ";1" version suffix.
+func newISOArchive(f *os.File) (archive, error) {
+	var primary, joliet []byte
+	for sector := int64(16); ; sector++ {
+		desc := make([]byte, isoSectorSize)
+		if _, err := f.ReadAt(desc, sector*isoSectorSize); err != nil {
+			return nil, err
+		}
+		if string(desc[1:6]) != "CD001" {
+			return nil, errors.New("bad ISO9660 volume descriptor")
+		}
+		switch desc[0] {
+		case 1:
+			primary = desc
+		case 2:
+			if escapes := desc[88:91]; bytes.Equal(escapes, []byte("%/@")) || bytes.Equal(escapes, []byte("%/C")) || bytes.Equal(escapes, []byte("%/E")) {
+				joliet = desc
+			}
+		}
+		if desc[0] == 255 {
+			break
+		}
+	}
+	if primary == nil {
+		return nil, errors.New("ISO9660 image has no primary volume descriptor")
+	}
+
+	walker := &isoWalker{f: f, members: make(map[string]*io.SectionReader), visited: make(map[int64]bool)}
+	if err := walker.walk(primary[156:190], "", 0); err != nil {
+		return nil, err
+	}
+	if !walker.rockRidge && joliet != nil {
+		walker = &isoWalker{f: f, members: make(map[string]*io.SectionReader), visited: make(map[int64]bool), joliet: true}
+		if err := walker.walk(joliet[156:190], "", 0); err != nil {
+			return nil, err
+		}
+	}
+	return &sectionArchive{f: f, members: walker.members}, nil
+}
+
+type isoWalker struct {
+	f         *os.File
+	joliet    bool
+	rockRidge bool // set once any Rock Ridge name has been seen
+	members   map[string]*io.SectionReader
+	visited   map[int64]bool // directory extents already walked, so a bad image can't loop or fan out
+}
+
+// walk indexes the directory described by the directory record dirRecord
+func (w *isoWalker) walk(dirRecord []byte, prefix string, depth int) error {
+	if depth > isoMaxDepth {
+		return errors.New("ISO9660 directories nested too deeply")
+	}
+	extent := int64(binary.LittleEndian.Uint32(dirRecord[2:])) * isoSectorSize
+	if w.visited[extent] {
+		return errors.New("ISO9660 directory appears more than once")
+	}
+	w.visited[extent] = true
+	size := int64(binary.LittleEndian.Uint32(dirRecord[10:]))
+	if size > isoMaxDirSize {
+		return errors.New("ISO9660 directory too large")
+	}
+	dir := make([]byte, size)
+	if _, err := w.f.ReadAt(dir, extent); err != nil {
+		return err
+	}
+
+	for pos := 0; pos < len(dir); {
+		length := int(dir[pos])
+		if length == 0 {
+			// records never straddle sectors, the rest of this one is padding
+			pos = (pos/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		if length < 34 || pos+length > len(dir) {
+			return errors.New("bad ISO9660 directory record")
+		}
+		record := dir[pos : pos+length]
+		pos += length
+
+		nameLen := int(record[32])
+		if 33+nameLen > len(record) {
+			return errors.New("bad ISO9660 directory record")
+		}
+		rawName := record[33 : 33+nameLen]
+		if nameLen == 1 && (rawName[0] == 0 || rawName[0] == 1) {
+			continue // the . and .. entries
+		}
+		systemUse := 33 + nameLen
+		if nameLen%2 == 0 {
+			systemUse++ // padding to keep the system use area aligned
+		}
+		if systemUse > len(record) {
+			systemUse = len(record)
+		}
+		name := w.name(rawName, record[systemUse:])
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			continue
+		}
+
+		if record[25]&2 != 0 {
+			if err := w.walk(record, prefix+name+"/", depth+1); err != nil {
+				return err
+			}
+		} else {
+			fileExtent := int64(binary.LittleEndian.Uint32(record[2:])) * isoSectorSize
+			fileSize := int64(binary.LittleEndian.Uint32(record[10:]))
+			w.members[prefix+name] = io.NewSectionReader(w.f, fileExtent, fileSize)
+		}
+	}
+	return nil
+}
+
+// name decodes the name of a directory record, preferring a Rock Ridge NM
+// entry in its system use area.
+func (w *isoWalker) name(rawName, systemUse []byte) string {
+	if w.joliet {
+		units := make([]uint16, len(rawName)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(rawName[2*i:])
+		}
+		return stripISOVersion(string(utf16.Decode(units)))
+	}
+	if name, ok := rockRidgeName(systemUse); ok {
+		w.rockRidge = true
+		return name
+	}
+	return strings.ToLower(strings.TrimSuffix(stripISOVersion(string(rawName)), "."))
+}
+
+// rockRidgeName pulls the alternate name out of the NM entries of a system use area
+func rockRidgeName(systemUse []byte) (string, bool) {
+	var name []byte
+	found := false
+	for len(systemUse) >= 4 {
+		length := int(systemUse[2])
+		if length < 4 || length > len(systemUse) {
+			break
+		}
+		if string(systemUse[:2]) == "NM" && length >= 5 {
+			found = true
+			name = append(name, systemUse[5:length]...)
+		}
+		systemUse = systemUse[length:]
+	}
+	return string(name), found
+}
+
+func stripISOVersion(name string) string {
+	if i := strings.LastIndexByte(name, ';'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var listenSpecs = []listenSpec{{network: "udp", address: ":9010"}} // sockets requests are accepted on.  change to 69 before submit
+
+// listenConfig is a listening socket as it appears in the config file.  Either
+// Address is a host:port, where an empty host listens on every IPv4 and IPv6
+// address, or Interface names a network interface to listen on every address
+// of, at Port.  Family, "ipv4" or "ipv6", restricts the listener to one
+// address family.  Parsing, "strict" or "lenient", is how closely requests
+// must follow the RFCs.
+type listenConfig struct {
+	Address   string `json:"address"`
+	Interface string `json:"interface"`
+	Port      int    `json:"port"`
+	Family    string `json:"family"`
+	Parsing   string `json:"parsing"`
+}
+
+// listenSpec is a socket to open, as arguments to net.ListenPacket, and how
+// requests arriving on it are parsed
+type listenSpec struct {
+	network string
+	address string
+	parsing wire.ParseMode
+}
+
+// parseModes are the parsing settings of a listener by name
+var parseModes = map[string]wire.ParseMode{
+	"":        wire.ParseDefault,
+	"strict":  wire.ParseStrict,
+	"lenient": wire.ParseLenient,
+}
+
+var interfaceAddrs = func(name string) ([]net.Addr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return iface.Addrs()
+}
+
+// compileListeners works out the sockets to open for configs
+func compileListeners(configs []listenConfig) ([]listenSpec, error) {
+	var specs []listenSpec
+	for i, c := range configs {
+		network := "udp"
+		switch c.Family {
+		case "":
+		case "ipv4":
+			network = "udp4"
+		case "ipv6":
+			network = "udp6"
+		default:
+			return nil, fmt.Errorf("listener %d: family must be \"ipv4\" or \"ipv6\", not %q", i+1, c.Family)
+		}
+
+		parsing, ok := parseModes[c.Parsing]
+		if !ok {
+			return nil, fmt.Errorf("listener %d: parsing must be \"strict\" or \"lenient\", not %q", i+1, c.Parsing)
+		}
+		if (c.Address == "") == (c.Interface == "") {
+			return nil, fmt.Errorf("listener %d: needs exactly one of address and interface", i+1)
+		}
+		if c.Address != "" {
+			host, port, err := net.SplitHostPort(c.Address)
+			if err != nil {
+				return nil, fmt.Errorf("listener %d: %s", i+1, err)
+			}
+			if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				return nil, fmt.Errorf("listener %d: bad port %q", i+1, port)
+			}
+			if host != "" {
+				ip := net.ParseIP(strings.SplitN(host, "%", 2)[0])
+				if ip == nil {
+					return nil, fmt.Errorf("listener %d: %q is not an IP address", i+1, host)
+				}
+				ipNetwork := ipFamily(ip)
+				if network != "udp" && network != ipNetwork {
+					return nil, fmt.Errorf("listener %d: %s is not an %s address", i+1, host, c.Family)
+				}
+				network = ipNetwork
+			}
+			specs = append(specs, listenSpec{network: network, address: c.Address, parsing: parsing})
+			continue
+		}
+
+		if c.Port <= 0 || c.Port > 65535 {
+			return nil, fmt.Errorf("listener %d: bad port %d", i+1, c.Port)
+		}
+		addrs, err := interfaceAddrs(c.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("listener %d: %s", i+1, err)
+		}
+		found := false
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ipNetwork := ipFamily(ipNet.IP)
+			if network != "udp" && network != ipNetwork {
+				continue
+			}
+			udpAddr := &net.UDPAddr{IP: ipNet.IP, Port: c.Port}
+			if ipNet.IP.IsLinkLocalUnicast() && ipNetwork == "udp6" {
+				udpAddr.Zone = c.Interface
+			}
+			specs = append(specs, listenSpec{network: ipNetwork, address: udpAddr.String(), parsing: parsing})
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("listener %d: interface %s has no matching addresses", i+1, c.Interface)
+		}
+	}
+	return specs, nil
+}
+
+// ipFamily is the network name for sockets of ip's address family
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// tidBinding is the network and local address a transfer socket should be
+// bound to, so that it matches the family and address of the socket the
+// request from peer arrived on at local.  local may be nil, or a wildcard
+// address, in which case only the family is matched.
+func tidBinding(local, peer net.Addr) (string, net.IP) {
+	network := "udp"
+	if peerUDP, ok := peer.(*net.UDPAddr); ok && peerUDP.IP != nil {
+		network = ipFamily(peerUDP.IP)
+	}
+	localUDP, ok := local.(*net.UDPAddr)
+	if !ok || localUDP.IP == nil || localUDP.IP.IsUnspecified() {
+		return network, nil
+	}
+	return network, localUDP.IP
+}
+
+// openListeners opens a socket for every spec, closing them all if any fails
+func openListeners(specs []listenSpec) ([]net.PacketConn, error) {
+	listeners := make([]net.PacketConn, 0, len(specs))
+	for _, spec := range specs {
+		conn, err := net.ListenPacket(spec.network, spec.address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		if err := enablePacketInfo(conn.(*net.UDPConn), spec.network); err != nil {
+			log.Printf("Unable to learn request destinations on %s, replies may come from another address.  error: %s", conn.LocalAddr(), err)
+		}
+		listeners = append(listeners, conn)
+	}
+	return listeners, nil
+}
+
+// spawn starts the goroutines serve hands packets to.  Tests on a simulated
+// network replace it, so that the network knows to wait for them.
+var spawn = func(f func()) { go f() }
+
+// serve accepts requests on server until it is closed, starting a transaction
+// for each.  Requests are parsed as parsing says.  txID is shared by every
+// listener so transaction numbers are unique.  In single port mode the
+// packets of each transfer arrive here too, and are passed on to the
+// transaction for their peer.  wg is done once server is closed and every
+// transaction started from it has ended.  Closing server ends them early.
+func serve(server net.PacketConn, parsing wire.ParseMode, txID *int64, txns chan string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var mux *portMux
+	if singlePort {
+		mux = newPortMux(server)
+	}
+	transfers := newTransferSet()
+	buf := make([]byte, 2048)
+	oob := make([]byte, packetInfoSpace)
+	for {
+		n, addr, local, err := readRequest(server, buf, oob)
+		if err == nil && mux != nil && mux.deliver(addr, buf[:n]) {
+			continue
+		}
+		id := atomic.AddInt64(txID, 1) - 1
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				transfers.close()
+				return
+			}
+			log.Println("Unable to read packet from connection.  Error: ", err)
+			txns <- fmt.Sprintf(txnTemplate, id, "unknown", "failed", "Initial packet unreadable")
+			continue
+		}
+		packet, err := wire.ParsePacketMode(buf[:n], parsing)
+		if errors.Is(err, wire.ErrNonconforming) {
+			nonconformingPacket(addr, server, err)
+			txns <- fmt.Sprintf(txnTemplate, id, "unknown", "failed", "Initial packet refused by strict parsing: "+err.Error())
+			continue
+		} else if err != nil {
+			// incorrectly formated packet
+			spawn(func() { badPacket(addr, server, err) })
+			txns <- fmt.Sprintf(txnTemplate, id, "unknown", "failed", "Initial packet corrupted")
+			continue
+		}
+		packetRequest, ok := packet.(*wire.PacketRequest)
+		if !ok {
+			log.Println(packet)
+			unexpectedPacket(addr, server, "RRQ or WRQ")
+			txns <- fmt.Sprintf(txnTemplate, id, "unknown", "failed", "Initial packet not RRQ or WRQ")
+		} else if strings.ToLower(packetRequest.Mode) != "octet" {
+			unsupportedMode(addr, server)
+			txns <- fmt.Sprintf(txnTemplate, id, "unknown", "failed", "Communication not in OCTET mode")
+		} else if packetRequest.Op == wire.OpRRQ || packetRequest.Op == wire.OpWRQ {
+			if !activeRequests.start(addr, packetRequest.Op, packetRequest.Filename, id) {
+				continue
+			}
+			// buf is reused for the next packet, so the transaction gets its own
+			// copy of the request to record
+			raw, received := append([]byte(nil), buf[:n]...), time.Now()
+			delay, err := admitRequest(addr, packetRequest.Op, received)
+			if err != nil {
+				activeRequests.finish(addr, packetRequest.Op, packetRequest.Filename)
+				wg.Add(1)
+				spawn(func() {
+					defer wg.Done()
+					rec := startRecording(id, packetRequest, raw, received, addr, local)
+					defer rec.close()
+					sendError(addr, recordedConn(server, rec), err)
+				})
+				txns <- refusedTxn(packetRequest, addr, id, "Request rejected by rate limits")
+				continue
+			}
+			wg.Add(1)
+			spawn(func() {
+				defer wg.Done()
+				startTransfer(packetRequest, raw, received, addr, server, mux, transfers, local, parsing, id, txns, delay)
+			})
+		}
+	}
+}
+
+// startTransfer runs the transaction for request, parsed from raw as received
+// at received, after holding it back for delay and waiting for a slot within
+// the concurrency limits.  Requests that get no slot are refused over server.
+// Retransmits of the request are dropped until it is over.  The transfer's
+// packets are parsed as parsing says, like the request, and recorded if
+// recordingRule selects it.  The transfer is ended early if transfers is
+// closed.
+func startTransfer(request *wire.PacketRequest, raw []byte, received time.Time, addr net.Addr, server net.PacketConn, mux *portMux, transfers *transferSet, local net.Addr, parsing wire.ParseMode, txID int64, txns chan string, delay time.Duration) {
+	defer activeRequests.finish(addr, request.Op, request.Filename)
+	// opening the recording here keeps its file I/O out of serve's loop
+	rec := startRecording(txID, request, raw, received, addr, local)
+	defer rec.close()
+	if !transfers.wait(delay) {
+		txns <- refusedTxn(request, addr, txID, "Server shut down before the transfer started")
+		return
+	}
+	ip, _ := clientIPPort(addr)
+	client := ip.String()
+	file := slotFile(request, addr)
+	if err := transferSlots.acquire(client, file, transfers.done); err != nil {
+		sendError(addr, recordedConn(server, rec), err)
+		txns <- refusedTxn(request, addr, txID, "Too many concurrent transfers")
+		return
+	}
+	defer transferSlots.release(client, file)
+
+	tidConn := transferConn(mux, local, addr)
+	if tidConn != nil && !transfers.add(tidConn) {
+		tidConn.Close()
+		txns <- refusedTxn(request, addr, txID, "Server shut down before the transfer started")
+		return
+	}
+	defer transfers.remove(tidConn)
+	conn := recordedConn(tidConn, rec)
+	if request.Op == wire.OpRRQ {
+		opRead(request, addr, conn, parsing, txID, txns)
+	} else {
+		opWrite(request, addr, conn, parsing, txID, txns)
+	}
+}
+
+// transferSet holds the connections of the transfers started from one
+// listener, so that closing the listener can end them rather than wait for
+// their peers to go quiet
+type transferSet struct {
+	sync.Mutex
+	conns map[net.PacketConn]bool
+	done  chan struct{} // closed once the listener is
+}
+
+func newTransferSet() *transferSet {
+	return &transferSet{conns: make(map[net.PacketConn]bool), done: make(chan struct{})}
+}
+
+// add keeps conn to be closed with the set.  It returns false if the set has
+// already been closed.
+func (s *transferSet) add(conn net.PacketConn) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.conns == nil {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+// remove forgets conn, once its transfer is over
+func (s *transferSet) remove(conn net.PacketConn) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.conns, conn)
+}
+
+// close ends every transfer in the set, and any started after
+func (s *transferSet) close() {
+	s.Lock()
+	conns := s.conns
+	s.conns = nil
+	close(s.done)
+	s.Unlock()
+	for conn := range conns {
+		conn.Close()
+	}
+}
+
+// wait sleeps for d, returning false if the set is closed in the meantime
+func (s *transferSet) wait(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// refusedTxn is the txn log line for request, refused before its transfer
+// started.  Refused uploads are sent to the webhooks as rejected, like those
+// opWrite refuses.
+func refusedTxn(request *wire.PacketRequest, addr net.Addr, txID int64, note string) string {
+	if request.Op == wire.OpWRQ {
+		return newTransferEvent("write", request, addr, txID).finish("rejected", note)
+	}
+	return fmt.Sprintf(txnTemplate, txID, "READ", "failed", note)
+}
+
+// transferConn opens the connection a transfer with peer runs over, or
+// returns nil if there isn't one to be had
+func transferConn(mux *portMux, local, peer net.Addr) net.PacketConn {
+	if mux != nil {
+		return mux.open(peer, local)
+	}
+	return newTIDConnection(local, peer)
+}
+
+// readRequest reads a packet from server, returning the address it was sent
+// to if the kernel reports it, so that the reply can come from the address the
+// client expects on a host with several.  Otherwise it returns the listener's
+// own address.
+func readRequest(server net.PacketConn, buf, oob []byte) (int, net.Addr, net.Addr, error) {
+	udp, ok := server.(*net.UDPConn)
+	if !ok || len(oob) == 0 {
+		n, addr, err := server.ReadFrom(buf)
+		return n, addr, server.LocalAddr(), err
+	}
+	n, oobn, _, addr, err := udp.ReadMsgUDP(buf, oob)
+	if err != nil {
+		return n, nil, nil, err
+	}
+	local := packetDestination(oob[:oobn])
+	if local == nil {
+		return n, addr, server.LocalAddr(), nil
+	}
+	if listening, ok := server.LocalAddr().(*net.UDPAddr); ok {
+		local.Port = listening.Port
+	}
+	return n, addr, local, nil
+}
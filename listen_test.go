@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCompileListeners(t *testing.T) {
+	oldInterfaceAddrs := interfaceAddrs
+	defer func() { interfaceAddrs = oldInterfaceAddrs }()
+	interfaceAddrs = func(name string) ([]net.Addr, error) {
+		if name != "eth1" {
+			return nil, errors.New("no such interface")
+		}
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("192.168.7.1"), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)},
+			&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+		}, nil
+	}
+
+	tests := []struct {
+		config   listenConfig
+		expected []listenSpec
+	}{
+		{listenConfig{Address: ":69"}, []listenSpec{{network: "udp", address: ":69"}}},
+		{listenConfig{Address: ":69", Family: "ipv6"}, []listenSpec{{network: "udp6", address: ":69"}}},
+		{listenConfig{Address: "0.0.0.0:69"}, []listenSpec{{network: "udp4", address: "0.0.0.0:69"}}},
+		{listenConfig{Address: "[::]:69"}, []listenSpec{{network: "udp6", address: "[::]:69"}}},
+		{listenConfig{Address: "[fe80::1%eth1]:69"}, []listenSpec{{network: "udp6", address: "[fe80::1%eth1]:69"}}},
+		{listenConfig{Interface: "eth1", Port: 69}, []listenSpec{
+			{network: "udp4", address: "192.168.7.1:69"},
+			{network: "udp6", address: "[2001:db8::1]:69"},
+			{network: "udp6", address: "[fe80::1%eth1]:69"},
+		}},
+		{listenConfig{Interface: "eth1", Port: 69, Family: "ipv4"}, []listenSpec{{network: "udp4", address: "192.168.7.1:69"}}},
+		{listenConfig{Address: ":69", Parsing: "strict"}, []listenSpec{{network: "udp", address: ":69", parsing: wire.ParseStrict}}},
+		{listenConfig{Interface: "eth1", Port: 69, Family: "ipv4", Parsing: "lenient"}, []listenSpec{{network: "udp4", address: "192.168.7.1:69", parsing: wire.ParseLenient}}},
+	}
+
+	for _, test := range tests {
+		actual, err := compileListeners([]listenConfig{test.config})
+		if err != nil {
+			t.Errorf("Compiling %#v: unexpected error %s", test.config, err)
+		} else if !reflect.DeepEqual(test.expected, actual) {
+			t.Errorf("Compiling %#v: expected %v; got %v", test.config, test.expected, actual)
+		}
+	}
+
+	invalid := []listenConfig{
+		{},
+		{Address: ":69", Interface: "eth1"},
+		{Address: "nowhere"},
+		{Address: "example.com:69"},
+		{Address: ":tftp"},
+		{Address: "10.0.0.1:69", Family: "ipv6"},
+		{Address: ":69", Family: "ipx"},
+		{Interface: "eth1"},
+		{Interface: "eth9", Port: 69},
+		{Address: ":69", Parsing: "picky"},
+	}
+	for _, config := range invalid {
+		if _, err := compileListeners([]listenConfig{config}); err == nil {
+			t.Errorf("Compiling %#v: expected error", config)
+		}
+	}
+}
+
+func TestTIDBinding(t *testing.T) {
+	v4Peer := &net.UDPAddr{IP: net.ParseIP("10.0.0.7"), Port: 2000}
+	v6Peer := &net.UDPAddr{IP: net.ParseIP("2001:db8::7"), Port: 2000}
+	tests := []struct {
+		local   net.Addr
+		peer    net.Addr
+		network string
+		ip      net.IP
+	}{
+		{nil, nil, "udp", nil},
+		{nil, v4Peer, "udp4", nil},
+		{nil, v6Peer, "udp6", nil},
+		{&net.UDPAddr{IP: net.IPv6unspecified, Port: 69}, v4Peer, "udp4", nil},
+		{&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 69}, v4Peer, "udp4", net.ParseIP("10.0.0.1")},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 69}, v6Peer, "udp6", net.ParseIP("2001:db8::1")},
+	}
+
+	for _, test := range tests {
+		network, ip := tidBinding(test.local, test.peer)
+		if network != test.network || !ip.Equal(test.ip) {
+			t.Errorf("Binding for %v from %v: expected %s %v; got %s %v", test.local, test.peer, test.network, test.ip, network, ip)
+		}
+	}
+}
+
+func TestServeIPv6(t *testing.T) {
+	listeners, err := openListeners([]listenSpec{{network: "udp6", address: "[::1]:0"}})
+	if err != nil {
+		t.Skip("no IPv6 loopback: ", err)
+	}
+	files = newCASStore()
+	files.Write("boot.cfg", "over v6", "")
+
+	var wg sync.WaitGroup
+	forgetRequests(t)
+	wg.Add(1)
+	txID := int64(0)
+	txns := make(chan string, 1)
+	go serve(listeners[0], wire.ParseDefault, &txID, txns, &wg)
+	defer func() {
+		listeners[0].Close()
+		wg.Wait()
+	}()
+
+	client, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	request := wire.PacketRequest{Op: wire.OpRRQ, Filename: "boot.cfg", Mode: "octet"}
+	client.WriteTo(request.Serialize(), listeners[0].LocalAddr())
+
+	buf := make([]byte, wire.MaxPacketSize)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := addr.(*net.UDPAddr).IP; !ip.Equal(net.IPv6loopback) {
+		t.Errorf("Expected reply from ::1; got %s", addr)
+	}
+	packet, err := wire.ParsePacket(buf[:n])
+	if data, ok := packet.(*wire.PacketData); err != nil || !ok || string(data.Data) != "over v6" {
+		t.Errorf("Expected DATA with the file; got %#v, %v", packet, err)
+	}
+	ack := wire.PacketAck{BlockNum: 1}
+	client.WriteTo(ack.Serialize(), addr)
+	<-txns
+}
+
+func TestServeParsing(t *testing.T) {
+	defer initABit()
+	files = newCASStore()
+	files.Write("boot.cfg", "quirky", "")
+	tests := []struct {
+		parsing  wire.ParseMode
+		request  string
+		expected string // DATA, or the message of the ERROR expected
+	}{
+		{wire.ParseDefault, "\x00\x01boot.cfg\x00octet\x00\x00\x00", "DATA"},
+		{wire.ParseDefault, "\x00\x01boot.cfg\x00octet", "Malformed packet"},
+		{wire.ParseLenient, "\x00\x01boot.cfg\x00octet", "DATA"},
+		{wire.ParseStrict, "\x00\x01boot.cfg\x00octet\x00", "DATA"},
+		{wire.ParseStrict, "\x00\x01boot.cfg\x00octet\x00\x00\x00", "nonconforming packet: 2 bytes of padding after the options"},
+		{wire.ParseStrict, "\x00\x01boot.cfg\x00bin\x00", `nonconforming packet: mode "bin" is not netascii, octet or mail`},
+	}
+
+	for _, test := range tests {
+		listeners, err := openListeners([]listenSpec{{network: "udp4", address: "127.0.0.1:0"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		forgetRequests(t)
+		wg.Add(1)
+		txID := int64(0)
+		txns := make(chan string, 1)
+		go serve(listeners[0], test.parsing, &txID, txns, &wg)
+
+		client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.WriteTo([]byte(test.request), listeners[0].LocalAddr())
+		buf := make([]byte, wire.MaxPacketSize)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		n, addr, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := "unexpected packet"
+		switch p, _ := wire.ParsePacket(buf[:n]); p := p.(type) {
+		case *wire.PacketData:
+			actual = "DATA"
+			ack := wire.PacketAck{BlockNum: 1}
+			client.WriteTo(ack.Serialize(), addr)
+		case *wire.PacketError:
+			actual = p.Msg
+		}
+		if actual != test.expected {
+			t.Errorf("%s parsing of %q: expected %s; got %s", test.parsing, test.request, test.expected, actual)
+		}
+		<-txns
+		client.Close()
+		listeners[0].Close()
+		wg.Wait()
+	}
+}
+
+func TestServeParsingInTransfers(t *testing.T) {
+	defer initABit()
+	files = newCASStore()
+	files.Write("boot.cfg", "quirky", "")
+	oversized := "\x00\x03\x00\x01" + strings.Repeat("x", 513)
+	tests := []struct {
+		parsing wire.ParseMode
+		op      uint16
+		answer  string // sent in answer to the server's first packet
+		txn     string // expected in the txn log
+	}{
+		{wire.ParseDefault, wire.OpRRQ, "\x00\x04\x00\x01\x00\x00", "success"},
+		{wire.ParseStrict, wire.OpRRQ, "\x00\x04\x00\x01\x00\x00", "ACK packet refused by strict parsing: nonconforming packet: 2 bytes after the block number of an ACK"},
+		{wire.ParseDefault, wire.OpRRQ, "\x00\x05\x00\x00gave up", "ACK packet parsing failed"},
+		{wire.ParseLenient, wire.OpRRQ, "\x00\x05\x00\x00gave up", "Peer aborted transfer"},
+		{wire.ParseStrict, wire.OpWRQ, oversized, "DATA packet refused by strict parsing: nonconforming packet: DATA carries 513 bytes, more than 512"},
+	}
+
+	for _, test := range tests {
+		listeners, err := openListeners([]listenSpec{{network: "udp4", address: "127.0.0.1:0"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		forgetRequests(t)
+		wg.Add(1)
+		txID := int64(0)
+		txns := make(chan string, 1)
+		go serve(listeners[0], test.parsing, &txID, txns, &wg)
+
+		client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := wire.PacketRequest{Op: test.op, Filename: "boot.cfg", Mode: "octet"}
+		client.WriteTo(request.Serialize(), listeners[0].LocalAddr())
+		buf := make([]byte, wire.MaxPacketSize)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, addr, err := client.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		} else {
+			client.WriteTo([]byte(test.answer), addr)
+		}
+		if txn := <-txns; !strings.Contains(txn, test.txn) {
+			t.Errorf("%s parsing of %q: expected %q in the txn log; got %q", test.parsing, test.answer, test.txn, txn)
+		}
+		client.Close()
+		listeners[0].Close()
+		wg.Wait()
+	}
+}
+
+func TestCloseEndsTransfers(t *testing.T) {
+	defer initABit()
+	defer func() { singlePort = false }()
+	files = newCASStore()
+	files.Write("boot.cfg", strings.Repeat("x", 2000), "")
+	for _, single := range []bool{false, true} {
+		singlePort = single
+		listeners, err := openListeners([]listenSpec{{network: "udp4", address: "127.0.0.1:0"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		forgetRequests(t)
+		wg.Add(1)
+		txID := int64(0)
+		txns := make(chan string, 1)
+		go serve(listeners[0], wire.ParseDefault, &txID, txns, &wg)
+
+		// a client that goes quiet after the first block
+		client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := wire.PacketRequest{Op: wire.OpRRQ, Filename: "boot.cfg", Mode: "octet"}
+		client.WriteTo(request.Serialize(), listeners[0].LocalAddr())
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := client.ReadFrom(make([]byte, wire.MaxPacketSize)); err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		listeners[0].Close()
+		wg.Wait()
+		if waited := time.Since(start); waited > time.Second {
+			t.Errorf("Single port %t: expected closing the listener to end the transfer; waited %s", single, waited)
+		}
+		if txn := <-txns; !strings.Contains(txn, "failed") {
+			t.Errorf("Single port %t: expected the transfer to fail; got %q", single, txn)
+		}
+		client.Close()
+	}
+}
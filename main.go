@@ -2,28 +2,29 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	wire "github.com/coffeepac/tftp/tftp_wire"
+	"io"
 	"log"
-	"math/rand"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strconv"
-	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
-var files map[string]string
+var files fileStore                                                                    // default store, for clients outside every virtual root
 var connectionAttempts = 15                                                            // attempts to randomly find an unused port
 var connRetries = 5                                                                    // attempts to send or wait
-var portRangeStart = 49152                                                             // IANA recommended port range start for ephemeral ports
-var portRangeSize = 16383                                                              // IANA recommended port range size for ephemeral ports
 var timeoutSeconds = 20                                                                // timeout for all ReadFroms in seconds
 var txnTemplate = "Transaction #%d of type %s completed with status %s and notes %s\n" // template so all txn log messages look the same
 
+var configFile = flag.String("config", "", "path to a JSON config file")
+var adminAddr = flag.String("admin", "", "address for the admin HTTP interface, e.g. 127.0.0.1:9011.  disabled if empty")
+
 func futureAck(addr net.Addr, conn net.PacketConn) {
 	errPack := wire.PacketError{Code: uint16(0), Msg: "Received ACK for packet not yet sent."}
 	conn.WriteTo(errPack.Serialize(), addr)
@@ -42,6 +43,13 @@ func badPacket(addr net.Addr, conn net.PacketConn, err error) {
 	log.Println("Received an incorrectly formatted packet.  Aborting connection.  error: ", err)
 }
 
+// nonconformingPacket tells the peer why strict parsing refused its packet
+func nonconformingPacket(addr net.Addr, conn net.PacketConn, err error) {
+	errPack := wire.PacketError{Code: 4, Msg: err.Error()}
+	conn.WriteTo(errPack.Serialize(), addr)
+	log.Println("Received a packet that breaks the RFCs.  Aborting connection.  error: ", err)
+}
+
 func unsupportedMode(addr net.Addr, conn net.PacketConn) {
 	unsupModePacket := wire.PacketError{Code: 0, Msg: "This server only supports a mode of OCTET"}
 	conn.WriteTo(unsupModePacket.Serialize(), addr)
@@ -49,41 +57,91 @@ func unsupportedMode(addr net.Addr, conn net.PacketConn) {
 }
 
 func unknownRemoteTID(addr net.Addr, conn net.PacketConn) {
-	unknownTID := wire.PacketError{Code: 0, Msg: "TID is not known to this server"}
+	unknownTID := wire.PacketError{Code: 5, Msg: "TID is not known to this server"}
 	conn.WriteTo(unknownTID.Serialize(), addr)
 	log.Println("Received a packet from an unknown TID.")
 }
 
-func newTIDConnection(seed int64) net.PacketConn {
-	rand.Seed(seed)
-	for attempts := connectionAttempts; attempts > 0; attempts-- {
-		port := portRangeStart + rand.Intn(portRangeSize) // IANA recommended ephemeral port range of 49512 - 65535
-		connection, err := net.ListenPacket("udp", ":"+strconv.Itoa(port))
-		if err != nil {
-			log.Printf("Unable to bind to port %d.  %d attempts left", port, attempts)
-		} else {
-			return connection
-		}
+// tftpError is an error that should be reported to the peer with a specific
+// TFTP error code.
+type tftpError struct {
+	Code uint16
+	Msg  string
+}
+
+func (e *tftpError) Error() string {
+	return e.Msg
+}
+
+var errFileNotFound = &tftpError{Code: 1, Msg: "File not found"}
+
+// sendError reports err to the peer, with its TFTP error code if it has one
+func sendError(addr net.Addr, conn net.PacketConn, err error) {
+	errPack := wire.PacketError{Code: 0, Msg: err.Error()}
+	if tErr, ok := err.(*tftpError); ok {
+		errPack.Code = tErr.Code
+	}
+	conn.WriteTo(errPack.Serialize(), addr)
+	log.Println("Sent error to peer.  Aborting connection.  error: ", err)
+}
+
+func rejectedRequest(addr net.Addr, conn net.PacketConn) {
+	rejected := wire.PacketError{Code: 2, Msg: "Access violation"}
+	conn.WriteTo(rejected.Serialize(), addr)
+	log.Println("Request rejected by server policy.  Aborting connection.")
+}
+
+// newTIDConnection opens the socket for a transfer with peer on a random port,
+// on the address family and local address of the listener at local the
+// request arrived on.
+func newTIDConnection(local, peer net.Addr) net.PacketConn {
+	network, ip := tidBinding(local, peer)
+	conn := tidPorts.allocate(network, ip)
+	if conn == nil {
+		log.Println("Unable to select an ephemeral port at random.  Return no connection")
 	}
+	return conn
+}
+
+// transferBuffers are reused for every block of a transfer, so that moving a
+// block allocates nothing
+type transferBuffers struct {
+	read    []byte // the packet last read from the peer
+	sent    []byte // the packet last sent, kept for resending
+	decoder wire.Decoder
+}
+
+// newTransferBuffers makes the buffers for a transfer whose packets are
+// parsed as parsing says.  The read buffer has room for more than a block, so
+// that an oversized DATA isn't silently cut down to one.
+func newTransferBuffers(parsing wire.ParseMode) *transferBuffers {
+	return &transferBuffers{read: make([]byte, wire.MaxPacketSize), sent: make([]byte, 0, 516), decoder: wire.Decoder{Mode: parsing}}
+}
 
-	log.Println("Unable to select an ephemeral port at random.  Return no connection")
-	return nil
+// tftpReadFrom reads the next packet from addr into data, resending prevData
+// each time the peer goes quiet
+func tftpReadFrom(conn net.PacketConn, addr net.Addr, prevData, data []byte) ([]byte, int, error) {
+	conn.SetReadDeadline(time.Now().Add(time.Duration(timeoutSeconds) * time.Second))
+	return tftpReadMore(conn, addr, prevData, data)
 }
 
-func tftpReadFrom(conn net.PacketConn, addr net.Addr, prevData []byte) ([]byte, int, error) {
+// tftpReadMore is tftpReadFrom for when the last packet read wasn't the one
+// wanted, such as a retransmitted old ACK.  The timeout already running is
+// left alone, as restarting it would let a peer that keeps resending put off
+// our own resend of prevData forever.
+func tftpReadMore(conn net.PacketConn, addr net.Addr, prevData, data []byte) ([]byte, int, error) {
 	retryCounter := 0
 	readComplete := false
-	data := make([]byte, 516)
 	n := 0
 	var readAddr net.Addr
 	var err error
 	for retryCounter < connRetries && !readComplete {
-		conn.SetDeadline(time.Now().Add(time.Duration(timeoutSeconds) * time.Second))
 		n, readAddr, err = conn.ReadFrom(data)
 		if err != nil && err.(net.Error).Timeout() == true {
 			conn.WriteTo(prevData, addr)
+			conn.SetReadDeadline(time.Now().Add(time.Duration(timeoutSeconds) * time.Second))
 		} else if err != nil {
-			return data, n, err // general errors end this loop, don't bother resetting deadline.  conn will be closed before used again
+			return data, n, err // general errors end this loop.  conn will be closed before used again
 		} else {
 			readComplete = true
 		}
@@ -91,144 +149,280 @@ func tftpReadFrom(conn net.PacketConn, addr net.Addr, prevData []byte) ([]byte,
 	}
 
 	if readComplete {
-		if readAddr.String() != addr.String() {
+		if !sameAddr(readAddr, addr) {
 			unknownRemoteTID(readAddr, conn)
-			conn.SetDeadline(time.Time{}) // reset to infinity
 			return nil, 0, errors.New("Errant packet received")
 		}
-		conn.SetDeadline(time.Time{}) // reset to infinity
 		return data, n, nil
 	} else {
 		return data, n, errors.New("ReadFrom timed out")
 	}
 }
 
-func opRead(request *wire.PacketRequest, addr net.Addr, txID int64, txns chan string) {
-	conn := newTIDConnection(txID)
+// sameAddr is addr1.String() == addr2.String() without building the strings
+func sameAddr(addr1, addr2 net.Addr) bool {
+	udp1, ok1 := addr1.(*net.UDPAddr)
+	udp2, ok2 := addr2.(*net.UDPAddr)
+	if ok1 && ok2 {
+		return udp1.Port == udp2.Port && udp1.Zone == udp2.Zone && udp1.IP.Equal(udp2.IP)
+	}
+	return addr1.String() == addr2.String()
+}
+
+// awaitAck waits for the ACK of blockNum, resending bufs.sent if the peer
+// goes quiet.  The returned error is the note for the txn log.
+func awaitAck(conn net.PacketConn, addr net.Addr, bufs *transferBuffers, blockNum uint16) error {
+	read := tftpReadFrom
+	for {
+		buf, n, err := read(conn, addr, bufs.sent, bufs.read)
+		read = tftpReadMore // anything but the ACK we want leaves the timeout running
+		if err != nil {
+			if err.Error() == "Errant packet received" {
+				continue
+			}
+			log.Println("ReadFrom failed.  Aborting. error: ", err)
+			return errors.New("ACK packet read failed.  Check application log")
+		}
+		ackPack, err := bufs.decoder.Parse(buf[:n])
+		if errors.Is(err, wire.ErrNonconforming) {
+			nonconformingPacket(addr, conn, err)
+			return errors.New("ACK packet refused by strict parsing: " + err.Error())
+		} else if err != nil {
+			badPacket(addr, conn, err)
+			return errors.New("ACK packet parsing failed.  Check application log")
+		}
+		if errPack, ok := ackPack.(*wire.PacketError); ok {
+			// never answer an error with an error, the peer has already given up
+			log.Printf("Peer aborted the transfer with error %d: %s", errPack.Code, errPack.Msg)
+			return errors.New("Peer aborted transfer with an ERROR packet.  Check application log")
+		}
+		ack, ok := ackPack.(*wire.PacketAck)
+		if !ok {
+			unexpectedPacket(addr, conn, "ACK")
+			return errors.New("Received unexpected packet type.  Check application log")
+		}
+		if ack.BlockNum == blockNum {
+			return nil
+		}
+		if int16(ack.BlockNum-blockNum) > 0 {
+			// ACK from the future.  I assume something is Wrong on the sending side.
+			// Block numbers wrap, so ahead means less than half the range ahead.
+			futureAck(addr, conn)
+			return errors.New("Recevied ACK from future.  Check application log")
+		}
+		// probably a retransmit of an old ack
+	}
+}
+
+// opRead serves the RRQ request from addr over conn, which is nil if no
+// connection could be opened for the transfer.  The client's packets are
+// parsed as parsing says.
+func opRead(request *wire.PacketRequest, addr net.Addr, conn net.PacketConn, parsing wire.ParseMode, txID int64, txns chan string) {
 	if conn == nil {
 		txns <- fmt.Sprintf(txnTemplate, txID, "READ", "failed", "unable to open new TID connection")
 		return
 	}
 	defer conn.Close()
 
-	if fileContents, ok := files[request.Filename]; ok {
-		notDone := true
-		blockNum := uint16(1)
-		for notDone {
-			var chunk []byte
-			if len(fileContents) >= 512 {
-				chunk = []byte(fileContents[:512])
-				fileContents = fileContents[512:]
-			} else {
-				chunk = []byte(fileContents)
-				notDone = false
-			}
-			data := wire.PacketData{BlockNum: blockNum, Data: chunk}
-			conn.WriteTo(data.Serialize(), addr)
-			ackReceived := false
-			for !ackReceived {
-				buf, _, err := tftpReadFrom(conn, addr, data.Serialize())
-				if err != nil {
-					if err.Error() == "Errant packet received" {
-						continue
-					} else {
-						log.Println("ReadFrom failed.  Aborting. error: ", err)
-						txns <- fmt.Sprintf(txnTemplate, txID, "READ", "failed", "ACK packet read failed.  Check application log")
-						return
-					}
-				}
-				ackPack, err := wire.ParsePacket(buf)
-				if err != nil {
-					badPacket(addr, conn, err)
-					txns <- fmt.Sprintf(txnTemplate, txID, "READ", "failed", "ACK packet parsing failed.  Check application log")
-					return
-				}
-				ack, ok := ackPack.(*wire.PacketAck)
-				if !ok {
-					unexpectedPacket(addr, conn, "ACK")
-					txns <- fmt.Sprintf(txnTemplate, txID, "READ", "failed", "Received unexpected packet type.  Check application log")
-					return
-				}
-				if ack.BlockNum != blockNum {
-					if ack.BlockNum < blockNum {
-						continue // probably a retransmit of an old ack
-					} else {
-						// ACK from the future.  I assume something is Wrong on the sending side.
-						futureAck(addr, conn)
-						txns <- fmt.Sprintf(txnTemplate, txID, "READ", "failed", "Recevied ACK from future.  Check application log")
-						return
-					}
-				} else {
-					ackReceived = true
-				}
+	filename, err := rewriteFilename(rewriteRules, request, addr)
+	if err != nil {
+		rejectedRequest(addr, conn)
+		txns <- fmt.Sprintf(txnTemplate, txID, "READ", "failed", "Request rejected by rewrite rules")
+		return
+	}
 
+	source, size, err := openReadSource(filename, request, addr)
+	if err != nil {
+		sendError(addr, conn, err)
+		txns <- fmt.Sprintf(txnTemplate, txID, "READ", "failed", "Unable to open requested file: "+err.Error())
+		return
+	}
+	defer source.Close()
+
+	bufs := newTransferBuffers(parsing)
+	if options := negotiateReadOptions(request.Options, size); options != nil {
+		oack := wire.PacketOAck{Options: options}
+		bufs.sent = oack.AppendTo(bufs.sent[:0])
+		conn.WriteTo(bufs.sent, addr)
+		if err := awaitAck(conn, addr, bufs, 0); err != nil {
+			txns <- fmt.Sprintf(txnTemplate, txID, "READ", "failed", err.Error())
+			return
+		}
+	}
+
+	pacer := newDataPacer()
+	chunk := make([]byte, 512)
+	blockNum := uint16(1)
+	for {
+		n, err := io.ReadFull(source, chunk)
+		lastBlock := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !lastBlock {
+			log.Println("Unable to read file contents.  Aborting. error: ", err)
+			if _, ok := err.(*tftpError); !ok {
+				err = &tftpError{Code: 0, Msg: "Unable to read file"}
 			}
-			blockNum++
+			sendError(addr, conn, err)
+			txns <- fmt.Sprintf(txnTemplate, txID, "READ", "failed", "File read failed.  Check application log")
+			return
 		}
-	} else {
-		errPack := wire.PacketError{Code: 1, Msg: "File not found"}
-		conn.WriteTo(errPack.Serialize(), addr)
-		txns <- fmt.Sprintf(txnTemplate, txID, "READ", "failed", "Requested file not found.")
-		return
+		if lastBlock {
+			// a source can still fail at the very end, e.g. a hook's exit status, so
+			// check before the short block tells the client it has the whole file
+			if err := source.Close(); err != nil {
+				sendError(addr, conn, err)
+				txns <- fmt.Sprintf(txnTemplate, txID, "READ", "failed", "File source failed: "+err.Error())
+				return
+			}
+		}
+		data := wire.PacketData{BlockNum: blockNum, Data: chunk[:n]}
+		pacer.wait(n)
+		bufs.sent = data.AppendTo(bufs.sent[:0])
+		conn.WriteTo(bufs.sent, addr)
+		if err := awaitAck(conn, addr, bufs, blockNum); err != nil {
+			txns <- fmt.Sprintf(txnTemplate, txID, "READ", "failed", err.Error())
+			return
+		}
+		if lastBlock {
+			break
+		}
+		blockNum++
 	}
 
 	txns <- fmt.Sprintf(txnTemplate, txID, "READ", "success", "<none>")
 
 }
 
-func opWrite(request *wire.PacketRequest, addr net.Addr, txID int64, txns chan string) {
-	conn := newTIDConnection(txID)
+// opWrite serves the WRQ request from addr over conn, which is nil if no
+// connection could be opened for the transfer.  The client's packets are
+// parsed as parsing says.
+func opWrite(request *wire.PacketRequest, addr net.Addr, conn net.PacketConn, parsing wire.ParseMode, txID int64, txns chan string) {
+	event := newTransferEvent("write", request, addr, txID)
 	if conn == nil {
-		txns <- fmt.Sprintf(txnTemplate, txID, "WRITE", "failed", "unable to open new TID connection")
+		txns <- event.finish("failed", "unable to open new TID connection")
 		return
 	}
 	defer conn.Close()
 
-	// ack the WRQ
-	ack := wire.PacketAck{BlockNum: 0}
-	_, err := conn.WriteTo(ack.Serialize(), addr)
+	filename, err := rewriteFilename(rewriteRules, request, addr)
+	if err != nil {
+		rejectedRequest(addr, conn)
+		txns <- event.finish("rejected", "Request rejected by rewrite rules")
+		return
+	}
+	event.Filename = filename
+	event.Root, _ = storeFor(addr)
+
+	// check the declared size before opening the sink, which may start a hook
+	accepted, declared := negotiateWriteOptions(request.Options)
+	stored := findHook(filename, wire.OpWRQ) == nil
+	allowance, err := startUpload(addr, declared, stored)
+	if err != nil {
+		sendError(addr, conn, err)
+		txns <- event.finish("rejected", "Declared size exceeds allocation")
+		return
+	}
+	defer allowance.release()
+
+	sink, err := openWriteSink(filename, request, addr)
+	if err != nil {
+		sendError(addr, conn, err)
+		txns <- event.finish("failed", "Unable to open file for writing: "+err.Error())
+		return
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			sink.Abort()
+		}
+	}()
+
+	// answer the WRQ with an OACK if options were accepted, otherwise ACK it
+	bufs := newTransferBuffers(parsing)
+	if accepted != nil {
+		oack := wire.PacketOAck{Options: accepted}
+		bufs.sent = oack.AppendTo(bufs.sent[:0])
+	} else {
+		ack := wire.PacketAck{BlockNum: 0}
+		bufs.sent = ack.AppendTo(bufs.sent[:0])
+	}
+	_, err = conn.WriteTo(bufs.sent, addr)
 	if err != nil {
 		log.Println("Initial ACK failed.  Aborting. error: ", err)
-		txns <- fmt.Sprintf(txnTemplate, txID, "WRITE", "failed", "initial ACK failed")
+		txns <- event.finish("failed", "initial ACK failed")
 		return
 	}
 
-	// loop over new connection waiting for new packets
+	// loop over new connection waiting for new packets.  Block numbers wrap
+	// from 65535 back to 0 on files too big for them.
+	expected := uint16(1)
+	read := tftpReadFrom
 	notDone := true
-	fileContents := ""
 	for notDone {
-		buf, n, err := tftpReadFrom(conn, addr, ack.Serialize())
+		buf, n, err := read(conn, addr, bufs.sent, bufs.read)
+		read = tftpReadFrom
 		if err != nil {
 			if err.Error() == "Errant packet received" {
+				read = tftpReadMore
 				continue
 			} else {
 				log.Println("ReadFrom failed.  Aborting. error: ", err)
-				txns <- fmt.Sprintf(txnTemplate, txID, "WRITE", "failed", "DATA packet read failed.  Check application log")
+				txns <- event.finish("failed", "DATA packet read failed.  Check application log")
 				return
 			}
 		} else {
-			dPacket, err := wire.ParsePacket(buf)
-			if err != nil {
+			dPacket, err := bufs.decoder.Parse(buf[:n])
+			if errors.Is(err, wire.ErrNonconforming) {
+				nonconformingPacket(addr, conn, err)
+				txns <- event.finish("failed", "DATA packet refused by strict parsing: "+err.Error())
+				return
+			} else if err != nil {
 				badPacket(addr, conn, err)
-				txns <- fmt.Sprintf(txnTemplate, txID, "WRITE", "failed", "DATA packet parsing failed.  Check application log")
+				txns <- event.finish("failed", "DATA packet parsing failed.  Check application log")
 				return
 			}
 			data, ok := dPacket.(*wire.PacketData)
 			if !ok {
 				unexpectedPacket(addr, conn, "DATA")
-				txns <- fmt.Sprintf(txnTemplate, txID, "WRITE", "failed", "Received unexpected packet type.  Check application log")
+				txns <- event.finish("failed", "Received unexpected packet type.  Check application log")
+				return
+			}
+			if data.BlockNum != expected {
+				// a retransmit of the last block means our ACK of it was lost, so
+				// ACK it again, but it mustn't be written twice
+				if data.BlockNum == expected-1 {
+					conn.WriteTo(bufs.sent, addr)
+				}
+				read = tftpReadMore
+				continue
+			}
+			expected++
+			event.Bytes += int64(len(data.Data))
+			if err := allowance.add(len(data.Data)); err != nil {
+				sendError(addr, conn, err)
+				txns <- event.finish("failed", "Upload exceeds allocation")
+				return
+			}
+			if _, err := sink.Write(data.Data); err != nil {
+				sendError(addr, conn, err)
+				txns <- event.finish("failed", "Unable to write file: "+err.Error())
 				return
 			}
-			fileContents = fileContents + string(data.Data[:n-4]) // fudge factor for header
-			ack = wire.PacketAck{BlockNum: data.BlockNum}
-			conn.WriteTo(ack.Serialize(), addr)
-			if n < 512 {
+			if len(data.Data) < 512 {
 				notDone = false
+				// the final ACK promises the client its file is safe, so commit first
+				committed = true
+				if err := sink.Commit(); err != nil {
+					sendError(addr, conn, err)
+					txns <- event.finish("failed", "Unable to store file: "+err.Error())
+					return
+				}
 			}
+			ack := wire.PacketAck{BlockNum: data.BlockNum}
+			bufs.sent = ack.AppendTo(bufs.sent[:0])
+			conn.WriteTo(bufs.sent, addr)
 		}
 	}
-	files[request.Filename] = fileContents
-	txns <- fmt.Sprintf(txnTemplate, txID, "WRITE", "success", "<none>")
+	txns <- event.finish("completed", "<none>")
 }
 
 func logTxns(txnFile *os.File, txns chan string) {
@@ -242,30 +436,41 @@ func logTxns(txnFile *os.File, txns chan string) {
 }
 
 func initABit() {
-	files = make(map[string]string, 1000)
+	files = newCASStore()
+}
+
+// subcommands are run instead of the server when named as the first argument
+var subcommands = map[string]func(args []string) int{
+	"chaos":       runChaos,
+	"conformance": runConformance,
+	"inspect":     runInspect,
+	"replay":      runReplay,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+	flag.Parse()
 	initABit()
 
-	// create server
-	server, err := net.ListenPacket("udp", ":9010") //  change to 69 before submit
+	if *configFile != "" {
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatal("Unable to read config file.  error: ", err)
+		}
+		if err := applyConfig(cfg); err != nil {
+			log.Fatal("Invalid config file.  error: ", err)
+		}
+	}
+
+	// create servers
+	listeners, err := openListeners(listenSpecs)
 	if err != nil {
 		fmt.Println(err)
 	} else {
-		defer server.Close()
-
-		// signal handling
-		signals := make(chan os.Signal)
-		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
-
-		keepLooping := true
-		go func() {
-			<-signals
-			server.SetDeadline(time.Now())
-			keepLooping = false
-		}()
-
 		// txn log create
 		ex, err := os.Executable()
 		if err != nil {
@@ -281,43 +486,47 @@ func main() {
 
 		txns := make(chan string)
 		go logTxns(txnFile, txns)
-
-		buf := make([]byte, 2048)
 		txID := int64(0)
-		for keepLooping {
-			_, addr, err := server.ReadFrom(buf)
-			if err != nil {
-				log.Println("Unable to read packet from connection.  Error: ", err)
-				txns <- fmt.Sprintf(txnTemplate, txID, "unknown", "failed", "Initial packet unreadable")
-			} else {
-				packet, err := wire.ParsePacket(buf)
-				if err != nil {
-					// incorrectly formated packet
-					go badPacket(addr, server, err)
-					txns <- fmt.Sprintf(txnTemplate, txID, "unknown", "failed", "Initial packet corrupted")
-				} else {
-					packetRequest, ok := packet.(*wire.PacketRequest)
-					if !ok {
-						log.Println(packet)
-						unexpectedPacket(addr, server, "RRQ or WRQ")
-						txns <- fmt.Sprintf(txnTemplate, txID, "unknown", "failed", "Initial packet not RRQ or WRQ")
-					} else if strings.ToLower(packetRequest.Mode) != "octet" {
-						unsupportedMode(addr, server)
-						txns <- fmt.Sprintf(txnTemplate, txID, "unknown", "failed", "Communication not in OCTET mode")
-					} else if packetRequest.Op == wire.OpRRQ {
-						go opRead(packetRequest, addr, txID, txns)
-					} else if packetRequest.Op == wire.OpWRQ {
-						go opWrite(packetRequest, addr, txID, txns)
-					}
-				}
-			}
-			txID++
+		go reapExpiredFiles(&txID, txns)
+
+		if *adminAddr != "" {
+			go serveAdmin(*adminAddr)
 		}
+
+		var wg sync.WaitGroup
+		for i, server := range listeners {
+			log.Println("Listening on", server.LocalAddr(), "with", listenSpecs[i].parsing, "parsing")
+			wg.Add(1)
+			go serve(server, listenSpecs[i].parsing, &txID, txns, &wg)
+		}
+
+		// signal handling.  Closing the listeners ends their transfers, which
+		// can take a moment to notice, so a second signal doesn't wait for them.
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		for _, server := range listeners {
+			server.Close()
+		}
+		go func() {
+			<-signals
+			log.Println("Quitting without waiting for transfers to end")
+			os.Exit(1)
+		}()
+		wg.Wait()
 	}
 
 	fmt.Println("Full list of files in memory at server quit")
-	for k, _ := range files {
+	for _, k := range files.Names() {
 		fmt.Println("filename: ", k)
 	}
+	for _, root := range rootNames() {
+		if root == "" {
+			continue
+		}
+		for _, k := range rootStores()[root].Names() {
+			fmt.Println("root: ", root, " filename: ", k)
+		}
+	}
 
 }
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"encoding/binary"
 	"errors"
 	wire "github.com/coffeepac/tftp/tftp_wire"
 	"net"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -17,13 +20,13 @@ type MockPacketConn struct {
 }
 
 func (f *MockPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
-	b = f.ReadFromBuf[0]
+	n = copy(b, f.ReadFromBuf[0])
 	addr = f.ReadFromAddr[0]
 	err = f.ReadFromErrors[0]
 	f.ReadFromBuf = f.ReadFromBuf[1:]
 	f.ReadFromAddr = f.ReadFromAddr[1:]
 	f.ReadFromErrors = f.ReadFromErrors[1:]
-	return len(b), nil, nil
+	return n, addr, err
 }
 
 func (f *MockPacketConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
@@ -68,33 +71,26 @@ func (m *MockNetError) Error() string {
 }
 
 func TestNewTIDConnection(t *testing.T) {
-	// check if txn seed is a. needed b. effective
-	conn1 := newTIDConnection(1)
+	// ports must not be predictable, nor handed out twice while in use
+	conn1 := newTIDConnection(nil, nil)
 	if conn1 == nil {
-		t.Errorf("Unable to allocate ephemeral port for conn1.")
+		t.Fatalf("Unable to allocate ephemeral port for conn1.")
 	}
-	conn1.Close()
+	defer conn1.Close()
 
-	conn2 := newTIDConnection(1)
+	conn2 := newTIDConnection(nil, nil)
 	if conn2 == nil {
-		t.Errorf("Unable to allocate ephemeral port for conn2.")
+		t.Fatalf("Unable to allocate ephemeral port for conn2.")
 	}
-	conn2.Close()
+	defer conn2.Close()
 
-	if conn1.LocalAddr().String() != conn2.LocalAddr().String() {
-		t.Errorf("Expected to get same net.Addr value if using same seed to newTIDConnection")
+	if conn1.LocalAddr().String() == conn2.LocalAddr().String() {
+		t.Errorf("Expected to get different net.Addr values from newTIDConnection while both are open")
 	}
-
-	conn3 := newTIDConnection(3)
-	if conn3 == nil {
-		t.Errorf("Unable to allocate ephemeral port for conn3.")
-	}
-	conn3.Close()
-
-	if conn1.LocalAddr().String() == conn3.LocalAddr().String() {
-		t.Errorf("Expected to get different net.Addr value if using different seed to newTIDConnection")
+	port := conn1.LocalAddr().(*net.UDPAddr).Port
+	if port < 49152 || port > 65535 {
+		t.Errorf("Expected a port in the IANA ephemeral range; got %d", port)
 	}
-
 }
 
 func TestMockPacketConn(t *testing.T) {
@@ -139,6 +135,8 @@ func TestErrorPackets(t *testing.T) {
 		t.Errorf("unknownRemoteTID not creating a valid tftp error packet.")
 	} else if unkRemote.Msg != "TID is not known to this server" {
 		t.Errorf("unknownRemoteTID not setting return msg properly.")
+	} else if unkRemote.Code != 5 {
+		t.Errorf("unknownRemoteTID not using the unknown transfer ID error code.")
 	}
 
 	unexpectedPacket(nil, mockConn, "DATA")
@@ -177,7 +175,7 @@ func TestTftpReadFromOpRead(t *testing.T) { // processing ACKs
 	mockConn.ReadFromAddr[0] = addr1
 	mockConn.ReadFromErrors[0] = nil
 
-	data, _, err := tftpReadFrom(mockConn, addr1, nil)
+	data, _, err := tftpReadFrom(mockConn, addr1, nil, make([]byte, 516))
 	if err != nil {
 		t.Errorf("received error, should have been <nil>")
 	} else if data[3] != ack1.Serialize()[3] { //  all single digit BlockNums
@@ -191,7 +189,7 @@ func TestTftpReadFromOpRead(t *testing.T) { // processing ACKs
 	mockConn.ReadFromAddr[0] = addr1
 	mockConn.ReadFromErrors[0] = nil
 
-	data, _, err = tftpReadFrom(mockConn, addr2, nil)
+	data, _, err = tftpReadFrom(mockConn, addr2, nil, make([]byte, 516))
 	if err == nil {
 		t.Errorf("did not receive error, should have. remote TID is unknown")
 	} else if err.Error() != "Errant packet received" {
@@ -208,15 +206,277 @@ func TestTftpReadFromOpRead(t *testing.T) { // processing ACKs
 	mockConn.ReadFromErrors[1] = nil
 
 	dataPack := wire.PacketData{BlockNum: 0, Data: []byte("Murgatroyd")}
-	if mockConn.WriteToBuf != nil {
-		t.Errorf("WriteToBuf has data.  That's wrong.")
-	}
-	data, _, err = tftpReadFrom(mockConn, addr1, dataPack.Serialize())
+	mockConn.WriteToBuf = nil // the unknown TID case above answered with an error
+	data, _, err = tftpReadFrom(mockConn, addr1, dataPack.Serialize(), make([]byte, 516))
 	if err != nil {
 		t.Errorf("received error, should not have.  error: %s", err)
-	} else if string(mockConn.WriteToBuf[4:13]) != "Murgatroyd" {
+	} else if string(mockConn.WriteToBuf[4:14]) != "Murgatroyd" {
 		t.Errorf("Failed to resend correct data.  Sent: %s", mockConn.WriteToBuf)
 	} else if data[3] != ack1.Serialize()[3] { //  all single digit BlockNums
 		t.Errorf("data corrupted by tftpReadFrom")
 	}
 }
+
+// readOverUDP runs opRead for request against a client on the loopback
+// interface, returning the file's contents and any options from an OACK.
+func readOverUDP(t *testing.T, request *wire.PacketRequest) ([]byte, map[string]string, error) {
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	txns := make(chan string, 1)
+	go opRead(request, client.LocalAddr(), newTIDConnection(nil, client.LocalAddr()), wire.ParseDefault, 0, txns)
+
+	var contents []byte
+	var options map[string]string
+	buf := make([]byte, wire.MaxPacketSize)
+	for {
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		n, addr, err := client.ReadFrom(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		packet, err := wire.ParsePacket(buf[:n])
+		if err != nil {
+			return nil, nil, err
+		}
+		switch p := packet.(type) {
+		case *wire.PacketOAck:
+			options = p.Options
+			ack := wire.PacketAck{BlockNum: 0}
+			client.WriteTo(ack.Serialize(), addr)
+		case *wire.PacketData:
+			contents = append(contents, p.Data...)
+			ack := wire.PacketAck{BlockNum: p.BlockNum}
+			client.WriteTo(ack.Serialize(), addr)
+			if len(p.Data) < 512 {
+				<-txns
+				return contents, options, nil
+			}
+		case *wire.PacketError:
+			<-txns
+			return nil, nil, errors.New(p.Msg)
+		default:
+			return nil, nil, errors.New("unexpected packet")
+		}
+	}
+}
+
+// writeOverUDP runs opWrite for request against a client on the loopback
+// interface, sending contents as the file.
+func writeOverUDP(t *testing.T, request *wire.PacketRequest, contents []byte) error {
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	txns := make(chan string, 1)
+	go opWrite(request, client.LocalAddr(), newTIDConnection(nil, client.LocalAddr()), wire.ParseDefault, 0, txns)
+	defer func() { <-txns }()
+
+	blockNum := uint16(0)
+	buf := make([]byte, wire.MaxPacketSize)
+	for {
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		n, addr, err := client.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		packet, err := wire.ParsePacket(buf[:n])
+		if err != nil {
+			return err
+		}
+		// an OACK acknowledges the WRQ just as ACK 0 would
+		var ackNum uint16
+		switch p := packet.(type) {
+		case *wire.PacketOAck:
+		case *wire.PacketAck:
+			ackNum = p.BlockNum
+		case *wire.PacketError:
+			return &tftpError{Code: p.Code, Msg: p.Msg}
+		default:
+			return errors.New("unexpected packet")
+		}
+		if ackNum != blockNum {
+			return errors.New("unexpected ACK")
+		}
+		if blockNum > 0 && len(contents) < 512 {
+			return nil
+		}
+		if blockNum > 0 {
+			contents = contents[512:]
+		}
+		chunk := contents
+		if len(chunk) > 512 {
+			chunk = chunk[:512]
+		}
+		blockNum++
+		data := wire.PacketData{BlockNum: blockNum, Data: chunk}
+		client.WriteTo(data.Serialize(), addr)
+	}
+}
+
+// promptPeer is a PacketConn whose peer answers every packet the moment it is
+// sent: DATA with its ACK, and an ACK with the next of blocks full DATA
+// packets and then an empty one.  It allocates nothing itself, so the
+// allocations of a transfer over it are all the server's.
+type promptPeer struct {
+	addr   *net.UDPAddr
+	blocks int    // full blocks to upload
+	sent   int    // DATA packets uploaded so far
+	next   []byte // the peer's answer to the last packet, to be read next
+	block  []byte
+}
+
+func newPromptPeer(blocks int) *promptPeer {
+	return &promptPeer{
+		addr:   &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2000},
+		blocks: blocks,
+		next:   make([]byte, 0, 516),
+		block:  make([]byte, 512),
+	}
+}
+
+func (p *promptPeer) ReadFrom(b []byte) (int, net.Addr, error) {
+	return copy(b, p.next), p.addr, nil
+}
+
+func (p *promptPeer) WriteTo(b []byte, addr net.Addr) (int, error) {
+	switch {
+	case b[1] == byte(wire.OpData):
+		p.next = append(p.next[:0], 0, byte(wire.OpAck), b[2], b[3])
+	case b[1] == byte(wire.OpAck) || b[1] == byte(wire.OpOAck):
+		p.sent++
+		data := wire.PacketData{BlockNum: uint16(p.sent)}
+		if p.sent <= p.blocks {
+			data.Data = p.block
+		}
+		p.next = data.AppendTo(p.next[:0])
+	}
+	return len(b), nil
+}
+
+func (p *promptPeer) Close() error                       { return nil }
+func (p *promptPeer) LocalAddr() net.Addr                { return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 3000} }
+func (p *promptPeer) SetDeadline(t time.Time) error      { return nil }
+func (p *promptPeer) SetReadDeadline(t time.Time) error  { return nil }
+func (p *promptPeer) SetWriteDeadline(t time.Time) error { return nil }
+
+// rolloverPeer ACKs every DATA sent to it, sending the ACK of block 65535
+// again before the ACK of the block after it, as a peer whose ACK was delayed
+// would once block numbers have rolled over
+type rolloverPeer struct {
+	promptPeer
+	replies  [][]byte
+	received int // DATA packets received
+}
+
+func (p *rolloverPeer) ReadFrom(b []byte) (int, net.Addr, error) {
+	reply := p.replies[0]
+	p.replies = p.replies[1:]
+	return copy(b, reply), p.addr, nil
+}
+
+func (p *rolloverPeer) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if b[1] == byte(wire.OpData) {
+		p.received++
+		blockNum := binary.BigEndian.Uint16(b[2:])
+		if blockNum == 0 {
+			late := wire.PacketAck{BlockNum: 65535}
+			p.replies = append(p.replies, late.Serialize())
+		}
+		ack := wire.PacketAck{BlockNum: blockNum}
+		p.replies = append(p.replies, ack.Serialize())
+	}
+	return len(b), nil
+}
+
+func TestReadRollsOverWithLateAck(t *testing.T) {
+	if testing.Short() {
+		t.Skip("moves 32MB")
+	}
+	defer initABit()
+	files = newCASStore()
+	files.Write("big.bin", strings.Repeat("x", 65537*512+10), "")
+	peer := &rolloverPeer{promptPeer: *newPromptPeer(0)}
+	txns := make(chan string, 1)
+	request := &wire.PacketRequest{Op: wire.OpRRQ, Filename: "big.bin", Mode: "octet"}
+	opRead(request, peer.addr, peer, wire.ParseDefault, 0, txns)
+	if txn := <-txns; !strings.Contains(txn, "success") {
+		t.Errorf("Expected the read to survive a late ACK after rollover; got %q", txn)
+	}
+	if peer.received != 65538 {
+		t.Errorf("Expected 65538 blocks; got %d", peer.received)
+	}
+}
+
+// transferAllocs counts the allocations of reading or writing a file of blocks
+// full blocks over a promptPeer
+func transferAllocs(t *testing.T, op uint16, blocks int) float64 {
+	files = newCASStore()
+	files.Write("blocks.bin", strings.Repeat("x", blocks*512), "")
+	txns := make(chan string, 1)
+	request := &wire.PacketRequest{Op: op, Filename: "blocks.bin", Mode: "octet"}
+	return testing.AllocsPerRun(5, func() {
+		if op == wire.OpRRQ {
+			opRead(request, newPromptPeer(0).addr, newPromptPeer(blocks), wire.ParseDefault, 0, txns)
+		} else {
+			opWrite(request, newPromptPeer(0).addr, newPromptPeer(blocks), wire.ParseDefault, 0, txns)
+		}
+		if txn := <-txns; !strings.Contains(txn, "success") && !strings.Contains(txn, "completed") {
+			t.Fatalf("Transfer failed: %s", txn)
+		}
+	})
+}
+
+func TestBlocksDoNotAllocate(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations can't be counted under the race detector")
+	}
+	defer initABit()
+	short, long := transferAllocs(t, wire.OpRRQ, 10), transferAllocs(t, wire.OpRRQ, 1000)
+	if long > short {
+		t.Errorf("Expected reading blocks to allocate nothing; 990 more blocks made %.0f more allocations", long-short)
+	}
+	// uploads to the store grow its buffer, which takes a few allocations per
+	// doubling but none for the packets
+	short, long = transferAllocs(t, wire.OpWRQ, 10), transferAllocs(t, wire.OpWRQ, 1000)
+	if long-short > 20 {
+		t.Errorf("Expected writing blocks to allocate nothing per block; 990 more blocks made %.0f more allocations", long-short)
+	}
+}
+
+// benchmarkTransfer moves a 1MB file per op, reporting allocations per block
+func benchmarkTransfer(b *testing.B, op uint16) {
+	defer initABit()
+	const blocks = 2048
+	files = newCASStore()
+	files.Write("blocks.bin", strings.Repeat("x", blocks*512), "")
+	txns := make(chan string, 1)
+	request := &wire.PacketRequest{Op: op, Filename: "blocks.bin", Mode: "octet"}
+	b.SetBytes(blocks * 512)
+	b.ReportAllocs()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < b.N; i++ {
+		if op == wire.OpRRQ {
+			opRead(request, newPromptPeer(0).addr, newPromptPeer(blocks), wire.ParseDefault, 0, txns)
+		} else {
+			opWrite(request, newPromptPeer(0).addr, newPromptPeer(blocks), wire.ParseDefault, 0, txns)
+		}
+		<-txns
+	}
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(b.N*(blocks+1)), "allocs/block")
+}
+
+func BenchmarkRead(b *testing.B) {
+	benchmarkTransfer(b, wire.OpRRQ)
+}
+
+func BenchmarkWrite(b *testing.B) {
+	benchmarkTransfer(b, wire.OpWRQ)
+}
@@ -0,0 +1,122 @@
+package memnet
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is a virtual clock.  Time only passes when Advance is called, or when
+// a Network with auto-advance finds everything waiting on it.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*timer // sorted by when, then by creation
+	seq    uint64
+}
+
+type timer struct {
+	when    time.Time
+	seq     uint64
+	f       func()
+	stopped bool
+}
+
+// NewClock returns a clock reading start
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// Now returns the virtual time
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d, running the timers that fall due in
+// order
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	until := c.now.Add(d)
+	c.mu.Unlock()
+	for c.runNext(until) {
+	}
+	c.mu.Lock()
+	if until.After(c.now) {
+		c.now = until
+	}
+	c.mu.Unlock()
+}
+
+// AdvanceToNext moves the clock to the next timer and runs it, returning
+// false if there are no timers
+func (c *Clock) AdvanceToNext() bool {
+	c.mu.Lock()
+	c.dropStopped()
+	if len(c.timers) == 0 {
+		c.mu.Unlock()
+		return false
+	}
+	until := c.timers[0].when
+	c.mu.Unlock()
+	for c.runNext(until) {
+	}
+	return true
+}
+
+// runNext runs the earliest timer due by until, reporting whether there was one
+func (c *Clock) runNext(until time.Time) bool {
+	c.mu.Lock()
+	c.dropStopped()
+	if len(c.timers) == 0 || c.timers[0].when.After(until) {
+		c.mu.Unlock()
+		return false
+	}
+	t := c.timers[0]
+	c.timers = c.timers[1:]
+	if t.when.After(c.now) {
+		c.now = t.when
+	}
+	c.mu.Unlock()
+	t.f()
+	return true
+}
+
+// dropStopped forgets stopped timers at the front of the queue.  The caller
+// must hold the lock.
+func (c *Clock) dropStopped() {
+	for len(c.timers) > 0 && c.timers[0].stopped {
+		c.timers = c.timers[1:]
+	}
+}
+
+// afterFunc runs f once the clock has advanced by d
+func (c *Clock) afterFunc(d time.Duration, f func()) *timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t := &timer{when: c.now.Add(d), seq: c.seq, f: f}
+	i := sort.Search(len(c.timers), func(i int) bool {
+		other := c.timers[i]
+		return other.when.After(t.when) || (other.when.Equal(t.when) && other.seq > t.seq)
+	})
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+	return t
+}
+
+func (c *Clock) stop(t *timer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.stopped = true
+}
+
+// pending reports whether any timers are waiting to run
+func (c *Clock) pending() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropStopped()
+	return len(c.timers) > 0
+}
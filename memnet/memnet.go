@@ -0,0 +1,380 @@
+// Package memnet is an in-memory packet network for testing.  Its endpoints
+// are net.PacketConns that can lose, duplicate, reorder, delay and corrupt
+// packets at configurable rates, chosen by a seeded random source so that a
+// run can be reproduced.  Time is kept by a virtual clock, so delays and read
+// deadlines resolve as soon as every goroutine registered with the network is
+// waiting on them instead of in real time.
+package memnet
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Conditions describe how a network mistreats the packets sent over it.
+// Rates are probabilities between 0 and 1.
+type Conditions struct {
+	Loss      float64       // a packet is dropped
+	Duplicate float64       // a packet is delivered twice
+	Reorder   float64       // a packet is held back until after the next one on its link
+	Corrupt   float64       // a bit of the packet is flipped
+	Delay     time.Duration // added to every packet
+	Jitter    time.Duration // up to this much more is added at random
+}
+
+// Filter decides the fate of each packet before Conditions are applied,
+// returning false to drop it.  It is for scripting particular losses, such as
+// the third ACK of a transfer.
+type Filter func(from, to net.Addr, packet []byte) bool
+
+// firstEphemeralPort is where ports picked for Listen on port 0 start
+const firstEphemeralPort = 49152
+
+// Network connects the Conns listening on it
+type Network struct {
+	Clock *Clock
+
+	sched      *scheduler
+	mu         sync.Mutex
+	rng        *rand.Rand
+	conns      map[string]*Conn
+	conditions Conditions
+	links      map[[2]string]Conditions // by source and destination IP
+	held       map[[2]string]*delivery  // packets held back for reordering, by link
+	filter     Filter
+	nextPort   int
+}
+
+type delivery struct {
+	from   *net.UDPAddr
+	to     string
+	packet []byte
+	timer  *timer
+}
+
+// New returns a network whose randomness comes from seed and whose clock
+// starts at the current time.  If autoAdvance is set the clock moves on by
+// itself whenever every goroutine registered with the network is blocked in
+// it, so timeouts fire at once.  Close stops it.
+func New(seed int64, autoAdvance bool) *Network {
+	n := &Network{
+		Clock:    NewClock(time.Now()),
+		sched:    newScheduler(),
+		rng:      rand.New(rand.NewSource(seed)),
+		conns:    make(map[string]*Conn),
+		links:    make(map[[2]string]Conditions),
+		held:     make(map[[2]string]*delivery),
+		nextPort: firstEphemeralPort,
+	}
+	if autoAdvance {
+		go n.advanceWhenBlocked()
+	}
+	return n
+}
+
+// Close stops the network advancing its clock
+func (n *Network) Close() {
+	n.sched.close()
+}
+
+// SetConditions sets how every link without its own conditions behaves
+func (n *Network) SetConditions(c Conditions) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.conditions = c
+}
+
+// SetLinkConditions sets how packets from the host fromIP to the host toIP
+// are treated, overriding SetConditions
+func (n *Network) SetLinkConditions(fromIP, toIP string, c Conditions) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links[[2]string{fromIP, toIP}] = c
+}
+
+// SetFilter installs f to see every packet sent, or removes it if f is nil
+func (n *Network) SetFilter(f Filter) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.filter = f
+}
+
+// Listen opens a Conn on address, an IP and port.  Port 0 picks a free one.
+func (n *Network) Listen(address string) (*Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP == nil {
+		return nil, errors.New("memnet: an address needs an IP")
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if addr.Port == 0 {
+		for ; n.conns[(&net.UDPAddr{IP: addr.IP, Port: n.nextPort}).String()] != nil; n.nextPort++ {
+		}
+		addr.Port = n.nextPort
+		n.nextPort++
+	}
+	key := addr.String()
+	if _, ok := n.conns[key]; ok {
+		return nil, errors.New("memnet: address already in use: " + key)
+	}
+	conn := &Conn{network: n, addr: addr}
+	conn.wake = sync.NewCond(&conn.mu)
+	n.conns[key] = conn
+	return conn, nil
+}
+
+// send carries packet from one Conn towards the address to
+func (n *Network) send(from *net.UDPAddr, to net.Addr, packet []byte) {
+	toUDP, ok := to.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.filter != nil && !n.filter(from, to, packet) {
+		return
+	}
+	link := [2]string{from.IP.String(), toUDP.IP.String()}
+	c, ok := n.links[link]
+	if !ok {
+		c = n.conditions
+	}
+	if n.chance(c.Loss) {
+		return
+	}
+	packet = append([]byte(nil), packet...)
+	if len(packet) > 0 && n.chance(c.Corrupt) {
+		bit := n.rng.Intn(len(packet) * 8)
+		packet[bit/8] ^= 1 << uint(bit%8)
+	}
+	copies := 1
+	if n.chance(c.Duplicate) {
+		copies = 2
+	}
+
+	held := n.held[link]
+	delete(n.held, link)
+	for i := 0; i < copies; i++ {
+		d := &delivery{from: from, to: toUDP.String(), packet: packet}
+		if i == 0 && held == nil && n.chance(c.Reorder) {
+			// hold it back until the next packet on the link, or for a while
+			// if there isn't one
+			n.held[link] = d
+			d.timer = n.Clock.afterFunc(c.Delay+c.Jitter+time.Millisecond, func() { n.releaseHeld(link, d) })
+			continue
+		}
+		n.schedule(d, c)
+	}
+	if held != nil {
+		n.Clock.stop(held.timer)
+		n.schedule(held, c)
+	}
+}
+
+// schedule delivers d after the link's delay.  The caller must hold the lock.
+func (n *Network) schedule(d *delivery, c Conditions) {
+	delay := c.Delay
+	if c.Jitter > 0 {
+		delay += time.Duration(n.rng.Int63n(int64(c.Jitter)))
+	}
+	if delay <= 0 {
+		n.deliver(d)
+		return
+	}
+	n.Clock.afterFunc(delay, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.deliver(d)
+	})
+}
+
+func (n *Network) releaseHeld(link [2]string, d *delivery) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.held[link] == d {
+		delete(n.held, link)
+		n.deliver(d)
+	}
+}
+
+// deliver queues d on the Conn it's addressed to, if there is one.  The
+// caller must hold the lock.
+func (n *Network) deliver(d *delivery) {
+	if conn, ok := n.conns[d.to]; ok {
+		conn.enqueue(d.from, d.packet)
+	}
+}
+
+// chance returns true with probability p.  The caller must hold the lock.
+func (n *Network) chance(p float64) bool {
+	return p > 0 && n.rng.Float64() < p
+}
+
+func (n *Network) remove(c *Conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conns[c.addr.String()] == c {
+		delete(n.conns, c.addr.String())
+	}
+}
+
+// Conn is an endpoint on a Network.  It implements net.PacketConn, with
+// deadlines given in real time converted to the network's virtual clock.
+type Conn struct {
+	network *Network
+	addr    *net.UDPAddr
+
+	mu       sync.Mutex
+	queue    []queued
+	deadline time.Time // virtual
+	writeBy  time.Time // virtual write deadline
+	timer    *timer
+	closed   bool
+	waiting  int        // reads blocked for a packet or their deadline
+	wake     *sync.Cond // signalled for each waiting read woken
+}
+
+type queued struct {
+	from   net.Addr
+	packet []byte
+}
+
+func (c *Conn) enqueue(from net.Addr, packet []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.queue = append(c.queue, queued{from: from, packet: packet})
+	c.signal()
+}
+
+// signal wakes a waiting ReadFrom, counting its goroutine as running again.
+// The caller must hold the lock.
+func (c *Conn) signal() {
+	if c.waiting > 0 {
+		c.waiting--
+		c.network.sched.wake()
+		c.wake.Signal()
+	}
+}
+
+// ReadFrom returns the next packet sent to c
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.closed {
+			return 0, nil, net.ErrClosed
+		}
+		if len(c.queue) > 0 {
+			next := c.queue[0]
+			c.queue = c.queue[1:]
+			return copy(b, next.packet), next.from, nil
+		}
+		if !c.deadline.IsZero() && !c.network.Clock.Now().Before(c.deadline) {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		c.waiting++
+		c.network.sched.block()
+		c.wake.Wait()
+	}
+}
+
+// WriteTo sends b to addr.  Like UDP it succeeds whether or not anything
+// is listening there, but it fails once the write deadline has passed.
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	closed := c.closed
+	late := !c.writeBy.IsZero() && !c.network.Clock.Now().Before(c.writeBy)
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	if late {
+		return 0, os.ErrDeadlineExceeded
+	}
+	c.network.send(c.addr, addr, b)
+	return len(b), nil
+}
+
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	for c.waiting > 0 {
+		c.signal()
+	}
+	c.mu.Unlock()
+	c.network.remove(c)
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline sets both the read and write deadlines, as it does for a UDP
+// connection
+func (c *Conn) SetDeadline(t time.Time) error {
+	d := time.Until(t)
+	c.setReadDeadline(t.IsZero(), d)
+	c.setWriteDeadline(t.IsZero(), d)
+	return nil
+}
+
+// SetReadDeadline sets when reads time out.  t is in real time, as callers
+// compute it from time.Now, and is taken as the same distance from the
+// virtual clock's current time.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.setReadDeadline(t.IsZero(), time.Until(t))
+	return nil
+}
+
+// SetWriteDeadline sets when writes start failing.  Writes never block, so
+// unlike reads they aren't woken when it passes.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.setWriteDeadline(t.IsZero(), time.Until(t))
+	return nil
+}
+
+// setReadDeadline sets the read deadline d from now on the virtual clock,
+// or clears it
+func (c *Conn) setReadDeadline(clear bool, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.network.Clock.stop(c.timer)
+		c.timer = nil
+	}
+	if clear {
+		c.deadline = time.Time{}
+		return
+	}
+	c.deadline = c.network.Clock.Now().Add(d)
+	c.timer = c.network.Clock.afterFunc(d, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.signal()
+	})
+}
+
+func (c *Conn) setWriteDeadline(clear bool, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if clear {
+		c.writeBy = time.Time{}
+	} else {
+		c.writeBy = c.network.Clock.Now().Add(d)
+	}
+}
@@ -0,0 +1,304 @@
+package memnet
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// pair opens a Conn on each of two hosts, and registers the test's goroutine
+// with n as it reads from them
+func pair(t *testing.T, n *Network) (*Conn, *Conn) {
+	n.Enter()
+	t.Cleanup(n.Leave)
+	a, err := n.Listen("10.0.0.1:69")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := n.Listen("10.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+// receive reads every packet that arrives at c within timeout of virtual time
+func receive(c *Conn, timeout time.Duration) []string {
+	var packets []string
+	buf := make([]byte, 100)
+	for {
+		c.SetReadDeadline(time.Now().Add(timeout))
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	n := New(1, true)
+	defer n.Close()
+	a, b := pair(t, n)
+
+	b.WriteTo([]byte("hello"), a.LocalAddr())
+	buf := make([]byte, 3)
+	count, from, err := a.ReadFrom(buf)
+	if err != nil || count != 3 || string(buf) != "hel" {
+		t.Errorf("Expected a truncated read of the packet; got %d %q %v", count, buf, err)
+	}
+	if from.String() != b.LocalAddr().String() {
+		t.Errorf("Expected packet from %s; got %s", b.LocalAddr(), from)
+	}
+	if port := b.LocalAddr().(*net.UDPAddr).Port; port != firstEphemeralPort {
+		t.Errorf("Expected the first ephemeral port; got %d", port)
+	}
+	if _, err := n.Listen("10.0.0.1:69"); err == nil {
+		t.Errorf("Expected a second listener on the same address to fail")
+	}
+}
+
+func TestDeadlinesUseVirtualTime(t *testing.T) {
+	n := New(1, true)
+	defer n.Close()
+	a, _ := pair(t, n)
+
+	virtualStart, realStart := n.Clock.Now(), time.Now()
+	a.SetDeadline(time.Now().Add(time.Hour))
+	_, _, err := a.ReadFrom(make([]byte, 10))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected a timeout; got %v", err)
+	}
+	if nErr, ok := err.(net.Error); !ok || !nErr.Timeout() {
+		t.Errorf("Expected the timeout to be a net.Error")
+	}
+	if elapsed := n.Clock.Now().Sub(virtualStart); elapsed < 59*time.Minute {
+		t.Errorf("Expected about an hour of virtual time to pass; %s did", elapsed)
+	}
+	if elapsed := time.Since(realStart); elapsed > 10*time.Second {
+		t.Errorf("Expected the timeout to resolve quickly; took %s", elapsed)
+	}
+
+	// SetDeadline covers writes too, just as it does on a real socket
+	if _, err := a.WriteTo([]byte("late"), a.LocalAddr()); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected a write after the deadline to fail; got %v", err)
+	}
+	a.SetReadDeadline(time.Now().Add(time.Hour))
+	if _, err := a.WriteTo([]byte("late"), a.LocalAddr()); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected a new read deadline to leave the write deadline alone; got %v", err)
+	}
+	a.SetWriteDeadline(time.Time{})
+	if _, err := a.WriteTo([]byte("on time"), a.LocalAddr()); err != nil {
+		t.Errorf("Expected clearing the write deadline to allow writes; got %v", err)
+	}
+}
+
+func TestClockWaitsForRegisteredGoroutines(t *testing.T) {
+	n := New(1, true)
+	defer n.Close()
+	a, b := pair(t, n)
+
+	// a registered goroutine that is busy outside the network holds the clock
+	// back, however long it takes in real time
+	release := make(chan struct{})
+	n.Go(func() {
+		<-release
+		b.WriteTo([]byte("late"), a.LocalAddr())
+	})
+	time.AfterFunc(20*time.Millisecond, func() { close(release) })
+	if received := receive(a, time.Second); len(received) != 1 || received[0] != "late" {
+		t.Errorf("Expected the busy goroutine's packet before the deadline; got %q", received)
+	}
+
+	// one sleeping on the clock doesn't
+	start := n.Clock.Now()
+	n.Go(func() {
+		n.Sleep(time.Minute)
+		b.WriteTo([]byte("awake"), a.LocalAddr())
+	})
+	if received := receive(a, 2*time.Minute); len(received) != 1 || received[0] != "awake" {
+		t.Errorf("Expected the sleeping goroutine's packet; got %q", received)
+	}
+	if elapsed := n.Clock.Now().Sub(start); elapsed < 2*time.Minute {
+		t.Errorf("Expected the clock to run on through the sleep and deadline; %s passed", elapsed)
+	}
+}
+
+func TestSettle(t *testing.T) {
+	n := New(1, true)
+	defer n.Close()
+	a, _ := n.Listen("10.0.0.1:69")
+	b, _ := n.Listen("10.0.0.2:0")
+
+	start := n.Clock.Now()
+	n.Go(func() {
+		n.Sleep(time.Hour)
+		b.WriteTo([]byte("done"), a.LocalAddr())
+		b.SetReadDeadline(time.Now().Add(time.Minute))
+		b.ReadFrom(make([]byte, 10))
+	})
+	n.Go(func() {
+		a.ReadFrom(make([]byte, 10))
+		a.ReadFrom(make([]byte, 10)) // never answered
+	})
+	n.Settle()
+	if elapsed := n.Clock.Now().Sub(start); elapsed < time.Hour+59*time.Second {
+		t.Errorf("Expected to settle once the sleep and deadline had passed; %s did", elapsed)
+	}
+}
+
+func TestConditions(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions Conditions
+		expected   []string
+	}{
+		{"clean", Conditions{}, []string{"one", "two"}},
+		{"loss", Conditions{Loss: 1}, nil},
+		{"duplicate", Conditions{Duplicate: 1}, []string{"one", "one", "two", "two"}},
+		{"reorder", Conditions{Reorder: 1}, []string{"two", "one"}},
+		{"delay", Conditions{Delay: time.Minute}, []string{"one", "two"}},
+	}
+
+	for _, test := range tests {
+		n := New(1, true)
+		a, b := pair(t, n)
+		n.SetConditions(test.conditions)
+		start := n.Clock.Now()
+		b.WriteTo([]byte("one"), a.LocalAddr())
+		b.WriteTo([]byte("two"), a.LocalAddr())
+		received := receive(a, 2*time.Minute)
+		if len(received) != len(test.expected) {
+			t.Errorf("%s: expected %q; got %q", test.name, test.expected, received)
+		} else {
+			for i := range received {
+				if received[i] != test.expected[i] {
+					t.Errorf("%s: expected %q; got %q", test.name, test.expected, received)
+					break
+				}
+			}
+		}
+		if test.conditions.Delay > 0 && n.Clock.Now().Sub(start) < test.conditions.Delay {
+			t.Errorf("%s: expected packets to take a minute to arrive", test.name)
+		}
+		n.Close()
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	n := New(1, true)
+	defer n.Close()
+	a, b := pair(t, n)
+	n.SetConditions(Conditions{Corrupt: 1})
+
+	sent := []byte("pristine")
+	b.WriteTo(sent, a.LocalAddr())
+	received := receive(a, time.Second)
+	if len(received) != 1 || received[0] == string(sent) || len(received[0]) != len(sent) {
+		t.Fatalf("Expected one corrupted packet; got %q", received)
+	}
+	flipped := 0
+	for i := range sent {
+		for diff := sent[i] ^ received[0][i]; diff != 0; diff &= diff - 1 {
+			flipped++
+		}
+	}
+	if flipped != 1 {
+		t.Errorf("Expected one bit to be flipped; %d were", flipped)
+	}
+	if string(sent) != "pristine" {
+		t.Errorf("Corruption changed the sender's buffer")
+	}
+}
+
+func TestLinkConditionsAndFilter(t *testing.T) {
+	n := New(1, true)
+	defer n.Close()
+	a, b := pair(t, n)
+	n.SetLinkConditions("10.0.0.2", "10.0.0.1", Conditions{Loss: 1})
+
+	b.WriteTo([]byte("lost"), a.LocalAddr())
+	a.WriteTo([]byte("kept"), b.LocalAddr())
+	if received := receive(a, time.Second); len(received) != 0 {
+		t.Errorf("Expected the lossy link to drop everything; got %q", received)
+	}
+	if received := receive(b, time.Second); len(received) != 1 {
+		t.Errorf("Expected the other direction to be clean; got %q", received)
+	}
+
+	n.SetFilter(func(from, to net.Addr, packet []byte) bool {
+		return !bytes.Equal(packet, []byte("drop me"))
+	})
+	a.WriteTo([]byte("drop me"), b.LocalAddr())
+	a.WriteTo([]byte("keep me"), b.LocalAddr())
+	if received := receive(b, time.Second); len(received) != 1 || received[0] != "keep me" {
+		t.Errorf("Expected the filter to drop one packet; got %q", received)
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	run := func(seed int64) []string {
+		n := New(seed, true)
+		defer n.Close()
+		a, b := pair(t, n)
+		n.SetConditions(Conditions{Loss: 0.5})
+		for _, p := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+			b.WriteTo([]byte(p), a.LocalAddr())
+		}
+		return receive(a, time.Second)
+	}
+	first, second := run(42), run(42)
+	if len(first) != len(second) {
+		t.Fatalf("Expected the same seed to lose the same packets; got %q and %q", first, second)
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Expected the same seed to lose the same packets; got %q and %q", first, second)
+		}
+	}
+}
+
+func TestClosedConn(t *testing.T) {
+	n := New(1, false)
+	defer n.Close()
+	a, b := pair(t, n)
+
+	done := make(chan error)
+	go func() {
+		_, _, err := a.ReadFrom(make([]byte, 10))
+		done <- err
+	}()
+	a.Close()
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected a blocked read to end when its Conn is closed; got %v", err)
+	}
+	if _, err := a.WriteTo([]byte("x"), b.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected writing to a closed Conn to fail; got %v", err)
+	}
+	if _, err := n.Listen("10.0.0.1:69"); err != nil {
+		t.Errorf("Expected a closed Conn's address to be free again; got %s", err)
+	}
+}
+
+func TestClockAdvance(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	var fired []int
+	clock.afterFunc(3*time.Second, func() { fired = append(fired, 3) })
+	clock.afterFunc(time.Second, func() { fired = append(fired, 1) })
+	stopped := clock.afterFunc(2*time.Second, func() { fired = append(fired, 2) })
+	clock.stop(stopped)
+
+	clock.Advance(2 * time.Second)
+	if len(fired) != 1 || fired[0] != 1 || !clock.Now().Equal(time.Unix(2, 0)) {
+		t.Errorf("Expected only the first timer to fire by 2s; got %v at %s", fired, clock.Now())
+	}
+	if !clock.AdvanceToNext() || len(fired) != 2 || !clock.Now().Equal(time.Unix(3, 0)) {
+		t.Errorf("Expected to jump to the timer at 3s; got %v at %s", fired, clock.Now())
+	}
+	if clock.AdvanceToNext() {
+		t.Errorf("Expected no timers left")
+	}
+}
@@ -0,0 +1,130 @@
+package memnet
+
+import (
+	"sync"
+	"time"
+)
+
+// scheduler counts the goroutines registered with a network, and how many of
+// them are running rather than blocked in it.  A goroutine woken from a read or
+// Sleep is counted as running again by whatever wakes it, so the count never
+// reads zero while a wakeup is on its way.
+type scheduler struct {
+	mu         sync.Mutex
+	changed    *sync.Cond
+	registered int
+	running    int
+	generation uint64 // bumped on every change, for the advancer to wait on
+	stuck      bool   // the clock had no timers left to run at stuckAt
+	stuckAt    uint64 // generation
+	closed     bool
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{}
+	s.changed = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *scheduler) update(registered, running int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registered += registered
+	s.running += running
+	s.generation++
+	s.changed.Broadcast()
+}
+
+// block counts a registered goroutine as blocked in the network
+func (s *scheduler) block() {
+	s.update(0, -1)
+}
+
+// wake counts a blocked goroutine as running again
+func (s *scheduler) wake() {
+	s.update(0, 1)
+}
+
+// settled reports whether every registered goroutine is blocked with no timer
+// left to wake it.  The caller must hold the lock.
+func (s *scheduler) settled() bool {
+	return s.stuck && s.stuckAt == s.generation
+}
+
+func (s *scheduler) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.changed.Broadcast()
+}
+
+// Go runs f in a new goroutine registered with the network.  The clock only
+// advances by itself while every registered goroutine is blocked reading from
+// a Conn or in Sleep.  Every goroutine using a Network with auto-advance
+// should be registered, with Go or Enter, or the clock may move on while it is
+// busy.
+func (n *Network) Go(f func()) {
+	n.sched.update(1, 1)
+	go func() {
+		defer n.sched.update(-1, -1)
+		f()
+	}()
+}
+
+// Enter registers the calling goroutine, as Go does, until it calls Leave
+func (n *Network) Enter() {
+	n.sched.update(1, 1)
+}
+
+func (n *Network) Leave() {
+	n.sched.update(-1, -1)
+}
+
+// Settle waits, from a goroutine that isn't registered, until every one that
+// is has blocked in the network with no timer left to wake it: as far as
+// things can go without more packets being sent.  It needs auto-advance to get
+// there, and returns at once if nothing is registered.
+func (n *Network) Settle() {
+	s := n.sched
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.closed && s.registered > 0 && !s.settled() {
+		s.changed.Wait()
+	}
+}
+
+// Sleep pauses the calling goroutine, which must be registered, for d on the
+// network's clock
+func (n *Network) Sleep(d time.Duration) {
+	woken := make(chan struct{})
+	n.Clock.afterFunc(d, func() {
+		n.sched.wake()
+		close(woken)
+	})
+	n.sched.block()
+	<-woken
+}
+
+// advanceWhenBlocked moves the clock to its next timer whenever every
+// registered goroutine is blocked in the network.  If there's no timer to wake
+// any of them it waits for something else to change.
+func (n *Network) advanceWhenBlocked() {
+	s := n.sched
+	for {
+		s.mu.Lock()
+		for !s.closed && (s.registered == 0 || s.running > 0 || s.settled()) {
+			s.changed.Wait()
+		}
+		closed, generation := s.closed, s.generation
+		s.mu.Unlock()
+		if closed {
+			return
+		}
+		if !n.Clock.AdvanceToNext() {
+			s.mu.Lock()
+			s.stuck, s.stuckAt = true, generation
+			s.changed.Broadcast()
+			s.mu.Unlock()
+		}
+	}
+}
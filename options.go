@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strconv"
+)
+
+// negotiateReadOptions picks the options of a RRQ that this server will honour
+// for a file of size bytes, returning nil if none were accepted and so no OACK
+// should be sent.  Options we don't understand are dropped, as RFC2347 allows.
+func negotiateReadOptions(requested map[string]string, size int64) map[string]string {
+	var accepted map[string]string
+	if _, ok := requested["tsize"]; ok && size >= 0 {
+		// RFC2349: the client sends 0 in a RRQ and the server answers with the size
+		accepted = map[string]string{"tsize": strconv.FormatInt(size, 10)}
+	}
+	return accepted
+}
+
+// negotiateWriteOptions picks the options of a WRQ that this server will
+// honour, returning nil if none were accepted and so a plain ACK should be
+// sent.  The size is the file size the client declared with tsize, or -1.
+func negotiateWriteOptions(requested map[string]string) (map[string]string, int64) {
+	var accepted map[string]string
+	size := int64(-1)
+	if tsize, ok := requested["tsize"]; ok {
+		// RFC2349: the client sends the size in a WRQ and the server echoes it
+		if n, err := strconv.ParseInt(tsize, 10, 64); err == nil && n >= 0 {
+			accepted = map[string]string{"tsize": tsize}
+			size = n
+		}
+	}
+	if ttl, ok := requested["ttl"]; ok {
+		// our own option: seconds the uploaded file should be kept for
+		if _, ok := parseTTLOption(ttl); ok {
+			if accepted == nil {
+				accepted = make(map[string]string)
+			}
+			accepted["ttl"] = ttl
+		}
+	}
+	return accepted, size
+}
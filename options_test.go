@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateReadOptions(t *testing.T) {
+	tests := []struct {
+		requested map[string]string
+		size      int64
+		expected  map[string]string
+	}{
+		{nil, 10, nil},
+		{map[string]string{"tsize": "0"}, 1234, map[string]string{"tsize": "1234"}},
+		{map[string]string{"tsize": "0", "madeup": "1"}, 0, map[string]string{"tsize": "0"}},
+		{map[string]string{"madeup": "1"}, 10, nil},
+		{map[string]string{"tsize": "0"}, -1, nil},
+	}
+
+	for _, test := range tests {
+		actual := negotiateReadOptions(test.requested, test.size)
+		if !reflect.DeepEqual(test.expected, actual) {
+			t.Errorf("Negotiating %#v for size %d: expected %#v; got %#v", test.requested, test.size, test.expected, actual)
+		}
+	}
+}
+
+func TestNegotiateWriteOptions(t *testing.T) {
+	tests := []struct {
+		requested map[string]string
+		expected  map[string]string
+		size      int64
+	}{
+		{nil, nil, -1},
+		{map[string]string{"tsize": "2048"}, map[string]string{"tsize": "2048"}, 2048},
+		{map[string]string{"tsize": "2048", "madeup": "1"}, map[string]string{"tsize": "2048"}, 2048},
+		{map[string]string{"tsize": "lots"}, nil, -1},
+		{map[string]string{"tsize": "-5"}, nil, -1},
+		{map[string]string{"ttl": "3600"}, map[string]string{"ttl": "3600"}, -1},
+		{map[string]string{"tsize": "10", "ttl": "0"}, map[string]string{"tsize": "10"}, 10},
+	}
+
+	for _, test := range tests {
+		actual, size := negotiateWriteOptions(test.requested)
+		if !reflect.DeepEqual(test.expected, actual) || size != test.size {
+			t.Errorf("Negotiating %#v: expected %#v, %d; got %#v, %d", test.requested, test.expected, test.size, actual, size)
+		}
+	}
+}
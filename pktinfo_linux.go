@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// packetInfoSpace is room for the control messages carrying a packet's
+// destination address.  A dual-stack socket has both options enabled, so it
+// holds one of each family.
+var packetInfoSpace = syscall.CmsgSpace(syscall.SizeofInet4Pktinfo) + syscall.CmsgSpace(syscall.SizeofInet6Pktinfo)
+
+// enablePacketInfo asks the kernel to report the destination address of each
+// packet received on conn.  A dual-stack socket needs both options, one for
+// each family of packet it receives.
+func enablePacketInfo(conn *net.UDPConn, network string) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if network != "udp6" {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+		}
+		if network != "udp4" {
+			if err6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1); err6 != nil || network == "udp6" {
+				sockErr = err6
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// packetDestination pulls the local address a packet was sent to out of the
+// control messages received with it, or returns nil if they don't say.
+func packetDestination(oob []byte) *net.UDPAddr {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.IPPROTO_IP && msg.Header.Type == syscall.IP_PKTINFO && len(msg.Data) >= syscall.SizeofInet4Pktinfo:
+			// ipi_spec_dst is the address replies should come from, which
+			// unlike ipi_addr is never a broadcast address
+			return &net.UDPAddr{IP: net.IP(append([]byte(nil), msg.Data[4:8]...))}
+		case msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == syscall.IPV6_PKTINFO && len(msg.Data) >= syscall.SizeofInet6Pktinfo:
+			addr := &net.UDPAddr{IP: net.IP(append([]byte(nil), msg.Data[:16]...))}
+			if addr.IP.IsLinkLocalUnicast() {
+				addr.Zone = strconv.Itoa(int(binary.NativeEndian.Uint32(msg.Data[16:20])))
+			}
+			return addr
+		}
+	}
+	return nil
+}
+
+// packetSource builds the control message that sends a packet from local, the
+// counterpart of packetDestination for replies on a wildcard socket.
+func packetSource(local *net.UDPAddr) []byte {
+	level, typ, size := syscall.IPPROTO_IPV6, syscall.IPV6_PKTINFO, syscall.SizeofInet6Pktinfo
+	if local.IP.To4() != nil {
+		level, typ, size = syscall.IPPROTO_IP, syscall.IP_PKTINFO, syscall.SizeofInet4Pktinfo
+	}
+	oob := make([]byte, syscall.CmsgSpace(size))
+	header := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = int32(level)
+	header.Type = int32(typ)
+	header.SetLen(syscall.CmsgLen(size))
+	data := oob[syscall.CmsgLen(0):]
+	if ip4 := local.IP.To4(); ip4 != nil {
+		copy(data[4:8], ip4) // ipi_spec_dst
+	} else {
+		copy(data[:16], local.IP.To16())
+		if index, err := strconv.Atoi(local.Zone); err == nil {
+			binary.NativeEndian.PutUint32(data[16:20], uint32(index))
+		}
+	}
+	return oob
+}
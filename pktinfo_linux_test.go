@@ -0,0 +1,67 @@
+package main
+
+import (
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplyFromRequestDestination(t *testing.T) {
+	files = newCASStore()
+	files.Write("boot.cfg", "multi-homed", "")
+
+	// every 127/8 address is local on Linux, so a wildcard listener can be
+	// reached on 127.0.0.2 by a client that is itself on 127.0.0.1
+	defer func() { singlePort = false }()
+	tests := []struct {
+		spec   listenSpec
+		single bool
+	}{
+		{listenSpec{network: "udp4", address: "0.0.0.0:0"}, false},
+		{listenSpec{network: "udp", address: ":0"}, false},
+		{listenSpec{network: "udp4", address: "0.0.0.0:0"}, true},
+		{listenSpec{network: "udp", address: ":0"}, true},
+	}
+	for _, test := range tests {
+		spec := test.spec
+		singlePort = test.single
+		listeners, err := openListeners([]listenSpec{spec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		forgetRequests(t)
+		wg.Add(1)
+		txID := int64(0)
+		txns := make(chan string, 1)
+		go serve(listeners[0], wire.ParseDefault, &txID, txns, &wg)
+
+		client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := listeners[0].LocalAddr().(*net.UDPAddr).Port
+		server, _ := net.ResolveUDPAddr("udp4", "127.0.0.2:"+strconv.Itoa(port))
+		request := wire.PacketRequest{Op: wire.OpRRQ, Filename: "boot.cfg", Mode: "octet"}
+		client.WriteTo(request.Serialize(), server)
+
+		buf := make([]byte, wire.MaxPacketSize)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, addr, err := client.ReadFrom(buf); err != nil {
+			t.Errorf("Listening on %s (single port %t): %s", spec.network, test.single, err)
+		} else {
+			if ip := addr.(*net.UDPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.2")) {
+				t.Errorf("Listening on %s (single port %t): expected reply from 127.0.0.2; got %s", spec.network, test.single, addr)
+			}
+			ack := wire.PacketAck{BlockNum: 1}
+			client.WriteTo(ack.Serialize(), addr)
+			<-txns
+		}
+		client.Close()
+		listeners[0].Close()
+		wg.Wait()
+	}
+}
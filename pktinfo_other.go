@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var packetInfoSpace = 0
+
+// enablePacketInfo isn't supported here, so transfers on wildcard listeners
+// are sent from whichever address the kernel picks
+func enablePacketInfo(conn *net.UDPConn, network string) error {
+	return errors.New("packet destination addresses are only supported on Linux")
+}
+
+func packetDestination(oob []byte) *net.UDPAddr {
+	return nil
+}
+
+func packetSource(local *net.UDPAddr) []byte {
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+)
+
+var tidPorts = newPortAllocator(49152, 65535) // IANA recommended ephemeral port range
+
+// portsConfig is the range transfer ports are picked from, inclusive
+type portsConfig struct {
+	First int `json:"first"`
+	Last  int `json:"last"`
+}
+
+// portAllocator picks the local ports of transfers uniformly at random from a
+// range, so that the next transfer's port can't be guessed by an attacker
+// trying to inject packets into it.  Ports handed out and not yet closed are
+// never picked again.
+type portAllocator struct {
+	sync.Mutex
+	first, last int
+	inUse       map[int]bool
+	metrics     portMetrics
+
+	listen func(network string, addr *net.UDPAddr) (net.PacketConn, error)
+	random func(n int) (int, error) // a number in [0, n), unpredictably
+}
+
+// portMetrics counts how allocation is going, for the admin interface
+type portMetrics struct {
+	RangeSize    int    `json:"range_size"`
+	InUse        int    `json:"in_use"`
+	Allocated    uint64 `json:"allocated"`     // ports successfully handed out
+	BindFailures uint64 `json:"bind_failures"` // picked ports that couldn't be bound, usually as another program had them
+	Collisions   uint64 `json:"collisions"`    // picked ports that were already in use by another transfer
+	Exhausted    uint64 `json:"exhausted"`     // transfers that got no port at all
+}
+
+func newPortAllocator(first, last int) *portAllocator {
+	return &portAllocator{
+		first: first,
+		last:  last,
+		inUse: make(map[int]bool),
+		listen: func(network string, addr *net.UDPAddr) (net.PacketConn, error) {
+			return net.ListenUDP(network, addr)
+		},
+		random: cryptoRandom,
+	}
+}
+
+// cryptoRandom picks a number in [0, n) from the system's secure source
+func cryptoRandom(n int) (int, error) {
+	r, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(r.Int64()), nil
+}
+
+func checkPortRange(c portsConfig) error {
+	if c.First < 1 || c.Last > 65535 || c.First > c.Last {
+		return fmt.Errorf("ports: %d-%d is not a valid port range", c.First, c.Last)
+	}
+	return nil
+}
+
+// setRange changes the range new ports are picked from
+func (a *portAllocator) setRange(first, last int) {
+	a.Lock()
+	defer a.Unlock()
+	a.first, a.last = first, last
+}
+
+// allocate binds a random free port in the range on ip, making up to
+// connectionAttempts attempts.  It returns nil if none could be bound.  The
+// port is freed when the returned connection is closed.
+func (a *portAllocator) allocate(network string, ip net.IP) net.PacketConn {
+	for attempts := connectionAttempts; attempts > 0; attempts-- {
+		port, ok := a.pick()
+		if !ok {
+			continue
+		}
+		conn, err := a.listen(network, &net.UDPAddr{IP: ip, Port: port})
+		if err != nil {
+			a.release(port)
+			a.Lock()
+			a.metrics.BindFailures++
+			a.Unlock()
+			log.Printf("Unable to bind to port %d.  %d attempts left", port, attempts-1)
+			continue
+		}
+		a.Lock()
+		a.metrics.Allocated++
+		a.Unlock()
+		return &allocatedConn{PacketConn: conn, allocator: a, port: port}
+	}
+	a.Lock()
+	a.metrics.Exhausted++
+	a.Unlock()
+	return nil
+}
+
+// pick chooses a port at random and marks it in use, or reports that the one
+// it chose was taken
+func (a *portAllocator) pick() (int, bool) {
+	a.Lock()
+	size := a.last - a.first + 1
+	a.Unlock()
+	n, err := a.random(size)
+	if err != nil {
+		log.Println("Unable to pick a random port.  error: ", err)
+		return 0, false
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	port := a.first + n
+	if port > a.last || a.inUse[port] {
+		// taken, or the range shrank since it was read
+		a.metrics.Collisions++
+		return 0, false
+	}
+	a.inUse[port] = true
+	return port, true
+}
+
+func (a *portAllocator) release(port int) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.inUse, port)
+}
+
+func (a *portAllocator) snapshot() portMetrics {
+	a.Lock()
+	defer a.Unlock()
+	metrics := a.metrics
+	metrics.RangeSize = a.last - a.first + 1
+	metrics.InUse = len(a.inUse)
+	return metrics
+}
+
+// allocatedConn is a transfer's socket, which gives its port back when closed
+type allocatedConn struct {
+	net.PacketConn
+	allocator *portAllocator
+	port      int
+	once      sync.Once
+}
+
+func (c *allocatedConn) Close() error {
+	err := c.PacketConn.Close()
+	c.once.Do(func() { c.allocator.release(c.port) })
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeListen binds nothing, failing for the ports in busy
+func fakeListen(busy map[int]bool) func(string, *net.UDPAddr) (net.PacketConn, error) {
+	return func(network string, addr *net.UDPAddr) (net.PacketConn, error) {
+		if busy[addr.Port] {
+			return nil, errors.New("address already in use")
+		}
+		return &MockPacketConn{Addr: addr}, nil
+	}
+}
+
+// cyclingRandom picks 0, 1, 2 and so on, wrapping around, so that every port
+// of a range is tried in turn
+func cyclingRandom() func(int) (int, error) {
+	next := 0
+	return func(n int) (int, error) {
+		picked := next % n
+		next++
+		return picked, nil
+	}
+}
+
+func TestPortAllocator(t *testing.T) {
+	allocator := newPortAllocator(40000, 40003)
+	allocator.listen = fakeListen(map[int]bool{40001: true})
+	allocator.random = cyclingRandom()
+	oldAttempts := connectionAttempts
+	connectionAttempts = 8
+	defer func() { connectionAttempts = oldAttempts }()
+
+	// three ports can be bound, and they must all differ while held
+	seen := make(map[int]bool)
+	var conns []net.PacketConn
+	for i := 0; i < 3; i++ {
+		conn := allocator.allocate("udp", nil)
+		if conn == nil {
+			t.Fatalf("Allocation %d failed", i+1)
+		}
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		if port < 40000 || port > 40003 || port == 40001 || seen[port] {
+			t.Errorf("Allocation %d: unexpected port %d", i+1, port)
+		}
+		seen[port] = true
+		conns = append(conns, conn)
+	}
+
+	if conn := allocator.allocate("udp", nil); conn != nil {
+		t.Errorf("Expected the range to be exhausted; got port %s", conn.LocalAddr())
+	}
+
+	metrics := allocator.snapshot()
+	if metrics.Allocated != 3 || metrics.Exhausted != 1 || metrics.InUse != 3 || metrics.RangeSize != 4 {
+		t.Errorf("Unexpected metrics %+v", metrics)
+	}
+	if metrics.BindFailures == 0 || metrics.Collisions == 0 {
+		t.Errorf("Expected bind failures and collisions to be counted; got %+v", metrics)
+	}
+
+	conns[0].Close()
+	conns[0].Close()
+	if metrics := allocator.snapshot(); metrics.InUse != 2 {
+		t.Errorf("Expected closing to free one port; %d in use", metrics.InUse)
+	}
+	if conn := allocator.allocate("udp", nil); conn == nil {
+		t.Errorf("Expected a freed port to be handed out again")
+	}
+}
+
+func TestPortAllocatorSpread(t *testing.T) {
+	allocator := newPortAllocator(50000, 50999)
+	allocator.listen = fakeListen(nil)
+	seen := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		conn := allocator.allocate("udp", nil)
+		seen[conn.LocalAddr().(*net.UDPAddr).Port] = true
+		conn.Close()
+	}
+	// a predictable allocator would keep handing back the same few ports
+	if len(seen) < 10 {
+		t.Errorf("Expected ports to be spread over the range; got %v", seen)
+	}
+}
+
+func TestCheckPortRange(t *testing.T) {
+	tests := []struct {
+		config portsConfig
+		valid  bool
+	}{
+		{portsConfig{49152, 65535}, true},
+		{portsConfig{40000, 40000}, true},
+		{portsConfig{0, 100}, false},
+		{portsConfig{50000, 70000}, false},
+		{portsConfig{50000, 40000}, false},
+	}
+
+	for _, test := range tests {
+		if err := checkPortRange(test.config); (err == nil) != test.valid {
+			t.Errorf("Checking %+v: expected valid %v; got %v", test.config, test.valid, err)
+		}
+	}
+}
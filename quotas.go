@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var maxFileSize int64           // largest file a client may upload.  0 for no limit
+var storeCapacity int64         // most bytes the store may hold after deduplication.  0 for no limit
+var clientQuotas []*clientQuota // checked in order, first quota matching the client applies.  Install with installQuotas
+var quotaGeneration int64       // bumped whenever clientQuotas changes, so stores know to recount their usage
+
+var uploads = &uploadTracker{inFlight: make(map[*clientQuota]int64)}
+
+var errAllocationExceeded = &tftpError{Code: 3, Msg: "Disk full or allocation exceeded"}
+
+// quotaConfig is the quotas section of the config file.  Sizes are in bytes and
+// zero means no limit.
+type quotaConfig struct {
+	MaxFileSize int64               `json:"max_file_size"`
+	Capacity    int64               `json:"capacity"`
+	Clients     []clientQuotaConfig `json:"clients"`
+}
+
+// clientQuotaConfig limits the bytes stored from a group of clients, counting
+// every retained version of every file they have written.
+type clientQuotaConfig struct {
+	Clients []string `json:"clients"`
+	Bytes   int64    `json:"bytes"`
+}
+
+type clientQuota struct {
+	clients []*net.IPNet
+	bytes   int64
+}
+
+func compileClientQuotas(configs []clientQuotaConfig) ([]*clientQuota, error) {
+	quotas := make([]*clientQuota, 0, len(configs))
+	for i, c := range configs {
+		if c.Bytes < 0 {
+			return nil, fmt.Errorf("quota %d: bytes can't be negative", i+1)
+		}
+		quota := &clientQuota{bytes: c.Bytes}
+		for _, client := range c.Clients {
+			subnet, err := parseSubnet(client)
+			if err != nil {
+				return nil, fmt.Errorf("quota %d: %s", i+1, err)
+			}
+			quota.clients = append(quota.clients, subnet)
+		}
+		quotas = append(quotas, quota)
+	}
+	return quotas, nil
+}
+
+func (q *clientQuota) contains(ip net.IP) bool {
+	for _, subnet := range q.clients {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// storedBytes counts the bytes of every retained version written by clients
+// covered by the quota.  Each store keeps a running count, so this is cheap
+// enough to do for every block of an upload.
+func (q *clientQuota) storedBytes() int64 {
+	total := int64(0)
+	for _, store := range rootStores() {
+		total += store.QuotaUsage(q)
+	}
+	return total
+}
+
+// installQuotas replaces the client quotas, making every store recount what
+// its files use of them
+func installQuotas(quotas []*clientQuota) {
+	uploads.Lock()
+	defer uploads.Unlock()
+	clientQuotas = quotas
+	atomic.AddInt64(&quotaGeneration, 1)
+}
+
+// uploaderQuota returns the quota covering the client that uploaded a
+// version, given as host:port, or nil if there isn't one
+func uploaderQuota(uploader string) *clientQuota {
+	host, _, err := net.SplitHostPort(uploader)
+	if err != nil {
+		return nil
+	}
+	return quotaFor(&net.UDPAddr{IP: net.ParseIP(host)})
+}
+
+// quotaFor returns the quota covering addr, or nil if there isn't one
+func quotaFor(addr net.Addr) *clientQuota {
+	ip, _ := clientIPPort(addr)
+	if ip == nil {
+		return nil
+	}
+	for _, quota := range clientQuotas {
+		if quota.contains(ip) {
+			return quota
+		}
+	}
+	return nil
+}
+
+// uploadTracker counts the bytes of uploads that are still in progress, so
+// that concurrent uploads can't each squeeze under a limit they break together.
+// Checking a limit and claiming bytes under it happen in one hold of the lock.
+type uploadTracker struct {
+	sync.Mutex
+	inFlight map[*clientQuota]int64
+	total    int64
+}
+
+// uploadAllowance is one upload's claim on the limits
+type uploadAllowance struct {
+	stored   bool // only uploads kept in the store count against capacity and quotas
+	quota    *clientQuota
+	received int64
+}
+
+// startUpload checks that an upload from addr of declared bytes (-1 if the
+// client didn't say) fits within the limits, returning errAllocationExceeded
+// if it doesn't.  Uploads handed to a hook rather than stored are only held to
+// maxFileSize.
+func startUpload(addr net.Addr, declared int64, stored bool) (*uploadAllowance, error) {
+	allowance := &uploadAllowance{stored: stored}
+	if stored {
+		allowance.quota = quotaFor(addr)
+	}
+	if declared > 0 {
+		uploads.Lock()
+		defer uploads.Unlock()
+		if err := allowance.check(declared); err != nil {
+			return nil, err
+		}
+	}
+	return allowance, nil
+}
+
+// add claims n more bytes for the upload, returning errAllocationExceeded if
+// that takes it over a limit.
+func (a *uploadAllowance) add(n int) error {
+	uploads.Lock()
+	defer uploads.Unlock()
+	if err := a.check(a.received + int64(n)); err != nil {
+		return err
+	}
+	a.received += int64(n)
+	if !a.stored {
+		return nil
+	}
+	uploads.total += int64(n)
+	if a.quota != nil {
+		uploads.inFlight[a.quota] += int64(n)
+	}
+	return nil
+}
+
+// release gives back the upload's claim.  Once an upload is committed its
+// bytes are counted in the store instead.
+func (a *uploadAllowance) release() {
+	if !a.stored {
+		return
+	}
+	uploads.Lock()
+	defer uploads.Unlock()
+	uploads.total -= a.received
+	if a.quota != nil {
+		if uploads.inFlight[a.quota] -= a.received; uploads.inFlight[a.quota] <= 0 {
+			delete(uploads.inFlight, a.quota)
+		}
+	}
+	a.received = 0
+}
+
+// check reports whether the upload would break a limit if it were size bytes.
+// The caller must hold the uploads lock.
+func (a *uploadAllowance) check(size int64) error {
+	if maxFileSize > 0 && size > maxFileSize {
+		return errAllocationExceeded
+	}
+	if !a.stored {
+		return nil
+	}
+	extra := size - a.received
+	if storeCapacity > 0 {
+		if _, stored := blobs.stats(); stored+uploads.total+extra > storeCapacity {
+			return errAllocationExceeded
+		}
+	}
+	if a.quota != nil && a.quota.bytes > 0 && a.quota.storedBytes()+uploads.inFlight[a.quota]+extra > a.quota.bytes {
+		return errAllocationExceeded
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withQuotas installs limits and a fresh store for the length of a test
+func withQuotas(t *testing.T, maxSize, capacity int64, quotas []clientQuotaConfig) {
+	compiled, err := compileClientQuotas(quotas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldBlobs, oldFiles := blobs, files
+	oldMax, oldCapacity, oldQuotas := maxFileSize, storeCapacity, clientQuotas
+	t.Cleanup(func() {
+		blobs, files = oldBlobs, oldFiles
+		maxFileSize, storeCapacity = oldMax, oldCapacity
+		installQuotas(oldQuotas)
+	})
+	blobs = newBlobStore()
+	files = newCASStore()
+	maxFileSize, storeCapacity = maxSize, capacity
+	installQuotas(compiled)
+}
+
+// waitForUploads waits for finished uploads to release their reservations,
+// which they do just after reporting their transaction.
+func waitForUploads(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		uploads.Lock()
+		idle := uploads.total == 0 && len(uploads.inFlight) == 0
+		uploads.Unlock()
+		if idle {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("upload reservations not released")
+}
+
+func TestUploadLimits(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 1500)
+	tests := []struct {
+		name     string
+		maxSize  int64
+		capacity int64
+		quotas   []clientQuotaConfig
+		tsize    string
+		existing int // bytes already uploaded by this client before the test write
+		rejected bool
+	}{
+		{"no limits", 0, 0, nil, "", 0, false},
+		{"under max size", 2000, 0, nil, "", 0, false},
+		{"over max size mid-stream", 1000, 0, nil, "", 0, true},
+		{"over max size by tsize", 1000, 0, nil, "1500", 0, true},
+		{"tsize under max size", 2000, 0, nil, "1500", 0, false},
+		{"over capacity", 0, 2000, nil, "", 1000, true},
+		{"under capacity", 0, 3000, nil, "", 1000, false},
+		{"over client quota", 0, 0, []clientQuotaConfig{{Clients: []string{"127.0.0.0/8"}, Bytes: 2000}}, "", 1000, true},
+		{"quota for other clients", 0, 0, []clientQuotaConfig{{Clients: []string{"10.0.0.0/8"}, Bytes: 2000}}, "", 1000, false},
+	}
+
+	for _, test := range tests {
+		waitForUploads(t)
+		withQuotas(t, test.maxSize, test.capacity, test.quotas)
+		if test.existing > 0 {
+			if err := writeOverUDP(t, &wire.PacketRequest{Op: wire.OpWRQ, Filename: "old.bin", Mode: "octet"}, bytes.Repeat([]byte("y"), test.existing)); err != nil {
+				t.Errorf("%s: unable to write existing file: %s", test.name, err)
+				continue
+			}
+		}
+		request := &wire.PacketRequest{Op: wire.OpWRQ, Filename: "new.bin", Mode: "octet"}
+		if test.tsize != "" {
+			request.Options = map[string]string{"tsize": test.tsize}
+		}
+		err := writeOverUDP(t, request, big)
+		_, stored := files.Read("new.bin")
+		if test.rejected {
+			if tErr, ok := err.(*tftpError); !ok || tErr.Code != 3 {
+				t.Errorf("%s: expected allocation exceeded; got %v", test.name, err)
+			}
+			if stored {
+				t.Errorf("%s: rejected upload was stored", test.name)
+			}
+		} else if err != nil || !stored {
+			t.Errorf("%s: expected upload to succeed; got %v", test.name, err)
+		}
+	}
+}
+
+func TestQuotaUsage(t *testing.T) {
+	withQuotas(t, 0, 0, []clientQuotaConfig{{Clients: []string{"10.0.0.0/8"}, Bytes: 1 << 20}})
+	oldKeep := keepVersions
+	keepVersions = 2
+	defer func() { keepVersions = oldKeep }()
+	quota := clientQuotas[0]
+
+	files.Write("a", strings.Repeat("1", 100), "10.0.0.1:2000")
+	files.Write("a", strings.Repeat("2", 200), "10.0.0.2:2000")
+	files.Write("b", strings.Repeat("3", 50), "192.0.2.1:2000")
+	if used := quota.storedBytes(); used != 300 {
+		t.Errorf("Expected 300 bytes used; got %d", used)
+	}
+	// the first version of a is pruned
+	files.Write("a", strings.Repeat("4", 10), "10.0.0.1:2000")
+	if used := quota.storedBytes(); used != 210 {
+		t.Errorf("Expected pruning to free 100 bytes; got %d used", used)
+	}
+	files.WriteExpiring("c", strings.Repeat("5", 40), "10.0.0.3:2000", time.Now().Add(-time.Minute))
+	files.Expire(time.Now())
+	if used := quota.storedBytes(); used != 210 {
+		t.Errorf("Expected expiry to free 40 bytes; got %d used", used)
+	}
+
+	// new quotas are counted afresh
+	narrower, _ := compileClientQuotas([]clientQuotaConfig{{Clients: []string{"10.0.0.1"}, Bytes: 1 << 20}})
+	installQuotas(narrower)
+	if used := narrower[0].storedBytes(); used != 10 {
+		t.Errorf("Expected 10 bytes used under the new quota; got %d", used)
+	}
+}
+
+func TestConcurrentUploadsShareQuota(t *testing.T) {
+	waitForUploads(t)
+	withQuotas(t, 0, 0, []clientQuotaConfig{{Clients: []string{"127.0.0.0/8"}, Bytes: 1000}})
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2000}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var granted []*uploadAllowance
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			allowance, _ := startUpload(addr, -1, true)
+			if allowance.add(100) == nil {
+				mu.Lock()
+				granted = append(granted, allowance)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(granted) != 10 {
+		t.Errorf("Expected exactly 10 uploads of 100 bytes to fit a 1000 byte quota; got %d", len(granted))
+	}
+	for _, allowance := range granted {
+		allowance.release()
+	}
+}
+
+func TestCompileClientQuotasInvalid(t *testing.T) {
+	tests := []clientQuotaConfig{
+		{Clients: []string{"not an address"}, Bytes: 10},
+		{Clients: []string{"10.0.0.0/8"}, Bytes: -1},
+	}
+
+	for _, test := range tests {
+		if _, err := compileClientQuotas([]clientQuotaConfig{test}); err == nil {
+			t.Errorf("Compiling %#v: expected error", test)
+		}
+	}
+}
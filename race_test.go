@@ -0,0 +1,7 @@
+//go:build race
+
+package main
+
+// raceEnabled is set when testing with the race detector, which makes
+// allocations of its own
+const raceEnabled = true
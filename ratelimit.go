@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"sync"
+	"time"
+)
+
+// rate limits, all nil when not configured
+var requestLimit *bucketConfig  // new requests per client IP
+var transferLimit *bucketConfig // DATA bytes per second of each read
+var totalBytes *tokenBucket     // DATA bytes per second across every read
+var rejectOverLimit = false     // reject requests over a limit instead of delaying them
+
+var maxRequestDelay = 5 * time.Second // longest a request is held back before it's rejected instead
+
+var requestBuckets = &bucketMap{buckets: make(map[string]*tokenBucket)}
+var rateMetrics = &rateLimitCounter{}
+
+var errRateLimited = &tftpError{Code: 0, Msg: "Rate limit exceeded, try again later"}
+
+// rateLimitsConfig is the rate_limits section of the config file.  Each
+// limit is a token bucket refilling at Rate per second up to Burst.  Action
+// is "delay", the default, or "reject".
+type rateLimitsConfig struct {
+	Requests      *bucketConfig `json:"requests_per_ip"`
+	TransferBytes *bucketConfig `json:"transfer_bytes"`
+	TotalBytes    *bucketConfig `json:"total_bytes"`
+	Action        string        `json:"action"`
+}
+
+type bucketConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+func checkBucketConfig(name string, c *bucketConfig) error {
+	if c != nil && (c.Rate <= 0 || c.Burst < 1) {
+		return errors.New("rate_limits: " + name + " needs a positive rate and a burst of at least 1")
+	}
+	return nil
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate per second.  Tokens
+// can be borrowed ahead of time, leaving the bucket in debt until it refills.
+type tokenBucket struct {
+	sync.Mutex
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+func newTokenBucket(c *bucketConfig, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: c.Rate, burst: c.Burst, tokens: c.Burst, last: now}
+}
+
+// refill adds the tokens earned since the bucket was last used.  The caller
+// must hold the lock.
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// allow takes n tokens if the bucket has them
+func (b *tokenBucket) allow(n float64, now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// reserve takes n tokens, borrowing them if need be, and returns how long to
+// wait before using them
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// reserveWithin is reserve for waits of up to max.  If n tokens would take
+// longer to come, it takes none and returns false.
+func (b *tokenBucket) reserveWithin(n float64, max time.Duration, now time.Time) (time.Duration, bool) {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(now)
+	var wait time.Duration
+	if b.tokens < n {
+		wait = time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+	}
+	if wait > max {
+		return 0, false
+	}
+	b.tokens -= n
+	return wait, true
+}
+
+// empty reports whether the bucket has nothing left to give
+func (b *tokenBucket) empty(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(now)
+	return b.tokens < 1
+}
+
+// full reports whether the bucket has refilled completely, and so is no
+// different from a new one
+func (b *tokenBucket) full(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// bucketMap keeps a bucket per client IP, forgetting clients whose buckets
+// have refilled so that it doesn't grow without bound
+type bucketMap struct {
+	sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func (m *bucketMap) get(key string, c *bucketConfig, now time.Time) *tokenBucket {
+	m.Lock()
+	defer m.Unlock()
+	if now.Sub(m.lastSweep) > time.Minute {
+		for k, b := range m.buckets {
+			if b.full(now) {
+				delete(m.buckets, k)
+			}
+		}
+		m.lastSweep = now
+	}
+	b, ok := m.buckets[key]
+	if !ok {
+		b = newTokenBucket(c, now)
+		m.buckets[key] = b
+	}
+	return b
+}
+
+// rateLimitMetrics counts what the rate limits have done, for the admin interface
+type rateLimitMetrics struct {
+	RequestsRejected uint64  `json:"requests_rejected"`
+	RequestsDelayed  uint64  `json:"requests_delayed"`
+	DataDelays       uint64  `json:"data_delays"`      // DATA packets held back to stay under a byte limit
+	DataDelayed      float64 `json:"data_delayed_sec"` // total time DATA packets were held back for
+}
+
+type rateLimitCounter struct {
+	sync.Mutex
+	counts rateLimitMetrics
+}
+
+func (c *rateLimitCounter) count(update func(*rateLimitMetrics)) {
+	c.Lock()
+	defer c.Unlock()
+	update(&c.counts)
+}
+
+func (c *rateLimitCounter) snapshot() rateLimitMetrics {
+	c.Lock()
+	defer c.Unlock()
+	return c.counts
+}
+
+// admitRequest applies the request limits to a request of op from addr.  It
+// returns how long to hold the request back for, or errRateLimited if it
+// should be rejected.  Delayed requests are rejected too once they would be
+// held back for longer than maxRequestDelay, so that a flood of them can't
+// pile up.
+func admitRequest(addr net.Addr, op uint16, now time.Time) (time.Duration, error) {
+	if rejectOverLimit && op == wire.OpRRQ && totalBytes != nil && totalBytes.empty(now) {
+		// the link is already saturated, don't add to it
+		return 0, rateRejected()
+	}
+	var delay time.Duration
+	if requestLimit != nil {
+		ip, _ := clientIPPort(addr)
+		bucket := requestBuckets.get(ip.String(), requestLimit, now)
+		if rejectOverLimit {
+			if !bucket.allow(1, now) {
+				return 0, rateRejected()
+			}
+		} else {
+			var ok bool
+			if delay, ok = bucket.reserveWithin(1, maxRequestDelay, now); !ok {
+				return 0, rateRejected()
+			}
+		}
+	}
+	if delay > 0 {
+		rateMetrics.count(func(m *rateLimitMetrics) { m.RequestsDelayed++ })
+	}
+	return delay, nil
+}
+
+func rateRejected() error {
+	rateMetrics.count(func(m *rateLimitMetrics) { m.RequestsRejected++ })
+	return errRateLimited
+}
+
+// dataPacer holds back the DATA packets of one read to keep it, and all reads
+// together, under their byte limits.
+type dataPacer struct {
+	transfer *tokenBucket
+}
+
+func newDataPacer() *dataPacer {
+	pacer := &dataPacer{}
+	if transferLimit != nil {
+		pacer.transfer = newTokenBucket(transferLimit, time.Now())
+	}
+	return pacer
+}
+
+// wait blocks until n more bytes may be sent
+func (p *dataPacer) wait(n int) {
+	now := time.Now()
+	var delay time.Duration
+	if p.transfer != nil {
+		delay = p.transfer.reserve(float64(n), now)
+	}
+	if total := totalBytes; total != nil {
+		if d := total.reserve(float64(n), now); d > delay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return
+	}
+	rateMetrics.count(func(m *rateLimitMetrics) {
+		m.DataDelays++
+		m.DataDelayed += delay.Seconds()
+	})
+	time.Sleep(delay)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	bucket := newTokenBucket(&bucketConfig{Rate: 2, Burst: 3}, start)
+
+	for i := 0; i < 3; i++ {
+		if !bucket.allow(1, start) {
+			t.Errorf("Expected token %d of the burst to be allowed", i+1)
+		}
+	}
+	if bucket.allow(1, start) {
+		t.Errorf("Expected the bucket to be empty after its burst")
+	}
+	if !bucket.allow(1, start.Add(500*time.Millisecond)) {
+		t.Errorf("Expected a token to be refilled after half a second")
+	}
+
+	// borrowing two tokens from an empty bucket refilling at 2/s takes a second
+	if delay := bucket.reserve(2, start.Add(500*time.Millisecond)); delay != time.Second {
+		t.Errorf("Expected a delay of 1s; got %s", delay)
+	}
+	if !bucket.empty(start.Add(time.Second)) {
+		t.Errorf("Expected the bucket to still be paying back its debt")
+	}
+	if !bucket.full(start.Add(10 * time.Second)) {
+		t.Errorf("Expected the bucket to refill to its burst and no further")
+	}
+}
+
+// withRateLimits installs rate limits for the length of a test
+func withRateLimits(t *testing.T, requests, transfer, total *bucketConfig, reject bool) {
+	oldRequest, oldTransfer, oldTotal, oldReject := requestLimit, transferLimit, totalBytes, rejectOverLimit
+	oldBuckets := requestBuckets
+	t.Cleanup(func() {
+		requestLimit, transferLimit, totalBytes, rejectOverLimit = oldRequest, oldTransfer, oldTotal, oldReject
+		requestBuckets = oldBuckets
+	})
+	requestLimit, transferLimit, rejectOverLimit = requests, transfer, reject
+	totalBytes = nil
+	if total != nil {
+		totalBytes = newTokenBucket(total, time.Now())
+	}
+	requestBuckets = &bucketMap{buckets: make(map[string]*tokenBucket)}
+}
+
+func TestAdmitRequest(t *testing.T) {
+	now := time.Now()
+	client1 := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2000}
+	client1Again := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2001}
+	client2 := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2000}
+
+	withRateLimits(t, &bucketConfig{Rate: 1, Burst: 2}, nil, nil, false)
+	delays := []time.Duration{}
+	for _, addr := range []net.Addr{client1, client1Again, client1, client2} {
+		delay, err := admitRequest(addr, wire.OpRRQ, now)
+		if err != nil {
+			t.Fatalf("Expected requests to be delayed, not rejected; got %s", err)
+		}
+		delays = append(delays, delay)
+	}
+	if delays[0] != 0 || delays[1] != 0 || delays[2] != time.Second || delays[3] != 0 {
+		t.Errorf("Expected only the third request from 10.0.0.1 to be delayed; got %v", delays)
+	}
+
+	// a flood is delayed until the wait reaches maxRequestDelay, then rejected
+	withRateLimits(t, &bucketConfig{Rate: 1, Burst: 1}, nil, nil, false)
+	admitted := 0
+	for i := 0; i < 20; i++ {
+		delay, err := admitRequest(client1, wire.OpRRQ, now)
+		if err == errRateLimited {
+			continue
+		}
+		if err != nil || delay > maxRequestDelay {
+			t.Errorf("Request %d: expected a delay of at most %s or a rejection; got %s, %v", i+1, maxRequestDelay, delay, err)
+		}
+		admitted++
+	}
+	if expected := 1 + int(maxRequestDelay/time.Second); admitted != expected {
+		t.Errorf("Expected %d of the flood to be admitted; got %d", expected, admitted)
+	}
+	if _, err := admitRequest(client1, wire.OpRRQ, now.Add(2*time.Second)); err != nil {
+		t.Errorf("Expected a request to be admitted once the bucket has refilled a little; got %v", err)
+	}
+
+	withRateLimits(t, &bucketConfig{Rate: 1, Burst: 1}, nil, &bucketConfig{Rate: 100, Burst: 100}, true)
+	if _, err := admitRequest(client1, wire.OpRRQ, now); err != nil {
+		t.Errorf("Expected first request to be admitted; got %s", err)
+	}
+	if _, err := admitRequest(client1, wire.OpRRQ, now); err != errRateLimited {
+		t.Errorf("Expected second request to be rejected; got %v", err)
+	}
+	totalBytes.reserve(1000, now)
+	if _, err := admitRequest(client2, wire.OpRRQ, now); err != errRateLimited {
+		t.Errorf("Expected a read to be rejected while the link is saturated; got %v", err)
+	}
+	if _, err := admitRequest(client2, wire.OpWRQ, now); err != nil {
+		t.Errorf("Expected a write to be admitted while reads saturate the link; got %v", err)
+	}
+}
+
+func TestBucketMapForgetsIdleClients(t *testing.T) {
+	buckets := &bucketMap{buckets: make(map[string]*tokenBucket)}
+	now := time.Now()
+	buckets.get("10.0.0.1", &bucketConfig{Rate: 1, Burst: 1}, now).allow(1, now)
+	buckets.get("10.0.0.2", &bucketConfig{Rate: 1, Burst: 1}, now)
+	later := now.Add(2 * time.Minute)
+	buckets.get("10.0.0.3", &bucketConfig{Rate: 1, Burst: 1}, later)
+	if len(buckets.buckets) != 1 {
+		t.Errorf("Expected refilled buckets to be forgotten; %d left", len(buckets.buckets))
+	}
+}
+
+func TestOpReadPacesData(t *testing.T) {
+	files = newCASStore()
+	files.Write("big.bin", string(bytes.Repeat([]byte("b"), 2048)), "")
+	withRateLimits(t, nil, &bucketConfig{Rate: 4096, Burst: 512}, nil, false)
+
+	start := time.Now()
+	contents, _, err := readOverUDP(t, &wire.PacketRequest{Op: wire.OpRRQ, Filename: "big.bin", Mode: "octet"})
+	if err != nil || len(contents) != 2048 {
+		t.Fatalf("Expected to read 2048 bytes; got %d, %v", len(contents), err)
+	}
+	// the first block fits the burst, the next four (the last is empty) wait
+	// for 1536 bytes to be refilled at 4096 bytes/s
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Errorf("Expected the read to be paced to at least 375ms; took %s", elapsed)
+	}
+}
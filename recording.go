@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/coffeepac/tftp/capture"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+var recordingRule *recordingSelection // transactions to record, nil to record none
+
+// recordingConfig is the recording section of the config file.  Every packet
+// of a transaction whose filename matches Match and whose client is in
+// Clients is written to a pcap capture in Dir.  Either may be left out to
+// record any file or any client.
+type recordingConfig struct {
+	Dir     string   `json:"dir"`
+	Match   string   `json:"match"`
+	Clients []string `json:"clients"`
+}
+
+type recordingSelection struct {
+	dir     string
+	re      *regexp.Regexp // nil for any filename
+	clients []*net.IPNet   // empty for any client
+}
+
+func compileRecording(c *recordingConfig) (*recordingSelection, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.Dir == "" {
+		return nil, errors.New("recording: missing dir")
+	}
+	selection := &recordingSelection{dir: c.Dir}
+	if c.Match != "" {
+		re, err := regexp.Compile(c.Match)
+		if err != nil {
+			return nil, fmt.Errorf("recording: %s", err)
+		}
+		selection.re = re
+	}
+	for _, client := range c.Clients {
+		subnet, err := parseSubnet(client)
+		if err != nil {
+			return nil, fmt.Errorf("recording: %s", err)
+		}
+		selection.clients = append(selection.clients, subnet)
+	}
+	return selection, nil
+}
+
+// selects reports whether the transaction of a request from addr for filename
+// should be recorded
+func (s *recordingSelection) selects(addr net.Addr, filename string) bool {
+	if s == nil || s.re != nil && !s.re.MatchString(filename) {
+		return false
+	}
+	if len(s.clients) == 0 {
+		return true
+	}
+	ip, _ := clientIPPort(addr)
+	for _, subnet := range s.clients {
+		if ip != nil && subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// recorder writes the packets of a transaction to its capture.  The server's
+// end of each packet is given the address the request was sent to, so that
+// sockets bound to every address still record one that can be replayed.
+type recorder struct {
+	f        *os.File
+	buf      *bufio.Writer
+	w        *capture.Writer
+	serverIP netip.Addr
+}
+
+// startRecording opens the capture for transaction txID, if recordingRule
+// selects it, and records its request, packet, as received at.  It returns nil
+// if the transaction isn't to be recorded or the capture can't be made.
+func startRecording(txID int64, request *wire.PacketRequest, packet []byte, at time.Time, client, local net.Addr) *recorder {
+	if !recordingRule.selects(client, request.Filename) {
+		return nil
+	}
+	name := fmt.Sprintf("%s-%d-%s.pcap", at.UTC().Format("20060102T150405"), txID, safeFilename(request.Filename))
+	f, err := os.Create(filepath.Join(recordingRule.dir, name))
+	if err != nil {
+		log.Println("Unable to record transaction.  Error: ", err)
+		return nil
+	}
+	buf := bufio.NewWriter(f)
+	w, err := capture.NewWriter(buf)
+	if err != nil {
+		f.Close()
+		log.Println("Unable to record transaction.  Error: ", err)
+		return nil
+	}
+	r := &recorder{f: f, buf: buf, w: w, serverIP: addrPort(local).Addr().Unmap()}
+	if clientIP := addrPort(client).Addr().Unmap(); !r.serverIP.IsValid() || r.serverIP.IsUnspecified() || r.serverIP.Is4() != clientIP.Is4() {
+		// without the address the request came to, any will do
+		r.serverIP = netip.IPv6Unspecified()
+		if clientIP.Is4() {
+			r.serverIP = netip.IPv4Unspecified()
+		}
+	}
+	r.record(at, client, local, packet, false)
+	return r
+}
+
+// record writes a packet between the client and the server's end, local, to
+// the capture.  A failed write ends the recording but not the transaction.
+func (r *recorder) record(at time.Time, client, local net.Addr, packet []byte, toClient bool) {
+	if r.w == nil {
+		return
+	}
+	server := netip.AddrPortFrom(r.serverIP, addrPort(local).Port())
+	var err error
+	if toClient {
+		err = r.w.WriteUDP(at, server, addrPort(client), packet)
+	} else {
+		err = r.w.WriteUDP(at, addrPort(client), server, packet)
+	}
+	if err != nil {
+		log.Println("Unable to record packet, recording stopped.  Error: ", err)
+		r.w = nil
+	}
+}
+
+// close finishes the capture
+func (r *recorder) close() {
+	if r == nil {
+		return
+	}
+	if err := r.buf.Flush(); err != nil {
+		log.Println("Unable to finish recording.  Error: ", err)
+	}
+	r.f.Close()
+}
+
+// addrPort converts a UDP address, or returns the zero AddrPort for any other
+func addrPort(addr net.Addr) netip.AddrPort {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.AddrPort()
+	}
+	return netip.AddrPort{}
+}
+
+// recordingConn records every packet sent and received over a transaction's
+// connection
+type recordingConn struct {
+	net.PacketConn
+	rec *recorder
+}
+
+// recordedConn wraps conn to record its packets to rec, if there is one
+func recordedConn(conn net.PacketConn, rec *recorder) net.PacketConn {
+	if conn == nil || rec == nil {
+		return conn
+	}
+	return &recordingConn{PacketConn: conn, rec: rec}
+}
+
+func (c *recordingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		c.rec.record(time.Now(), addr, c.LocalAddr(), b[:n], false)
+	}
+	return n, addr, err
+}
+
+func (c *recordingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if err == nil {
+		c.rec.record(time.Now(), addr, c.LocalAddr(), b, true)
+	}
+	return n, err
+}
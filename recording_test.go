@@ -0,0 +1,214 @@
+package main
+
+import (
+	"github.com/coffeepac/tftp/capture"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCompileRecording(t *testing.T) {
+	selection, err := compileRecording(&recordingConfig{Dir: "/tmp", Match: `^pxe/`, Clients: []string{"10.0.0.0/8", "192.0.2.7"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		client   string
+		filename string
+		expected bool
+	}{
+		{"10.1.2.3", "pxe/boot.0", true},
+		{"192.0.2.7", "pxe/boot.0", true},
+		{"192.0.2.8", "pxe/boot.0", false},
+		{"10.1.2.3", "firmware.bin", false},
+	}
+	for _, test := range tests {
+		addr := &net.UDPAddr{IP: net.ParseIP(test.client), Port: 2000}
+		if actual := selection.selects(addr, test.filename); actual != test.expected {
+			t.Errorf("%s reading %s: expected %t; got %t", test.client, test.filename, test.expected, actual)
+		}
+	}
+	everything, _ := compileRecording(&recordingConfig{Dir: "/tmp"})
+	if !everything.selects(&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 2000}, "anything") {
+		t.Errorf("Expected a recording without match or clients to select everything")
+	}
+	var none *recordingSelection
+	if none.selects(&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 2000}, "pxe/boot.0") {
+		t.Errorf("Expected nothing to be recorded without a recording section")
+	}
+
+	bad := []recordingConfig{
+		{Match: "x"},
+		{Dir: "/tmp", Match: "("},
+		{Dir: "/tmp", Clients: []string{"10.0.0.0/33"}},
+	}
+	for _, c := range bad {
+		if _, err := compileRecording(&c); err == nil || !strings.HasPrefix(err.Error(), "recording:") {
+			t.Errorf("%+v: expected a recording error; got %v", c, err)
+		}
+	}
+}
+
+// readFromServer reads filename from the server at addr, waiting pause before
+// each ACK, and returns the client's address
+func readFromServer(t *testing.T, addr net.Addr, filename string, pause time.Duration) net.Addr {
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	request := wire.PacketRequest{Op: wire.OpRRQ, Filename: filename, Mode: "octet"}
+	client.WriteTo(request.Serialize(), addr)
+	buf := make([]byte, wire.MaxPacketSize)
+	for {
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		n, from, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet, err := wire.ParsePacket(buf[:n])
+		data, ok := packet.(*wire.PacketData)
+		if err != nil || !ok {
+			t.Fatalf("Expected DATA; got %v, %v", packet, err)
+		}
+		time.Sleep(pause)
+		ack := wire.PacketAck{BlockNum: data.BlockNum}
+		client.WriteTo(ack.Serialize(), from)
+		if len(data.Data) < 512 {
+			return client.LocalAddr()
+		}
+	}
+}
+
+// inspectRecording reads the transfers recorded at path.  A recording holds
+// nothing but its transfer, so requests to any port are taken.
+func inspectRecording(path string) (*inspection, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader, err := capture.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return inspectCapture(reader, 0)
+}
+
+// finishedRecordings returns the recordings in dir once the transfer in each
+// has completed.  The txn log is written before a recording is closed, so
+// the last packets may not be in it yet.
+func finishedRecordings(dir string) []string {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		recordings, _ := filepath.Glob(filepath.Join(dir, "*.pcap"))
+		finished := true
+		for _, path := range recordings {
+			in, err := inspectRecording(path)
+			finished = finished && err == nil && len(in.transfers) == 1 && in.transfers[0].outcome() == "completed"
+		}
+		if finished || time.Now().After(deadline) {
+			return recordings
+		}
+	}
+}
+
+func TestRecordTransactions(t *testing.T) {
+	dir := t.TempDir()
+	recordingRule, _ = compileRecording(&recordingConfig{Dir: dir, Match: `^boot`})
+	defer func() { recordingRule = nil }()
+	files = newCASStore()
+	contents := strings.Repeat("recorded", 150) // 1200 bytes, 3 blocks
+	files.Write("boot.cfg", contents, "")
+	files.Write("other.cfg", "not recorded", "")
+
+	listeners, err := openListeners([]listenSpec{{network: "udp4", address: "127.0.0.1:0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	forgetRequests(t)
+	wg.Add(1)
+	txID := int64(0)
+	txns := make(chan string, 2)
+	go serve(listeners[0], wire.ParseDefault, &txID, txns, &wg)
+	defer func() {
+		listeners[0].Close()
+		wg.Wait()
+	}()
+
+	client := readFromServer(t, listeners[0].LocalAddr(), "boot.cfg", 0)
+	readFromServer(t, listeners[0].LocalAddr(), "other.cfg", 0)
+	<-txns
+	<-txns
+
+	recordings := finishedRecordings(dir)
+	if len(recordings) != 1 || !strings.HasSuffix(recordings[0], "-0-boot.cfg.pcap") {
+		t.Fatalf("Expected one recording of boot.cfg; got %v", recordings)
+	}
+	in, err := inspectRecording(recordings[0])
+	if err != nil || len(in.transfers) != 1 || in.stray != 0 {
+		t.Fatalf("Expected the recording to hold one transfer; got %d and %d other packets, %v", len(in.transfers), in.stray, err)
+	}
+	recorded := in.transfers[0]
+	if recorded.outcome() != "completed" || string(recorded.contents) != contents || len(recorded.events) != 7 {
+		t.Errorf("Expected the whole read of %d bytes in 7 packets; got %s, %d bytes in %d packets", len(contents), recorded.outcome(), len(recorded.contents), len(recorded.events))
+	}
+	if recorded.client.String() != client.String() || recorded.server.String() != listeners[0].LocalAddr().String() {
+		t.Errorf("Expected the request from %s to %s; got %s to %s", client, listeners[0].LocalAddr(), recorded.client, recorded.server)
+	}
+	if recorded.tid.Addr() != recorded.server.Addr() || recorded.tid.Port() == recorded.server.Port() {
+		t.Errorf("Expected the transfer from its own port on %s; got %s", recorded.server.Addr(), recorded.tid)
+	}
+}
+
+func TestRecordRejectedRequest(t *testing.T) {
+	dir := t.TempDir()
+	recordingRule, _ = compileRecording(&recordingConfig{Dir: dir})
+	defer func() { recordingRule = nil }()
+	withRateLimits(t, &bucketConfig{Rate: 0.001, Burst: 1}, nil, nil, true)
+	requestBuckets.get("127.0.0.1", requestLimit, time.Now()).allow(1, time.Now())
+
+	listeners, err := openListeners([]listenSpec{{network: "udp4", address: "127.0.0.1:0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	forgetRequests(t)
+	wg.Add(1)
+	txID := int64(0)
+	txns := make(chan string, 1)
+	go serve(listeners[0], wire.ParseDefault, &txID, txns, &wg)
+
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	request := wire.PacketRequest{Op: wire.OpRRQ, Filename: "boot.cfg", Mode: "octet"}
+	client.WriteTo(request.Serialize(), listeners[0].LocalAddr())
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := client.ReadFrom(make([]byte, wire.MaxPacketSize)); err != nil {
+		t.Fatal(err)
+	}
+	<-txns
+	// the recording is closed by the time serve is done
+	listeners[0].Close()
+	wg.Wait()
+
+	recordings, _ := filepath.Glob(filepath.Join(dir, "*.pcap"))
+	if len(recordings) != 1 {
+		t.Fatalf("Expected one recording; got %v", recordings)
+	}
+	in, err := inspectRecording(recordings[0])
+	if err != nil || len(in.transfers) != 1 {
+		t.Fatalf("Expected the recording to hold one transfer; got %v", err)
+	}
+	if outcome := in.transfers[0].outcome(); outcome != `failed: ERROR 0 "Rate limit exceeded, try again later" from the server` {
+		t.Errorf("Expected the rejection to be recorded; got %s", outcome)
+	}
+}
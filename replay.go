@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/coffeepac/tftp/capture"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// recordedTransfer is the first transfer of a recording, from its request on
+type recordedTransfer struct {
+	client  netip.AddrPort   // where the request came from
+	server  netip.AddrPort   // where it went
+	packets []recordedPacket // the request and everything after it between the client and the server's host
+}
+
+// recordedPacket is a packet of a recorded transfer
+type recordedPacket struct {
+	at         time.Duration // since the request
+	fromClient bool
+	listener   bool // the server's end was the port the request went to, rather than the transfer's
+	payload    []byte
+}
+
+// replayEvent is a packet that arrived during a replay
+type replayEvent struct {
+	at      time.Time
+	from    net.Addr
+	payload []byte
+}
+
+// replaySide is what playing one side of a recording needs to know of the
+// network it's played on
+type replaySide struct {
+	fromClient bool                                     // which side of the recording is played
+	peer       string                                   // what the other side is called
+	send       func(p recordedPacket) (net.Addr, error) // puts a packet on the wire, returning where it went
+	heard      func(e replayEvent)                      // learns of a packet from the other side
+}
+
+// loadRecording reads the first transfer of the capture in r.  Recordings the
+// server makes hold one, but a capture of anything is fine.
+func loadRecording(r *capture.Reader) (*recordedTransfer, error) {
+	var t *recordedTransfer
+	var start time.Time
+	for {
+		packet, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		d, ok := capture.DecodeUDP(packet.LinkType, packet.Data)
+		if !ok {
+			continue
+		}
+		if t == nil {
+			if p, err := wire.ParsePacketMode(d.Payload, wire.ParseLenient); err == nil {
+				if _, ok := p.(*wire.PacketRequest); ok {
+					t = &recordedTransfer{client: d.Src, server: d.Dst}
+					t.packets = append(t.packets, recordedPacket{fromClient: true, listener: true, payload: d.Payload})
+					start = packet.Time
+				}
+			}
+			continue
+		}
+		// matched on the client alone, as inspect does, since a server with
+		// several addresses may answer from another
+		p := recordedPacket{at: packet.Time.Sub(start), payload: d.Payload}
+		switch {
+		case d.Src == t.client:
+			p.fromClient, p.listener = true, d.Dst == t.server
+		case d.Dst == t.client:
+			p.listener = d.Src == t.server
+		default:
+			continue
+		}
+		t.packets = append(t.packets, p)
+	}
+	if t == nil {
+		return nil, errors.New("no TFTP request in the capture")
+	}
+	return t, nil
+}
+
+// sentBy returns the payloads of the packets one side of the transfer sent
+func (t *recordedTransfer) sentBy(fromClient bool) [][]byte {
+	var payloads [][]byte
+	for _, p := range t.packets {
+		if p.fromClient == fromClient {
+			payloads = append(payloads, p.payload)
+		}
+	}
+	return payloads
+}
+
+// readReplayPackets passes what arrives on conn to events until conn is
+// closed or done is
+func readReplayPackets(conn net.PacketConn, events chan<- replayEvent, done <-chan struct{}) {
+	for {
+		buf := make([]byte, 65536)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case events <- replayEvent{at: time.Now(), from: addr, payload: buf[:n]}:
+		case <-done:
+			return
+		}
+	}
+}
+
+// replay plays side's packets of t, from the one at index first on, with
+// their recorded timing counted from start and sped up by speed, reporting
+// them and what arrives on events to out.  It returns what arrived once
+// linger has passed quietly after the last packet was sent.
+func replay(t *recordedTransfer, side replaySide, first int, start time.Time, speed float64, linger time.Duration, events <-chan replayEvent, out io.Writer) [][]byte {
+	var received [][]byte
+	last := start
+	next := first
+	for {
+		for next < len(t.packets) && t.packets[next].fromClient != side.fromClient {
+			next++
+		}
+		due := last.Add(linger)
+		if next < len(t.packets) {
+			due = start.Add(time.Duration(float64(t.packets[next].at) / speed))
+		} else if !time.Now().Before(due) {
+			return received
+		}
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case e := <-events:
+			timer.Stop()
+			side.heard(e)
+			received = append(received, e.payload)
+			reportReplayed(out, e.at.Sub(start), "from", e.from, e.payload, nil)
+			last = e.at
+		case <-timer.C:
+			if next == len(t.packets) {
+				return received
+			}
+			to, err := side.send(t.packets[next])
+			last = time.Now()
+			reportReplayed(out, last.Sub(start), "to", to, t.packets[next].payload, err)
+			next++
+		}
+	}
+}
+
+// reportReplayed writes a line of a replay's timeline
+func reportReplayed(out io.Writer, at time.Duration, direction string, addr net.Addr, payload []byte, err error) {
+	fmt.Fprintf(out, "  %+11.6f  %-4s %-21s  %s", at.Seconds(), direction, addr, describePayload(payload))
+	if err != nil {
+		fmt.Fprintf(out, "  (%s)", err)
+	}
+	fmt.Fprintln(out)
+}
+
+// describePayload names a packet on a replay's timeline
+func describePayload(payload []byte) string {
+	packet, err := wire.ParsePacketMode(payload, wire.ParseLenient)
+	if err != nil {
+		return fmt.Sprintf("%d bytes, %s", len(payload), err)
+	}
+	return describeInspected(packet)
+}
+
+// compareReplayed reports to out whether what the peer sent during a replay
+// is what it sent in the recording
+func compareReplayed(out io.Writer, peer string, recorded, received [][]byte) bool {
+	for i := 0; i < len(recorded) && i < len(received); i++ {
+		if !bytes.Equal(recorded[i], received[i]) {
+			fmt.Fprintf(out, "The %s's packet %d differs from the recording: recorded %s, got %s\n", peer, i+1, describePayload(recorded[i]), describePayload(received[i]))
+			return false
+		}
+	}
+	if len(recorded) != len(received) {
+		fmt.Fprintf(out, "The %s sent %d packets where the recording has %d\n", peer, len(received), len(recorded))
+		return false
+	}
+	fmt.Fprintf(out, "The %s's %d packets match the recording\n", peer, len(received))
+	return true
+}
+
+// replayClient plays the client side of t over conn against the server at
+// server, reporting to out.  It returns whether the server answered as it
+// did in the recording.
+func replayClient(t *recordedTransfer, conn net.PacketConn, server net.Addr, speed float64, linger time.Duration, out io.Writer) bool {
+	events := make(chan replayEvent)
+	done := make(chan struct{})
+	defer close(done)
+	go readReplayPackets(conn, events, done)
+
+	var tid net.Addr // where the server answers from, once it has
+	side := replaySide{
+		fromClient: true,
+		peer:       "server",
+		send: func(p recordedPacket) (net.Addr, error) {
+			to := server
+			if !p.listener && tid != nil {
+				to = tid
+			}
+			_, err := conn.WriteTo(p.payload, to)
+			return to, err
+		},
+		heard: func(e replayEvent) {
+			if tid == nil {
+				tid = e.from
+			}
+		},
+	}
+	received := replay(t, side, 0, time.Now(), speed, linger, events, out)
+	return compareReplayed(out, side.peer, t.sentBy(false), received)
+}
+
+// replayServer waits on listener for a request, then plays the server side
+// of t to whoever sent it.  Packets the server sent from its transfer port go
+// over tid.  It returns whether the client behaved as it did in the
+// recording.
+func replayServer(t *recordedTransfer, listener, tid net.PacketConn, speed float64, linger time.Duration, out io.Writer) bool {
+	buf := make([]byte, 65536)
+	n, client, err := listener.ReadFrom(buf)
+	if err != nil {
+		fmt.Fprintln(out, "No request:", err)
+		return false
+	}
+	start := time.Now()
+	reportReplayed(out, 0, "from", client, buf[:n], nil)
+	if !bytes.Equal(buf[:n], t.packets[0].payload) {
+		fmt.Fprintf(out, "The request differs from the recording's: %s\n", describePayload(t.packets[0].payload))
+	}
+
+	events := make(chan replayEvent)
+	done := make(chan struct{})
+	defer close(done)
+	go readReplayPackets(listener, events, done)
+	go readReplayPackets(tid, events, done)
+
+	side := replaySide{
+		fromClient: false,
+		peer:       "client",
+		send: func(p recordedPacket) (net.Addr, error) {
+			conn := tid
+			if p.listener {
+				conn = listener
+			}
+			_, err := conn.WriteTo(p.payload, client)
+			return client, err
+		},
+		heard: func(e replayEvent) {},
+	}
+	received := replay(t, side, 1, start, speed, linger, events, out)
+	return compareReplayed(out, side.peer, t.sentBy(true)[1:], received)
+}
+
+// runReplay is the replay subcommand: it plays one side of a recorded
+// transfer against a live server or client with the recording's timing, and
+// reports whether the other side answered as it did when recorded.
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	side := flags.String("side", "client", "side of the recording to play, \"client\" or \"server\"")
+	server := flags.String("server", "127.0.0.1:9010", "address of the server to play the client side against")
+	listen := flags.String("listen", "", "address to play from; for the server side, where to wait for the client's request")
+	speed := flags.Float64("speed", 1, "how many times faster than recorded to play")
+	linger := flags.Duration("linger", 2*time.Second, "how long to wait for more packets after the last one played")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: tftp replay [-side client|server] [-server addr] [-listen addr] recording.pcap")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || *side != "client" && *side != "server" || *speed <= 0 {
+		flags.Usage()
+		return 2
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 1
+	}
+	defer f.Close()
+	reader, err := capture.NewReader(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %s: %s\n", flags.Arg(0), err)
+		return 1
+	}
+	recorded, err := loadRecording(reader)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %s: %s\n", flags.Arg(0), err)
+		return 1
+	}
+	fmt.Printf("Replaying the %s side of %s from %s to %s\n", *side, describePayload(recorded.packets[0].payload), recorded.client, recorded.server)
+
+	matched := false
+	if *side == "client" {
+		serverAddr, err := net.ResolveUDPAddr("udp", *server)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "replay:", err)
+			return 2
+		}
+		conn, err := net.ListenPacket("udp", *listen)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "replay:", err)
+			return 1
+		}
+		defer conn.Close()
+		matched = replayClient(recorded, conn, serverAddr, *speed, *linger, os.Stdout)
+	} else {
+		if *listen == "" {
+			fmt.Fprintln(os.Stderr, "replay: the server side needs -listen")
+			return 2
+		}
+		listener, err := net.ListenPacket("udp", *listen)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "replay:", err)
+			return 1
+		}
+		defer listener.Close()
+		host, _, _ := net.SplitHostPort(listener.LocalAddr().String())
+		tid, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "replay:", err)
+			return 1
+		}
+		defer tid.Close()
+		fmt.Printf("Waiting for a request on %s\n", listener.LocalAddr())
+		matched = replayServer(recorded, listener, tid, *speed, *linger, os.Stdout)
+	}
+	if !matched {
+		return 1
+	}
+	return 0
+}
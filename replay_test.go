@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"github.com/coffeepac/tftp/capture"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadRecording(t *testing.T) {
+	const (
+		server = "10.0.0.1:69"
+		tid    = "10.0.0.8:40001" // answering from another of the server's addresses
+		client = "10.0.0.2:2000"
+	)
+	request := &wire.PacketRequest{Op: wire.OpRRQ, Filename: "boot.cfg", Mode: "octet"}
+	packets := []capturedPacket{
+		{"10.0.0.9:53", "10.0.0.2:53", nil},
+		{client, server, request},
+		{client, server, request},
+		{tid, client, &wire.PacketData{BlockNum: 1, Data: []byte("short")}},
+		{"10.0.0.3:2000", tid, &wire.PacketAck{BlockNum: 1}},
+		{client, tid, &wire.PacketAck{BlockNum: 1}},
+	}
+	reader, _ := capture.NewReader(bytes.NewReader(buildCapture(t, packets)))
+	recorded, err := loadRecording(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded.client.String() != client || recorded.server.String() != server {
+		t.Errorf("Expected a request from %s to %s; got %s to %s", client, server, recorded.client, recorded.server)
+	}
+	expected := []recordedPacket{
+		{0, true, true, request.Serialize()},
+		{time.Millisecond, true, true, request.Serialize()},
+		{2 * time.Millisecond, false, false, (&wire.PacketData{BlockNum: 1, Data: []byte("short")}).Serialize()},
+		{4 * time.Millisecond, true, false, (&wire.PacketAck{BlockNum: 1}).Serialize()},
+	}
+	if len(recorded.packets) != len(expected) {
+		t.Fatalf("Expected %d packets; got %d", len(expected), len(recorded.packets))
+	}
+	for i, e := range expected {
+		p := recorded.packets[i]
+		if p.at != e.at || p.fromClient != e.fromClient || p.listener != e.listener || !bytes.Equal(p.payload, e.payload) {
+			t.Errorf("Packet %d: expected %+v; got %+v", i+1, e, p)
+		}
+	}
+	if sent := recorded.sentBy(false); len(sent) != 1 {
+		t.Errorf("Expected the server to have sent one packet; got %d", len(sent))
+	}
+
+	reader, _ = capture.NewReader(bytes.NewReader(buildCapture(t, packets[:1])))
+	if _, err := loadRecording(reader); err == nil {
+		t.Errorf("Expected an error for a capture without a request")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	recordingRule, _ = compileRecording(&recordingConfig{Dir: dir})
+	defer func() { recordingRule = nil }()
+	files = newCASStore()
+	files.Write("boot.cfg", strings.Repeat("replayed", 150), "")
+
+	listeners, err := openListeners([]listenSpec{{network: "udp4", address: "127.0.0.1:0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	forgetRequests(t)
+	wg.Add(1)
+	txID := int64(0)
+	txns := make(chan string, 2)
+	go serve(listeners[0], wire.ParseDefault, &txID, txns, &wg)
+	defer func() {
+		listeners[0].Close()
+		wg.Wait()
+	}()
+
+	// a slow client, so that replayed ACKs can't overtake the server's DATA
+	readFromServer(t, listeners[0].LocalAddr(), "boot.cfg", 50*time.Millisecond)
+	<-txns
+	recordings := finishedRecordings(dir)
+	if len(recordings) != 1 {
+		t.Fatalf("Expected one recording; got %v", recordings)
+	}
+	f, err := os.Open(recordings[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader, err := capture.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := loadRecording(reader)
+	if err != nil || len(recorded.packets) != 7 {
+		t.Fatalf("Expected a recording of 7 packets; got %v, %v", recorded, err)
+	}
+
+	// the client side against the server it was recorded from
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	matched := replayClient(recorded, conn, listeners[0].LocalAddr(), 1, 200*time.Millisecond, &out)
+	conn.Close()
+	<-txns
+	if !matched || !strings.Contains(out.String(), "The server's 3 packets match the recording") {
+		t.Errorf("Expected the server to answer as recorded; got\n%s", out.String())
+	}
+
+	// both sides against each other, twice as fast
+	listener, _ := net.ListenPacket("udp4", "127.0.0.1:0")
+	tid, _ := net.ListenPacket("udp4", "127.0.0.1:0")
+	conn, _ = net.ListenPacket("udp4", "127.0.0.1:0")
+	serverMatched := make(chan bool)
+	var serverOut bytes.Buffer
+	go func() {
+		serverMatched <- replayServer(recorded, listener, tid, 2, 200*time.Millisecond, &serverOut)
+	}()
+	var clientOut bytes.Buffer
+	clientMatched := replayClient(recorded, conn, listener.LocalAddr(), 2, 200*time.Millisecond, &clientOut)
+	if !<-serverMatched || !clientMatched {
+		t.Errorf("Expected each side to see the other as recorded; got\n%s\n%s", serverOut.String(), clientOut.String())
+	}
+	for _, c := range []net.PacketConn{listener, tid, conn} {
+		c.Close()
+	}
+	if !strings.Contains(clientOut.String(), "from "+tid.LocalAddr().String()) {
+		t.Errorf("Expected the server side to be played from its transfer port; got\n%s", clientOut.String())
+	}
+}
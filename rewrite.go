@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var rewriteRules []*rewriteRule // applied in order to every requested filename
+var arpTable = "/proc/net/arp"  // where client MAC addresses are looked up for the \m placeholder
+
+var errRequestRejected = errors.New("request rejected by rewrite rules")
+
+// rewriteRuleConfig is a rewrite rule as it appears in the config file.  Flags
+// follow tftp-hpa's remap files:
+//
+//	g  replace every match instead of only the first
+//	i  match case-insensitively
+//	e  stop processing rules if this one matched
+//	a  reject the request if this rule matched
+//	G  only apply this rule to read requests
+//	P  only apply this rule to write requests
+//
+// Replace may use $1 or ${name} for submatches, and \i (client IP), \x (client
+// IP as 8 hex digits, like pxelinux), \p (client port) and \m (client MAC,
+// dash separated) for the requesting client.  A rule without Replace only
+// matches, which is useful with the e and a flags.
+type rewriteRuleConfig struct {
+	Match   string  `json:"match"`
+	Replace *string `json:"replace"`
+	Flags   string  `json:"flags"`
+}
+
+type rewriteRule struct {
+	re      *regexp.Regexp
+	replace *string
+	global  bool
+	stop    bool
+	reject  bool
+	onlyOp  uint16 // 0 for any request, otherwise wire.OpRRQ or wire.OpWRQ
+}
+
+func compileRewriteRules(configs []rewriteRuleConfig) ([]*rewriteRule, error) {
+	rules := make([]*rewriteRule, 0, len(configs))
+	for i, c := range configs {
+		rule := &rewriteRule{replace: c.Replace}
+		pattern := c.Match
+		for _, flag := range c.Flags {
+			switch flag {
+			case 'g':
+				rule.global = true
+			case 'i':
+				pattern = "(?i)" + pattern
+			case 'e':
+				rule.stop = true
+			case 'a':
+				rule.reject = true
+			case 'G':
+				rule.onlyOp = wire.OpRRQ
+			case 'P':
+				rule.onlyOp = wire.OpWRQ
+			default:
+				return nil, fmt.Errorf("rewrite rule %d: unknown flag %q", i+1, flag)
+			}
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite rule %d: %s", i+1, err)
+		}
+		rule.re = re
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// rewriteFilename runs the requested filename through rules, returning the
+// name that should be looked up or errRequestRejected.
+func rewriteFilename(rules []*rewriteRule, request *wire.PacketRequest, addr net.Addr) (string, error) {
+	filename, err := applyRewriteRules(rules, request, addr)
+	if err == nil && filename != request.Filename {
+		log.Printf("Rewrote requested filename %q to %q", request.Filename, filename)
+	}
+	return filename, err
+}
+
+// applyRewriteRules is rewriteFilename without the logging
+func applyRewriteRules(rules []*rewriteRule, request *wire.PacketRequest, addr net.Addr) (string, error) {
+	filename := request.Filename
+	for _, rule := range rules {
+		if rule.onlyOp != 0 && rule.onlyOp != request.Op {
+			continue
+		}
+		if !rule.re.MatchString(filename) {
+			continue
+		}
+		if rule.reject {
+			return "", errRequestRejected
+		}
+		if rule.replace != nil {
+			filename = rule.apply(filename, addr)
+		}
+		if rule.stop {
+			break
+		}
+	}
+	return filename, nil
+}
+
+// apply substitutes the rule's replacement for the first (or, with the g flag,
+// every) match in filename.
+func (r *rewriteRule) apply(filename string, addr net.Addr) string {
+	template := expandClientPlaceholders(*r.replace, addr)
+	n := 1
+	if r.global {
+		n = -1
+	}
+	var result []byte
+	last := 0
+	for _, match := range r.re.FindAllStringSubmatchIndex(filename, n) {
+		result = append(result, filename[last:match[0]]...)
+		result = r.re.ExpandString(result, template, filename, match)
+		last = match[1]
+	}
+	return string(append(result, filename[last:]...))
+}
+
+// expandClientPlaceholders replaces the \i, \x, \p and \m placeholders in a
+// replacement with details of the client at addr.  \\ is a literal backslash.
+func expandClientPlaceholders(replace string, addr net.Addr) string {
+	if !strings.Contains(replace, `\`) {
+		return replace
+	}
+	ip, port := clientIPPort(addr)
+	var b strings.Builder
+	for i := 0; i < len(replace); i++ {
+		if replace[i] != '\\' || i+1 == len(replace) {
+			b.WriteByte(replace[i])
+			continue
+		}
+		i++
+		switch replace[i] {
+		case 'i':
+			if ip != nil {
+				b.WriteString(ip.String())
+			}
+		case 'x':
+			if ip4 := ip.To4(); ip4 != nil {
+				fmt.Fprintf(&b, "%02X%02X%02X%02X", ip4[0], ip4[1], ip4[2], ip4[3])
+			}
+		case 'p':
+			b.WriteString(strconv.Itoa(port))
+		case 'm':
+			b.WriteString(strings.Replace(lookupMAC(ip), ":", "-", -1))
+		default:
+			b.WriteByte(replace[i])
+		}
+	}
+	return b.String()
+}
+
+// clientIPPort pulls the IP and port out of a UDP address.  Any other kind of
+// address yields a nil IP and port 0.
+func clientIPPort(addr net.Addr) (net.IP, int) {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP, udpAddr.Port
+	}
+	return nil, 0
+}
+
+// lookupMAC finds ip in the kernel's ARP table, returning its hardware address
+// in lower case, or "" if it isn't there.
+func lookupMAC(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	f, err := os.Open(arpTable)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // skip over the header line
+	for scanner.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 4 && net.ParseIP(fields[0]).Equal(ip) {
+			return strings.ToLower(fields[3])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"os"
+	"testing"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestRewriteFilename(t *testing.T) {
+	arp, err := os.CreateTemp("", "arp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(arp.Name())
+	arp.WriteString("IP address       HW type     Flags       HW address            Mask     Device\n")
+	arp.WriteString("10.0.0.7         0x1         0x2         AA:BB:CC:DD:EE:FF     *        eth0\n")
+	arp.Close()
+	oldArpTable := arpTable
+	arpTable = arp.Name()
+	defer func() { arpTable = oldArpTable }()
+
+	rules, err := compileRewriteRules([]rewriteRuleConfig{
+		{Match: `\\`, Replace: strPtr("/"), Flags: "g"},
+		{Match: `^/tftpboot/`, Replace: strPtr(""), Flags: "i"},
+		{Match: `^/`, Replace: strPtr("")},
+		{Match: `\.\.`, Flags: "a"},
+		{Match: `^mine$`, Replace: strPtr(`hosts/\i-\p/\m`), Flags: "e"},
+		{Match: `^pxelinux\.cfg/default$`, Replace: strPtr(`pxelinux.cfg/\x`), Flags: "G"},
+		{Match: `^upload/(.*)$`, Replace: strPtr(`incoming/$1`), Flags: "P"},
+		{Match: `^hosts/`, Replace: strPtr("never/")},
+	})
+	if err != nil {
+		t.Fatalf("unable to compile rules: %s", err)
+	}
+
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.7"), Port: 2000}
+	tests := []struct {
+		op       uint16
+		filename string
+		expected string
+		rejected bool
+	}{
+		{wire.OpRRQ, "boot.cfg", "boot.cfg", false},
+		{wire.OpRRQ, `\pxelinux.cfg\01-aa-bb`, "pxelinux.cfg/01-aa-bb", false},
+		{wire.OpRRQ, "/TFTPBOOT/kernel", "kernel", false},
+		{wire.OpRRQ, "../etc/passwd", "", true},
+		{wire.OpRRQ, "mine", "hosts/10.0.0.7-2000/aa-bb-cc-dd-ee-ff", false},
+		{wire.OpRRQ, "pxelinux.cfg/default", "pxelinux.cfg/0A000007", false},
+		{wire.OpWRQ, "pxelinux.cfg/default", "pxelinux.cfg/default", false},
+		{wire.OpRRQ, "upload/switch1", "upload/switch1", false},
+		{wire.OpWRQ, "upload/switch1", "incoming/switch1", false},
+	}
+
+	for _, test := range tests {
+		request := &wire.PacketRequest{Op: test.op, Filename: test.filename, Mode: "octet"}
+		actual, err := rewriteFilename(rules, request, addr)
+		if test.rejected {
+			if err != errRequestRejected {
+				t.Errorf("Rewriting %q: expected rejection; got %q, %v", test.filename, actual, err)
+			}
+		} else if err != nil {
+			t.Errorf("Rewriting %q: unexpected error %s", test.filename, err)
+		} else if actual != test.expected {
+			t.Errorf("Rewriting %q: expected %q; got %q", test.filename, test.expected, actual)
+		}
+	}
+}
+
+func TestCompileRewriteRulesInvalid(t *testing.T) {
+	tests := []rewriteRuleConfig{
+		{Match: "(unclosed"},
+		{Match: "ok", Flags: "z"},
+	}
+
+	for _, test := range tests {
+		if _, err := compileRewriteRules([]rewriteRuleConfig{test}); err == nil {
+			t.Errorf("Compiling %#v: expected error", test)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+var virtualRoots []*virtualRoot // checked in order, first root matching the client wins
+
+// virtualRootConfig is a virtual root as it appears in the config file.  Clients
+// are IP addresses or CIDR subnets.  Roots with the same name share a store, so
+// several subnets can be pointed at one lab's files.
+type virtualRootConfig struct {
+	Root    string   `json:"root"`
+	Clients []string `json:"clients"`
+}
+
+// virtualRoot gives the clients in a set of subnets their own namespace of files
+type virtualRoot struct {
+	name    string
+	clients []*net.IPNet
+	store   fileStore
+}
+
+func compileVirtualRoots(configs []virtualRootConfig) ([]*virtualRoot, error) {
+	stores := make(map[string]fileStore)
+	roots := make([]*virtualRoot, 0, len(configs))
+	for i, c := range configs {
+		if c.Root == "" {
+			return nil, fmt.Errorf("virtual root %d: missing root name", i+1)
+		}
+		root := &virtualRoot{name: c.Root}
+		for _, client := range c.Clients {
+			subnet, err := parseSubnet(client)
+			if err != nil {
+				return nil, fmt.Errorf("virtual root %q: %s", c.Root, err)
+			}
+			root.clients = append(root.clients, subnet)
+		}
+		if _, ok := stores[c.Root]; !ok {
+			stores[c.Root] = newCASStore()
+		}
+		root.store = stores[c.Root]
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// parseSubnet parses a CIDR subnet, treating a bare IP address as a subnet of one.
+func parseSubnet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, subnet, err := net.ParseCIDR(s)
+	return subnet, err
+}
+
+// storeFor returns the name of the root and the store that requests from addr
+// are served from.  Clients outside every virtual root use the default store.
+func storeFor(addr net.Addr) (string, fileStore) {
+	ip, _ := clientIPPort(addr)
+	if ip != nil {
+		for _, root := range virtualRoots {
+			for _, subnet := range root.clients {
+				if subnet.Contains(ip) {
+					return root.name, root.store
+				}
+			}
+		}
+	}
+	return "", files
+}
+
+// rootStores maps the name of every root to its store, with the default store
+// under "".
+func rootStores() map[string]fileStore {
+	stores := map[string]fileStore{"": files}
+	for _, root := range virtualRoots {
+		stores[root.name] = root.store
+	}
+	return stores
+}
+
+// rootNames lists the names of every root in sorted order, starting with "".
+func rootNames() []string {
+	names := make([]string, 0, len(virtualRoots)+1)
+	for name := range rootStores() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestStoreFor(t *testing.T) {
+	files = newCASStore()
+	roots, err := compileVirtualRoots([]virtualRootConfig{
+		{Root: "labA", Clients: []string{"10.1.0.0/16", "192.168.0.9"}},
+		{Root: "labB", Clients: []string{"10.2.0.0/16", "fd00::/64"}},
+		{Root: "labA", Clients: []string{"10.3.0.0/16"}},
+	})
+	if err != nil {
+		t.Fatalf("unable to compile virtual roots: %s", err)
+	}
+	oldRoots := virtualRoots
+	virtualRoots = roots
+	defer func() { virtualRoots = oldRoots }()
+
+	tests := []struct {
+		ip   string
+		root string
+	}{
+		{"10.1.2.3", "labA"},
+		{"192.168.0.9", "labA"},
+		{"192.168.0.10", ""},
+		{"10.2.0.1", "labB"},
+		{"fd00::5", "labB"},
+		{"10.3.255.255", "labA"},
+		{"10.4.0.1", ""},
+	}
+
+	for _, test := range tests {
+		root, _ := storeFor(&net.UDPAddr{IP: net.ParseIP(test.ip), Port: 2000})
+		if root != test.root {
+			t.Errorf("Client %s: expected root %q; got %q", test.ip, test.root, root)
+		}
+	}
+
+	// the same name requested from different labs gets each lab's own copy
+	_, storeA := storeFor(&net.UDPAddr{IP: net.ParseIP("10.1.0.1")})
+	_, storeB := storeFor(&net.UDPAddr{IP: net.ParseIP("10.2.0.1")})
+	_, storeA2 := storeFor(&net.UDPAddr{IP: net.ParseIP("10.3.0.1")})
+	storeA.Write("boot.cfg", "lab A", "")
+	storeB.Write("boot.cfg", "lab B", "")
+	if contents, _ := storeA2.Read("boot.cfg"); contents != "lab A" {
+		t.Errorf("Expected roots with the same name to share a store; got %q", contents)
+	}
+	if contents, _ := storeB.Read("boot.cfg"); contents != "lab B" {
+		t.Errorf("Expected lab B's copy of boot.cfg; got %q", contents)
+	}
+	if _, ok := files.Read("boot.cfg"); ok {
+		t.Errorf("Expected default store to be untouched by writes to virtual roots")
+	}
+}
+
+func TestCompileVirtualRootsInvalid(t *testing.T) {
+	tests := []virtualRootConfig{
+		{Clients: []string{"10.0.0.0/8"}},
+		{Root: "lab", Clients: []string{"10.0.0.0/33"}},
+		{Root: "lab", Clients: []string{"not-an-ip"}},
+	}
+
+	for _, test := range tests {
+		if _, err := compileVirtualRoots([]virtualRootConfig{test}); err == nil {
+			t.Errorf("Compiling %#v: expected error", test)
+		}
+	}
+}
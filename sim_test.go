@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"github.com/coffeepac/tftp/memnet"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// simTransfer runs opRead or opWrite for request on a simulated network
+// between a server at 10.0.0.1 and a client at 10.0.0.2, which retransmits
+// like a real client would.  It returns what the client read and the server's
+// txn log line.  The server and the client both run registered with network,
+// so its clock only moves on when they're both waiting.
+func simTransfer(t *testing.T, network *memnet.Network, request *wire.PacketRequest, upload []byte) ([]byte, string) {
+	server, err := network.Listen("10.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := network.Listen("10.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	txns := make(chan string, 1)
+	if request.Op == wire.OpRRQ {
+		network.Go(func() { opRead(request, client.LocalAddr(), server, wire.ParseDefault, 0, txns) })
+	} else {
+		network.Go(func() { opWrite(request, client.LocalAddr(), server, wire.ParseDefault, 0, txns) })
+	}
+
+	network.Enter()
+	contents, txn := simClient(t, client, server.LocalAddr(), txns, upload)
+	network.Leave()
+	if txn == "" {
+		txn = <-txns
+	}
+	return contents, txn
+}
+
+// simClient runs simTransfer's client over client until the transfer with
+// server is over, returning what it read and the txn log line if it has
+// already seen it.
+func simClient(t *testing.T, client net.PacketConn, server net.Addr, txns chan string, upload []byte) ([]byte, string) {
+	var contents []byte
+	var last []byte // the client's last packet, to resend on a timeout
+	expected := uint16(1)
+	finished := false
+	buf := make([]byte, wire.MaxPacketSize)
+	// outlast the server's retries, so that it's the one to give up first
+	patience := connRetries * timeoutSeconds / 5
+	for timeouts := 0; timeouts <= patience; {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, addr, err := client.ReadFrom(buf)
+		if err != nil && err.(net.Error).Timeout() {
+			if finished {
+				// dally until the server is done, in case the last ACK was lost
+				select {
+				case txn := <-txns:
+					return contents, txn
+				default:
+				}
+			} else if last != nil {
+				client.WriteTo(last, server)
+			}
+			timeouts++
+			continue
+		}
+		if addr.String() != server.String() {
+			t.Errorf("Packet from unexpected address %s", addr)
+			continue
+		}
+		timeouts = 0
+		packet, err := wire.ParsePacket(buf[:n])
+		if err != nil {
+			t.Fatalf("Unparseable packet from the server: %s", err)
+		}
+		switch p := packet.(type) {
+		case *wire.PacketData:
+			if p.BlockNum == expected {
+				contents = append(contents, p.Data...)
+				expected++
+				finished = len(p.Data) < 512
+			}
+			if p.BlockNum < expected {
+				ack := wire.PacketAck{BlockNum: p.BlockNum}
+				last = ack.Serialize()
+				client.WriteTo(last, addr)
+			}
+		case *wire.PacketAck:
+			if p.BlockNum != expected-1 || finished {
+				continue // a duplicate
+			}
+			offset := int(p.BlockNum) * 512
+			if offset > len(upload) {
+				finished = true
+				continue
+			}
+			chunk := upload[offset:]
+			if len(chunk) > 512 {
+				chunk = chunk[:512]
+			}
+			data := wire.PacketData{BlockNum: expected, Data: chunk}
+			last = data.Serialize()
+			client.WriteTo(last, addr)
+			expected++
+		case *wire.PacketError:
+			return contents, ""
+		}
+	}
+	return contents, ""
+}
+
+func TestSimulatedReads(t *testing.T) {
+	contents := bytes.Repeat([]byte("0123456789abcdef"), 200) // 3200 bytes, 7 blocks
+	tests := []struct {
+		name       string
+		conditions memnet.Conditions
+	}{
+		{"clean", memnet.Conditions{}},
+		{"lossy", memnet.Conditions{Loss: 0.2}},
+		{"duplicating", memnet.Conditions{Duplicate: 0.5}},
+		{"reordering", memnet.Conditions{Reorder: 0.3}},
+		{"slow", memnet.Conditions{Delay: 2 * time.Second, Jitter: 3 * time.Second}},
+		{"everything", memnet.Conditions{Loss: 0.1, Duplicate: 0.2, Reorder: 0.2, Delay: time.Second, Jitter: time.Second}},
+	}
+
+	for _, test := range tests {
+		files = newCASStore()
+		files.Write("image.bin", string(contents), "")
+		network := memnet.New(7, true)
+		network.SetConditions(test.conditions)
+		start := time.Now()
+		received, txn := simTransfer(t, network, &wire.PacketRequest{Op: wire.OpRRQ, Filename: "image.bin", Mode: "octet"}, nil)
+		network.Close()
+		if !bytes.Equal(received, contents) {
+			t.Errorf("%s: expected %d bytes intact; got %d", test.name, len(contents), len(received))
+		}
+		if !strings.Contains(txn, "success") {
+			t.Errorf("%s: expected the server to log success; got %q", test.name, txn)
+		}
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("%s: expected virtual timeouts to pass quickly; took %s", test.name, elapsed)
+		}
+	}
+}
+
+func TestSimulatedReadLostAck(t *testing.T) {
+	files = newCASStore()
+	files.Write("boot.cfg", strings.Repeat("x", 1000), "")
+	network := memnet.New(1, true)
+	defer network.Close()
+
+	// lose the client's first ACK of block 1, so the server must time out
+	// and resend
+	lost := false
+	network.SetFilter(func(from, to net.Addr, packet []byte) bool {
+		if !lost && bytes.Equal(packet, (&wire.PacketAck{BlockNum: 1}).Serialize()) {
+			lost = true
+			return false
+		}
+		return true
+	})
+	virtualStart := network.Clock.Now()
+	received, txn := simTransfer(t, network, &wire.PacketRequest{Op: wire.OpRRQ, Filename: "boot.cfg", Mode: "octet"}, nil)
+	if len(received) != 1000 || !strings.Contains(txn, "success") {
+		t.Errorf("Expected the read to recover from a lost ACK; got %d bytes, %q", len(received), txn)
+	}
+	if elapsed := network.Clock.Now().Sub(virtualStart); elapsed < 5*time.Second {
+		t.Errorf("Expected the client's retransmission timeout to pass on the virtual clock; %s did", elapsed)
+	}
+}
+
+func TestSimulatedWrite(t *testing.T) {
+	files = newCASStore()
+	contents := bytes.Repeat([]byte("w"), 1500)
+	network := memnet.New(3, true)
+	defer network.Close()
+	// only the client's packets are lost, so the server never sees a DATA twice
+	network.SetLinkConditions("10.0.0.2", "10.0.0.1", memnet.Conditions{Loss: 0.3, Delay: time.Second})
+
+	_, txn := simTransfer(t, network, &wire.PacketRequest{Op: wire.OpWRQ, Filename: "upload.bin", Mode: "octet"}, contents)
+	if !strings.Contains(txn, "success") {
+		t.Errorf("Expected the write to succeed; got %q", txn)
+	}
+	if stored, _ := files.Read("upload.bin"); stored != string(contents) {
+		t.Errorf("Expected %d bytes stored; got %d", len(contents), len(stored))
+	}
+}
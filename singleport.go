@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/binary"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var singlePort = false  // run every transfer over the listening socket instead of a new port each
+var muxQueueLength = 16 // packets held for a transfer in single port mode before more are dropped
+
+// portMux shares one listening socket between every transfer on it, handing
+// each packet to the transfer with the peer it came from.
+type portMux struct {
+	server net.PacketConn
+
+	sync.Mutex
+	peers map[string]*muxConn
+}
+
+func newPortMux(server net.PacketConn) *portMux {
+	return &portMux{server: server, peers: make(map[string]*muxConn)}
+}
+
+// open starts a transfer with peer, which sent its request to local.  It
+// returns nil if one is already running, as peers are told apart by address
+// alone.
+func (m *portMux) open(peer, local net.Addr) net.PacketConn {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.peers[peer.String()]; ok {
+		return nil
+	}
+	conn := &muxConn{
+		mux:     m,
+		peer:    peer,
+		packets: make(chan []byte, muxQueueLength),
+		closed:  make(chan struct{}),
+		source:  m.replySource(local),
+	}
+	m.peers[peer.String()] = conn
+	return conn
+}
+
+// replySource is the control message that sends replies from local, the
+// address a request was sent to, or nil if the listener isn't a wildcard
+// socket that needs telling.
+func (m *portMux) replySource(local net.Addr) []byte {
+	listening, ok := m.server.LocalAddr().(*net.UDPAddr)
+	if _, udp := m.server.(*net.UDPConn); !udp || !ok || (listening.IP != nil && !listening.IP.IsUnspecified()) {
+		return nil
+	}
+	localUDP, ok := local.(*net.UDPAddr)
+	if !ok || localUDP.IP == nil || localUDP.IP.IsUnspecified() {
+		return nil
+	}
+	return packetSource(localUDP)
+}
+
+// deliver passes packet to the transfer with peer, reporting whether there
+// is one.  Requests from a peer with a transfer running are retransmits of
+// the request that started it and are dropped.
+func (m *portMux) deliver(peer net.Addr, packet []byte) bool {
+	m.Lock()
+	conn, ok := m.peers[peer.String()]
+	m.Unlock()
+	if !ok {
+		return false
+	}
+	if op := packetOp(packet); op == wire.OpRRQ || op == wire.OpWRQ {
+		log.Printf("Dropped request from %s, which already has a transfer running", peer)
+		return true
+	}
+	select {
+	case conn.packets <- append([]byte(nil), packet...):
+	default:
+		log.Printf("Dropped packet from %s, its transfer has fallen behind", peer)
+	}
+	return true
+}
+
+// muxConn is one transfer's view of a shared socket.  It only reads packets
+// from its peer and writes through the shared socket, from the address the
+// peer sent its request to.
+type muxConn struct {
+	mux     *portMux
+	peer    net.Addr
+	packets chan []byte
+	source  []byte // control message setting the source address of replies, if they need one
+
+	sync.Mutex
+	deadline  time.Time
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *muxConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.Lock()
+	deadline := c.deadline
+	c.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case packet := <-c.packets:
+		return copy(b, packet), c.peer, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *muxConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok && c.source != nil {
+		n, _, err := c.mux.server.(*net.UDPConn).WriteMsgUDP(b, c.source, udpAddr)
+		return n, err
+	}
+	return c.mux.server.WriteTo(b, addr)
+}
+
+// Close ends the transfer, so that the next request from its peer starts a new one
+func (c *muxConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mux.Lock()
+		delete(c.mux.peers, c.peer.String())
+		c.mux.Unlock()
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *muxConn) LocalAddr() net.Addr {
+	return c.mux.server.LocalAddr()
+}
+
+func (c *muxConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *muxConn) SetReadDeadline(t time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+	c.deadline = t
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes go straight to the shared socket
+func (c *muxConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// packetOp is the opcode of packet, or 0 if it's too short to have one
+func packetOp(packet []byte) uint16 {
+	if len(packet) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(packet)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSinglePortTransfers(t *testing.T) {
+	files = newCASStore()
+	singlePort = true
+	defer func() { singlePort = false }()
+
+	listeners, err := openListeners([]listenSpec{{network: "udp4", address: "127.0.0.1:0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := listeners[0]
+	var wg sync.WaitGroup
+	forgetRequests(t)
+	wg.Add(1)
+	txID := int64(0)
+	txns := make(chan string, 10)
+	go serve(server, wire.ParseDefault, &txID, txns, &wg)
+	defer func() {
+		server.Close()
+		wg.Wait()
+	}()
+
+	// exchange sends packet to the server and returns its reply, checking that
+	// it came from the listening port
+	exchange := func(client net.PacketConn, packet []byte) wire.Packet {
+		client.WriteTo(packet, server.LocalAddr())
+		buf := make([]byte, wire.MaxPacketSize)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		n, addr, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != server.LocalAddr().String() {
+			t.Errorf("Expected reply from %s; got %s", server.LocalAddr(), addr)
+		}
+		reply, err := wire.ParsePacket(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	contents := bytes.Repeat([]byte("z"), 700)
+	writer, _ := net.ListenPacket("udp4", "127.0.0.1:0")
+	defer writer.Close()
+	reader, _ := net.ListenPacket("udp4", "127.0.0.1:0")
+	defer reader.Close()
+
+	wrq := wire.PacketRequest{Op: wire.OpWRQ, Filename: "shared.bin", Mode: "octet"}
+	if ack, ok := exchange(writer, wrq.Serialize()).(*wire.PacketAck); !ok || ack.BlockNum != 0 {
+		t.Fatalf("Expected ACK 0; got %#v", ack)
+	}
+	// a retransmitted WRQ mid-transfer is dropped rather than starting another
+	writer.WriteTo(wrq.Serialize(), server.LocalAddr())
+	block1 := wire.PacketData{BlockNum: 1, Data: contents[:512]}
+	if ack, ok := exchange(writer, block1.Serialize()).(*wire.PacketAck); !ok || ack.BlockNum != 1 {
+		t.Fatalf("Expected ACK 1; got %#v", ack)
+	}
+
+	// another client's transfer runs on the same port at the same time
+	files.Write("other.cfg", "interleaved", "")
+	rrq := wire.PacketRequest{Op: wire.OpRRQ, Filename: "other.cfg", Mode: "octet"}
+	if data, ok := exchange(reader, rrq.Serialize()).(*wire.PacketData); !ok || string(data.Data) != "interleaved" {
+		t.Fatalf("Expected DATA for other.cfg; got %#v", data)
+	}
+	ack := wire.PacketAck{BlockNum: 1}
+	reader.WriteTo(ack.Serialize(), server.LocalAddr())
+
+	block2 := wire.PacketData{BlockNum: 2, Data: contents[512:]}
+	if ack, ok := exchange(writer, block2.Serialize()).(*wire.PacketAck); !ok || ack.BlockNum != 2 {
+		t.Fatalf("Expected ACK 2; got %#v", ack)
+	}
+	<-txns
+	<-txns
+
+	if stored, _ := files.Read("shared.bin"); stored != string(contents) {
+		t.Errorf("Expected %d bytes stored; got %d", len(contents), len(stored))
+	}
+	if versions := files.Versions("shared.bin"); len(versions) != 1 {
+		t.Errorf("Expected the retransmitted WRQ not to start a second write; got %d versions", len(versions))
+	}
+}
+
+func TestMuxConnDeadline(t *testing.T) {
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	mux := newPortMux(server)
+	peer := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2000}
+
+	conn := mux.open(peer, nil)
+	if mux.open(peer, nil) != nil {
+		t.Errorf("Expected a second transfer with the same peer to be refused")
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err = conn.ReadFrom(make([]byte, 10))
+	if nErr, ok := err.(net.Error); !ok || !nErr.Timeout() {
+		t.Errorf("Expected a timeout; got %v", err)
+	}
+
+	conn.Close()
+	if mux.deliver(peer, []byte{0, 4, 0, 1}) {
+		t.Errorf("Expected no transfer to deliver to once closed")
+	}
+	if mux.open(peer, nil) == nil {
+		t.Errorf("Expected a new transfer with the peer once the last was closed")
+	}
+}
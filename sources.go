@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// writeSink receives the contents of a WRQ as its DATA packets arrive
+type writeSink interface {
+	io.Writer
+	// Commit is called once the last block has arrived, before it is ACKed.
+	// An error is reported to the client in place of the final ACK.
+	Commit() error
+	// Abort is called instead of Commit if the transfer fails
+	Abort()
+}
+
+// openReadSource finds the contents to serve for a RRQ of filename, in order
+// from a template, a command hook, an archive mount and then the client's store.  The size is -1
+// if it isn't known up front.
+func openReadSource(filename string, request *wire.PacketRequest, addr net.Addr) (io.ReadCloser, int64, error) {
+	contents, ok, err := renderTemplate(filename, request, addr)
+	if err != nil {
+		log.Println("Unable to render template.  error: ", err)
+		return nil, 0, &tftpError{Code: 0, Msg: "Unable to generate file"}
+	}
+	if ok {
+		return io.NopCloser(strings.NewReader(contents)), int64(len(contents)), nil
+	}
+
+	rootName, store := storeFor(addr)
+	if hook := findHook(filename, wire.OpRRQ); hook != nil {
+		source, err := hook.startRead(filename, rootName, request, addr)
+		return source, -1, err
+	}
+
+	if mount, member := findMount(filename); mount != nil {
+		return mount.open(member)
+	}
+
+	if contents, ok = store.Read(filename); !ok {
+		return nil, 0, errFileNotFound
+	}
+	return io.NopCloser(strings.NewReader(contents)), int64(len(contents)), nil
+}
+
+// openWriteSink finds where the contents of a WRQ of filename should go,
+// either a command hook or the client's store.
+func openWriteSink(filename string, request *wire.PacketRequest, addr net.Addr) (writeSink, error) {
+	rootName, store := storeFor(addr)
+	if hook := findHook(filename, wire.OpWRQ); hook != nil {
+		return hook.startWrite(filename, rootName, request, addr)
+	}
+	if mount, _ := findMount(filename); mount != nil {
+		return nil, &tftpError{Code: 2, Msg: "Archive mounts are read-only"}
+	}
+	if _, _, ok := splitVersionSuffix(filename); ok {
+		return nil, &tftpError{Code: 2, Msg: "Old versions are read-only"}
+	}
+	return &storeSink{store: store, name: filename, uploader: addr.String(), ttl: fileTTL(filename, request.Options)}, nil
+}
+
+// storeSink buffers an upload so that it only replaces the stored file once
+// the whole thing has arrived.
+type storeSink struct {
+	store    fileStore
+	name     string
+	uploader string
+	ttl      time.Duration // 0 if the file doesn't expire
+	buf      bytes.Buffer
+}
+
+func (s *storeSink) Write(p []byte) (int, error) {
+	return s.buf.Write(p)
+}
+
+func (s *storeSink) Commit() error {
+	var expires time.Time
+	if s.ttl > 0 {
+		expires = time.Now().Add(s.ttl)
+	}
+	if err := s.store.WriteExpiring(s.name, s.buf.String(), s.uploader, expires); err != nil {
+		log.Println("Unable to store written file.  error: ", err)
+		return &tftpError{Code: 0, Msg: "Unable to store file"}
+	}
+	return nil
+}
+
+func (s *storeSink) Abort() {}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var blobs = newBlobStore() // contents of every stored file, shared by all stores
+var keepVersions = 1       // versions of each file to keep, including the current one.  0 for no limit
+var keepVersionDays = 0    // days to keep old versions of a file for.  0 for no limit
+
+// fileStore is met by everything that files can be served from or written to
+type fileStore interface {
+	// Read returns the contents of the named file and whether it exists
+	Read(name string) (string, bool)
+	// Write stores contents under name as its new current version
+	Write(name string, contents string, uploader string) error
+	// WriteExpiring is Write for a version that expires at expires, taking
+	// every version of the file with it.  A zero time never expires.
+	WriteExpiring(name string, contents string, uploader string, expires time.Time) error
+	// Expire removes the files that have expired by now and returns their names
+	Expire(now time.Time) []string
+	// Stat describes the named file and whether it exists
+	Stat(name string) (fileInfo, bool)
+	// Versions describes the retained versions of the named file, oldest first
+	Versions(name string) []fileInfo
+	// Names lists the names of all stored files in sorted order
+	Names() []string
+	// QuotaUsage counts the bytes of retained versions written by clients
+	// covered by quota
+	QuotaUsage(quota *clientQuota) int64
+}
+
+// fileInfo describes a stored file
+type fileInfo struct {
+	Name     string     `json:"name"`
+	Size     int64      `json:"size"`
+	SHA256   string     `json:"sha256"`
+	Modified time.Time  `json:"modified"`
+	Version  int        `json:"version"`
+	Uploader string     `json:"uploader"` // address of the client that wrote this version
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+type blobHash [sha256.Size]byte
+
+func (h blobHash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// blobStore keeps file contents keyed by their SHA-256, counting the names
+// that refer to each so that identical files are only held in memory once and
+// are dropped when the last name goes.
+type blobStore struct {
+	sync.Mutex
+	blobs map[blobHash]*blob
+	size  int64 // total bytes of every blob
+}
+
+type blob struct {
+	data string
+	refs int
+}
+
+func newBlobStore() *blobStore {
+	return &blobStore{blobs: make(map[blobHash]*blob)}
+}
+
+// ref adds a reference to contents, storing them if they're new
+func (s *blobStore) ref(contents string) blobHash {
+	hash := blobHash(sha256.Sum256([]byte(contents)))
+	s.Lock()
+	defer s.Unlock()
+	if b, ok := s.blobs[hash]; ok {
+		b.refs++
+	} else {
+		s.blobs[hash] = &blob{data: contents, refs: 1}
+		s.size += int64(len(contents))
+	}
+	return hash
+}
+
+// unref drops a reference to the blob with hash, freeing it if it was the last
+func (s *blobStore) unref(hash blobHash) {
+	s.Lock()
+	defer s.Unlock()
+	if b, ok := s.blobs[hash]; ok {
+		if b.refs--; b.refs <= 0 {
+			delete(s.blobs, hash)
+			s.size -= int64(len(b.data))
+		}
+	}
+}
+
+func (s *blobStore) get(hash blobHash) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	b, ok := s.blobs[hash]
+	if !ok {
+		return "", false
+	}
+	return b.data, true
+}
+
+// stats returns the number of distinct blobs and the bytes they take up
+func (s *blobStore) stats() (int, int64) {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.blobs), s.size
+}
+
+// casStore is a namespace of names referring to content-addressed blobs.  Each
+// write adds a version, and older versions are kept according to keepVersions
+// and keepVersionDays.  It is safe for concurrent use, as reads and writes come
+// from many transaction goroutines at once.
+type casStore struct {
+	sync.RWMutex
+	blobs *blobStore
+	names map[string]*fileHistory
+
+	// bytes of retained versions by the quota covering their uploader, as of
+	// quotaGeneration usageGeneration
+	usage           map[*clientQuota]int64
+	usageGeneration int64
+}
+
+// fileHistory holds the retained versions of a file, oldest first
+type fileHistory struct {
+	versions []fileVersion
+	next     int // number of the next version written
+}
+
+type fileVersion struct {
+	number   int
+	hash     blobHash
+	size     int64
+	modified time.Time
+	uploader string
+	expires  time.Time // zero if the version never expires
+}
+
+func newCASStore() *casStore {
+	return &casStore{blobs: blobs, names: make(map[string]*fileHistory, 1000)}
+}
+
+// Read returns the current contents of name.  If there's no such file and
+// name ends in a version suffix like "@v3", that version is returned instead.
+func (s *casStore) Read(name string) (string, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	version, ok := s.find(name)
+	if !ok {
+		return "", false
+	}
+	return s.blobs.get(version.hash)
+}
+
+func (s *casStore) Write(name string, contents string, uploader string) error {
+	return s.WriteExpiring(name, contents, uploader, time.Time{})
+}
+
+func (s *casStore) WriteExpiring(name string, contents string, uploader string, expires time.Time) error {
+	hash := s.blobs.ref(contents)
+	s.Lock()
+	defer s.Unlock()
+	s.recountUsage()
+	history, ok := s.names[name]
+	if !ok {
+		history = &fileHistory{next: 1}
+		s.names[name] = history
+	}
+	history.versions = append(history.versions, fileVersion{
+		number:   history.next,
+		hash:     hash,
+		size:     int64(len(contents)),
+		modified: time.Now(),
+		uploader: uploader,
+		expires:  expires,
+	})
+	history.next++
+	s.countUsage(uploader, int64(len(contents)))
+	s.prune(history, time.Now())
+	return nil
+}
+
+func (s *casStore) Stat(name string) (fileInfo, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	version, ok := s.find(name)
+	if !ok {
+		return fileInfo{}, false
+	}
+	return version.info(name), true
+}
+
+func (s *casStore) Versions(name string) []fileInfo {
+	s.RLock()
+	defer s.RUnlock()
+	history, ok := s.names[name]
+	if !ok {
+		return nil
+	}
+	cutoff := versionCutoff(time.Now())
+	infos := make([]fileInfo, 0, len(history.versions))
+	for i, version := range history.versions {
+		if i == len(history.versions)-1 || !version.modified.Before(cutoff) {
+			infos = append(infos, version.info(name))
+		}
+	}
+	return infos
+}
+
+func (s *casStore) Expire(now time.Time) []string {
+	s.Lock()
+	defer s.Unlock()
+	s.recountUsage()
+	var expired []string
+	for name, history := range s.names {
+		if !history.current().expiredBy(now) {
+			continue
+		}
+		for _, version := range history.versions {
+			s.blobs.unref(version.hash)
+			s.countUsage(version.uploader, -version.size)
+		}
+		delete(s.names, name)
+		expired = append(expired, name)
+	}
+	sort.Strings(expired)
+	return expired
+}
+
+func (s *casStore) Names() []string {
+	s.RLock()
+	defer s.RUnlock()
+	names := make([]string, 0, len(s.names))
+	for name := range s.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *casStore) QuotaUsage(quota *clientQuota) int64 {
+	s.Lock()
+	defer s.Unlock()
+	s.recountUsage()
+	return s.usage[quota]
+}
+
+// recountUsage counts the bytes each quota's clients have stored afresh if the
+// quotas have changed since they were last counted.  The caller must hold the
+// write lock.
+func (s *casStore) recountUsage() {
+	generation := atomic.LoadInt64(&quotaGeneration)
+	if s.usage != nil && s.usageGeneration == generation {
+		return
+	}
+	s.usage = make(map[*clientQuota]int64)
+	s.usageGeneration = generation
+	for _, history := range s.names {
+		for _, version := range history.versions {
+			s.countUsage(version.uploader, version.size)
+		}
+	}
+}
+
+// countUsage adds delta bytes written by uploader to its quota's count.  The
+// caller must hold the write lock.
+func (s *casStore) countUsage(uploader string, delta int64) {
+	if quota := uploaderQuota(uploader); quota != nil {
+		if s.usage[quota] += delta; s.usage[quota] == 0 {
+			delete(s.usage, quota)
+		}
+	}
+}
+
+// find returns the current version of name, or the version named by its
+// "@vN" suffix.  Files that have expired but not yet been reaped aren't found.
+// The caller must hold the lock.
+func (s *casStore) find(name string) (fileVersion, bool) {
+	now := time.Now()
+	if history, ok := s.names[name]; ok {
+		if history.current().expiredBy(now) {
+			return fileVersion{}, false
+		}
+		return history.current(), true
+	}
+	base, number, ok := splitVersionSuffix(name)
+	if !ok {
+		return fileVersion{}, false
+	}
+	history, ok := s.names[base]
+	if !ok || history.current().expiredBy(now) {
+		return fileVersion{}, false
+	}
+	cutoff := versionCutoff(now)
+	for i, version := range history.versions {
+		if version.number == number && (i == len(history.versions)-1 || !version.modified.Before(cutoff)) {
+			return version, true
+		}
+	}
+	return fileVersion{}, false
+}
+
+// prune drops old versions of history beyond the retention policy, releasing
+// their blobs.  The current version is always kept.  The caller must hold the
+// write lock.
+func (s *casStore) prune(history *fileHistory, now time.Time) {
+	cutoff := versionCutoff(now)
+	current := len(history.versions) - 1
+	kept := history.versions[:0]
+	for i, version := range history.versions {
+		tooMany := keepVersions > 0 && current-i >= keepVersions
+		tooOld := version.modified.Before(cutoff)
+		if i != current && (tooMany || tooOld) {
+			s.blobs.unref(version.hash)
+			s.countUsage(version.uploader, -version.size)
+			continue
+		}
+		kept = append(kept, version)
+	}
+	history.versions = kept
+}
+
+func (h *fileHistory) current() fileVersion {
+	return h.versions[len(h.versions)-1]
+}
+
+func (v fileVersion) expiredBy(now time.Time) bool {
+	return !v.expires.IsZero() && !now.Before(v.expires)
+}
+
+func (v fileVersion) info(name string) fileInfo {
+	info := fileInfo{
+		Name:     name,
+		Size:     v.size,
+		SHA256:   v.hash.String(),
+		Modified: v.modified,
+		Version:  v.number,
+		Uploader: v.uploader,
+	}
+	if !v.expires.IsZero() {
+		expires := v.expires
+		info.Expires = &expires
+	}
+	return info
+}
+
+var versionSuffix = regexp.MustCompile(`^(.+)@v([0-9]+)$`)
+
+// splitVersionSuffix splits "name@v3" into "name" and 3
+func splitVersionSuffix(name string) (string, int, bool) {
+	match := versionSuffix.FindStringSubmatch(name)
+	if match == nil {
+		return "", 0, false
+	}
+	number, err := strconv.Atoi(match[2])
+	if err != nil {
+		return "", 0, false
+	}
+	return match[1], number, true
+}
+
+// versionCutoff is the time before which old versions are no longer kept
+func versionCutoff(now time.Time) time.Time {
+	if keepVersionDays <= 0 {
+		return time.Time{}
+	}
+	return now.AddDate(0, 0, -keepVersionDays)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCASStoreDeduplicates(t *testing.T) {
+	pool := newBlobStore()
+	labA := &casStore{blobs: pool, names: make(map[string]*fileHistory)}
+	labB := &casStore{blobs: pool, names: make(map[string]*fileHistory)}
+	kernel := strings.Repeat("vmlinuz", 1000)
+
+	labA.Write("vmlinuz", kernel, "")
+	labA.Write("vmlinuz-copy", kernel, "")
+	labB.Write("boot/vmlinuz", kernel, "")
+	if count, size := pool.stats(); count != 1 || size != int64(len(kernel)) {
+		t.Errorf("Expected identical files to share one blob; got %d blobs of %d bytes", count, size)
+	}
+
+	sum := sha256.Sum256([]byte(kernel))
+	info, ok := labB.Stat("boot/vmlinuz")
+	if !ok || info.SHA256 != hex.EncodeToString(sum[:]) || info.Size != int64(len(kernel)) || info.Name != "boot/vmlinuz" {
+		t.Errorf("Unexpected stat %#v", info)
+	}
+
+	// overwriting drops the reference, and the blob goes with the last one
+	labA.Write("vmlinuz", "new kernel", "")
+	labA.Write("vmlinuz-copy", "new kernel", "")
+	if count, _ := pool.stats(); count != 2 {
+		t.Errorf("Expected 2 blobs after overwriting; got %d", count)
+	}
+	labB.Write("boot/vmlinuz", "", "")
+	if count, size := pool.stats(); count != 2 || size != int64(len("new kernel")) {
+		t.Errorf("Expected the old kernel to be freed; got %d blobs of %d bytes", count, size)
+	}
+	if contents, ok := labA.Read("vmlinuz-copy"); !ok || contents != "new kernel" {
+		t.Errorf("Expected overwritten contents; got %q, %v", contents, ok)
+	}
+	if _, ok := labA.Read("missing"); ok {
+		t.Errorf("Expected missing file to be missing")
+	}
+}
+
+func TestCASStoreConcurrentWrites(t *testing.T) {
+	pool := newBlobStore()
+	store := &casStore{blobs: pool, names: make(map[string]*fileHistory)}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				store.Write("shared", strings.Repeat("x", (i+j)%3), "")
+			}
+		}(i)
+	}
+	wg.Wait()
+	if count, _ := pool.stats(); count != 1 {
+		t.Errorf("Expected only the last write's blob to remain; got %d blobs", count)
+	}
+}
+
+func TestCASStoreVersions(t *testing.T) {
+	oldKeep, oldKeepDays := keepVersions, keepVersionDays
+	defer func() { keepVersions, keepVersionDays = oldKeep, oldKeepDays }()
+	keepVersions, keepVersionDays = 3, 0
+
+	pool := newBlobStore()
+	store := &casStore{blobs: pool, names: make(map[string]*fileHistory)}
+	for i := 1; i <= 5; i++ {
+		store.Write("switch.cfg", strings.Repeat("v", i), "10.0.0.1:1234")
+	}
+
+	versions := store.Versions("switch.cfg")
+	if len(versions) != 3 || versions[0].Version != 3 || versions[2].Version != 5 || versions[2].Uploader != "10.0.0.1:1234" {
+		t.Errorf("Expected versions 3 through 5; got %#v", versions)
+	}
+	if count, _ := pool.stats(); count != 3 {
+		t.Errorf("Expected pruned versions to release their blobs; %d blobs left", count)
+	}
+	tests := []struct {
+		name     string
+		expected string
+		ok       bool
+	}{
+		{"switch.cfg", "vvvvv", true},
+		{"switch.cfg@v5", "vvvvv", true},
+		{"switch.cfg@v3", "vvv", true},
+		{"switch.cfg@v2", "", false},
+		{"switch.cfg@v9", "", false},
+		{"other.cfg@v1", "", false},
+	}
+	for _, test := range tests {
+		contents, ok := store.Read(test.name)
+		if ok != test.ok || contents != test.expected {
+			t.Errorf("Reading %s: expected %q, %v; got %q, %v", test.name, test.expected, test.ok, contents, ok)
+		}
+	}
+
+	// age out everything but the current version
+	keepVersions, keepVersionDays = 0, 7
+	store.names["switch.cfg"].versions[0].modified = time.Now().AddDate(0, 0, -8)
+	if _, ok := store.Read("switch.cfg@v3"); ok {
+		t.Errorf("Expected version older than the retention period to be unreadable")
+	}
+	store.Write("switch.cfg", "new", "10.0.0.2:1234")
+	versions = store.Versions("switch.cfg")
+	if len(versions) != 3 || versions[0].Version != 4 || versions[2].Version != 6 {
+		t.Errorf("Expected versions 4 through 6; got %#v", versions)
+	}
+	store.names["switch.cfg"].versions[2].modified = time.Now().AddDate(-1, 0, 0)
+	if info, ok := store.Stat("switch.cfg"); !ok || info.Version != 6 {
+		t.Errorf("Expected the current version to be kept however old it is; got %#v", info)
+	}
+}
+
+func TestOpWriteVersions(t *testing.T) {
+	files = newCASStore()
+	oldKeep := keepVersions
+	defer func() { keepVersions = oldKeep }()
+	keepVersions = 0
+
+	for _, contents := range []string{"good config", "bad config"} {
+		if err := writeOverUDP(t, &wire.PacketRequest{Op: wire.OpWRQ, Filename: "sw1.cfg", Mode: "octet"}, []byte(contents)); err != nil {
+			t.Fatalf("write failed: %s", err)
+		}
+	}
+	contents, _, err := readOverUDP(t, &wire.PacketRequest{Op: wire.OpRRQ, Filename: "sw1.cfg@v1", Mode: "octet"})
+	if err != nil || string(contents) != "good config" {
+		t.Errorf("Reading previous version: expected %q; got %q, %v", "good config", contents, err)
+	}
+	if info, _ := files.Stat("sw1.cfg"); !strings.HasPrefix(info.Uploader, "127.0.0.1:") {
+		t.Errorf("Expected uploader to be recorded; got %q", info.Uploader)
+	}
+
+	err = writeOverUDP(t, &wire.PacketRequest{Op: wire.OpWRQ, Filename: "sw1.cfg@v1", Mode: "octet"}, []byte("x"))
+	if tErr, ok := err.(*tftpError); !ok || tErr.Code != 2 {
+		t.Errorf("Writing an old version: expected access violation; got %v", err)
+	}
+}
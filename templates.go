@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var fileTemplates []*fileTemplate // checked in order, first template matching the filename is rendered
+var hostInventory *inventory      // per-host variables handed to templates, nil if there is no inventory
+
+// fileTemplateConfig is a generated file as it appears in the config file.
+// Match is a regular expression on the (rewritten) filename and Template the
+// path of a text/template file to render for it.
+type fileTemplateConfig struct {
+	Match    string `json:"match"`
+	Template string `json:"template"`
+}
+
+type fileTemplate struct {
+	re   *regexp.Regexp
+	tmpl *template.Template
+}
+
+// templateData is what templates are executed with
+type templateData struct {
+	ClientIP   string
+	ClientPort int
+	ClientMAC  string            // colon separated and lower case, "" if not in the ARP table
+	Filename   string            // the filename after rewriting
+	Requested  string            // the filename as the client sent it
+	Match      []string          // the template's match and its submatches
+	Vars       map[string]string // the client's inventory entry, empty if it has none
+}
+
+var templateFuncs = template.FuncMap{
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"replace": func(s, old, new string) string { return strings.Replace(s, old, new, -1) },
+}
+
+func compileFileTemplates(configs []fileTemplateConfig) ([]*fileTemplate, error) {
+	templates := make([]*fileTemplate, 0, len(configs))
+	for i, c := range configs {
+		re, err := regexp.Compile(c.Match)
+		if err != nil {
+			return nil, fmt.Errorf("template %d: %s", i+1, err)
+		}
+		tmpl, err := template.New(filepath.Base(c.Template)).Funcs(templateFuncs).ParseFiles(c.Template)
+		if err != nil {
+			return nil, fmt.Errorf("template %d: %s", i+1, err)
+		}
+		templates = append(templates, &fileTemplate{re: re, tmpl: tmpl})
+	}
+	return templates, nil
+}
+
+// renderTemplate renders the first template matching filename for the client
+// at addr.  ok is false if no template matches, and the file should be looked
+// up in the store instead.
+func renderTemplate(filename string, request *wire.PacketRequest, addr net.Addr) (contents string, ok bool, err error) {
+	for _, t := range fileTemplates {
+		match := t.re.FindStringSubmatch(filename)
+		if match == nil {
+			continue
+		}
+		ip, port := clientIPPort(addr)
+		data := &templateData{
+			ClientPort: port,
+			Filename:   filename,
+			Requested:  request.Filename,
+			Match:      match,
+		}
+		if ip != nil {
+			data.ClientIP = ip.String()
+			data.ClientMAC = lookupMAC(ip)
+		}
+		if hostInventory != nil {
+			if data.Vars, err = hostInventory.lookup(data.ClientIP, data.ClientMAC); err != nil {
+				return "", true, err
+			}
+		}
+		if data.Vars == nil {
+			data.Vars = map[string]string{}
+		}
+		var buf bytes.Buffer
+		if err := t.tmpl.Execute(&buf, data); err != nil {
+			return "", true, err
+		}
+		return buf.String(), true, nil
+	}
+	return "", false, nil
+}
+
+// inventory is a table of per-host variables keyed by IP address and MAC
+// address.  It is reread whenever the file changes so hosts can be added
+// without restarting the server.
+//
+// A .json inventory is an object mapping an IP or MAC to an object of
+// variables.  Anything else is read as CSV with a header row naming the
+// variables; rows are keyed by their "ip" and "mac" columns.
+type inventory struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	hosts   map[string]map[string]string
+}
+
+func newInventory(path string) (*inventory, error) {
+	inv := &inventory{path: path}
+	if err := inv.reload(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// lookup returns the variables for the host with the given IP or MAC address.
+// The IP wins if both have entries.
+func (inv *inventory) lookup(ip, mac string) (map[string]string, error) {
+	inv.Lock()
+	defer inv.Unlock()
+	if err := inv.reload(); err != nil {
+		return nil, err
+	}
+	if vars, ok := inv.hosts[inventoryKey(ip)]; ok && ip != "" {
+		return vars, nil
+	}
+	if vars, ok := inv.hosts[inventoryKey(mac)]; ok && mac != "" {
+		return vars, nil
+	}
+	return nil, nil
+}
+
+// reload rereads the inventory if it has changed since it was last read
+func (inv *inventory) reload() error {
+	info, err := os.Stat(inv.path)
+	if err != nil {
+		return err
+	}
+	if inv.hosts != nil && info.ModTime().Equal(inv.modTime) {
+		return nil
+	}
+	raw, err := os.ReadFile(inv.path)
+	if err != nil {
+		return err
+	}
+	var hosts map[string]map[string]string
+	if strings.HasSuffix(strings.ToLower(inv.path), ".json") {
+		hosts, err = parseJSONInventory(raw)
+	} else {
+		hosts, err = parseCSVInventory(raw)
+	}
+	if err != nil {
+		return fmt.Errorf("inventory %s: %s", inv.path, err)
+	}
+	inv.hosts = hosts
+	inv.modTime = info.ModTime()
+	return nil
+}
+
+func parseJSONInventory(raw []byte) (map[string]map[string]string, error) {
+	var entries map[string]map[string]string
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, err
+	}
+	hosts := make(map[string]map[string]string, len(entries))
+	for key, vars := range entries {
+		hosts[inventoryKey(key)] = vars
+	}
+	return hosts, nil
+}
+
+func parseCSVInventory(raw []byte) (map[string]map[string]string, error) {
+	rows, err := csv.NewReader(bytes.NewReader(raw)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return map[string]map[string]string{}, nil
+	}
+	header := rows[0]
+	hosts := make(map[string]map[string]string, len(rows)-1)
+	for _, row := range rows[1:] {
+		vars := make(map[string]string, len(header))
+		for i, name := range header {
+			vars[strings.TrimSpace(name)] = strings.TrimSpace(row[i])
+		}
+		for _, key := range []string{vars["ip"], vars["mac"]} {
+			if key != "" {
+				hosts[inventoryKey(key)] = vars
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// inventoryKey normalizes an IP or MAC address so that different spellings of
+// the same address find the same entry.
+func inventoryKey(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+	if hw, err := net.ParseMAC(strings.Replace(addr, "-", ":", -1)); err == nil {
+		return hw.String()
+	}
+	return strings.ToLower(addr)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRenderTemplate(t *testing.T) {
+	dir := t.TempDir()
+	tmpl := writeTestFile(t, dir, "menu.tmpl", "host={{.Vars.hostname}} ip={{.ClientIP}} mac={{.ClientMAC}} arg={{index .Match 1}} asked={{.Requested}}")
+	arp := writeTestFile(t, dir, "arp", "IP address HW type Flags HW address Mask Device\n10.0.0.8 0x1 0x2 00:11:22:33:44:55 * eth0\n")
+
+	oldArpTable, oldTemplates, oldInventory := arpTable, fileTemplates, hostInventory
+	defer func() { arpTable, fileTemplates, hostInventory = oldArpTable, oldTemplates, oldInventory }()
+	arpTable = arp
+
+	var err error
+	if fileTemplates, err = compileFileTemplates([]fileTemplateConfig{{Match: `^menus/(\w+)\.cfg$`, Template: tmpl}}); err != nil {
+		t.Fatalf("unable to compile templates: %s", err)
+	}
+
+	inventories := []string{
+		writeTestFile(t, dir, "hosts.csv", "ip,mac,hostname\n10.0.0.7,,sw-ip\n,00-11-22-33-44-55,sw-mac\n"),
+		writeTestFile(t, dir, "hosts.json", `{"10.0.0.7": {"hostname": "sw-ip"}, "00:11:22:33:44:55": {"hostname": "sw-mac"}}`),
+	}
+	for _, path := range inventories {
+		if hostInventory, err = newInventory(path); err != nil {
+			t.Fatalf("unable to read inventory %s: %s", path, err)
+		}
+		tests := []struct {
+			ip       string
+			filename string
+			expected string
+			ok       bool
+		}{
+			{"10.0.0.7", "menus/pxe.cfg", "host=sw-ip ip=10.0.0.7 mac= arg=pxe asked=/menus/pxe.cfg", true},
+			{"10.0.0.8", "menus/grub.cfg", "host=sw-mac ip=10.0.0.8 mac=00:11:22:33:44:55 arg=grub asked=/menus/grub.cfg", true},
+			{"10.0.0.9", "menus/pxe.cfg", "host=<no value> ip=10.0.0.9 mac= arg=pxe asked=/menus/pxe.cfg", true},
+			{"10.0.0.7", "kernel", "", false},
+		}
+		for _, test := range tests {
+			request := &wire.PacketRequest{Op: wire.OpRRQ, Filename: "/" + test.filename, Mode: "octet"}
+			contents, ok, err := renderTemplate(test.filename, request, &net.UDPAddr{IP: net.ParseIP(test.ip), Port: 2000})
+			if err != nil {
+				t.Errorf("%s: rendering %s for %s: unexpected error %s", path, test.filename, test.ip, err)
+			} else if ok != test.ok || contents != test.expected {
+				t.Errorf("%s: rendering %s for %s: expected %q, %v; got %q, %v", path, test.filename, test.ip, test.expected, test.ok, contents, ok)
+			}
+		}
+	}
+}
+
+func TestOpReadTemplateTsize(t *testing.T) {
+	dir := t.TempDir()
+	tmpl := writeTestFile(t, dir, "big.tmpl", `{{printf "%0600d" 7}}`)
+
+	oldTemplates, oldInventory := fileTemplates, hostInventory
+	defer func() { fileTemplates, hostInventory = oldTemplates, oldInventory }()
+	hostInventory = nil
+
+	var err error
+	if fileTemplates, err = compileFileTemplates([]fileTemplateConfig{{Match: `^generated$`, Template: tmpl}}); err != nil {
+		t.Fatalf("unable to compile templates: %s", err)
+	}
+
+	files = newCASStore()
+	request := &wire.PacketRequest{Op: wire.OpRRQ, Filename: "generated", Mode: "octet", Options: map[string]string{"tsize": "0"}}
+	contents, options, err := readOverUDP(t, request)
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if len(contents) != 600 {
+		t.Errorf("expected 600 bytes; got %d", len(contents))
+	}
+	if options["tsize"] != "600" {
+		t.Errorf("expected tsize of 600 in OACK; got %#v", options)
+	}
+}
@@ -0,0 +1,160 @@
+package tftp_wire
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// seedPackets are well formed and malformed packets to start fuzzing from
+var seedPackets = [][]byte{
+	[]byte("\x00\x01pxelinux.0\x00octet\x00"),
+	[]byte("\x00\x02upload.bin\x00netascii\x00"),
+	[]byte("\x00\x01foo\x00octet\x00blksize\x001428\x00tsize\x000\x00"),
+	[]byte("\x00\x01foo\x00octet\x00\x00\x00\x00"),
+	[]byte("\x00\x03\x12\x34fnord"),
+	[]byte("\x00\x03\x00\x01"),
+	[]byte("\x00\x04\xd0\x0f"),
+	[]byte("\x00\x05\x00\x01File not found\x00"),
+	[]byte("\x00\x06tsize\x001234\x00"),
+	[]byte(""),
+	[]byte("\x00"),
+	[]byte("\x00\x03"),
+	[]byte("\x00\x05\xab"),
+	[]byte("\xff\xff"),
+}
+
+// FuzzParsePacket checks that no input panics, and that any packet that
+// parses serializes to bytes that parse to the same packet again
+func FuzzParsePacket(f *testing.F) {
+	for _, seed := range seedPackets {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		p, err := ParsePacket(buf)
+		if err != nil {
+			return
+		}
+		again, err := ParsePacket(p.Serialize())
+		if err != nil {
+			t.Fatalf("%#v serialized to %q, which doesn't parse: %s", p, p.Serialize(), err)
+		}
+		if !reflect.DeepEqual(p, again) {
+			t.Fatalf("%q parsed to %#v but round tripped to %#v", buf, p, again)
+		}
+		var d Decoder
+		if decoded, err := d.Parse(buf); err != nil || !reflect.DeepEqual(p, decoded) {
+			t.Fatalf("%q parsed to %#v but decoded to %#v %v", buf, p, decoded, err)
+		}
+		if appended := p.AppendTo(nil); !bytes.Equal(appended, p.Serialize()) {
+			t.Fatalf("%#v serialized to %q but appended %q", p, p.Serialize(), appended)
+		}
+	})
+}
+
+// FuzzParsers hands every packet type's parser any input, whatever its
+// opcode, as callers may use them directly
+func FuzzParsers(f *testing.F) {
+	for _, seed := range seedPackets {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		for _, p := range []Packet{&PacketRequest{}, &PacketData{}, &PacketAck{}, &PacketError{}, &PacketOAck{}} {
+			p.Parse(buf)
+		}
+	})
+}
+
+// FuzzRequestRoundTrip builds requests from their fields, which must survive
+// serializing and parsing whenever they're representable on the wire
+func FuzzRequestRoundTrip(f *testing.F) {
+	f.Add(true, "pxelinux.0", "octet", "tsize", "0")
+	f.Add(false, "", "", "", "")
+	f.Add(true, "dir/file name", "NETASCII", "BlkSize", "1428")
+	f.Fuzz(func(t *testing.T, read bool, filename, mode, option, value string) {
+		request := &PacketRequest{Op: OpWRQ, Filename: filename, Mode: mode}
+		if read {
+			request.Op = OpRRQ
+		}
+		if option != "" {
+			request.Options = map[string]string{option: value}
+		}
+		parsed, err := ParsePacket(request.Serialize())
+		if strings.ContainsRune(filename+mode+option+value, 0) {
+			return // NULs end strings on the wire, so these can't round trip
+		}
+		if err != nil {
+			t.Fatalf("%#v doesn't parse after serializing: %s", request, err)
+		}
+		if request.Options != nil {
+			request.Options = map[string]string{strings.ToLower(option): value}
+		}
+		if !reflect.DeepEqual(request, parsed) {
+			t.Fatalf("%#v round tripped to %#v", request, parsed)
+		}
+	})
+}
+
+// FuzzDataRoundTrip checks DATA and ACK packets survive serializing and parsing
+func FuzzDataRoundTrip(f *testing.F) {
+	f.Add(uint16(1), []byte("first block"))
+	f.Add(uint16(65535), []byte{})
+	f.Add(uint16(0), bytes.Repeat([]byte{0}, 512))
+	f.Fuzz(func(t *testing.T, block uint16, data []byte) {
+		parsed, err := ParsePacket((&PacketData{BlockNum: block, Data: data}).Serialize())
+		if d, ok := parsed.(*PacketData); err != nil || !ok || d.BlockNum != block || !bytes.Equal(d.Data, data) {
+			t.Fatalf("DATA %d of %q round tripped to %#v, %v", block, data, parsed, err)
+		}
+		parsed, err = ParsePacket((&PacketAck{BlockNum: block}).Serialize())
+		if a, ok := parsed.(*PacketAck); err != nil || !ok || a.BlockNum != block {
+			t.Fatalf("ACK %d round tripped to %#v, %v", block, parsed, err)
+		}
+	})
+}
+
+// FuzzErrorRoundTrip checks ERROR packets survive serializing and parsing
+func FuzzErrorRoundTrip(f *testing.F) {
+	f.Add(uint16(1), "File not found")
+	f.Add(uint16(0), "")
+	f.Fuzz(func(t *testing.T, code uint16, msg string) {
+		if strings.ContainsRune(msg, 0) {
+			return
+		}
+		packet := &PacketError{Code: code, Msg: msg}
+		parsed, err := ParsePacket(packet.Serialize())
+		if err != nil || !reflect.DeepEqual(packet, parsed) {
+			t.Fatalf("%#v round tripped to %#v, %v", packet, parsed, err)
+		}
+	})
+}
+
+// FuzzParseModes checks that what strict mode accepts the default does too,
+// and likewise the default and lenient mode, with the same result.  Lenient
+// mode may keep a last option the default drops for want of its NUL, so
+// options aren't compared.
+func FuzzParseModes(f *testing.F) {
+	for _, seed := range seedPackets {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		strict, strictErr := ParsePacketMode(buf, ParseStrict)
+		def, defErr := ParsePacketMode(buf, ParseDefault)
+		lenient, lenientErr := ParsePacketMode(buf, ParseLenient)
+		if strictErr == nil && (defErr != nil || !reflect.DeepEqual(strict, def)) {
+			t.Fatalf("%q parsed strictly to %#v but by default to %#v %v", buf, strict, def, defErr)
+		}
+		if defErr != nil {
+			return
+		}
+		if lenientErr != nil {
+			t.Fatalf("%q parsed by default to %#v but not leniently: %s", buf, def, lenientErr)
+		}
+		if request, ok := lenient.(*PacketRequest); ok {
+			request.Options = def.(*PacketRequest).Options
+		}
+		if !reflect.DeepEqual(def, lenient) {
+			t.Fatalf("%q parsed by default to %#v but leniently to %#v", buf, def, lenient)
+		}
+	})
+}
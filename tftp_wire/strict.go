@@ -0,0 +1,148 @@
+package tftp_wire
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ParseMode says how closely a packet must follow the RFCs to be parsed
+type ParseMode int
+
+const (
+	// ParseDefault is ParsePacket's behaviour.  Padding and incomplete options
+	// after a request are ignored, but every string must be NUL terminated.
+	ParseDefault ParseMode = iota
+	// ParseStrict rejects anything RFC1350 and its option extensions don't
+	// allow, with an error wrapping ErrNonconforming that says what was wrong
+	ParseStrict
+	// ParseLenient also accepts the quirks of known clients, such as a
+	// request or ERROR whose last string is missing its NUL
+	ParseLenient
+)
+
+func (m ParseMode) String() string {
+	switch m {
+	case ParseStrict:
+		return "strict"
+	case ParseLenient:
+		return "lenient"
+	}
+	return "default"
+}
+
+// ErrNonconforming is wrapped by the errors of strict parsing for packets that
+// could be parsed but break the RFCs
+var ErrNonconforming = errors.New("nonconforming packet")
+
+// maxRequestSize is the longest a request may be, options included (RFC2347)
+const maxRequestSize = 512
+
+// maxDataSize is the most a DATA packet may carry (RFC1350).  The blksize
+// option (RFC2348) raises it, but only for the transfer it was agreed for,
+// which a parser doesn't know about.
+const maxDataSize = 512
+
+// maxErrorCode is the last error code defined, by RFC2347
+const maxErrorCode = 8
+
+// ParsePacketMode parses a packet from its wire representation as mode says.
+func ParsePacketMode(buf []byte, mode ParseMode) (Packet, error) {
+	if mode == ParseLenient {
+		buf = terminate(buf)
+	}
+	p, err := ParsePacket(buf)
+	if err != nil || mode != ParseStrict {
+		return p, err
+	}
+	if err := conforms(p, buf); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// terminate adds the NUL missing from the end of a request or ERROR, copying
+// buf so the caller's isn't changed.  Other packets are returned as they are.
+func terminate(buf []byte) []byte {
+	if len(buf) < 2 || buf[len(buf)-1] == 0 {
+		return buf
+	}
+	switch op, _, _ := parseUint16(buf); op {
+	case OpRRQ, OpWRQ, OpError:
+		return append(buf[:len(buf):len(buf)], 0)
+	}
+	return buf
+}
+
+// conforms checks a packet that parsed from buf against the RFCs
+func conforms(p Packet, buf []byte) error {
+	switch p := p.(type) {
+	case *PacketRequest:
+		if len(buf) > maxRequestSize {
+			return nonconforming("request is %d bytes, longer than %d", len(buf), maxRequestSize)
+		}
+		if p.Filename == "" {
+			return nonconforming("filename is empty")
+		}
+		for i := 0; i < len(p.Filename); i++ {
+			if c := p.Filename[i]; c < 0x20 || c > 0x7e {
+				return nonconforming("filename has byte %#x, which isn't printable netascii", c)
+			}
+		}
+		switch strings.ToLower(p.Mode) {
+		case "netascii", "octet", "mail":
+		default:
+			return nonconforming("mode %q is not netascii, octet or mail", p.Mode)
+		}
+		return optionsConform(buf[2+len(p.Filename)+1+len(p.Mode)+1:])
+	case *PacketData:
+		if len(p.Data) > maxDataSize {
+			return nonconforming("DATA carries %d bytes, more than %d", len(p.Data), maxDataSize)
+		}
+	case *PacketAck:
+		if len(buf) != 4 {
+			return nonconforming("%d bytes after the block number of an ACK", len(buf)-4)
+		}
+	case *PacketError:
+		if p.Code > maxErrorCode {
+			return nonconforming("error code %d is undefined", p.Code)
+		}
+		if extra := len(buf) - (4 + len(p.Msg) + 1); extra > 0 {
+			return nonconforming("%d bytes after the message of an ERROR", extra)
+		}
+	case *PacketOAck:
+		if len(buf) == 2 {
+			return nonconforming("OACK has no options")
+		}
+		return optionsConform(buf[2:])
+	}
+	return nil
+}
+
+// optionsConform checks the options that trail a request or OACK are whole
+// name and value pairs, with nothing after and no name given twice
+func optionsConform(buf []byte) error {
+	seen := make(map[string]bool)
+	for len(buf) > 0 {
+		if buf[0] == 0 {
+			return nonconforming("%d bytes of padding after the options", len(buf))
+		}
+		name, rest, err := parseString(buf)
+		if err != nil {
+			return nonconforming("option name %q is unterminated", buf)
+		}
+		if _, rest, err = parseString(rest); err != nil {
+			return nonconforming("option %q has an unterminated value", name)
+		}
+		if seen[strings.ToLower(name)] {
+			return nonconforming("option %q given twice", name)
+		}
+		seen[strings.ToLower(name)] = true
+		buf = rest
+	}
+	return nil
+}
+
+func nonconforming(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrNonconforming, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,103 @@
+package tftp_wire
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseModes(t *testing.T) {
+	// whether each mode accepts a packet, and the reason strict mode gives
+	tests := []struct {
+		bytes   []byte
+		def     bool
+		lenient bool
+		strict  string // "" if strict mode accepts it too
+	}{
+		{[]byte("\x00\x01foo\x00octet\x00"), true, true, ""},
+		{[]byte("\x00\x01foo\x00NetASCII\x00"), true, true, ""},
+		{[]byte("\x00\x01foo\x00octet\x00tsize\x000\x00blksize\x001428\x00"), true, true, ""},
+		{[]byte("\x00\x06tsize\x001234\x00"), true, true, ""},
+		{[]byte("\x00\x04\x00\x01"), true, true, ""},
+		{[]byte("\x00\x05\x00\x01File not found\x00"), true, true, ""},
+		{[]byte("\x00\x03\x00\x01fnord"), true, true, ""},
+
+		// quirks of clients only lenient mode forgives
+		{[]byte("\x00\x01foo\x00octet"), false, true, ""},
+		{[]byte("\x00\x05\x00\x01File not found"), false, true, ""},
+
+		// tolerated by default, refused by strict mode
+		{[]byte("\x00\x01foo\x00octet\x00\x00\x00\x00"), true, true, "3 bytes of padding after the options"},
+		{[]byte("\x00\x01foo\x00octet\x00tsize\x00"), true, true, `option "tsize" has an unterminated value`},
+		{[]byte("\x00\x01foo\x00octet\x00tsize\x000"), true, true, `option "tsize" has an unterminated value`},
+		{[]byte("\x00\x01foo\x00octet\x00tsize"), true, true, `option name "tsize" is unterminated`},
+		{[]byte("\x00\x01foo\x00octet\x00tsize\x000\x00TSize\x001\x00"), true, true, `option "TSize" given twice`},
+		{[]byte("\x00\x01foo\x00binary\x00"), true, true, `mode "binary" is not netascii, octet or mail`},
+		{[]byte("\x00\x01\x00octet\x00"), true, true, "filename is empty"},
+		{[]byte("\x00\x01foo\nbar\x00octet\x00"), true, true, "filename has byte 0xa, which isn't printable netascii"},
+		{[]byte("\x00\x01caf\xc3\xa9\x00octet\x00"), true, true, "filename has byte 0xc3, which isn't printable netascii"},
+		{append([]byte("\x00\x01"+strings.Repeat("a", 505)), "\x00octet\x00"...), true, true, "request is 514 bytes, longer than 512"},
+		{[]byte("\x00\x04\x00\x01\x00\x00"), true, true, "2 bytes after the block number of an ACK"},
+		{[]byte("\x00\x05\x00\x09oops\x00"), true, true, "error code 9 is undefined"},
+		{[]byte("\x00\x05\x00\x01gone\x00\x00"), true, true, "1 bytes after the message of an ERROR"},
+		{[]byte("\x00\x06"), true, true, "OACK has no options"},
+		{append([]byte("\x00\x03\x00\x01"), strings.Repeat("x", 513)...), true, true, "DATA carries 513 bytes, more than 512"},
+
+		// refused by every mode
+		{[]byte("\x00\x01foo"), false, false, ""},
+		{[]byte("\x00\x04\x00"), false, false, ""},
+		{[]byte("\x00\x07"), false, false, ""},
+	}
+
+	for _, test := range tests {
+		if _, err := ParsePacketMode(test.bytes, ParseDefault); (err == nil) != test.def {
+			t.Errorf("Parsing %q by default: expected acceptance %t; got %v", test.bytes, test.def, err)
+		}
+		if _, err := ParsePacketMode(test.bytes, ParseLenient); (err == nil) != test.lenient {
+			t.Errorf("Parsing %q leniently: expected acceptance %t; got %v", test.bytes, test.lenient, err)
+		}
+		_, err := ParsePacketMode(test.bytes, ParseStrict)
+		switch {
+		case test.def && test.strict == "" && err != nil:
+			t.Errorf("Parsing %q strictly: expected acceptance; got %v", test.bytes, err)
+		case test.strict != "" && (err == nil || !errors.Is(err, ErrNonconforming) || !strings.HasSuffix(err.Error(), ": "+test.strict)):
+			t.Errorf("Parsing %q strictly: expected %q; got %v", test.bytes, test.strict, err)
+		case !test.def && err == nil:
+			t.Errorf("Parsing %q strictly: expected an error", test.bytes)
+		}
+
+		// a Decoder accepts what ParsePacketMode does
+		for _, mode := range []ParseMode{ParseDefault, ParseLenient, ParseStrict} {
+			_, expected := ParsePacketMode(test.bytes, mode)
+			decoder := Decoder{Mode: mode}
+			if _, err := decoder.Parse(test.bytes); (err == nil) != (expected == nil) {
+				t.Errorf("Decoding %q in %s mode: expected %v; got %v", test.bytes, mode, expected, err)
+			}
+		}
+	}
+}
+
+func TestLenientLeavesBufferAlone(t *testing.T) {
+	buf := append(make([]byte, 0, 100), "\x00\x01foo\x00octetx"...)
+	buf = buf[:len(buf)-1]
+	p, err := ParsePacketMode(buf, ParseLenient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (&PacketRequest{OpRRQ, "foo", "octet", nil}); !reflect.DeepEqual(p, expected) {
+		t.Errorf("Expected %#v; got %#v", expected, p)
+	}
+	if buf[:len(buf)+1][len(buf)] != 'x' {
+		t.Errorf("Lenient parsing wrote the missing NUL into the caller's buffer")
+	}
+
+	// an option value missing its NUL is dropped by default, but kept leniently
+	buf = []byte("\x00\x01foo\x00octet\x00tsize\x000")
+	if p, _ := ParsePacket(buf); p.(*PacketRequest).Options != nil {
+		t.Errorf("Expected the unterminated option to be dropped by default; got %v", p.(*PacketRequest).Options)
+	}
+	if p, _ := ParsePacketMode(buf, ParseLenient); p.(*PacketRequest).Options["tsize"] != "0" {
+		t.Errorf("Expected the unterminated option to be kept leniently; got %v", p.(*PacketRequest).Options)
+	}
+}
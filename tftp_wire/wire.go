@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 )
 
 // larger than a typical mtu (1500), and largest DATA packet (516).
@@ -17,6 +19,7 @@ const (
 	OpData         = 3
 	OpAck          = 4
 	OpError        = 5
+	OpOAck         = 6
 )
 
 // packet is the interface met by all packet structs
@@ -25,13 +28,23 @@ type Packet interface {
 	Parse([]byte) error
 	// Serialize serializes a packet to its wire representation
 	Serialize() []byte
+	// AppendTo appends the packet's wire representation to dst, returning the
+	// extended slice.  It only allocates if dst hasn't the capacity.
+	AppendTo(dst []byte) []byte
+	// MarshalTo writes the packet's wire representation into buf, returning
+	// the number of bytes written, or ErrShortBuffer if it doesn't fit.
+	MarshalTo(buf []byte) (int, error)
 }
 
+// ErrShortBuffer is returned by MarshalTo when a packet doesn't fit the buffer
+var ErrShortBuffer = errors.New("buffer too small for packet")
+
 // PacketRequest represents a request to read or rite a file.
 type PacketRequest struct {
 	Op       uint16 // OpRRQ or OpWRQ
 	Filename string
 	Mode     string
+	Options  map[string]string // RFC2347 options, keyed by lower case name.  nil if there were none
 }
 
 func (p *PacketRequest) Parse(buf []byte) (err error) {
@@ -44,15 +57,23 @@ func (p *PacketRequest) Parse(buf []byte) (err error) {
 	if p.Mode, buf, err = parseString(buf); err != nil {
 		return err
 	}
+	p.Options = parseOptions(buf)
 	return nil
 }
 
 func (p *PacketRequest) Serialize() []byte {
-	buf := make([]byte, 2+len(p.Filename)+1+len(p.Mode)+1)
-	binary.BigEndian.PutUint16(buf, p.Op)
-	copy(buf[2:], p.Filename)
-	copy(buf[2+len(p.Filename)+1:], p.Mode)
-	return buf
+	return p.AppendTo(make([]byte, 0, 2+len(p.Filename)+1+len(p.Mode)+1+optionsLen(p.Options)))
+}
+
+func (p *PacketRequest) AppendTo(dst []byte) []byte {
+	dst = appendUint16(dst, p.Op)
+	dst = appendString(dst, p.Filename)
+	dst = appendString(dst, p.Mode)
+	return appendOptions(dst, p.Options)
+}
+
+func (p *PacketRequest) MarshalTo(buf []byte) (int, error) {
+	return marshalTo(p, buf)
 }
 
 // PacketData carries a block of data in a file transmission.
@@ -62,7 +83,9 @@ type PacketData struct {
 }
 
 func (p *PacketData) Parse(buf []byte) (err error) {
-	buf = buf[2:] // skip over op
+	if _, buf, err = parseUint16(buf); err != nil { // skip over op
+		return err
+	}
 	if p.BlockNum, buf, err = parseUint16(buf); err != nil {
 		return err
 	}
@@ -71,11 +94,17 @@ func (p *PacketData) Parse(buf []byte) (err error) {
 }
 
 func (p *PacketData) Serialize() []byte {
-	buf := make([]byte, 4+len(p.Data))
-	binary.BigEndian.PutUint16(buf, OpData)
-	binary.BigEndian.PutUint16(buf[2:], p.BlockNum)
-	copy(buf[4:], p.Data)
-	return buf
+	return p.AppendTo(make([]byte, 0, 4+len(p.Data)))
+}
+
+func (p *PacketData) AppendTo(dst []byte) []byte {
+	dst = appendUint16(dst, OpData)
+	dst = appendUint16(dst, p.BlockNum)
+	return append(dst, p.Data...)
+}
+
+func (p *PacketData) MarshalTo(buf []byte) (int, error) {
+	return marshalTo(p, buf)
 }
 
 // PacketAck acknowledges receipt of a data packet
@@ -84,7 +113,9 @@ type PacketAck struct {
 }
 
 func (p *PacketAck) Parse(buf []byte) (err error) {
-	buf = buf[2:] // skip over op
+	if _, buf, err = parseUint16(buf); err != nil { // skip over op
+		return err
+	}
 	if p.BlockNum, buf, err = parseUint16(buf); err != nil {
 		return err
 	}
@@ -92,10 +123,16 @@ func (p *PacketAck) Parse(buf []byte) (err error) {
 }
 
 func (p *PacketAck) Serialize() []byte {
-	buf := make([]byte, 4)
-	binary.BigEndian.PutUint16(buf, OpAck)
-	binary.BigEndian.PutUint16(buf[2:], p.BlockNum)
-	return buf
+	return p.AppendTo(make([]byte, 0, 4))
+}
+
+func (p *PacketAck) AppendTo(dst []byte) []byte {
+	dst = appendUint16(dst, OpAck)
+	return appendUint16(dst, p.BlockNum)
+}
+
+func (p *PacketAck) MarshalTo(buf []byte) (int, error) {
+	return marshalTo(p, buf)
 }
 
 // PacketError is sent by a peer who has encountered an error condition
@@ -105,7 +142,9 @@ type PacketError struct {
 }
 
 func (p *PacketError) Parse(buf []byte) (err error) {
-	buf = buf[2:] // skip over op
+	if _, buf, err = parseUint16(buf); err != nil { // skip over op
+		return err
+	}
 	if p.Code, buf, err = parseUint16(buf); err != nil {
 		return err
 	}
@@ -116,13 +155,115 @@ func (p *PacketError) Parse(buf []byte) (err error) {
 }
 
 func (p *PacketError) Serialize() []byte {
-	buf := make([]byte, 4+len(p.Msg)+1)
-	binary.BigEndian.PutUint16(buf, OpError)
-	binary.BigEndian.PutUint16(buf[2:], p.Code)
-	copy(buf[4:], p.Msg)
+	return p.AppendTo(make([]byte, 0, 4+len(p.Msg)+1))
+}
+
+func (p *PacketError) AppendTo(dst []byte) []byte {
+	dst = appendUint16(dst, OpError)
+	dst = appendUint16(dst, p.Code)
+	return appendString(dst, p.Msg)
+}
+
+func (p *PacketError) MarshalTo(buf []byte) (int, error) {
+	return marshalTo(p, buf)
+}
+
+// PacketOAck acknowledges the options of a request that the server accepted (RFC2347)
+type PacketOAck struct {
+	Options map[string]string
+}
+
+func (p *PacketOAck) Parse(buf []byte) (err error) {
+	if _, buf, err = parseUint16(buf); err != nil { // skip over op
+		return err
+	}
+	p.Options = parseOptions(buf)
+	return nil
+}
+
+func (p *PacketOAck) Serialize() []byte {
+	return p.AppendTo(make([]byte, 0, 2+optionsLen(p.Options)))
+}
+
+func (p *PacketOAck) AppendTo(dst []byte) []byte {
+	return appendOptions(appendUint16(dst, OpOAck), p.Options)
+}
+
+func (p *PacketOAck) MarshalTo(buf []byte) (int, error) {
+	return marshalTo(p, buf)
+}
+
+// marshalTo is MarshalTo for any packet.  buf's length caps the capacity
+// AppendTo sees, so nothing past it is written.
+func marshalTo(p Packet, buf []byte) (int, error) {
+	out := p.AppendTo(buf[:0:len(buf)])
+	if len(out) > len(buf) {
+		return 0, ErrShortBuffer
+	}
+	return len(out), nil
+}
+
+// parseOptions reads the name/value pairs that trail a request or OACK.  Names
+// are case-insensitive so they are lower cased.  Anything after the last
+// complete pair, such as the padding some clients send, is ignored.
+func parseOptions(buf []byte) map[string]string {
+	var options map[string]string
+	for len(buf) > 0 {
+		name, rest, err := parseString(buf)
+		if err != nil || name == "" {
+			break
+		}
+		value, rest, err := parseString(rest)
+		if err != nil {
+			break
+		}
+		if options == nil {
+			options = make(map[string]string)
+		}
+		options[strings.ToLower(name)] = value
+		buf = rest
+	}
+	return options
+}
+
+// optionsLen is the number of bytes options take up on the wire.
+func optionsLen(options map[string]string) int {
+	n := 0
+	for name, value := range options {
+		n += len(name) + 1 + len(value) + 1
+	}
+	return n
+}
+
+// appendOptions appends options to buf in their wire representation, sorted by
+// name so that serialization is repeatable.
+func appendOptions(buf []byte, options map[string]string) []byte {
+	if len(options) == 0 {
+		return buf
+	}
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buf = appendString(buf, name)
+		buf = appendString(buf, options[name])
+	}
 	return buf
 }
 
+// appendUint16 appends v to buf big-endian
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+// appendString appends s to buf null-terminated
+func appendString(buf []byte, s string) []byte {
+	buf = append(buf, s...)
+	return append(buf, 0)
+}
+
 // parseUint16 reads a big-endian uint16 from the beginning of buf,
 // returning it along with a slice pointing at the next position in the buffer.
 func parseUint16(buf []byte) (uint16, []byte, error) {
@@ -157,6 +298,8 @@ func ParsePacket(buf []byte) (p Packet, err error) {
 		p = &PacketAck{}
 	case OpError:
 		p = &PacketError{}
+	case OpOAck:
+		p = &PacketOAck{}
 	default:
 		err = fmt.Errorf("unexpected opcode %d", opcode)
 		return
@@ -164,3 +307,55 @@ func ParsePacket(buf []byte) (p Packet, err error) {
 	err = p.Parse(buf)
 	return
 }
+
+// Decoder parses packets into structs of its own that it reuses, so that the
+// DATA and ACKs of a running transfer are parsed without allocating.  The
+// packet returned is only good until the next call to Parse, and the Data of
+// a PacketData points into buf rather than being copied.
+type Decoder struct {
+	Mode ParseMode // how closely packets must follow the RFCs
+
+	request PacketRequest
+	data    PacketData
+	ack     PacketAck
+	err     PacketError
+	oack    PacketOAck
+}
+
+// Parse parses a packet from its wire representation, as ParsePacketMode
+// does with d's Mode.
+func (d *Decoder) Parse(buf []byte) (p Packet, err error) {
+	if d.Mode == ParseLenient {
+		buf = terminate(buf)
+	}
+	var opcode uint16
+	if opcode, _, err = parseUint16(buf); err != nil {
+		return
+	}
+	switch opcode {
+	case OpRRQ, OpWRQ:
+		d.request = PacketRequest{}
+		p = &d.request
+	case OpData:
+		d.data = PacketData{}
+		p = &d.data
+	case OpAck:
+		d.ack = PacketAck{}
+		p = &d.ack
+	case OpError:
+		d.err = PacketError{}
+		p = &d.err
+	case OpOAck:
+		d.oack = PacketOAck{}
+		p = &d.oack
+	default:
+		err = fmt.Errorf("unexpected opcode %d", opcode)
+		return
+	}
+	if err = p.Parse(buf); err == nil && d.Mode == ParseStrict {
+		if err = conforms(p, buf); err != nil {
+			p = nil
+		}
+	}
+	return
+}
@@ -12,11 +12,15 @@ func TestSerializationDeserialization(t *testing.T) {
 	}{
 		{
 			[]byte("\x00\x01foo\x00bar\x00"),
-			&PacketRequest{OpRRQ, "foo", "bar"},
+			&PacketRequest{OpRRQ, "foo", "bar", nil},
 		},
 		{
 			[]byte("\x00\x02foo\x00bar\x00"),
-			&PacketRequest{OpWRQ, "foo", "bar"},
+			&PacketRequest{OpWRQ, "foo", "bar", nil},
+		},
+		{
+			[]byte("\x00\x01foo\x00octet\x00blksize\x001428\x00tsize\x000\x00"),
+			&PacketRequest{OpRRQ, "foo", "octet", map[string]string{"blksize": "1428", "tsize": "0"}},
 		},
 		{
 			[]byte("\x00\x03\x12\x34fnord"),
@@ -34,6 +38,14 @@ func TestSerializationDeserialization(t *testing.T) {
 			[]byte("\x00\x05\xab\xcdparachute failure\x00"),
 			&PacketError{0xabcd, "parachute failure"},
 		},
+		{
+			[]byte("\x00\x06tsize\x001234\x00"),
+			&PacketOAck{map[string]string{"tsize": "1234"}},
+		},
+		{
+			[]byte("\x00\x06"),
+			&PacketOAck{},
+		},
 	}
 
 	for _, test := range tests {
@@ -51,6 +63,29 @@ func TestSerializationDeserialization(t *testing.T) {
 	}
 }
 
+func TestDeserializationOptions(t *testing.T) {
+	tests := []struct {
+		bytes   []byte
+		options map[string]string
+	}{
+		// option names are case-insensitive
+		{[]byte("\x00\x01foo\x00octet\x00TSize\x000\x00"), map[string]string{"tsize": "0"}},
+		// padding and incomplete trailing options are ignored
+		{[]byte("\x00\x01foo\x00octet\x00\x00\x00\x00"), nil},
+		{[]byte("\x00\x01foo\x00octet\x00tsize\x000\x00blksize"), map[string]string{"tsize": "0"}},
+		{[]byte("\x00\x01foo\x00octet\x00tsize\x00"), nil},
+	}
+
+	for _, test := range tests {
+		p, err := ParsePacket(test.bytes)
+		if err != nil {
+			t.Errorf("Unable to parse packet %q: %s", test.bytes, err)
+		} else if options := p.(*PacketRequest).Options; !reflect.DeepEqual(test.options, options) {
+			t.Errorf("Parsing options of %q: expected %#v; got %#v", test.bytes, test.options, options)
+		}
+	}
+}
+
 func TestDeserializationInvalid(t *testing.T) {
 	tests := [][]byte{
 		// no opcode
@@ -58,7 +93,7 @@ func TestDeserializationInvalid(t *testing.T) {
 
 		// invalid opcode
 		[]byte("\x00\x00"),
-		[]byte("\x00\x06"),
+		[]byte("\x00\x07"),
 		[]byte("\xff\x01"),
 		[]byte("\xff\xff"),
 
@@ -95,3 +130,139 @@ func TestDeserializationInvalid(t *testing.T) {
 		}
 	}
 }
+
+func TestParseShortBuffers(t *testing.T) {
+	// each parser must refuse a buffer too short for its opcode, not panic
+	parsers := []Packet{&PacketRequest{}, &PacketData{}, &PacketAck{}, &PacketError{}, &PacketOAck{}}
+	for _, p := range parsers {
+		for _, buf := range [][]byte{nil, []byte("\x00")} {
+			if err := p.Parse(buf); err == nil {
+				t.Errorf("%T parsing %q: expected error", p, buf)
+			}
+		}
+	}
+}
+
+func TestAppendToAndMarshalTo(t *testing.T) {
+	packets := []Packet{
+		&PacketRequest{OpRRQ, "foo", "octet", map[string]string{"blksize": "1428", "tsize": "0"}},
+		&PacketData{0x1234, []byte("fnord")},
+		&PacketAck{0xd00f},
+		&PacketError{0xabcd, "parachute failure"},
+		&PacketOAck{map[string]string{"tsize": "1234"}},
+	}
+
+	for _, p := range packets {
+		expected := p.Serialize()
+		prefix := []byte("prefix")
+		if appended := p.AppendTo(prefix); string(appended) != "prefix"+string(expected) {
+			t.Errorf("Appending %#v: expected %q after the prefix; got %q", p, expected, appended)
+		}
+
+		buf := make([]byte, len(expected)+1)
+		buf[len(expected)] = 0xff
+		if n, err := p.MarshalTo(buf); err != nil || string(buf[:n]) != string(expected) {
+			t.Errorf("Marshaling %#v: expected %q; got %q %v", p, expected, buf[:n], err)
+		}
+		short := make([]byte, len(expected)-1, len(expected)+10)
+		if _, err := p.MarshalTo(short); err != ErrShortBuffer {
+			t.Errorf("Marshaling %#v into %d bytes: expected ErrShortBuffer; got %v", p, len(short), err)
+		}
+		if short[:cap(short)][len(short)] != 0 {
+			t.Errorf("Marshaling %#v wrote past the end of the buffer", p)
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	var d Decoder
+	first, err := d.Parse([]byte("\x00\x03\x00\x01fnord"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := first.(*PacketData); !ok || data.BlockNum != 1 || string(data.Data) != "fnord" {
+		t.Errorf("Expected DATA 1 fnord; got %#v", first)
+	}
+	second, err := d.Parse([]byte("\x00\x03\x00\x02"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Errorf("Expected the decoder to reuse its PacketData")
+	}
+	if data := second.(*PacketData); data.BlockNum != 2 || len(data.Data) != 0 {
+		t.Errorf("Expected DATA 2 with nothing from the last packet left over; got %#v", data)
+	}
+	if _, err := d.Parse([]byte("\x00\x01foo\x00octet\x00tsize\x000\x00")); err != nil {
+		t.Fatal(err)
+	}
+	p, err := d.Parse([]byte("\x00\x02bar\x00octet\x00"))
+	if request := p.(*PacketRequest); err != nil || request.Options != nil || request.Filename != "bar" {
+		t.Errorf("Expected the options of the last request to be cleared; got %#v %v", p, err)
+	}
+	if _, err := d.Parse([]byte("\x00\x07")); err == nil {
+		t.Errorf("Expected an error for an unknown opcode")
+	}
+}
+
+func TestBlocksDoNotAllocate(t *testing.T) {
+	var d Decoder
+	block := make([]byte, 512)
+	out := make([]byte, 0, 516)
+	allocs := testing.AllocsPerRun(100, func() {
+		data := PacketData{BlockNum: 7, Data: block}
+		out = data.AppendTo(out[:0])
+		ack := PacketAck{BlockNum: 7}
+		p, _ := d.Parse(ack.AppendTo(out[:0]))
+		_ = p.(*PacketAck)
+		d.Parse(data.AppendTo(out[:0]))
+	})
+	if allocs != 0 {
+		t.Errorf("Expected encoding and decoding a block to allocate nothing; %.0f allocations", allocs)
+	}
+}
+
+func BenchmarkDataSerialize(b *testing.B) {
+	data := PacketData{Data: make([]byte, 512)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data.BlockNum = uint16(i)
+		data.Serialize()
+	}
+}
+
+func BenchmarkDataAppendTo(b *testing.B) {
+	data := PacketData{Data: make([]byte, 512)}
+	buf := make([]byte, 0, 516)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data.BlockNum = uint16(i)
+		buf = data.AppendTo(buf[:0])
+	}
+}
+
+func BenchmarkAckParsePacket(b *testing.B) {
+	buf := (&PacketAck{BlockNum: 7}).Serialize()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ParsePacket(buf)
+	}
+}
+
+func BenchmarkAckDecoder(b *testing.B) {
+	var d Decoder
+	buf := (&PacketAck{BlockNum: 7}).Serialize()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		d.Parse(buf)
+	}
+}
+
+func BenchmarkDataDecoder(b *testing.B) {
+	var d Decoder
+	buf := (&PacketData{BlockNum: 7, Data: make([]byte, 512)}).Serialize()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		d.Parse(buf)
+	}
+}
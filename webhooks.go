@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+var webhooks []*webhook             // notified of finished uploads
+var webhookBackoff = time.Second    // delay before the first retry, doubled for each one after
+var webhookMaxBackoff = time.Minute // cap on the delay between retries
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+var webhookDeliveries = make(chan bool, 256) // bounds deliveries in flight, extra events are dropped
+
+// webhookConfig is a webhook as it appears in the config file.  Events lists
+// which of "completed", "failed" and "rejected" to send, empty for all of them.
+// Match optionally restricts the webhook to filenames matching a regular
+// expression.  Retries defaults to 5.
+type webhookConfig struct {
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	Match   string   `json:"match"`
+	Retries *int     `json:"retries"`
+}
+
+type webhook struct {
+	url     string
+	events  map[string]bool // nil for every event
+	re      *regexp.Regexp  // nil for every filename
+	retries int
+}
+
+// transferEvent is the JSON body POSTed to webhooks
+type transferEvent struct {
+	Event      string    `json:"event"` // "completed", "failed" or "rejected"
+	TxnID      int64     `json:"txn_id"`
+	Operation  string    `json:"operation"`
+	Filename   string    `json:"filename"`
+	Requested  string    `json:"requested_filename"`
+	Root       string    `json:"root"`
+	ClientIP   string    `json:"client_ip"`
+	ClientPort int       `json:"client_port"`
+	Bytes      int64     `json:"bytes"`
+	Note       string    `json:"note,omitempty"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+}
+
+func compileWebhooks(configs []webhookConfig) ([]*webhook, error) {
+	hooks := make([]*webhook, 0, len(configs))
+	for i, c := range configs {
+		if c.URL == "" {
+			return nil, fmt.Errorf("webhook %d: missing url", i+1)
+		}
+		hook := &webhook{url: c.URL, retries: 5}
+		if c.Retries != nil {
+			hook.retries = *c.Retries
+		}
+		for _, event := range c.Events {
+			if event != "completed" && event != "failed" && event != "rejected" {
+				return nil, fmt.Errorf("webhook %d: unknown event %q", i+1, event)
+			}
+			if hook.events == nil {
+				hook.events = make(map[string]bool)
+			}
+			hook.events[event] = true
+		}
+		if c.Match != "" {
+			re, err := regexp.Compile(c.Match)
+			if err != nil {
+				return nil, fmt.Errorf("webhook %d: %s", i+1, err)
+			}
+			hook.re = re
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+func newTransferEvent(operation string, request *wire.PacketRequest, addr net.Addr, txID int64) *transferEvent {
+	event := &transferEvent{
+		TxnID:     txID,
+		Operation: operation,
+		Filename:  request.Filename,
+		Requested: request.Filename,
+		Started:   time.Now(),
+	}
+	ip, port := clientIPPort(addr)
+	if ip != nil {
+		event.ClientIP = ip.String()
+	}
+	event.ClientPort = port
+	return event
+}
+
+// finish records how the transfer ended, sends the event to the webhooks and
+// returns the matching line for the txn log.
+func (e *transferEvent) finish(event, note string) string {
+	e.Event = event
+	e.Finished = time.Now()
+	status := "failed"
+	if event == "completed" {
+		status = "success"
+		note = "<none>"
+	} else {
+		e.Note = note
+	}
+	notifyWebhooks(e)
+	return fmt.Sprintf(txnTemplate, e.TxnID, "WRITE", status, note)
+}
+
+// notifyWebhooks POSTs event to every interested webhook in the background.
+// It never blocks: if too many deliveries are already in flight the event is
+// dropped and logged.
+func notifyWebhooks(event *transferEvent) {
+	var body []byte
+	for _, hook := range webhooks {
+		if hook.events != nil && !hook.events[event.Event] {
+			continue
+		}
+		if hook.re != nil && !hook.re.MatchString(event.Filename) {
+			continue
+		}
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(event); err != nil {
+				log.Println("Unable to encode webhook event.  error: ", err)
+				return
+			}
+		}
+		select {
+		case webhookDeliveries <- true:
+			go func(hook *webhook) {
+				defer func() { <-webhookDeliveries }()
+				hook.deliver(body)
+			}(hook)
+		default:
+			log.Printf("Too many webhook deliveries in flight.  Dropped %s event for txn #%d to %s", event.Event, event.TxnID, hook.url)
+		}
+	}
+}
+
+// deliver POSTs body to the webhook, retrying with exponential backoff until
+// it gets a 2xx response or runs out of retries.
+func (h *webhook) deliver(body []byte) {
+	backoff := webhookBackoff
+	for attempt := 0; ; attempt++ {
+		err := h.post(body)
+		if err == nil {
+			return
+		}
+		if attempt >= h.retries {
+			log.Printf("Giving up on webhook %s after %d attempts.  error: %s", h.url, attempt+1, err)
+			return
+		}
+		log.Printf("Webhook %s failed, retrying in %s.  error: %s", h.url, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+func (h *webhook) post(body []byte) error {
+	resp, err := webhookClient.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	wire "github.com/coffeepac/tftp/tftp_wire"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	events := make(chan transferEvent, 10)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			// the first delivery fails so that the retry is exercised
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event transferEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("Unable to decode webhook body: %s", err)
+		}
+		events <- event
+	}))
+	defer server.Close()
+
+	oldWebhooks, oldBackoff, oldRules := webhooks, webhookBackoff, rewriteRules
+	defer func() { webhooks, webhookBackoff, rewriteRules = oldWebhooks, oldBackoff, oldRules }()
+	webhookBackoff = time.Millisecond
+
+	var err error
+	if webhooks, err = compileWebhooks([]webhookConfig{{URL: server.URL, Events: []string{"completed", "rejected"}}}); err != nil {
+		t.Fatalf("unable to compile webhooks: %s", err)
+	}
+	if rewriteRules, err = compileRewriteRules([]rewriteRuleConfig{{Match: `^secret`, Flags: "a"}}); err != nil {
+		t.Fatalf("unable to compile rewrite rules: %s", err)
+	}
+	files = newCASStore()
+
+	if err := writeOverUDP(t, &wire.PacketRequest{Op: wire.OpWRQ, Filename: "sw1.cfg", Mode: "octet"}, []byte("hostname sw1\n")); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	select {
+	case event := <-events:
+		if event.Event != "completed" || event.Filename != "sw1.cfg" || event.Bytes != 13 || event.ClientIP != "127.0.0.1" {
+			t.Errorf("Unexpected completed event %#v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("completed event was never delivered")
+	}
+	if attempts != 2 {
+		t.Errorf("Expected completed event to take 2 attempts; took %d", attempts)
+	}
+
+	if err := writeOverUDP(t, &wire.PacketRequest{Op: wire.OpWRQ, Filename: "secret", Mode: "octet"}, []byte("x")); err == nil {
+		t.Fatalf("write of rejected file succeeded")
+	}
+	select {
+	case event := <-events:
+		if event.Event != "rejected" || event.Filename != "secret" || event.Note == "" {
+			t.Errorf("Unexpected rejected event %#v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("rejected event was never delivered")
+	}
+}
+
+func TestCompileWebhooksInvalid(t *testing.T) {
+	tests := []webhookConfig{
+		{},
+		{URL: "http://localhost/", Events: []string{"started"}},
+		{URL: "http://localhost/", Match: "(unclosed"},
+	}
+
+	for _, test := range tests {
+		if _, err := compileWebhooks([]webhookConfig{test}); err == nil {
+			t.Errorf("Compiling %#v: expected error", test)
+		}
+	}
+}
+
+func TestRefusedUploadsNotifyWebhooks(t *testing.T) {
+	events := make(chan transferEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event transferEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer server.Close()
+	oldWebhooks := webhooks
+	defer func() { webhooks = oldWebhooks }()
+	webhooks, _ = compileWebhooks([]webhookConfig{{URL: server.URL}})
+
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2000}
+	read := &wire.PacketRequest{Op: wire.OpRRQ, Filename: "boot.cfg", Mode: "octet"}
+	if txn := refusedTxn(read, addr, 7, "Too many concurrent transfers"); !strings.Contains(txn, "#7 of type READ completed with status failed") {
+		t.Errorf("Unexpected txn line for a refused read %q", txn)
+	}
+	write := &wire.PacketRequest{Op: wire.OpWRQ, Filename: "sw1.cfg", Mode: "octet"}
+	if txn := refusedTxn(write, addr, 8, "Request rejected by rate limits"); !strings.Contains(txn, "#8 of type WRITE completed with status failed") {
+		t.Errorf("Unexpected txn line for a refused write %q", txn)
+	}
+	select {
+	case event := <-events:
+		if event.Event != "rejected" || event.Filename != "sw1.cfg" || event.Note != "Request rejected by rate limits" || event.TxnID != 8 {
+			t.Errorf("Unexpected rejected event %#v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("rejected event was never delivered")
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Expected no event for the refused read; got %#v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}